@@ -1,22 +1,48 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/canary"
+	"github.com/henneberger/metrics-fs/internal/chunkcache"
 	"github.com/henneberger/metrics-fs/internal/fusefs"
+	"github.com/henneberger/metrics-fs/internal/golden"
+	"github.com/henneberger/metrics-fs/internal/httpserve"
 	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/indexrpc"
+	"github.com/henneberger/metrics-fs/internal/indexstore"
+	"github.com/henneberger/metrics-fs/internal/loadtest"
+	"github.com/henneberger/metrics-fs/internal/mapgen"
+	"github.com/henneberger/metrics-fs/internal/mapper"
+	"github.com/henneberger/metrics-fs/internal/nfsserve"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/p9serve"
 	"github.com/henneberger/metrics-fs/internal/projector"
+	"github.com/henneberger/metrics-fs/internal/sftpserve"
+	"github.com/henneberger/metrics-fs/internal/vtree"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+	"github.com/henneberger/metrics-fs/pkg/enums"
+	"golang.org/x/crypto/ssh"
 )
 
 type commonFlags struct {
@@ -29,13 +55,36 @@ type commonFlags struct {
 	spiceEndpoint       string
 	spiceToken          string
 	spiceTokenEnv       string
+	spiceTokenFile      string
+	spiceTokenRefresh   time.Duration
+	spiceTokenK8s       bool
 	spiceConsistency    string
+	spiceExportInterval time.Duration
+	spiceTransport      string
+	spiceInsecure       bool
+	spiceCAFile         string
+	spiceCaveatContext  string
+	authzMode           string
+	authzCacheTTL       time.Duration
+	authzCacheNegTTL    time.Duration
+	authzCacheMax       int
 	watchEnabled        bool
 	watchBackoff        string
 	reconcileInterval   time.Duration
 	onSpiceUnavailable  string
 	staleSnapshotTTL    time.Duration
+	spiceRetries        int
+	spiceRetryBackoff   time.Duration
+	breakerThreshold    int
+	breakerCooldown     time.Duration
 	indexDir            string
+	indexStore          string
+	store               indexstore.Store
+	indexServer         string
+	indexServerToken    string
+	indexServerInsecure bool
+	indexServerCAFile   string
+	builder             options.IndexBuilder
 	indexFormatVersion  int
 	indexHash           string
 	indexWorkers        int
@@ -44,37 +93,159 @@ type commonFlags struct {
 	mapperInheritParent bool
 	missingMapper       string
 	missingResourceKey  string
+	globCase            string
 	permissionsFile     string
+	authDB              string
+	authURL             string
+	authTokenEnv        string
+	opaDecision         string
+	cedarPolicy         string
+	cedarEntities       string
+	casbinModel         string
+	casbinPolicy        string
+	authSnapshot        string
+	defaultPermission   string
+	authAuditLog        string
 	allowNoAuthz        bool
+	collisionPolicy     string
+	provenance          bool
+	outputFormat        string
+	outputColumns       string
+	visibilityTopN      int
+	subjectMap          string
+	subjectPerLogin     bool
+	expiredRules        string
+	chunkCacheBytes     int64
+	tombstoneFile       string
+	tombstonePerm       string
+	overridesFile       string
+	hideEmptyFiles      bool
+	mountUID            int
+	mountGID            int
+	fileMode            string
+	dirMode             string
+	fileModeBits        os.FileMode
+	dirModeBits         os.FileMode
+	attrTimeout         time.Duration
+	entryTimeout        time.Duration
+	noKernelCache       bool
+	watchSource         bool
+	openFiles           int
+	maxConcurrentReads  int
+	maxReadahead        int
+	maxSubjectReads     int
+	passthroughMin      int64
+	strictReadOnly      bool
+	volumeName          string
+	exclude             globList
+	createMountDir      bool
+	preserveCompression bool
 }
 
 func addCommonFlags(fs *flag.FlagSet, c *commonFlags, needMountFields bool) {
 	fs.StringVar(&c.sourceDir, "source-dir", "", "source directory")
 	fs.StringVar(&c.mountDir, "mount-dir", "", "mount directory")
-	fs.StringVar(&c.authBackend, "auth-backend", "file", "authorization backend: file|spicedb")
+	fs.StringVar(&c.authBackend, "auth-backend", string(enums.AuthBackendFile), "authorization backend: file|spicedb|sqlite|http|opa|cedar|casbin|snapshot, or a comma-separated chain where the first definitive answer wins")
+	fs.StringVar(&c.authAuditLog, "auth-audit-log", "", "append one JSON line per authorization decision, naming the backend that decided, to this file")
 	fs.StringVar(&c.subject, "subject", "", "subject, e.g. user:alice")
-	fs.BoolVar(&c.readOnly, "read-only", true, "read only")
+	fs.BoolVar(&c.readOnly, "read-only", true, "read only; false accepts appends to .jsonl files from subjects with write permission")
 	fs.BoolVar(&c.allowOther, "allow-other", false, "allow other users")
 	fs.StringVar(&c.spiceEndpoint, "spicedb-endpoint", "", "spicedb endpoint")
 	fs.StringVar(&c.spiceToken, "spicedb-token", "", "spicedb token")
 	fs.StringVar(&c.spiceTokenEnv, "spicedb-token-env", "SPICEDB_TOKEN", "spicedb token env var")
-	fs.StringVar(&c.spiceConsistency, "spicedb-consistency", "minimize_latency", "spicedb consistency")
-	fs.BoolVar(&c.watchEnabled, "watch-enabled", true, "watch enabled")
+	fs.StringVar(&c.spiceTokenFile, "spicedb-token-file", "", "file holding the spicedb token, re-read as it changes so the key can be rotated (e.g. a Vault agent sidecar's rendered secret)")
+	fs.BoolVar(&c.spiceTokenK8s, "spicedb-token-kubernetes", false, "authenticate to spicedb with the pod's projected service account token (a JWT at --spicedb-token-file, default "+auth.KubernetesTokenPath+"), re-read before it expires")
+	fs.DurationVar(&c.spiceTokenRefresh, "spicedb-token-refresh", time.Minute, "how often --spicedb-token-file is checked for a new token (0 only on SIGHUP)")
+	fs.StringVar(&c.spiceConsistency, "spicedb-consistency", string(enums.ConsistencyMinimizeLatency), "spicedb consistency")
+	fs.StringVar(&c.spiceTransport, "spicedb-transport", string(enums.SpiceDBTransportHTTP), "spicedb API: http (HTTP gateway) or grpc")
+	fs.BoolVar(&c.spiceInsecure, "spicedb-insecure", false, "dial the spicedb grpc endpoint without TLS")
+	fs.StringVar(&c.spiceCAFile, "spicedb-ca-file", "", "PEM CA bundle that signs the spicedb grpc endpoint's certificate (default: system roots)")
+	fs.StringVar(&c.spiceCaveatContext, "spicedb-caveat-context", "", "JSON object sent as caveat context with every spicedb check, under the rows' caveat_context fields")
+	fs.DurationVar(&c.spiceExportInterval, "spicedb-export-interval", 0, "bulk export relationships for mapper object types and answer checks locally, re-exporting at this interval (0 checks live)")
+	fs.DurationVar(&c.authzCacheTTL, "authz-cache-ttl", 5*time.Minute, "how long an allowed check result is reused by the spicedb, http, or opa backend and by the mount's decision cache (0 until evicted)")
+	fs.DurationVar(&c.authzCacheNegTTL, "authz-cache-negative-ttl", 30*time.Second, "how long a denied check result is reused by the spicedb, http, or opa backend and by the mount's decision cache (0 until evicted)")
+	fs.IntVar(&c.authzCacheMax, "authz-cache-max-entries", 100000, "check results kept by each spicedb, http, or opa backend and by the mount's decision cache, least recently used evicted first (0 unbounded)")
+	fs.StringVar(&c.authzMode, "authz-mode", string(enums.AuthzModeCheck), "spicedb decisions: check (per candidate) or lookup (LookupResources per mapper type and permission, repeated every --reconcile-interval)")
+	fs.BoolVar(&c.watchEnabled, "watch-enabled", true, "reload permissions and invalidate kernel caches when decisions change")
 	fs.StringVar(&c.watchBackoff, "watch-reconnect-backoff", "100ms..5s", "watch reconnect backoff range")
-	fs.DurationVar(&c.reconcileInterval, "reconcile-interval", 30*time.Second, "reconcile interval")
-	fs.StringVar(&c.onSpiceUnavailable, "on-spicedb-unavailable", "fail_closed", "fail_closed or serve_stale")
-	fs.DurationVar(&c.staleSnapshotTTL, "stale-snapshot-ttl", 0, "stale ttl")
+	fs.DurationVar(&c.reconcileInterval, "reconcile-interval", 30*time.Second, "how often permissions are re-checked for changes")
+	fs.StringVar(&c.onSpiceUnavailable, "on-spicedb-unavailable", string(enums.UnavailableFailClosed), "fail_closed or serve_stale")
+	fs.DurationVar(&c.staleSnapshotTTL, "stale-snapshot-ttl", 0, "with serve_stale, how long after it was checked a result may answer for an unreachable spicedb (0 disables)")
+	fs.IntVar(&c.spiceRetries, "spicedb-retries", 2, "times a failed spicedb check request is retried")
+	fs.DurationVar(&c.spiceRetryBackoff, "spicedb-retry-backoff", 100*time.Millisecond, "delay before the first spicedb retry, doubled for each further one and jittered")
+	fs.IntVar(&c.breakerThreshold, "spicedb-breaker-threshold", 5, "failed spicedb check requests in a row that open the circuit breaker, failing checks at once (0 disables)")
+	fs.DurationVar(&c.breakerCooldown, "spicedb-breaker-cooldown", 10*time.Second, "how long the open circuit breaker fails checks before letting one through to probe spicedb")
 	fs.StringVar(&c.indexDir, "index-dir", defaultIndexDir(), "index directory")
+	fs.StringVar(&c.indexStore, "index-store", "", "shared index store URL (s3://bucket/prefix, redis://host:port/db, file:///dir); overrides --index-dir")
 	fs.IntVar(&c.indexFormatVersion, "index-format-version", 1, "index format version")
+	fs.StringVar(&c.indexServer, "index-server", "", "host:port of a metricfs index-server that builds indexes missing from the index store")
+	fs.StringVar(&c.indexServerToken, "index-server-token", os.Getenv("METRICFS_INDEX_SERVER_TOKEN"), "bearer token shared with the index server")
+	fs.BoolVar(&c.indexServerInsecure, "index-server-insecure", false, "dial the index server without TLS, sending --index-server-token in the clear")
+	fs.StringVar(&c.indexServerCAFile, "index-server-ca-file", "", "PEM CA bundle that signs the index server's certificate (default: system roots)")
 	fs.StringVar(&c.indexHash, "index-hash", "xxh3_64", "index hash")
 	fs.IntVar(&c.indexWorkers, "index-workers", runtime.NumCPU(), "index workers")
 	fs.StringVar(&c.mapperFileName, "mapper-file-name", ".metricfs-map.yaml", "mapper file name")
-	fs.StringVar(&c.mapperResolution, "mapper-resolution", "nearest_ancestor", "mapper resolution")
+	fs.StringVar(&c.mapperResolution, "mapper-resolution", string(enums.MapperResolutionNearestAncestor), "mapper resolution")
 	fs.BoolVar(&c.mapperInheritParent, "mapper-inherit-parent", true, "mapper inherit parent")
-	fs.StringVar(&c.missingMapper, "missing-mapper", "deny", "missing mapper behavior")
-	fs.StringVar(&c.missingResourceKey, "missing-resource-key", "deny", "default missing resource key behavior")
+	fs.StringVar(&c.missingMapper, "missing-mapper", string(enums.MissingMapperDeny), "missing mapper behavior")
+	fs.StringVar(&c.missingResourceKey, "missing-resource-key", string(enums.MissingResourceDeny), "default missing resource key behavior")
+	fs.StringVar(&c.globCase, "glob-case", string(enums.GlobCaseAuto), "mapper glob case sensitivity: auto|sensitive|insensitive (auto folds case on Windows and macOS)")
 	fs.StringVar(&c.permissionsFile, "permissions-file", "", "explicit permissions file")
+	fs.StringVar(&c.authDB, "auth-db", "", "sqlite database with the allow table for --auth-backend sqlite")
+	fs.StringVar(&c.authURL, "auth-url", "", "authorization service each check is POSTed to for --auth-backend http, or OPA server base URL for opa")
+	fs.StringVar(&c.cedarPolicy, "cedar-policy", "", "Cedar policy file evaluated locally for --auth-backend cedar")
+	fs.StringVar(&c.cedarEntities, "cedar-entities", "", "Cedar entities JSON file the policies refer to")
+	fs.StringVar(&c.casbinModel, "casbin-model", "", "Casbin model.conf for --auth-backend casbin")
+	fs.StringVar(&c.casbinPolicy, "casbin-policy", "", "Casbin policy.csv for --auth-backend casbin")
+	fs.StringVar(&c.defaultPermission, "default-permission", "read", "permission checked for mapper rules and permissions file entries that name none, e.g. view")
+	fs.StringVar(&c.authSnapshot, "auth-snapshot", "", "snapshot written by `metricfs authz snapshot` for --auth-backend snapshot")
+	fs.StringVar(&c.opaDecision, "opa-decision", "metricfs/allow", "OPA data path of the boolean rule deciding each check")
+	fs.StringVar(&c.authTokenEnv, "auth-token-env", "", "env var holding a bearer token for --auth-url")
 	fs.BoolVar(&c.allowNoAuthz, "allow-no-authz", false, "allow startup without auth source (denies all rows)")
+	fs.StringVar(&c.collisionPolicy, "collision-policy", projector.CollisionPreferPlain, "virtual name collision policy: prefer-plain|prefer-compressed|expose-both-with-suffix|error")
+	if needMountFields {
+		fs.Int64Var(&c.chunkCacheBytes, "chunk-cache-bytes", 64<<20, "bytes of source chunks shared between renders for different subjects (0 disables)")
+		fs.BoolVar(&c.hideEmptyFiles, "hide-empty-files", false, "omit JSONL files in which the subject sees no rows from listings and lookups")
+		fs.IntVar(&c.mountUID, "mount-uid", -1, "uid presented as the owner of every file and directory (-1 keeps the mount process or caller)")
+		fs.IntVar(&c.mountGID, "mount-gid", -1, "gid presented as the group of every file and directory (-1 keeps the mount process or caller)")
+		fs.StringVar(&c.fileMode, "file-mode", "", "octal permission bits presented for files, e.g. 0440")
+		fs.StringVar(&c.dirMode, "dir-mode", "", "octal permission bits presented for directories, e.g. 0550")
+		fs.DurationVar(&c.attrTimeout, "attr-timeout", 0, "how long the kernel may cache file attributes (ignored with --subject-map)")
+		fs.DurationVar(&c.entryTimeout, "entry-timeout", 0, "how long the kernel may cache directory entries")
+		fs.StringVar(&c.volumeName, "volume-name", "", "macOS Finder volume name (default metricfs-<source dir name>)")
+		fs.BoolVar(&c.strictReadOnly, "strict-read-only", false, "also reject O_TRUNC opens and record every rejected write in .metricfs/warnings.jsonl")
+		fs.BoolVar(&c.noKernelCache, "no-kernel-cache", false, "disable kernel attribute, entry, and page caching")
+		fs.BoolVar(&c.preserveCompression, "preserve-compression", false, "serve .jsonl.gz files under their own name with the filtered rows re-gzipped instead of decompressed to .jsonl")
+		fs.BoolVar(&c.createMountDir, "create-mount-dir", false, "create --mount-dir if it does not exist")
+		fs.IntVar(&c.openFiles, "open-files", 128, "released source files kept open with their loaded index for later opens (0 disables)")
+		fs.IntVar(&c.maxConcurrentReads, "max-concurrent-reads", 0, "renders and source reads run at once across all callers, also passed to the kernel as max_background (0 is unlimited)")
+		fs.IntVar(&c.maxSubjectReads, "max-concurrent-reads-per-subject", 0, "renders and source reads one subject runs at once; freed slots go to waiting subjects in turn (0 is unlimited)")
+		fs.IntVar(&c.maxReadahead, "max-readahead", 0, "kernel readahead in bytes per file (0 keeps the kernel default)")
+		fs.Int64Var(&c.passthroughMin, "passthrough-min-bytes", 0, "serve non-JSONL files of at least this size straight from the source (kernel FUSE passthrough where available) instead of reading them into memory (0 disables)")
+		fs.BoolVar(&c.watchSource, "watch-source", true, "watch --source-dir for new, appended, and removed files and refresh the mount without a remount")
+		fs.StringVar(&c.subjectMap, "subject-map", "", "JSON file mapping caller uids/gids to subjects for multi-user mounts (spicedb backend only)")
+		fs.StringVar(&c.expiredRules, "expired-rules", "warn", "mapper rules past their expires date at startup: warn|fail")
+	}
+	fs.StringVar(&c.tombstoneFile, "tombstone-file", "", "JSON suppression list of objects whose rows are never visible")
+	fs.StringVar(&c.tombstonePerm, "tombstone-permission", "", "permission (e.g. banned) that suppresses an object's rows when allowed")
+	fs.StringVar(&c.overridesFile, "overrides-file", "", "hot-reloaded JSON file of force_allow/force_deny candidates applied ahead of every other decision")
+	fs.IntVar(&c.visibilityTopN, "visibility-top-n", indexer.DefaultVisibilityTopN, "objects listed in ._visibility.json files and render --visibility")
+	fs.Var(&c.exclude, "exclude", "glob of source files or directories to hide and never index, relative to --source-dir or a base name (repeatable)")
+	fs.BoolVar(&c.provenance, "provenance", false, "annotate visible rows with a _metricfs field (rule hash, granting object IDs) for debugging")
+	fs.StringVar(&c.outputFormat, "output-format", projector.OutputJSONL, "encoding of visible rows: jsonl|json|json-pretty|csv")
+	fs.StringVar(&c.outputColumns, "columns", "", "comma-separated JSON pointers for csv output, e.g. /a,/b")
+}
+
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(v string) error {
+	if !doublestar.ValidatePattern(v) {
+		return fmt.Errorf("invalid glob %q", v)
+	}
+	*g = append(*g, v)
+	return nil
 }
 
 func defaultIndexDir() string {
@@ -88,6 +259,60 @@ func defaultIndexDir() string {
 	return filepath.Join(home, ".cache", "metricfs")
 }
 
+func (c commonFlags) options() options.Options {
+	return options.New(
+		options.WithSourceDir(c.sourceDir),
+		options.WithMountDir(c.mountDir),
+		options.WithMapper(c.mapperFileName, c.mapperInheritParent),
+		options.WithDefaultPermission(c.defaultPermission),
+		options.WithMissingMapperMode(enums.MissingMapperMode(c.missingMapper)),
+		options.WithMissingResource(enums.MissingResourceKey(c.missingResourceKey)),
+		options.WithGlobCase(enums.GlobCase(c.globCase)),
+		options.WithIndex(c.indexDir, c.indexFormatVersion),
+		options.WithIndexStore(c.store),
+		options.WithIndexBuilder(c.builder),
+		options.WithAllowOther(c.allowOther),
+		options.WithVolumeName(c.volumeName),
+		options.WithReadOnly(c.readOnly),
+		options.WithStrictReadOnly(c.strictReadOnly),
+		options.WithCollisionPolicy(c.collisionPolicy),
+		options.WithProvenance(c.provenance),
+		options.WithOutput(c.outputFormat, projector.ParseColumns(c.outputColumns)),
+		options.WithHideEmptyFiles(c.hideEmptyFiles),
+		options.WithVisibilityTopN(c.visibilityTopN),
+		options.WithOwner(c.mountUID, c.mountGID),
+		options.WithModes(c.fileModeBits, c.dirModeBits),
+		options.WithCacheTimeouts(c.attrTimeout, c.entryTimeout),
+		options.WithNoKernelCache(c.noKernelCache),
+		options.WithOpenFiles(c.openFiles),
+		options.WithReadLimits(c.maxConcurrentReads, c.maxReadahead),
+		options.WithSubjectReadLimit(c.maxSubjectReads),
+		options.WithPassthroughMin(c.passthroughMin),
+		options.WithExclude(c.exclude),
+		options.WithPreserveCompression(c.preserveCompression),
+		options.WithTrace(os.Stderr),
+	)
+}
+
+func connectIndex(c *commonFlags) (func(), error) {
+	if c.indexStore != "" {
+		store, err := indexstore.Open(c.indexStore)
+		if err != nil {
+			return nil, fmt.Errorf("--index-store: %w", err)
+		}
+		c.store = store
+	}
+	if c.indexServer == "" {
+		return func() {}, nil
+	}
+	client, err := indexrpc.Dial(c.indexServer, c.sourceDir, c.indexServerToken, indexrpc.Transport{Insecure: c.indexServerInsecure, CAFile: c.indexServerCAFile})
+	if err != nil {
+		return nil, fmt.Errorf("--index-server: %w", err)
+	}
+	c.builder = client
+	return func() { _ = client.Close() }, nil
+}
+
 func validate(c *commonFlags, needMountFields bool) error {
 	if c.sourceDir == "" {
 		return fmt.Errorf("--source-dir is required")
@@ -95,37 +320,193 @@ func validate(c *commonFlags, needMountFields bool) error {
 	if needMountFields && c.mountDir == "" {
 		return fmt.Errorf("--mount-dir is required")
 	}
-	if c.mapperResolution != "nearest_ancestor" {
+	if _, err := enums.ParseMapperResolution(c.mapperResolution); err != nil {
 		return fmt.Errorf("--mapper-resolution supports nearest_ancestor only")
 	}
-	if c.missingMapper != "deny" && c.missingMapper != "passthrough" {
+	if _, err := enums.ParseMissingMapperMode(c.missingMapper); err != nil {
 		return fmt.Errorf("--missing-mapper must be deny|passthrough")
 	}
-	if c.missingResourceKey != "deny" && c.missingResourceKey != "ignore" {
+	if _, err := enums.ParseMissingResourceKey(c.missingResourceKey); err != nil {
 		return fmt.Errorf("--missing-resource-key must be deny|ignore")
 	}
-	if !c.readOnly {
-		return fmt.Errorf("writable mode is not supported in MVP")
+	globCase, err := enums.ParseGlobCase(c.globCase)
+	if err != nil {
+		return fmt.Errorf("--glob-case must be auto|sensitive|insensitive")
+	}
+	c.globCase = string(globCase)
+	if _, err := enums.ParseConsistency(c.spiceConsistency); err != nil {
+		return fmt.Errorf("--spicedb-consistency must be minimize_latency|fully_consistent|at_least_as_fresh")
+	}
+	if _, err := enums.ParseUnavailableMode(c.onSpiceUnavailable); err != nil {
+		return fmt.Errorf("--on-spicedb-unavailable must be fail_closed|serve_stale")
+	}
+	if c.staleSnapshotTTL < 0 {
+		return fmt.Errorf("--stale-snapshot-ttl must be >= 0")
+	}
+	if c.spiceRetries < 0 || c.spiceRetryBackoff < 0 {
+		return fmt.Errorf("--spicedb-retries and --spicedb-retry-backoff must be >= 0")
+	}
+	c.defaultPermission = strings.TrimSpace(c.defaultPermission)
+	if c.defaultPermission == "" || strings.ContainsAny(c.defaultPermission, auth.PermissionSeparator+":# \t") {
+		return fmt.Errorf("--default-permission must be a single permission name")
+	}
+	if c.spiceTokenK8s && c.spiceTokenFile == "" {
+		c.spiceTokenFile = auth.KubernetesTokenPath
+	}
+	if c.spiceTokenFile != "" && c.spiceToken != "" {
+		return fmt.Errorf("--spicedb-token-file and --spicedb-token-kubernetes cannot be combined with --spicedb-token")
+	}
+	if c.spiceTokenRefresh < 0 {
+		return fmt.Errorf("--spicedb-token-refresh must be >= 0")
+	}
+	if c.breakerThreshold < 0 || c.breakerCooldown < 0 {
+		return fmt.Errorf("--spicedb-breaker-threshold and --spicedb-breaker-cooldown must be >= 0")
+	}
+	if err := projector.ValidateOutputFormat(c.outputFormat, projector.ParseColumns(c.outputColumns)); err != nil {
+		return fmt.Errorf("--output-format: %w", err)
+	}
+	if err := projector.ValidateCollisionPolicy(c.collisionPolicy); err != nil {
+		return fmt.Errorf("--collision-policy: %w", err)
+	}
+	if !c.readOnly && !needMountFields {
+		return fmt.Errorf("--read-only=false only applies to mount")
+	}
+	if c.strictReadOnly && !c.readOnly {
+		return fmt.Errorf("--strict-read-only cannot be combined with --read-only=false")
+	}
+	if c.visibilityTopN <= 0 {
+		return fmt.Errorf("--visibility-top-n must be positive")
+	}
+	if c.attrTimeout < 0 || c.entryTimeout < 0 {
+		return fmt.Errorf("--attr-timeout and --entry-timeout must not be negative")
+	}
+	if c.maxConcurrentReads < 0 || c.maxConcurrentReads > math.MaxUint16 || c.maxReadahead < 0 {
+		return fmt.Errorf("--max-concurrent-reads must be between 0 and %d and --max-readahead must not be negative", math.MaxUint16)
+	}
+	if c.maxSubjectReads < 0 {
+		return fmt.Errorf("--max-concurrent-reads-per-subject must not be negative")
+	}
+	if c.passthroughMin < 0 {
+		return fmt.Errorf("--passthrough-min-bytes must not be negative")
+	}
+	if c.noKernelCache && (c.attrTimeout > 0 || c.entryTimeout > 0) {
+		return fmt.Errorf("--no-kernel-cache cannot be combined with --attr-timeout or --entry-timeout")
+	}
+	for _, m := range []struct {
+		flag string
+		raw  string
+		bits *os.FileMode
+	}{{"--file-mode", c.fileMode, &c.fileModeBits}, {"--dir-mode", c.dirMode, &c.dirModeBits}} {
+		if m.raw == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(m.raw, 8, 32)
+		if err != nil || v == 0 || v > 0o777 {
+			return fmt.Errorf("%s must be octal permission bits between 1 and 0777", m.flag)
+		}
+		*m.bits = os.FileMode(v)
 	}
 	if st, err := os.Stat(c.sourceDir); err != nil || !st.IsDir() {
 		return fmt.Errorf("source dir invalid: %s", c.sourceDir)
 	}
 	if needMountFields {
-		if st, err := os.Stat(c.mountDir); err != nil || !st.IsDir() {
+		st, err := os.Stat(c.mountDir)
+		switch {
+		case errors.Is(err, syscall.ENOTCONN):
+			return fmt.Errorf("mount dir %s is a disconnected mount; run metricfs unmount %s", c.mountDir, c.mountDir)
+		case os.IsNotExist(err) && c.createMountDir:
+		case err != nil || !st.IsDir():
 			return fmt.Errorf("mount dir invalid: %s", c.mountDir)
 		}
 	}
-	if c.authBackend != "file" && c.authBackend != "spicedb" {
-		return fmt.Errorf("--auth-backend must be file|spicedb")
+	backends, err := parseAuthBackends(c.authBackend)
+	if err != nil {
+		return err
+	}
+	uses := func(b enums.AuthBackend) bool { return slices.Contains(backends, b) }
+	transport, err := enums.ParseSpiceDBTransport(c.spiceTransport)
+	if err != nil {
+		return fmt.Errorf("--spicedb-transport must be http|grpc")
+	}
+	if (c.spiceInsecure || c.spiceCAFile != "") && transport != enums.SpiceDBTransportGRPC {
+		return fmt.Errorf("--spicedb-insecure and --spicedb-ca-file require --spicedb-transport grpc")
+	}
+	if c.spiceInsecure && c.spiceCAFile != "" {
+		return fmt.Errorf("--spicedb-insecure cannot be combined with --spicedb-ca-file")
+	}
+	if (c.indexServerInsecure || c.indexServerCAFile != "") && c.indexServer == "" {
+		return fmt.Errorf("--index-server-insecure and --index-server-ca-file require --index-server")
 	}
-	if c.authBackend == "file" && c.permissionsFile == "" && !c.allowNoAuthz {
+	if c.indexServerInsecure && c.indexServerCAFile != "" {
+		return fmt.Errorf("--index-server-insecure cannot be combined with --index-server-ca-file")
+	}
+	if _, err := parseCaveatContext(c.spiceCaveatContext); err != nil {
+		return fmt.Errorf("--spicedb-caveat-context must be a JSON object: %v", err)
+	}
+	if c.spiceExportInterval < 0 {
+		return fmt.Errorf("--spicedb-export-interval must not be negative")
+	}
+	if c.spiceExportInterval > 0 && !uses(enums.AuthBackendSpiceDB) {
+		return fmt.Errorf("--spicedb-export-interval requires --auth-backend spicedb")
+	}
+	if c.authzCacheTTL < 0 || c.authzCacheNegTTL < 0 || c.authzCacheMax < 0 {
+		return fmt.Errorf("--authz-cache-ttl, --authz-cache-negative-ttl and --authz-cache-max-entries must not be negative")
+	}
+	mode, err := enums.ParseAuthzMode(c.authzMode)
+	if err != nil {
+		return fmt.Errorf("--authz-mode must be check|lookup")
+	}
+	if mode == enums.AuthzModeLookup && !uses(enums.AuthBackendSpiceDB) {
+		return fmt.Errorf("--authz-mode lookup requires --auth-backend spicedb")
+	}
+	if mode == enums.AuthzModeLookup && c.spiceExportInterval > 0 {
+		return fmt.Errorf("--authz-mode lookup cannot be combined with --spicedb-export-interval")
+	}
+	if c.expiredRules != "" && c.expiredRules != "warn" && c.expiredRules != "fail" {
+		return fmt.Errorf("--expired-rules must be warn|fail")
+	}
+	if c.subjectMap != "" && !uses(enums.AuthBackendSpiceDB) {
+		return fmt.Errorf("--subject-map requires --auth-backend spicedb")
+	}
+	if uses(enums.AuthBackendFile) && c.permissionsFile == "" && !c.allowNoAuthz {
 		return fmt.Errorf("file auth backend requires --permissions-file or --allow-no-authz")
 	}
-	if c.authBackend == "spicedb" {
+	if uses(enums.AuthBackendSQLite) != (c.authDB != "") {
+		return fmt.Errorf("--auth-db is required by, and only used with, --auth-backend sqlite")
+	}
+	if uses(enums.AuthBackendHTTP) && uses(enums.AuthBackendOPA) {
+		return fmt.Errorf("--auth-backend cannot chain http and opa, which share --auth-url")
+	}
+	callout := uses(enums.AuthBackendHTTP) || uses(enums.AuthBackendOPA)
+	if callout != (c.authURL != "") {
+		return fmt.Errorf("--auth-url is required by, and only used with, --auth-backend http|opa")
+	}
+	if c.authTokenEnv != "" && !callout {
+		return fmt.Errorf("--auth-token-env requires --auth-backend http|opa")
+	}
+	if uses(enums.AuthBackendCedar) != (c.cedarPolicy != "") {
+		return fmt.Errorf("--cedar-policy is required by, and only used with, --auth-backend cedar")
+	}
+	if c.cedarEntities != "" && !uses(enums.AuthBackendCedar) {
+		return fmt.Errorf("--cedar-entities requires --auth-backend cedar")
+	}
+	if uses(enums.AuthBackendCasbin) && (c.casbinModel == "" || c.casbinPolicy == "") ||
+		!uses(enums.AuthBackendCasbin) && (c.casbinModel != "" || c.casbinPolicy != "") {
+		return fmt.Errorf("--casbin-model and --casbin-policy are required by, and only used with, --auth-backend casbin")
+	}
+	if uses(enums.AuthBackendSnapshot) != (c.authSnapshot != "") {
+		return fmt.Errorf("--auth-snapshot is required by, and only used with, --auth-backend snapshot")
+	}
+	for _, b := range []enums.AuthBackend{enums.AuthBackendCedar, enums.AuthBackendCasbin} {
+		if uses(b) && c.subject == "" {
+			return fmt.Errorf("%s auth backend requires --subject", b)
+		}
+	}
+	if uses(enums.AuthBackendSpiceDB) {
 		if c.spiceEndpoint == "" {
 			return fmt.Errorf("spicedb auth backend requires --spicedb-endpoint")
 		}
-		if c.subject == "" {
+		if c.subject == "" && c.subjectMap == "" && !c.subjectPerLogin {
 			return fmt.Errorf("spicedb auth backend requires --subject")
 		}
 	}
@@ -148,11 +529,21 @@ func main() {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(2)
 		}
+	case "index-inspect":
+		if err := runIndexInspect(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	case "mount":
 		if err := runMount(os.Args[2:]); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(3)
 		}
+	case "unmount":
+		if err := runUnmount(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
 	case "stats":
 		if err := runStats(os.Args[2:]); err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -163,6 +554,71 @@ func main() {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(2)
 		}
+	case "loadtest":
+		if err := runLoadTest(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	case "impersonate":
+		if err := runImpersonate(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	case "index-server":
+		if err := runIndexServer(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
+	case "serve-nfs":
+		if err := runServeNFS(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
+	case "serve-9p":
+		if err := runServe9P(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
+	case "serve-sftp":
+		if err := runServeSFTP(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
+	case "serve-http":
+		if err := runServeHTTP(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
+	case "share":
+		if err := runShare(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	case "init-mapper":
+		if err := runInitMapper(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	case "lint-mapper":
+		if err := runLintMapper(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "mapper":
+		if err := runMapper(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "golden":
+		if err := runGolden(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "authz":
+		if err := runAuthz(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
 	default:
 		usage()
 		os.Exit(2)
@@ -170,192 +626,1384 @@ func main() {
 }
 
 func usage() {
-	fmt.Println("metricfs <mount|validate-flags|warm-index|stats|render>")
-}
-
-func runValidate(args []string) error {
-	fs := flag.NewFlagSet("validate-flags", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
-	var c commonFlags
-	addCommonFlags(fs, &c, true)
-	if err := fs.Parse(args); err != nil {
-		return err
-	}
-	return validate(&c, true)
+	fmt.Println("metricfs <mount|unmount|validate-flags|warm-index|index-inspect|stats|render|golden|loadtest|impersonate|index-server|serve-nfs|serve-9p|serve-sftp|serve-http|share|init-mapper|lint-mapper|mapper|authz>")
 }
 
-func runWarmIndex(args []string) error {
-	fs := flag.NewFlagSet("warm-index", flag.ContinueOnError)
+func runIndexServer(args []string) error {
+	fs := flag.NewFlagSet("index-server", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
 	var c commonFlags
 	addCommonFlags(fs, &c, false)
+	listen := fs.String("listen", "127.0.0.1:7443", "gRPC listen address; other than loopback requires --index-server-token")
+	certFile := fs.String("tls-cert-file", "", "PEM certificate the server presents to mounts")
+	keyFile := fs.String("tls-key-file", "", "PEM key of --tls-cert-file")
+	plaintext := fs.Bool("insecure", false, "serve without TLS even though --index-server-token is set")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	if (*certFile == "") != (*keyFile == "") {
+		return fmt.Errorf("--tls-cert-file and --tls-key-file must be set together")
+	}
+	if *certFile == "" && c.indexServerToken != "" && !*plaintext {
+		return fmt.Errorf("--index-server-token would be sent in the clear; set --tls-cert-file and --tls-key-file, or --insecure")
+	}
+	// Index builds never authorize rows.
+	c.allowNoAuthz = true
 	if err := validate(&c, false); err != nil {
 		return err
 	}
-	count := 0
-	err := filepath.WalkDir(c.sourceDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		if !strings.HasSuffix(d.Name(), ".jsonl") {
-			return nil
-		}
-		_, err = indexer.BuildOrLoad(path, indexer.Options{
-			SourceDir:         c.sourceDir,
-			MapperFileName:    c.mapperFileName,
-			MapperInherit:     c.mapperInheritParent,
-			MissingMapperMode: c.missingMapper,
-			MissingResource:   c.missingResourceKey,
-			IndexDir:          c.indexDir,
-			FormatVersion:     c.indexFormatVersion,
-		})
-		if err != nil {
-			return err
-		}
-		count++
-		return nil
-	})
+	if c.indexServer != "" {
+		return fmt.Errorf("--index-server cannot point an index server at another one")
+	}
+	disconnect, err := connectIndex(&c)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("warmed %d jsonl files\n", count)
-	return nil
+	defer disconnect()
+	warns := warnings.New()
+	defer func() { _ = warns.WriteSummary(os.Stderr) }()
+	srv, err := indexrpc.NewServer(c.options().With(options.WithWarnings(warns)), c.indexServerToken).GRPC(*certFile, *keyFile)
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	// Indexes list every row's object IDs, so only loopback is open to all.
+	if addr, ok := lis.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() && c.indexServerToken == "" {
+		_ = lis.Close()
+		return fmt.Errorf("--listen %s is not loopback; set --index-server-token", *listen)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	fmt.Printf("index server for %s listening on %s\n", c.sourceDir, lis.Addr())
+	return srv.Serve(lis)
 }
 
-func runMount(args []string) error {
-	fs := flag.NewFlagSet("mount", flag.ContinueOnError)
+func runServeNFS(args []string) error {
+	fs := flag.NewFlagSet("serve-nfs", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
 	var c commonFlags
-	addCommonFlags(fs, &c, true)
+	addCommonFlags(fs, &c, false)
+	listen := fs.String("listen", "127.0.0.1:2049", "NFSv3 listen address; clients are not authenticated, so bind only to trusted networks")
+	fs.BoolVar(&c.hideEmptyFiles, "hide-empty-files", false, "omit JSONL files in which the subject sees no rows from listings and lookups")
+	fs.IntVar(&c.mountUID, "mount-uid", -1, "uid presented as the owner of every file and directory (-1 keeps the server process)")
+	fs.IntVar(&c.mountGID, "mount-gid", -1, "gid presented as the group of every file and directory (-1 keeps the server process)")
+	fs.StringVar(&c.fileMode, "file-mode", "", "octal permission bits presented for files, e.g. 0440")
+	fs.StringVar(&c.dirMode, "dir-mode", "", "octal permission bits presented for directories, e.g. 0550")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	if err := validate(&c, true); err != nil {
+	if err := validate(&c, false); err != nil {
 		return err
 	}
-	az, err := newAuthorizer(c)
+	disconnect, err := connectIndex(&c)
 	if err != nil {
 		return err
 	}
-	if cl, ok := az.(io.Closer); ok {
-		defer func() { _ = cl.Close() }()
+	defer disconnect()
+	az, closeAz, err := newExportAuthorizer(c)
+	if err != nil {
+		return err
 	}
-	srv := fusefs.New(fusefs.Config{
-		SourceDir:          c.sourceDir,
-		MountDir:           c.mountDir,
-		MapperFileName:     c.mapperFileName,
-		MapperInherit:      c.mapperInheritParent,
-		MissingMapperMode:  c.missingMapper,
-		MissingResource:    c.missingResourceKey,
-		IndexDir:           c.indexDir,
-		IndexFormatVersion: c.indexFormatVersion,
-		AllowOther:         c.allowOther,
-		ReadOnly:           c.readOnly,
-	}, az)
-
+	defer closeAz()
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	warns := warnings.New()
+	defer func() { _ = warns.WriteSummary(os.Stderr) }()
+	nfsFS := nfsserve.New(c.options().With(options.WithWarnings(warns)), az)
+	defer nfsFS.Close()
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
-	fmt.Printf("mounted metricfs at %s\n", c.mountDir)
-	return srv.MountAndServe(ctx)
+	fmt.Printf("serving metricfs for %s over NFSv3 on %s\n", c.sourceDir, lis.Addr())
+	return nfsserve.Serve(ctx, lis, nfsFS)
 }
 
-func runStats(args []string) error {
-	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+func newDecisionCache(c commonFlags) *auth.DecisionCache {
+	return auth.NewDecisionCache(c.authzCacheTTL, c.authzCacheNegTTL, c.authzCacheMax)
+}
+
+func newExportAuthorizer(c commonFlags) (az auth.Authorizer, cleanup func(), err error) {
+	az, err = newAuthorizer(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	decisions := newDecisionCache(c)
+	az = decisions.Wrap(c.subject, az)
+	if r, ok := az.(auth.Reconciler); ok && c.watchEnabled {
+		r.StartReconcile(c.reconcileInterval)
+	}
+	closers := []io.Closer{decisions}
+	if cl, ok := az.(io.Closer); ok {
+		closers = append(closers, cl)
+	}
+	cleanup = func() {
+		for _, cl := range closers {
+			_ = cl.Close()
+		}
+	}
+	tombstones, err := newTombstones(c)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if tombstones != nil {
+		az = tombstones.Wrap(az)
+	}
+	overrides, err := newOverrides(c)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if overrides != nil {
+		closers = append(closers, overrides)
+		az = overrides.Wrap(az)
+	}
+	return az, cleanup, nil
+}
+
+func runServe9P(args []string) error {
+	fs := flag.NewFlagSet("serve-9p", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
-	mountDir := fs.String("mount", "", "mount path")
+	var c commonFlags
+	addCommonFlags(fs, &c, false)
+	listen := fs.String("listen", "127.0.0.1:5640", "9P listen address, host:port or unix:/path; clients are not authenticated")
+	fs.BoolVar(&c.hideEmptyFiles, "hide-empty-files", false, "omit JSONL files in which the subject sees no rows from listings and lookups")
+	fs.IntVar(&c.mountUID, "mount-uid", -1, "uid presented as the owner of every file and directory (-1 keeps the server process)")
+	fs.IntVar(&c.mountGID, "mount-gid", -1, "gid presented as the group of every file and directory (-1 keeps the server process)")
+	fs.StringVar(&c.fileMode, "file-mode", "", "octal permission bits presented for files, e.g. 0440")
+	fs.StringVar(&c.dirMode, "dir-mode", "", "octal permission bits presented for directories, e.g. 0550")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	if *mountDir == "" {
-		return fmt.Errorf("--mount is required")
+	if err := validate(&c, false); err != nil {
+		return err
 	}
-	var files int
-	var bytes int64
-	err := filepath.WalkDir(*mountDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		files++
-		st, err := d.Info()
-		if err == nil {
-			bytes += st.Size()
-		}
-		return nil
-	})
+	disconnect, err := connectIndex(&c)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("files=%d bytes=%d\n", files, bytes)
-	return nil
+	defer disconnect()
+	network, addr := "tcp", *listen
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	az, closeAz, err := newExportAuthorizer(c)
+	if err != nil {
+		return err
+	}
+	defer closeAz()
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	warns := warnings.New()
+	defer func() { _ = warns.WriteSummary(os.Stderr) }()
+	p9FS := p9serve.New(c.options().With(options.WithWarnings(warns)), az)
+	defer p9FS.Close()
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	fmt.Printf("serving metricfs for %s over 9P2000.L on %s\n", c.sourceDir, lis.Addr())
+	return p9serve.Serve(ctx, lis, p9FS)
 }
 
-func runRender(args []string) error {
-	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+func runServeSFTP(args []string) error {
+	fs := flag.NewFlagSet("serve-sftp", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
 	var c commonFlags
 	addCommonFlags(fs, &c, false)
-	filePath := fs.String("file", "", "source file to render filtered output")
+	listen := fs.String("listen", ":2022", "SSH listen address")
+	hostKey := fs.String("host-key", "", "PEM private key the server presents as its SSH host key")
+	keysFile := fs.String("authorized-subjects", "", "JSON file mapping SSH public keys to subjects")
+	fs.BoolVar(&c.hideEmptyFiles, "hide-empty-files", false, "omit JSONL files in which the subject sees no rows from listings and lookups")
+	fs.IntVar(&c.mountUID, "mount-uid", -1, "uid presented as the owner of every file and directory (-1 keeps the server process)")
+	fs.IntVar(&c.mountGID, "mount-gid", -1, "gid presented as the group of every file and directory (-1 keeps the server process)")
+	fs.StringVar(&c.fileMode, "file-mode", "", "octal permission bits presented for files, e.g. 0440")
+	fs.StringVar(&c.dirMode, "dir-mode", "", "octal permission bits presented for directories, e.g. 0550")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
-	if *filePath == "" {
-		return fmt.Errorf("--file is required")
+	if *hostKey == "" || *keysFile == "" {
+		return fmt.Errorf("--host-key and --authorized-subjects are required")
 	}
-	if c.sourceDir == "" {
-		c.sourceDir = filepath.Dir(*filePath)
+	if !c.usesBackend(enums.AuthBackendSpiceDB) {
+		return fmt.Errorf("serve-sftp requires --auth-backend spicedb")
+	}
+	if c.subject != "" {
+		return fmt.Errorf("serve-sftp takes subjects from --authorized-subjects, not --subject")
 	}
+	c.subjectPerLogin = true
 	if err := validate(&c, false); err != nil {
 		return err
 	}
-	az, err := newAuthorizer(c)
+	disconnect, err := connectIndex(&c)
 	if err != nil {
 		return err
 	}
-	if cl, ok := az.(io.Closer); ok {
-		defer func() { _ = cl.Close() }()
+	defer disconnect()
+	pem, err := os.ReadFile(*hostKey)
+	if err != nil {
+		return fmt.Errorf("--host-key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return fmt.Errorf("--host-key: %w", err)
+	}
+	keys, err := sftpserve.LoadKeys(*keysFile)
+	if err != nil {
+		return fmt.Errorf("--authorized-subjects: %w", err)
+	}
+	asSubject, cleanup, err := newSubjectAuthorizers(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
 	}
-	return projector.RenderFiltered(*filePath, projector.Options{
-		SourceDir:         c.sourceDir,
-		MapperFileName:    c.mapperFileName,
-		MapperInherit:     c.mapperInheritParent,
-		MissingMapperMode: c.missingMapper,
-		MissingResource:   c.missingResourceKey,
-		IndexDir:          c.indexDir,
-		FormatVersion:     c.indexFormatVersion,
-	}, az, os.Stdout)
+	warns := warnings.New()
+	defer func() { _ = warns.WriteSummary(os.Stderr) }()
+	srv := sftpserve.New(c.options().With(options.WithWarnings(warns)), signer, keys, asSubject)
+	defer srv.Close()
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	fmt.Printf("serving metricfs for %s over SFTP on %s\n", c.sourceDir, lis.Addr())
+	return srv.Serve(ctx, lis)
 }
 
-func newAuthorizer(c commonFlags) (auth.Authorizer, error) {
-	switch c.authBackend {
-	case "file":
-		if c.permissionsFile == "" {
-			return auth.NewDenyAll(), nil
-		}
-		return auth.New(c.permissionsFile)
-	case "spicedb":
-		token := strings.TrimSpace(c.spiceToken)
-		if token == "" && c.spiceTokenEnv != "" {
-			token = strings.TrimSpace(os.Getenv(c.spiceTokenEnv))
+func newSubjectAuthorizers(c commonFlags) (asSubject func(subject string) (auth.Authorizer, error), cleanup func(), err error) {
+	tombstones, err := newTombstones(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	overrides, err := newOverrides(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	decisions := newDecisionCache(c)
+	cleanup = func() { _ = decisions.Close() }
+	if overrides != nil {
+		cleanup = func() {
+			_ = decisions.Close()
+			_ = overrides.Close()
 		}
-		if token == "" {
-			return nil, fmt.Errorf("spicedb auth backend requires --spicedb-token or %s env var", c.spiceTokenEnv)
+	}
+	asSubject = func(subject string) (auth.Authorizer, error) {
+		as := c
+		as.subject = subject
+		az, err := newAuthorizer(as)
+		if err != nil {
+			return nil, err
+		}
+		az = decisions.Wrap(subject, az)
+		if r, ok := az.(auth.Reconciler); ok && c.watchEnabled {
+			r.StartReconcile(c.reconcileInterval)
+		}
+		if tombstones != nil {
+			az = tombstones.Wrap(az)
+		}
+		if overrides != nil {
+			az = overrides.Wrap(az)
+		}
+		return az, nil
+	}
+	return asSubject, cleanup, nil
+}
+
+func runServeHTTP(args []string) error {
+	fs := flag.NewFlagSet("serve-http", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var c commonFlags
+	addCommonFlags(fs, &c, false)
+	listen := fs.String("listen", "127.0.0.1:8080", "HTTP listen address")
+	keyFile := fs.String("share-key-file", "", "file holding the key share links are signed with (at least 32 bytes)")
+	fs.BoolVar(&c.hideEmptyFiles, "hide-empty-files", false, "omit JSONL files in which the subject sees no rows from listings and lookups")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		return fmt.Errorf("--share-key-file is required")
+	}
+	if !c.usesBackend(enums.AuthBackendSpiceDB) {
+		return fmt.Errorf("serve-http requires --auth-backend spicedb")
+	}
+	if c.subject != "" {
+		return fmt.Errorf("serve-http takes subjects from share links, not --subject")
+	}
+	c.subjectPerLogin = true
+	if err := validate(&c, false); err != nil {
+		return err
+	}
+	disconnect, err := connectIndex(&c)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+	key, err := httpserve.LoadKey(*keyFile)
+	if err != nil {
+		return fmt.Errorf("--share-key-file: %w", err)
+	}
+	asSubject, cleanup, err := newSubjectAuthorizers(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	warns := warnings.New()
+	defer func() { _ = warns.WriteSummary(os.Stderr) }()
+	srv := httpserve.New(c.options().With(options.WithWarnings(warns)), key, asSubject)
+	defer srv.Close()
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	fmt.Printf("serving metricfs share links for %s on http://%s\n", c.sourceDir, lis.Addr())
+	return srv.Serve(ctx, lis)
+}
+
+func runShare(args []string) error {
+	if len(args) == 0 || args[0] != "create" {
+		return fmt.Errorf("usage: metricfs share create --share-key-file FILE --subject TYPE:ID --path PATH [--ttl 24h] [--base-url URL]")
+	}
+	fs := flag.NewFlagSet("share create", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	keyFile := fs.String("share-key-file", "", "file holding the key serve-http verifies share links with")
+	subject := fs.String("subject", "", "subject whose filtered view the link shares")
+	prefix := fs.String("path", "/", "file or directory the link is limited to, relative to the served source dir")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the link is valid")
+	baseURL := fs.String("base-url", "http://127.0.0.1:8080", "URL serve-http is reachable at")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *keyFile == "" || *subject == "" {
+		return fmt.Errorf("--share-key-file and --subject are required")
+	}
+	if *ttl <= 0 {
+		return fmt.Errorf("--ttl must be positive")
+	}
+	key, err := httpserve.LoadKey(*keyFile)
+	if err != nil {
+		return fmt.Errorf("--share-key-file: %w", err)
+	}
+	sh := httpserve.Share{Subject: *subject, Prefix: *prefix, Expires: time.Now().Add(*ttl)}
+	token, err := httpserve.Sign(key, sh)
+	if err != nil {
+		return err
+	}
+	p := strings.TrimPrefix(vtree.Clean(*prefix), "/")
+	fmt.Printf("%s/share/%s/%s\n", strings.TrimRight(*baseURL, "/"), token, p)
+	return nil
+}
+
+func runInitMapper(args []string) error {
+	fs := flag.NewFlagSet("init-mapper", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	file := fs.String("file", "", "sample JSONL file")
+	rows := fs.Int("rows", 1000, "rows to sample")
+	objectType := fs.String("object-type", "metric_row", "object type of the generated rule")
+	permission := fs.String("permission", "read", "permission of the generated rule")
+	glob := fs.String("glob", "*.jsonl", "match glob of the generated rule")
+	out := fs.String("out", "", "mapper file to write (default: .metricfs-map.yaml next to --file; - for stdout)")
+	yes := fs.Bool("yes", false, "use the best proposal without prompting")
+	force := fs.Bool("force", false, "overwrite an existing mapper file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("--file is required")
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	fields, n, err := mapgen.Analyze(f, *rows)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("no string field with more than one value in %d sampled rows of %s", n, *file)
+	}
+	if len(fields) > 5 {
+		fields = fields[:5]
+	}
+	choice := 0
+	if !*yes {
+		fmt.Printf("candidate ID fields from %d rows of %s:\n", n, *file)
+		for i, fd := range fields {
+			fmt.Printf("  %d) %-30s present %3.0f%%  distinct %3.0f%%  e.g. %s\n",
+				i+1, fd.Pointer, 100*fd.Coverage(), 100*fd.Cardinality(), strings.Join(fd.Examples, ", "))
+		}
+		fmt.Printf("use which field [1]: ")
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			i, err := strconv.Atoi(line)
+			if err != nil || i < 1 || i > len(fields) {
+				return fmt.Errorf("invalid choice %q", line)
+			}
+			choice = i - 1
+		}
+	}
+	b, err := mapgen.Generate(fields[choice], mapgen.Options{Glob: *glob, ObjectType: *objectType, Permission: *permission})
+	if err != nil {
+		return err
+	}
+	if *out == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	path := *out
+	if path == "" {
+		path = filepath.Join(filepath.Dir(*file), ".metricfs-map.yaml")
+	}
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s exists; use --force to overwrite or --out - to print", path)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s (pointer %s)\n", path, fields[choice].Pointer)
+	return nil
+}
+
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate-flags", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var c commonFlags
+	addCommonFlags(fs, &c, true)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return validate(&c, true)
+}
+
+func runWarmIndex(args []string) error {
+	fs := flag.NewFlagSet("warm-index", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var c commonFlags
+	addCommonFlags(fs, &c, false)
+	manifestPath := fs.String("manifest", "", "write a manifest of the indexed files (paths, sizes, mtimes, SHA-256, rule hashes) to this path")
+	sincePath := fs.String("since-manifest", "", "only warm files that are new or changed since this manifest")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := validate(&c, false); err != nil {
+		return err
+	}
+	disconnect, err := connectIndex(&c)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+	next, err := indexer.NewManifest(c.sourceDir)
+	if err != nil {
+		return err
+	}
+	var prev *indexer.Manifest
+	if *sincePath != "" {
+		if prev, err = indexer.LoadManifest(*sincePath); err != nil {
+			return err
+		}
+		if prev.SourceDir != next.SourceDir {
+			return fmt.Errorf("--since-manifest was written for --source-dir %s", prev.SourceDir)
+		}
+	}
+	warns := warnings.New()
+	defer func() { _ = warns.WriteSummary(os.Stderr) }()
+	opts := c.options().With(options.WithWarnings(warns))
+	count, skipped, unchanged := 0, 0, 0
+	err = filepath.WalkDir(c.sourceDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if opts.Excluded(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".jsonl") {
+			return nil
+		}
+		res, err := indexer.WarmSince(path, opts, prev, next)
+		if err != nil {
+			return err
+		}
+		switch res {
+		case indexer.Warmed:
+			count++
+		case indexer.Unchanged:
+			unchanged++
+		case indexer.SkippedNoIndex:
+			skipped++
 		}
-		return auth.NewSpiceDB(auth.SpiceDBConfig{
-			Endpoint:    c.spiceEndpoint,
-			Token:       token,
-			Subject:     c.subject,
-			Consistency: c.spiceConsistency,
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("warmed %d jsonl files\n", count)
+	if prev != nil {
+		fmt.Printf("%d jsonl files unchanged since %s\n", unchanged, *sincePath)
+	}
+	if skipped > 0 {
+		fmt.Printf("skipped %d jsonl files with index: none\n", skipped)
+	}
+	if *manifestPath != "" {
+		return next.Write(*manifestPath)
+	}
+	return nil
+}
+
+func runIndexInspect(args []string) error {
+	fs := flag.NewFlagSet("index-inspect", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var c commonFlags
+	addCommonFlags(fs, &c, false)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: metricfs index-inspect [--source-dir <dir> ...] <index-or-source-file>")
+	}
+	fi, err := indexer.ReadIndexFile(fs.Arg(0))
+	if err != nil {
+		if c.sourceDir == "" {
+			return err
+		}
+		// Inspecting never authorizes rows.
+		c.allowNoAuthz = true
+		if err := validate(&c, false); err != nil {
+			return err
+		}
+		disconnect, err := connectIndex(&c)
+		if err != nil {
+			return err
+		}
+		defer disconnect()
+		if fi, err = indexer.Cached(fs.Arg(0), c.options()); err != nil {
+			return err
+		}
+	}
+	out := struct {
+		SourcePath  string               `json:"source_path"`
+		Size        int64                `json:"size"`
+		MtimeUnix   int64                `json:"mtime_unix"`
+		RuleHash    string               `json:"rule_hash"`
+		Passthrough bool                 `json:"passthrough"`
+		BuiltAt     time.Time            `json:"built_at"`
+		Codec       string               `json:"codec,omitempty"`
+		Rows        int                  `json:"rows"`
+		Header      *indexer.IndexHeader `json:"header"`
+	}{fi.SourcePath, fi.Size, fi.MtimeUnix, fi.RuleHash, fi.Passthrough, fi.BuiltAt, fi.Codec, len(fi.Lines), fi.Header}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func runAuthz(args []string) error {
+	if len(args) == 0 || args[0] != "snapshot" {
+		return fmt.Errorf("usage: metricfs authz snapshot --out <file> [flags]")
+	}
+	fs := flag.NewFlagSet("authz snapshot", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var c commonFlags
+	addCommonFlags(fs, &c, false)
+	out := fs.String("out", "", "file the snapshot is written to")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("--out is required")
+	}
+	if err := validate(&c, false); err != nil {
+		return err
+	}
+	disconnect, err := connectIndex(&c)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+	az, err := newAuthorizer(c)
+	if err != nil {
+		return err
+	}
+	if cl, ok := az.(io.Closer); ok {
+		defer func() { _ = cl.Close() }()
+	}
+	var cands []auth.CandidateKey
+	seen := map[auth.CandidateKey]struct{}{}
+	add := func(cand auth.CandidateKey) {
+		if _, ok := seen[cand]; !ok {
+			seen[cand] = struct{}{}
+			cands = append(cands, cand)
+		}
+	}
+	files := 0
+	for _, op := range []enums.Operation{enums.OperationOpen, enums.OperationExport} {
+		opts := c.options().With(options.WithOperation(op))
+		err := filepath.WalkDir(c.sourceDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if opts.Excluded(path) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() || !strings.HasSuffix(d.Name(), ".jsonl") {
+				return nil
+			}
+			fi, err := indexer.BuildOrLoad(path, opts)
+			if err != nil {
+				return err
+			}
+			if op == enums.OperationOpen {
+				files++
+			}
+			for _, ln := range fi.Lines {
+				for _, cand := range ln.Candidates {
+					add(cand)
+					for _, q := range fi.RowQuotas {
+						cand.Permission = q.Permission
+						add(cand)
+					}
+				}
+			}
+			return nil
 		})
+		if err != nil {
+			return err
+		}
+	}
+	snap, err := auth.TakeSnapshot(context.Background(), az, c.subject, cands)
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	if err := snap.Write(*out); err != nil {
+		return err
+	}
+	fmt.Printf("snapshot of %d decisions from %d files written to %s\n", len(snap.Decisions), files, *out)
+	return nil
+}
+
+func runMount(args []string) error {
+	fs := flag.NewFlagSet("mount", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var c commonFlags
+	addCommonFlags(fs, &c, true)
+	allowImpersonation := fs.Bool("allow-impersonation", false, "let a privileged subject view files as another subject via ioctl (spicedb backend only)")
+	canaryFile := fs.String("canary-file", "", "source file rendered at startup and every reconcile interval as a self-test (relative to --source-dir)")
+	canarySHA := fs.String("canary-sha256", "", "expected hex SHA-256 of the rendered canary file")
+	canaryWebhook := fs.String("canary-webhook", "", "URL that receives a JSON POST when the canary drifts")
+	visibilityThreshold := fs.Float64("visibility-alert-threshold", 0, "alert when a file's visible-row percentage moves by this many points between reconcile intervals; 0 disables")
+	visibilityWebhook := fs.String("visibility-webhook", "", "URL that receives a JSON POST when a file's visibility moves beyond --visibility-alert-threshold")
+	impersonationCheck := fs.String("impersonation-permission", fusefs.DefaultImpersonationCheck, "permission the mount subject needs to impersonate, as type:id#permission")
+	healthListen := fs.String("health-listen", "", "serve GET /healthz on this address: 200 while the mount, authorizer, and index cache are healthy, 503 otherwise")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if c.mountDir != "" {
+		if err := fusefs.PrepareMountDir(c.mountDir, c.createMountDir); err != nil {
+			return err
+		}
+	}
+	if err := validate(&c, true); err != nil {
+		return err
+	}
+	disconnect, err := connectIndex(&c)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+	if (*canaryFile == "") != (*canarySHA == "") {
+		return fmt.Errorf("--canary-file and --canary-sha256 must be set together")
+	}
+	if *visibilityThreshold < 0 || *visibilityThreshold > 100 {
+		return fmt.Errorf("--visibility-alert-threshold must be between 0 and 100")
+	}
+	if *visibilityWebhook != "" && *visibilityThreshold == 0 {
+		return fmt.Errorf("--visibility-webhook requires --visibility-alert-threshold")
+	}
+	decisions := newDecisionCache(c)
+	defer decisions.Close()
+	asSubject := func(subject string) (auth.Authorizer, error) {
+		as := c
+		as.subject = subject
+		az, err := newAuthorizer(as)
+		if err != nil {
+			return nil, err
+		}
+		return decisions.Wrap(subject, az), nil
+	}
+	var imp *fusefs.Impersonation
+	if *allowImpersonation {
+		check, err := auth.ParseCandidateKey(*impersonationCheck)
+		if err != nil {
+			return fmt.Errorf("--impersonation-permission: %w", err)
+		}
+		if !c.usesBackend(enums.AuthBackendSpiceDB) {
+			return fmt.Errorf("--allow-impersonation requires --auth-backend spicedb")
+		}
+		if runtime.GOOS == "darwin" {
+			// macFUSE does not forward the Linux ioctl numbers impersonation uses.
+			return fmt.Errorf("--allow-impersonation is not supported on macOS")
+		}
+		imp = &fusefs.Impersonation{Check: check, NewAuthorizer: asSubject}
+	}
+	var subjects *fusefs.SubjectMap
+	if c.subjectMap != "" {
+		m, err := fusefs.LoadSubjectMap(c.subjectMap)
+		if err != nil {
+			return fmt.Errorf("--subject-map: %w", err)
+		}
+		subjects = m
+	}
+	var az auth.Authorizer = auth.NewDenyAll()
+	if c.subject != "" || subjects == nil {
+		var err error
+		if az, err = asSubject(c.subject); err != nil {
+			return err
+		}
+	}
+	if cl, ok := az.(io.Closer); ok {
+		defer func() { _ = cl.Close() }()
+	}
+	reconcile := func(az auth.Authorizer) {
+		if r, ok := az.(auth.Reconciler); ok && c.watchEnabled {
+			r.StartReconcile(c.reconcileInterval)
+		}
+	}
+	reconcile(az)
+	warns := warnings.New()
+	if err := checkRuleReviews(c, warns); err != nil {
+		return err
+	}
+	cfg := c.options().With(options.WithWarnings(warns), options.WithChunkCache(chunkcache.New(c.chunkCacheBytes)))
+	srv := fusefs.New(cfg, az)
+	tombstones, err := newTombstones(c)
+	if err != nil {
+		return err
+	}
+	if tombstones != nil {
+		srv.EnableTombstones(tombstones)
+	}
+	overrides, err := newOverrides(c)
+	if err != nil {
+		return err
+	}
+	if overrides != nil {
+		defer func() { _ = overrides.Close() }()
+		srv.EnableOverrides(overrides)
+	}
+	if imp != nil {
+		srv.EnableImpersonation(*imp)
+	}
+	if c.watchSource {
+		srv.EnableSourceWatch()
+	}
+	if *canaryFile != "" {
+		path := *canaryFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(c.sourceDir, path)
+		}
+		cn := canary.New(path, *canarySHA, cfg)
+		cn.Webhook = *canaryWebhook
+		cn.Interval = c.reconcileInterval
+		srv.EnableCanary(cn)
+	}
+	if *visibilityThreshold > 0 {
+		tr := canary.NewTrend(*visibilityThreshold, cfg)
+		tr.Webhook = *visibilityWebhook
+		tr.Interval = c.reconcileInterval
+		srv.EnableVisibilityTrend(tr)
+	}
+	if subjects != nil {
+		srv.EnableSubjectMap(subjects, func(subject string) (auth.Authorizer, error) {
+			az, err := asSubject(subject)
+			if err == nil {
+				reconcile(az)
+			}
+			return az, err
+		})
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reloadMount(c, srv, decisions, overrides, cfg, warns)
+			}
+		}
+	}()
+	if *healthListen != "" {
+		lis, err := net.Listen("tcp", *healthListen)
+		if err != nil {
+			return fmt.Errorf("--health-listen: %w", err)
+		}
+		hs := &http.Server{Handler: healthHandler(srv), ReadHeaderTimeout: 5 * time.Second}
+		go func() { _ = hs.Serve(lis) }()
+		defer hs.Close()
+	}
+	fmt.Printf("mounted metricfs at %s\n", c.mountDir)
+	return srv.MountAndServe(ctx)
+}
+
+func healthHandler(srv *fusefs.Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		out := map[string]string{}
+		code := http.StatusOK
+		for _, ch := range srv.Health(2 * time.Second) {
+			out[ch.Name] = "ok"
+			if ch.Err != nil {
+				out[ch.Name] = ch.Err.Error()
+				code = http.StatusServiceUnavailable
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(out)
+	})
+	return mux
+}
+
+func reloadMount(c commonFlags, srv *fusefs.Server, decisions *auth.DecisionCache, overrides *auth.Overrides, cfg options.Options, warns *warnings.Collector) {
+	fmt.Fprintln(os.Stderr, "metricfs: SIGHUP, reloading")
+	if err := checkRuleReviews(c, warns); err != nil {
+		fmt.Fprintf(os.Stderr, "metricfs: reload mapper files: %v\n", err)
+	}
+	if overrides != nil {
+		if err := overrides.Reload(); err != nil {
+			fmt.Fprintf(os.Stderr, "metricfs: reload --overrides-file: %v\n", err)
+		}
+	}
+	decisions.Clear()
+	cfg.ChunkCache.Clear()
+	if err := srv.Reload(); err != nil {
+		fmt.Fprintf(os.Stderr, "metricfs: reload permissions: %v\n", err)
+	}
+}
+
+func checkRuleReviews(c commonFlags, warns *warnings.Collector) error {
+	findings, err := mapper.Lint(c.options().MapperConfig(), time.Now())
+	if err != nil {
+		return err
+	}
+	expired := 0
+	for _, f := range findings {
+		kind := warnings.KindRuleDeprecated
+		if f.Expired {
+			kind, expired = warnings.KindRuleExpired, expired+1
+		}
+		warns.Add(kind, f.Path, 0, "rule %d (%s): %s", f.Rule+1, f.Glob, f.Message)
+		fmt.Fprintf(os.Stderr, "metricfs: %s\n", f)
+	}
+	if expired > 0 && c.expiredRules == "fail" {
+		return fmt.Errorf("%d mapper rules are past their expires date (--expired-rules fail)", expired)
+	}
+	return nil
+}
+
+func runLintMapper(args []string) error {
+	fs := flag.NewFlagSet("lint-mapper", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	sourceDir := fs.String("source-dir", "", "source directory whose mapper files are checked")
+	mapperFile := fs.String("mapper-file-name", ".metricfs-map.yaml", "mapper file name")
+	failDeprecated := fs.Bool("fail-on-deprecated", false, "also fail when a rule is deprecated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *sourceDir == "" {
+		return fmt.Errorf("--source-dir is required")
+	}
+	findings, err := mapper.Lint(mapper.Config{SourceDir: *sourceDir, MapperFileName: *mapperFile}, time.Now())
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, f := range findings {
+		level := "warning"
+		if f.Expired || *failDeprecated {
+			level = "error"
+			failed++
+		}
+		fmt.Printf("%s: %s\n", level, f)
+	}
+	if failed > 0 {
+		return fmt.Errorf("lint-mapper: %d rules need review", failed)
+	}
+	return nil
+}
+
+func runMapper(args []string) error {
+	const usage = "usage: metricfs mapper <validate [--mapper-file-name name] <dir>|schema>"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	switch args[0] {
+	case "schema":
+		_, err := os.Stdout.Write(mapper.Schema)
+		return err
+	case "validate":
+	default:
+		return fmt.Errorf(usage)
+	}
+	fs := flag.NewFlagSet("mapper validate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	mapperFile := fs.String("mapper-file-name", ".metricfs-map.yaml", "mapper file name")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf(usage)
+	}
+	problems, err := mapper.Validate(mapper.Config{SourceDir: fs.Arg(0), MapperFileName: *mapperFile, InheritParent: true})
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("mapper validate: %d problems", len(problems))
+	}
+	return nil
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	mountDir := fs.String("mount", "", "mount path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *mountDir == "" {
+		return fmt.Errorf("--mount is required")
+	}
+	var files int
+	var bytes int64
+	err := filepath.WalkDir(*mountDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		files++
+		st, err := d.Info()
+		if err == nil {
+			bytes += st.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("files=%d bytes=%d\n", files, bytes)
+	return nil
+}
+
+func runRender(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var c commonFlags
+	addCommonFlags(fs, &c, false)
+	filePath := fs.String("file", "", "source file to render filtered output")
+	schemaOnly := fs.Bool("schema", false, "print the inferred JSON schema of visible rows instead of the rows")
+	visibilityOnly := fs.Bool("visibility", false, "print visible row counts per granting object instead of the rows (.jsonl only)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *filePath == "" {
+		return fmt.Errorf("--file is required")
+	}
+	if c.sourceDir == "" {
+		c.sourceDir = filepath.Dir(*filePath)
+	}
+	if err := validate(&c, false); err != nil {
+		return err
+	}
+	disconnect, err := connectIndex(&c)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+	if c.options().Excluded(*filePath) {
+		return fmt.Errorf("--file %s is excluded by --exclude", *filePath)
+	}
+	az, err := newAuthorizer(c)
+	if err != nil {
+		return err
+	}
+	if cl, ok := az.(io.Closer); ok {
+		defer func() { _ = cl.Close() }()
+	}
+	tombstones, err := newTombstones(c)
+	if err != nil {
+		return err
+	}
+	if tombstones != nil {
+		az = tombstones.Wrap(az)
+		defer func() {
+			if n := tombstones.SuppressedRows(); n > 0 {
+				fmt.Fprintf(os.Stderr, "metricfs: %d rows suppressed by tombstones\n", n)
+			}
+		}()
+	}
+	overrides, err := newOverrides(c)
+	if err != nil {
+		return err
+	}
+	if overrides != nil {
+		defer func() { _ = overrides.Close() }()
+		az = overrides.Wrap(az)
+	}
+	warns := warnings.New()
+	defer func() { _ = warns.WriteSummary(os.Stderr) }()
+	opts := c.options().With(
+		options.WithWarnings(warns),
+		options.WithOperation(enums.OperationExport),
+	)
+	if *schemaOnly {
+		return projector.RenderSchema(*filePath, opts, az, os.Stdout)
+	}
+	if *visibilityOnly {
+		return projector.RenderVisibility(*filePath, opts, az, os.Stdout)
+	}
+	return projector.RenderFiltered(*filePath, opts, az, os.Stdout)
+}
+
+func runUnmount(args []string) error {
+	fs := flag.NewFlagSet("unmount", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	lazy := fs.Bool("lazy", false, "detach the mount now and finish unmounting once open files are closed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: metricfs unmount [--lazy] <dir>")
+	}
+	return fusefs.Unmount(fs.Arg(0), *lazy)
+}
+
+func runImpersonate(args []string) error {
+	fs := flag.NewFlagSet("impersonate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	filePath := fs.String("file", "", "file inside a mount started with --allow-impersonation")
+	subject := fs.String("as", "", "subject to view the file as, e.g. user:bob")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *filePath == "" || *subject == "" {
+		return fmt.Errorf("--file and --as are required")
+	}
+	f, err := os.Open(*filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := fusefs.Impersonate(f, *subject); err != nil {
+		return fmt.Errorf("impersonate %s: %w", *subject, err)
+	}
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+func runLoadTest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	mountDir := fs.String("mount", "", "mount path")
+	readers := fs.Int("readers", 8, "concurrent readers")
+	pattern := fs.String("pattern", loadtest.PatternSequential, "read pattern: sequential|random")
+	duration := fs.Duration("duration", 30*time.Second, "test duration")
+	blockSize := fs.Int("block-size", 128<<10, "read block size in bytes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *mountDir == "" {
+		return fmt.Errorf("--mount is required")
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	rep, err := loadtest.Run(ctx, loadtest.Config{
+		MountDir:  *mountDir,
+		Readers:   *readers,
+		Pattern:   *pattern,
+		Duration:  *duration,
+		BlockSize: *blockSize,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(rep.String())
+	if rep.FirstErr != nil {
+		fmt.Fprintf(os.Stderr, "first error: %v\n", rep.FirstErr)
+	}
+	return nil
+}
+
+func runGolden(args []string) error {
+	if len(args) < 1 || (args[0] != "record" && args[0] != "check") {
+		return fmt.Errorf("usage: metricfs golden record|check --fixtures dir")
+	}
+	mode := args[0]
+	fs := flag.NewFlagSet("golden "+mode, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fixtures := fs.String("fixtures", "", "fixture directory with source/, permissions/ and golden/")
+	mapperFileName := fs.String("mapper-file-name", ".metricfs-map.yaml", "mapper file name")
+	missingMapper := fs.String("missing-mapper", string(enums.MissingMapperDeny), "missing mapper behavior")
+	missingResourceKey := fs.String("missing-resource-key", string(enums.MissingResourceDeny), "default missing resource key behavior")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *fixtures == "" {
+		return fmt.Errorf("--fixtures is required")
+	}
+	mm, err := enums.ParseMissingMapperMode(*missingMapper)
+	if err != nil {
+		return err
+	}
+	mr, err := enums.ParseMissingResourceKey(*missingResourceKey)
+	if err != nil {
+		return err
+	}
+	opts := options.New(
+		options.WithMapper(*mapperFileName, true),
+		options.WithMissingMapperMode(mm),
+		options.WithMissingResource(mr),
+	)
+	if mode == "record" {
+		n, err := golden.Record(*fixtures, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("recorded %d golden outputs\n", n)
+		return nil
+	}
+	mismatches, err := golden.Check(*fixtures, opts)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		fmt.Println(m.String())
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("golden check failed: %d mismatches", len(mismatches))
+	}
+	fmt.Println("golden check passed")
+	return nil
+}
+
+func newTombstones(c commonFlags) (*auth.Tombstones, error) {
+	if c.tombstoneFile == "" && c.tombstonePerm == "" {
+		return nil, nil
+	}
+	t, err := auth.NewTombstones(c.tombstoneFile, c.tombstonePerm)
+	if err != nil {
+		return nil, fmt.Errorf("--tombstone-file: %w", err)
+	}
+	return t, nil
+}
+
+func newOverrides(c commonFlags) (*auth.Overrides, error) {
+	if c.overridesFile == "" {
+		return nil, nil
+	}
+	o, err := auth.NewOverrides(c.overridesFile)
+	if err != nil {
+		return nil, fmt.Errorf("--overrides-file: %w", err)
+	}
+	o.Start(time.Second)
+	return o, nil
+}
+
+func parseCaveatContext(s string) (map[string]any, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseAuthBackends(s string) ([]enums.AuthBackend, error) {
+	var out []enums.AuthBackend
+	for _, name := range strings.Split(s, ",") {
+		b, err := enums.ParseAuthBackend(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("--auth-backend must be file|spicedb|sqlite|http|opa|cedar|casbin|snapshot, or a comma-separated chain of them")
+		}
+		if slices.Contains(out, b) {
+			return nil, fmt.Errorf("--auth-backend lists %s twice", b)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func (c commonFlags) usesBackend(b enums.AuthBackend) bool {
+	backends, err := parseAuthBackends(c.authBackend)
+	return err == nil && slices.Contains(backends, b)
+}
+
+func newAuthorizer(c commonFlags) (auth.Authorizer, error) {
+	backends, err := parseAuthBackends(c.authBackend)
+	if err != nil {
+		return nil, err
+	}
+	if len(backends) == 1 && c.authAuditLog == "" {
+		return newBackend(c, backends[0])
+	}
+	links := make([]auth.ChainLink, 0, len(backends))
+	closeAll := func() {
+		for _, l := range links {
+			if cl, ok := l.Authorizer.(io.Closer); ok {
+				_ = cl.Close()
+			}
+		}
+	}
+	for _, b := range backends {
+		az, err := newBackend(c, b)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("%s: %w", b, err)
+		}
+		links = append(links, auth.ChainLink{Name: string(b), Authorizer: az})
+	}
+	var audit io.Writer
+	if c.authAuditLog != "" {
+		f, err := os.OpenFile(c.authAuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("--auth-audit-log: %w", err)
+		}
+		audit = f
+	}
+	return auth.NewChain(c.subject, audit, links...), nil
+}
+
+func newBackend(c commonFlags, backend enums.AuthBackend) (auth.Authorizer, error) {
+	switch backend {
+	case enums.AuthBackendFile:
+		if c.permissionsFile == "" {
+			return auth.NewDenyAll(), nil
+		}
+		return auth.New(c.permissionsFile, c.subject, auth.WithDefaultPermission(c.defaultPermission))
+	case enums.AuthBackendSQLite:
+		return auth.NewSQLite(c.authDB, c.subject)
+	case enums.AuthBackendCedar:
+		return auth.NewCedar(c.cedarPolicy, c.cedarEntities, c.subject)
+	case enums.AuthBackendCasbin:
+		return auth.NewCasbin(c.casbinModel, c.casbinPolicy, c.subject)
+	case enums.AuthBackendSnapshot:
+		return auth.NewSnapshot(c.authSnapshot, c.subject)
+	case enums.AuthBackendHTTP, enums.AuthBackendOPA:
+		var token string
+		if c.authTokenEnv != "" {
+			token = os.Getenv(c.authTokenEnv)
+		}
+		cfg := auth.HTTPConfig{
+			URL:              c.authURL,
+			Subject:          c.subject,
+			Token:            token,
+			CacheTTL:         c.authzCacheTTL,
+			NegativeCacheTTL: c.authzCacheNegTTL,
+			CacheMaxEntries:  c.authzCacheMax,
+		}
+		if backend == enums.AuthBackendOPA {
+			return auth.NewOPA(cfg, c.opaDecision)
+		}
+		return auth.NewHTTP(cfg)
+	case enums.AuthBackendSpiceDB:
+		token := strings.TrimSpace(c.spiceToken)
+		if token == "" && c.spiceTokenFile == "" && c.spiceTokenEnv != "" {
+			token = strings.TrimSpace(os.Getenv(c.spiceTokenEnv))
+		}
+		if token == "" && c.spiceTokenFile == "" {
+			return nil, fmt.Errorf("spicedb auth backend requires --spicedb-token, --spicedb-token-file, or %s env var", c.spiceTokenEnv)
+		}
+		caveatContext, err := parseCaveatContext(c.spiceCaveatContext)
+		if err != nil {
+			return nil, fmt.Errorf("--spicedb-caveat-context: %w", err)
+		}
+		var zedTokenFile string
+		if enums.Consistency(c.spiceConsistency) == enums.ConsistencyAtLeastAsFresh && c.indexDir != "" {
+			zedTokenFile = filepath.Join(c.indexDir, "spicedb.zedtoken")
+		}
+		live, err := auth.NewSpiceDB(auth.SpiceDBConfig{
+			Endpoint:         c.spiceEndpoint,
+			Token:            token,
+			TokenFile:        c.spiceTokenFile,
+			TokenRefresh:     c.spiceTokenRefresh,
+			TokenJWT:         c.spiceTokenK8s,
+			Subject:          c.subject,
+			Consistency:      c.spiceConsistency,
+			Transport:        c.spiceTransport,
+			Insecure:         c.spiceInsecure,
+			CAFile:           c.spiceCAFile,
+			CacheTTL:         c.authzCacheTTL,
+			NegativeCacheTTL: c.authzCacheNegTTL,
+			CacheMaxEntries:  c.authzCacheMax,
+			ZedTokenFile:     zedTokenFile,
+			OnUnavailable:    c.onSpiceUnavailable,
+			StaleTTL:         c.staleSnapshotTTL,
+			CaveatContext:    caveatContext,
+			Retries:          c.spiceRetries,
+			RetryBackoff:     c.spiceRetryBackoff,
+			BreakerThreshold: c.breakerThreshold,
+			BreakerCooldown:  c.breakerCooldown,
+		})
+		if err != nil {
+			return nil, err
+		}
+		mapperCfg := mapper.Config{SourceDir: c.sourceDir, MapperFileName: c.mapperFileName, InheritParent: c.mapperInheritParent, DefaultPermission: c.defaultPermission}
+		if mode, _ := enums.ParseAuthzMode(c.authzMode); mode == enums.AuthzModeLookup {
+			pairs, err := mapper.ObjectPermissions(mapperCfg)
+			if err != nil {
+				return nil, fmt.Errorf("--authz-mode lookup: %w", err)
+			}
+			l := auth.NewSpiceDBLookup(live, pairs)
+			if _, err := l.Refresh(); err != nil {
+				fmt.Fprintf(os.Stderr, "metricfs: spicedb lookup failed, checking live until the next lookup: %v\n", err)
+			}
+			return l, nil
+		}
+		if c.spiceExportInterval == 0 {
+			return live, nil
+		}
+		types, err := mapper.ObjectTypes(mapperCfg)
+		if err != nil {
+			return nil, fmt.Errorf("--spicedb-export-interval: %w", err)
+		}
+		exp := auth.NewSpiceDBExport(live, types, c.spiceExportInterval)
+		if _, err := exp.Refresh(); err != nil {
+			fmt.Fprintf(os.Stderr, "metricfs: spicedb export failed, checking live until the next export: %v\n", err)
+		}
+		return exp, nil
 	default:
-		return nil, fmt.Errorf("unsupported --auth-backend: %s", c.authBackend)
+		return nil, fmt.Errorf("unsupported --auth-backend: %s", backend)
 	}
 }
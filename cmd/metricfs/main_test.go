@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSpiceDBOnlyFlagsAcceptBackendChains(t *testing.T) {
+	dir := t.TempDir()
+	parse := func(args ...string) commonFlags {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		var c commonFlags
+		addCommonFlags(fs, &c, true)
+		if err := fs.Parse(append([]string{"--source-dir", dir, "--spicedb-token", "t", "--spicedb-endpoint", "http://127.0.0.1:1"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	for backend, ok := range map[string]bool{"spicedb": true, "spicedb,file": true, "file,spicedb": true, "file": false} {
+		c := parse("--auth-backend", backend, "--allow-no-authz", "--subject-map", "map.json")
+		err := validate(&c, false)
+		if ok && err != nil {
+			t.Errorf("%s: %v", backend, err)
+		}
+		if !ok && (err == nil || !strings.Contains(err.Error(), "--subject-map requires")) {
+			t.Errorf("%s: got %v, want a --subject-map error", backend, err)
+		}
+		if got := c.usesBackend("spicedb"); got != ok {
+			t.Errorf("%s: usesBackend(spicedb) = %v", backend, got)
+		}
+	}
+}
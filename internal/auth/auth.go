@@ -1,68 +1,279 @@
 package auth
 
 import (
-	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+const DefaultPermission = "read"
+
 type CandidateKey struct {
 	ObjectType string `json:"object_type"`
 	ObjectID   string `json:"object_id"`
 	Permission string `json:"permission"`
+	Context    string `json:"caveat_context,omitempty"`
+}
+
+func ParseCandidateKey(s string) (CandidateKey, error) {
+	object, perm, ok := strings.Cut(strings.TrimSpace(s), "#")
+	if !ok || perm == "" {
+		return CandidateKey{}, fmt.Errorf("invalid candidate %q, expected type:id#permission", s)
+	}
+	typ, id, ok := strings.Cut(object, ":")
+	if !ok || typ == "" || id == "" {
+		return CandidateKey{}, fmt.Errorf("invalid candidate %q, expected type:id#permission", s)
+	}
+	return CandidateKey{ObjectType: typ, ObjectID: id, Permission: perm}, nil
 }
 
 type Authorizer interface {
 	IsAllowed(CandidateKey) bool
 }
 
+const PermissionSeparator = "+"
+
+func Allowed(az Authorizer, c CandidateKey) bool {
+	if !strings.Contains(c.Permission, PermissionSeparator) {
+		return az.IsAllowed(c)
+	}
+	for _, p := range strings.Split(c.Permission, PermissionSeparator) {
+		if !az.IsAllowed(CandidateKey{ObjectType: c.ObjectType, ObjectID: c.ObjectID, Permission: p, Context: c.Context}) {
+			return false
+		}
+	}
+	return true
+}
+
 type SetAuthorizer struct {
-	allowed map[CandidateKey]struct{}
+	notifier
+	stopper
+
+	mu                sync.RWMutex
+	allowed           map[CandidateKey]struct{}
+	patterns          map[idPattern]struct{}
+	matchers          idMatchers
+	path              string
+	subject           string
+	defaultPermission string
+	modTime           time.Time
+	size              int64
 }
 
 type denyAllAuthorizer struct{}
 
 func (d denyAllAuthorizer) IsAllowed(CandidateKey) bool { return false }
 
+func (d denyAllAuthorizer) Decide(CandidateKey) (bool, bool) { return false, false }
+
 func NewDenyAll() Authorizer { return denyAllAuthorizer{} }
 
 func (a *SetAuthorizer) IsAllowed(c CandidateKey) bool {
-	_, ok := a.allowed[c]
-	return ok
+	c.Context = ""
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if _, ok := a.allowed[c]; ok {
+		return true
+	}
+	return a.matchers.match(c)
+}
+
+// An allow-list says nothing about candidates it does not list.
+func (a *SetAuthorizer) Decide(c CandidateKey) (bool, bool) {
+	allowed := a.IsAllowed(c)
+	return allowed, allowed
+}
+
+func (a *SetAuthorizer) StartReconcile(interval time.Duration) {
+	if a.path == "" {
+		return
+	}
+	a.loop(interval, func() {
+		if changed, err := a.reload(); err == nil && changed {
+			a.notify()
+		}
+	})
+}
+
+func (a *SetAuthorizer) Reload() error {
+	if a.path == "" {
+		return nil
+	}
+	changed, err := a.load(true)
+	if err == nil && changed {
+		a.notify()
+	}
+	return err
+}
+
+func (a *SetAuthorizer) Ping() error {
+	if a.path == "" {
+		return nil
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (a *SetAuthorizer) Close() error {
+	a.stop()
+	return nil
+}
+
+func (a *SetAuthorizer) reload() (bool, error) {
+	return a.load(false)
+}
+
+func (a *SetAuthorizer) load(force bool) (bool, error) {
+	st, err := os.Stat(a.path)
+	if err != nil {
+		return false, err
+	}
+	a.mu.RLock()
+	same := st.Size() == a.size && st.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if same && !force {
+		return false, nil
+	}
+	next, err := loadPermissionsFile(a.path, a.subject, a.defaultPermission)
+	if err != nil {
+		return false, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	changed := !sameSet(a.allowed, next.allowed) || !maps.Equal(a.patterns, next.patterns)
+	a.allowed, a.patterns, a.matchers = next.allowed, next.patterns, next.matchers
+	a.modTime, a.size = next.modTime, next.size
+	return changed, nil
+}
+
+func sameSet(a, b map[CandidateKey]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 type permissionsDoc struct {
-	Allow []CandidateKey `json:"allow"`
+	Allow   []permissionEntry   `json:"allow" yaml:"allow"`
+	Groups  map[string][]string `json:"groups" yaml:"groups"`
+	Grants  []permissionEntry   `json:"grants" yaml:"grants"`
+	Implies map[string][]string `json:"implies" yaml:"implies"`
 }
 
-func NewFromPermissionsFile(path string) (*SetAuthorizer, error) {
-	b, err := os.ReadFile(path)
+type permissionEntry struct {
+	Subject        string `json:"subject,omitempty" yaml:"subject"`
+	Group          string `json:"group,omitempty" yaml:"group"`
+	ObjectType     string `json:"object_type" yaml:"object_type"`
+	ObjectID       string `json:"object_id" yaml:"object_id"`
+	ObjectIDPrefix string `json:"object_id_prefix" yaml:"object_id_prefix"`
+	Permission     string `json:"permission" yaml:"permission"`
+}
+
+func NewFromPermissionsFile(path string, opts ...FileOption) (*SetAuthorizer, error) {
+	return loadPermissionsFile(path, "", fileDefaultPermission(opts))
+}
+
+type FileOption func(*fileOptions)
+
+type fileOptions struct {
+	defaultPermission string
+}
+
+func WithDefaultPermission(p string) FileOption {
+	return func(o *fileOptions) {
+		if p != "" {
+			o.defaultPermission = p
+		}
+	}
+}
+
+func fileDefaultPermission(opts []FileOption) string {
+	o := fileOptions{defaultPermission: DefaultPermission}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.defaultPermission
+}
+
+func loadPermissionsFile(path, subject, defaultPermission string) (*SetAuthorizer, error) {
+	st, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	var doc permissionsDoc
-	if err := json.Unmarshal(b, &doc); err != nil {
+	b, err := os.ReadFile(path)
+	if err != nil {
 		return nil, err
 	}
+	doc, err := decodePermissionsDoc(path, b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	in, err := memberships(doc.Groups, subject)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := checkImplies(doc.Implies); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var entries []permissionEntry
+	for _, e := range doc.Allow {
+		if e.Subject == "" || e.Subject == strings.TrimSpace(subject) {
+			entries = append(entries, e)
+		}
+	}
+	for i, g := range doc.Grants {
+		if _, ok := doc.Groups[g.Group]; !ok {
+			return nil, fmt.Errorf("%s: grant %d names undefined group %q", path, i+1, g.Group)
+		}
+		if in[g.Group] {
+			entries = append(entries, g)
+		}
+	}
 	allowed := map[CandidateKey]struct{}{}
-	for _, k := range doc.Allow {
-		if k.Permission == "" {
-			k.Permission = "read"
+	patterns := map[idPattern]struct{}{}
+	for i, e := range entries {
+		if e.Permission == "" {
+			e.Permission = defaultPermission
+		}
+		if e.ObjectIDPrefix != "" && e.ObjectID != "" {
+			return nil, fmt.Errorf("%s: entry %d sets both object_id and object_id_prefix", path, i+1)
+		}
+		for _, p := range impliedPermissions(doc.Implies, e.Permission) {
+			switch {
+			case e.ObjectIDPrefix != "":
+				patterns[idPattern{ObjectType: e.ObjectType, Permission: p, Pattern: e.ObjectIDPrefix + "*"}] = struct{}{}
+			case strings.Contains(e.ObjectID, "*"):
+				patterns[idPattern{ObjectType: e.ObjectType, Permission: p, Pattern: e.ObjectID}] = struct{}{}
+			default:
+				allowed[CandidateKey{ObjectType: e.ObjectType, ObjectID: e.ObjectID, Permission: p}] = struct{}{}
+			}
 		}
-		allowed[k] = struct{}{}
 	}
-	return &SetAuthorizer{allowed: allowed}, nil
+	return &SetAuthorizer{allowed: allowed, patterns: patterns, matchers: newIDMatchers(patterns), path: path, subject: subject, defaultPermission: defaultPermission, modTime: st.ModTime(), size: st.Size()}, nil
 }
 
-func New(permissionsFile string) (*SetAuthorizer, error) {
+func New(permissionsFile, subject string, opts ...FileOption) (*SetAuthorizer, error) {
 	if permissionsFile == "" {
 		return nil, fmt.Errorf("--permissions-file is required")
 	}
-	return NewFromPermissionsFile(permissionsFile)
+	return loadPermissionsFile(permissionsFile, subject, fileDefaultPermission(opts))
 }
 
 func DebugAllowed(a *SetAuthorizer) []CandidateKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	out := make([]CandidateKey, 0, len(a.allowed))
 	for k := range a.allowed {
 		out = append(out, k)
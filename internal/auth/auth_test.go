@@ -3,7 +3,9 @@ package auth
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestPermissionsFile(t *testing.T) {
@@ -31,3 +33,394 @@ func TestPermissionsFile(t *testing.T) {
 		t.Fatalf("expected orders_2 denied")
 	}
 }
+
+func TestPermissionsFileWildcardsAndPrefixes(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "permissions.json")
+	content := `{"allow":[
+		{"object_type":"metric_row","object_id":"orders_*"},
+		{"object_type":"metric_row","object_id":"*_2026_*_eu","permission":"export"},
+		{"object_id_prefix":"eu/"},
+		{"object_type":"dataset","object_id_prefix":"acme/","permission":"write"}]}`
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatalf("write permissions file: %v", err)
+	}
+	a, err := NewFromPermissionsFile(p)
+	if err != nil {
+		t.Fatalf("load permissions: %v", err)
+	}
+	for _, tc := range []struct {
+		c    CandidateKey
+		want bool
+	}{
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}, true},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_", Permission: "read"}, true},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "order_1", Permission: "read"}, false},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "export"}, false},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "sales_2026_q1_eu", Permission: "export"}, true},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "sales_2026_q1_us", Permission: "export"}, false},
+		{CandidateKey{ObjectType: "job", ObjectID: "eu/etl/daily", Permission: "read"}, true},
+		{CandidateKey{ObjectType: "job", ObjectID: "us/etl/daily", Permission: "read"}, false},
+		{CandidateKey{ObjectType: "dataset", ObjectID: "acme/orders", Permission: "write"}, true},
+		{CandidateKey{ObjectType: "dataset", ObjectID: "acme/orders", Permission: "read"}, false},
+	} {
+		if got := a.IsAllowed(tc.c); got != tc.want {
+			t.Fatalf("%+v: got %v, want %v", tc.c, got, tc.want)
+		}
+	}
+
+	if err := os.WriteFile(p, []byte(`{"allow":[{"object_type":"metric_row","object_id":"a","object_id_prefix":"b"}]}`), 0o644); err != nil {
+		t.Fatalf("write permissions file: %v", err)
+	}
+	if _, err := NewFromPermissionsFile(p); err == nil {
+		t.Fatalf("expected an entry with both object_id and object_id_prefix to be rejected")
+	}
+}
+
+func TestPermissionsFileGroupsExpandForSubject(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "permissions.json")
+	content := `{
+		"allow": [{"object_type":"metric_row","object_id":"public"}],
+		"groups": {
+			"analysts": ["user:alice", "group:leads"],
+			"leads": ["user:bob"],
+			"finance": ["user:carol"]
+		},
+		"grants": [
+			{"group":"analysts","object_type":"metric_row","object_id_prefix":"orders_"},
+			{"group":"leads","object_type":"metric_row","object_id":"salaries","permission":"read"},
+			{"group":"finance","object_type":"metric_row","object_id":"ledger"}
+		]}`
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatalf("write permissions file: %v", err)
+	}
+	row := func(id string) CandidateKey {
+		return CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"}
+	}
+	for subject, want := range map[string][]string{
+		"user:alice": {"public", "orders_1"},
+		"user:bob":   {"public", "orders_1", "salaries"},
+		"user:dave":  {"public"},
+		"":           {"public"},
+	} {
+		a, err := New(p, subject)
+		if err != nil {
+			t.Fatalf("%s: load permissions: %v", subject, err)
+		}
+		for _, id := range []string{"public", "orders_1", "salaries", "ledger"} {
+			if got := a.IsAllowed(row(id)); got != slices.Contains(want, id) {
+				t.Fatalf("%q on %s: got %v", subject, id, got)
+			}
+		}
+	}
+
+	if err := os.WriteFile(p, []byte(`{"groups":{"a":["group:missing"]}}`), 0o644); err != nil {
+		t.Fatalf("write permissions file: %v", err)
+	}
+	if _, err := New(p, "user:alice"); err == nil {
+		t.Fatalf("expected a member naming an undefined group to be rejected")
+	}
+}
+
+func TestPermissionsFileImpliedPermissions(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "permissions.yaml")
+	content := `implies:
+  admin: [write]
+  write: [read]
+allow:
+  - {object_type: dataset, object_id: orders, permission: admin}
+  - {object_type: dataset, object_id_prefix: "eu/", permission: write}
+`
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatalf("write permissions file: %v", err)
+	}
+	a, err := New(p, "")
+	if err != nil {
+		t.Fatalf("load permissions: %v", err)
+	}
+	check := func(id, perm string) bool {
+		return a.IsAllowed(CandidateKey{ObjectType: "dataset", ObjectID: id, Permission: perm})
+	}
+	for _, perm := range []string{"admin", "write", "read"} {
+		if !check("orders", perm) {
+			t.Fatalf("admin grant should satisfy %s", perm)
+		}
+	}
+	if !check("eu/sales", "read") || check("eu/sales", "admin") {
+		t.Fatalf("write grant should imply read but not admin")
+	}
+
+	if err := os.WriteFile(p, []byte("implies:\n  admin: [\"write+read\"]\n"), 0o644); err != nil {
+		t.Fatalf("write permissions file: %v", err)
+	}
+	if _, err := New(p, ""); err == nil {
+		t.Fatalf("expected a composite implied permission to be rejected")
+	}
+}
+
+func TestPermissionsFileYAMLAndCSV(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"permissions.yaml": `
+allow:
+  - object_type: metric_row
+    object_id: orders_1
+groups:
+  analysts: [user:alice]
+grants:
+  - group: analysts
+    object_type: metric_row
+    object_id_prefix: eu/
+    permission: export
+`,
+		"permissions.csv": "\ufeffsubject,object_type,object_id,object_id_prefix,permission\n" +
+			",metric_row,orders_1,,\n" +
+			"user:alice,metric_row,,eu/,export\n" +
+			"user:bob,metric_row,orders_2,,read\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		a, err := New(p, "user:alice")
+		if err != nil {
+			t.Fatalf("%s: load permissions: %v", name, err)
+		}
+		for _, tc := range []struct {
+			c    CandidateKey
+			want bool
+		}{
+			{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}, true},
+			{CandidateKey{ObjectType: "metric_row", ObjectID: "eu/orders", Permission: "export"}, true},
+			{CandidateKey{ObjectType: "metric_row", ObjectID: "eu/orders", Permission: "read"}, false},
+			{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}, false},
+		} {
+			if got := a.IsAllowed(tc.c); got != tc.want {
+				t.Fatalf("%s: %+v: got %v, want %v", name, tc.c, got, tc.want)
+			}
+		}
+	}
+
+	p := filepath.Join(dir, "bad.csv")
+	if err := os.WriteFile(p, []byte("object_type,object_id,owner\nmetric_row,a,x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(p, ""); err == nil {
+		t.Fatalf("expected an unknown csv column to be rejected")
+	}
+}
+
+func TestParseCandidateKey(t *testing.T) {
+	got, err := ParseCandidateKey("metricfs:mount#impersonate")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got != (CandidateKey{ObjectType: "metricfs", ObjectID: "mount", Permission: "impersonate"}) {
+		t.Fatalf("unexpected key: %+v", got)
+	}
+	for _, bad := range []string{"", "metricfs:mount", "metricfs#read", ":x#read", "a:#read"} {
+		if _, err := ParseCandidateKey(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestAllowedRequiresEveryPermission(t *testing.T) {
+	a := &SetAuthorizer{allowed: map[CandidateKey]struct{}{
+		{ObjectType: "metric_row", ObjectID: "a", Permission: "read"}:   {},
+		{ObjectType: "metric_row", ObjectID: "a", Permission: "export"}: {},
+		{ObjectType: "metric_row", ObjectID: "b", Permission: "read"}:   {},
+	}}
+	if !Allowed(a, CandidateKey{ObjectType: "metric_row", ObjectID: "a", Permission: "export+read"}) {
+		t.Fatalf("expected a allowed for read+export")
+	}
+	if Allowed(a, CandidateKey{ObjectType: "metric_row", ObjectID: "b", Permission: "export+read"}) {
+		t.Fatalf("expected b denied without export")
+	}
+}
+
+func TestTombstonePermission(t *testing.T) {
+	a := &SetAuthorizer{allowed: map[CandidateKey]struct{}{
+		{ObjectType: "metric_row", ObjectID: "x", Permission: "banned"}: {},
+	}}
+	ts, err := NewTombstones("", "banned")
+	if err != nil {
+		t.Fatalf("tombstones: %v", err)
+	}
+	sup := ts.Wrap(a).(Suppressor)
+	if !sup.Suppressed(CandidateKey{ObjectType: "metric_row", ObjectID: "x", Permission: "read"}) {
+		t.Fatalf("expected x suppressed via banned permission")
+	}
+	if sup.Suppressed(CandidateKey{ObjectType: "metric_row", ObjectID: "y", Permission: "read"}) {
+		t.Fatalf("expected y not suppressed")
+	}
+}
+
+func TestPermissionsFileReload(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "permissions.json")
+	if err := os.WriteFile(p, []byte(`{"allow":[{"object_type":"metric_row","object_id":"a"}]}`), 0o644); err != nil {
+		t.Fatalf("write permissions file: %v", err)
+	}
+	a, err := NewFromPermissionsFile(p)
+	if err != nil {
+		t.Fatalf("load permissions: %v", err)
+	}
+	if changed, err := a.reload(); err != nil || changed {
+		t.Fatalf("expected unchanged file to be skipped, got %v, %v", changed, err)
+	}
+	if err := os.WriteFile(p, []byte(`{"allow":[{"object_type":"metric_row","object_id":"b"},{"object_type":"metric_row","object_id":"c"}]}`), 0o644); err != nil {
+		t.Fatalf("rewrite permissions file: %v", err)
+	}
+	if changed, err := a.reload(); err != nil || !changed {
+		t.Fatalf("expected reload to report a change, got %v, %v", changed, err)
+	}
+	if a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "a", Permission: "read"}) ||
+		!a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "b", Permission: "read"}) {
+		t.Fatalf("expected reloaded allow set")
+	}
+}
+
+func TestReloadForcesReadThroughWrappers(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "permissions.json")
+	if err := os.WriteFile(p, []byte(`{"allow":[{"object_type":"metric_row","object_id":"a"}]}`), 0o644); err != nil {
+		t.Fatalf("write permissions file: %v", err)
+	}
+	st, _ := os.Stat(p)
+	set, err := NewFromPermissionsFile(p)
+	if err != nil {
+		t.Fatalf("load permissions: %v", err)
+	}
+	ts, _ := NewTombstones("", "")
+	d := NewDecisionCache(0, 0, 0)
+	az := ts.Wrap(d.Wrap("user:alice", set))
+	notified := 0
+	Subscribe(az, func() { notified++ })
+	a := CandidateKey{ObjectType: "metric_row", ObjectID: "a", Permission: "read"}
+	if !az.IsAllowed(a) {
+		t.Fatalf("expected a allowed")
+	}
+	// Same size and mtime: only a forced reload sees the edit.
+	if err := os.WriteFile(p, []byte(`{"allow":[{"object_type":"metric_row","object_id":"b"}]}`), 0o644); err != nil {
+		t.Fatalf("rewrite permissions file: %v", err)
+	}
+	if err := os.Chtimes(p, st.ModTime(), st.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := set.reload(); changed {
+		t.Fatalf("polling reload should skip an unchanged stat")
+	}
+	if err := Reload(az); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if notified != 1 || d.Len() != 0 || az.IsAllowed(a) {
+		t.Fatalf("forced reload: notified=%d cached=%d a allowed=%v", notified, d.Len(), az.IsAllowed(a))
+	}
+}
+
+type countingAuthorizer struct {
+	notifier
+	calls int
+}
+
+func (a *countingAuthorizer) IsAllowed(c CandidateKey) bool {
+	a.calls++
+	return c.ObjectID == "a"
+}
+
+func TestDecisionCacheSharedAcrossInstances(t *testing.T) {
+	d := NewDecisionCache(0, 0, 0)
+	first, second := &countingAuthorizer{}, &countingAuthorizer{}
+	c := CandidateKey{ObjectType: "metric_row", ObjectID: "a", Permission: "read"}
+	if !d.Wrap("user:alice", first).IsAllowed(c) || !d.Wrap("user:alice", second).IsAllowed(c) {
+		t.Fatalf("expected a allowed")
+	}
+	if first.calls != 1 || second.calls != 0 {
+		t.Fatalf("expected one backend call for the subject, got %d and %d", first.calls, second.calls)
+	}
+	d.Wrap("user:bob", second).IsAllowed(c)
+	if second.calls != 1 {
+		t.Fatalf("expected decisions not shared across subjects")
+	}
+	Subscribe(d.Wrap("user:alice", first), func() {})
+	first.notify()
+	if d.Len() != 1 {
+		t.Fatalf("expected alice's decisions dropped on change, got %d entries", d.Len())
+	}
+}
+
+func TestDecisionCacheBoundedAndExpires(t *testing.T) {
+	d := NewDecisionCache(time.Minute, 10*time.Second, 2)
+	defer d.Close()
+	now := time.Unix(0, 0)
+	d.cache.now = func() time.Time { return now }
+	backend := &countingAuthorizer{}
+	az := d.Wrap("user:alice", backend)
+	key := func(id string) CandidateKey { return CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"} }
+	az.IsAllowed(key("a"))
+	az.IsAllowed(key("b"))
+	az.IsAllowed(key("c"))
+	if d.Len() != 2 {
+		t.Fatalf("expected the cache capped at 2 entries, got %d", d.Len())
+	}
+	az.IsAllowed(key("a"))
+	if backend.calls != 4 {
+		t.Fatalf("expected the least recently used decision evicted, got %d calls", backend.calls)
+	}
+	// c (denied) expires after the negative TTL, a (allowed) after the TTL.
+	now = now.Add(11 * time.Second)
+	d.cache.evictExpired()
+	if d.Len() != 1 {
+		t.Fatalf("expected the denial swept after the negative ttl, got %d entries", d.Len())
+	}
+	now = now.Add(time.Minute)
+	d.cache.evictExpired()
+	if d.Len() != 0 {
+		t.Fatalf("expected the grant swept after the ttl, got %d entries", d.Len())
+	}
+}
+
+func TestOverridesTakePrecedenceAndReload(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "overrides.json")
+	if err := os.WriteFile(p, []byte(`{"force_allow":[{"object_type":"metric_row","object_id":"b","permission":"read"}],"force_deny":[{"object_type":"metric_row","object_id":"a"}]}`), 0o644); err != nil {
+		t.Fatalf("write overrides: %v", err)
+	}
+	o, err := NewOverrides(p)
+	if err != nil {
+		t.Fatalf("load overrides: %v", err)
+	}
+	base := &SetAuthorizer{allowed: map[CandidateKey]struct{}{
+		{ObjectType: "metric_row", ObjectID: "a", Permission: "read"}: {},
+		{ObjectType: "metric_row", ObjectID: "c", Permission: "read"}: {},
+	}}
+	az := o.Wrap(base)
+	read := func(id string) CandidateKey { return CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"} }
+	if az.IsAllowed(read("a")) || !az.IsAllowed(read("b")) || !az.IsAllowed(read("c")) {
+		t.Fatalf("expected a denied, b force-allowed, c from the backend")
+	}
+	if az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "b", Permission: "export"}) {
+		t.Fatalf("force_allow with a permission should not grant other permissions")
+	}
+	if !az.(Suppressor).Suppressed(read("a")) || az.(Suppressor).Suppressed(read("c")) {
+		t.Fatalf("expected only force_deny candidates to suppress rows")
+	}
+
+	notified := make(chan struct{}, 1)
+	cancel := Subscribe(az, func() { notified <- struct{}{} })
+	defer cancel()
+	o.Start(10 * time.Millisecond)
+	defer o.Close()
+	if err := os.WriteFile(p, []byte(`{"force_deny":[{"object_type":"metric_row","object_id":"c"}]}`), 0o644); err != nil {
+		t.Fatalf("rewrite overrides: %v", err)
+	}
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a notification after the overrides file changed")
+	}
+	if !az.IsAllowed(read("a")) || az.IsAllowed(read("b")) || az.IsAllowed(read("c")) {
+		t.Fatalf("expected reloaded overrides")
+	}
+	if _, err := NewOverrides(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatalf("expected an error for a missing overrides file")
+	}
+}
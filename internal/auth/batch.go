@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+)
+
+type BatchAuthorizer interface {
+	IsAllowedBatch([]CandidateKey) []bool
+}
+
+type ContextBatchAuthorizer interface {
+	IsAllowedBatchCtx(ctx context.Context, cands []CandidateKey) ([]bool, error)
+}
+
+func Prefetch(az Authorizer, cands []CandidateKey) Authorizer {
+	if _, ok := az.(BatchAuthorizer); !ok {
+		return az
+	}
+	keys := splitCandidates(cands)
+	if len(keys) == 0 {
+		return az
+	}
+	m := make(map[CandidateKey]bool, len(keys))
+	for i, ok := range isAllowedBatch(az, keys) {
+		m[keys[i]] = ok
+	}
+	return &prefetched{Authorizer: az, m: m}
+}
+
+type prefetched struct {
+	Authorizer
+	m map[CandidateKey]bool
+}
+
+func (p *prefetched) IsAllowed(c CandidateKey) bool {
+	if ok, seen := p.m[c]; seen {
+		return ok
+	}
+	return p.Authorizer.IsAllowed(c)
+}
+
+func (p *prefetched) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	if ok, seen := p.m[c]; seen {
+		return ok, nil
+	}
+	return IsAllowedCtx(ctx, p.Authorizer, c)
+}
+
+func isAllowedBatch(az Authorizer, cands []CandidateKey) []bool {
+	out, _ := isAllowedBatchCtx(context.Background(), az, cands)
+	return out
+}
+
+func isAllowedBatchCtx(ctx context.Context, az Authorizer, cands []CandidateKey) ([]bool, error) {
+	out := make([]bool, len(cands))
+	if err := ctx.Err(); err != nil {
+		return out, err
+	}
+	switch b := az.(type) {
+	case ContextBatchAuthorizer:
+		return b.IsAllowedBatchCtx(ctx, cands)
+	case BatchAuthorizer:
+		return b.IsAllowedBatch(cands), nil
+	}
+	var first error
+	for i, c := range cands {
+		allowed, err := IsAllowedCtx(ctx, az, c)
+		if err != nil && first == nil {
+			first = err
+		}
+		out[i] = allowed
+	}
+	return out, first
+}
+
+func decideBatch(cands []CandidateKey, local func(CandidateKey) (allowed, ok bool), remote func([]CandidateKey) ([]bool, error)) ([]bool, error) {
+	out := make([]bool, len(cands))
+	var idx []int
+	var rest []CandidateKey
+	for i, c := range cands {
+		if allowed, ok := local(c); ok {
+			out[i] = allowed
+			continue
+		}
+		idx = append(idx, i)
+		rest = append(rest, c)
+	}
+	var err error
+	if len(rest) > 0 {
+		var decided []bool
+		decided, err = remote(rest)
+		for j, allowed := range decided {
+			out[idx[j]] = allowed
+		}
+	}
+	return out, err
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const KubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+type bearerToken struct {
+	path string
+	jwt  bool
+
+	mu        sync.RWMutex
+	token     string
+	stamp     string
+	refreshAt time.Time
+	expiry    time.Time
+}
+
+func newBearerToken(token, path string, jwt bool) (*bearerToken, error) {
+	b := &bearerToken{path: path, jwt: jwt, token: strings.TrimSpace(token)}
+	if path != "" {
+		if _, err := b.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	if b.get() == "" {
+		return nil, fmt.Errorf("spicedb token is required")
+	}
+	return b, nil
+}
+
+func (b *bearerToken) get() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.token
+}
+
+func (b *bearerToken) refresh() (bool, error) {
+	if b.path == "" {
+		return false, nil
+	}
+	stamp, err := filesStamp(b.path)
+	if err != nil {
+		return false, fmt.Errorf("spicedb token file: %w", err)
+	}
+	b.mu.RLock()
+	same := stamp == b.stamp && (b.refreshAt.IsZero() || time.Now().Before(b.refreshAt))
+	b.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	raw, err := os.ReadFile(b.path)
+	if err != nil {
+		return false, fmt.Errorf("spicedb token file: %w", err)
+	}
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return false, fmt.Errorf("spicedb token file %s is empty", b.path)
+	}
+	var refreshAt, expiry time.Time
+	if b.jwt {
+		issued, exp, err := jwtLifetime(token)
+		if err != nil {
+			return false, fmt.Errorf("spicedb token file %s: %w", b.path, err)
+		}
+		if !time.Now().Before(exp) {
+			return false, fmt.Errorf("spicedb token in %s expired at %s", b.path, exp.Format(time.RFC3339))
+		}
+		refreshAt, expiry = issued.Add(exp.Sub(issued)*4/5), exp
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := token != b.token
+	b.token, b.stamp, b.refreshAt, b.expiry = token, stamp, refreshAt, expiry
+	return changed, nil
+}
+
+func (b *bearerToken) expires() time.Time {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.expiry
+}
+
+func jwtLifetime(token string) (issued, expiry time.Time, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, time.Time{}, fmt.Errorf("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("JWT payload: %w", err)
+	}
+	var claims struct {
+		Iat int64 `json:"iat"`
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("JWT payload: %w", err)
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("JWT has no exp claim")
+	}
+	issued = time.Now()
+	if claims.Iat != 0 {
+		issued = time.Unix(claims.Iat, 0)
+	}
+	return issued, time.Unix(claims.Exp, 0), nil
+}
+
+type bearerCredentials struct {
+	token  *bearerToken
+	secure bool
+}
+
+func (c bearerCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token.get()}, nil
+}
+
+func (c bearerCredentials) RequireTransportSecurity() bool { return c.secure }
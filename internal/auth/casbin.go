@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+)
+
+type CasbinAuthorizer struct {
+	notifier
+	stopper
+
+	modelPath  string
+	policyPath string
+	subject    string
+
+	mu       sync.RWMutex
+	enforcer *casbin.SyncedEnforcer
+	split    bool
+	stamp    string
+}
+
+func NewCasbin(modelPath, policyPath, subject string) (*CasbinAuthorizer, error) {
+	a := &CasbinAuthorizer{modelPath: modelPath, policyPath: policyPath, subject: strings.TrimSpace(subject)}
+	if _, err := a.load(true); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *CasbinAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := a.IsAllowedCtx(context.Background(), c)
+	return allowed
+}
+
+func (a *CasbinAuthorizer) IsAllowedCtx(_ context.Context, c CandidateKey) (bool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var ok bool
+	var err error
+	if a.split {
+		ok, err = a.enforcer.Enforce(a.subject, c.ObjectType, c.ObjectID, c.Permission)
+	} else {
+		ok, err = a.enforcer.Enforce(a.subject, c.ObjectType+":"+c.ObjectID, c.Permission)
+	}
+	return err == nil && ok, err
+}
+
+func (a *CasbinAuthorizer) StartReconcile(interval time.Duration) {
+	a.loop(interval, func() {
+		if changed, err := a.load(false); err == nil && changed {
+			a.notify()
+		}
+	})
+}
+
+func (a *CasbinAuthorizer) Reload() error {
+	changed, err := a.load(true)
+	if err == nil && changed {
+		a.notify()
+	}
+	return err
+}
+
+func (a *CasbinAuthorizer) Ping() error {
+	_, err := filesStamp(a.modelPath, a.policyPath)
+	return err
+}
+
+func (a *CasbinAuthorizer) Close() error {
+	a.stop()
+	return nil
+}
+
+func (a *CasbinAuthorizer) load(force bool) (bool, error) {
+	stamp, err := filesStamp(a.modelPath, a.policyPath)
+	if err != nil {
+		return false, err
+	}
+	a.mu.RLock()
+	same := a.enforcer != nil && stamp == a.stamp
+	a.mu.RUnlock()
+	if same && !force {
+		return false, nil
+	}
+	e, err := casbin.NewSyncedEnforcer(a.modelPath, a.policyPath)
+	if err != nil {
+		return false, fmt.Errorf("casbin: %w", err)
+	}
+	r, ok := e.GetModel()["r"]["r"]
+	if !ok {
+		return false, fmt.Errorf("casbin: %s has no request_definition", a.modelPath)
+	}
+	var split bool
+	switch len(r.Tokens) {
+	case 3:
+	case 4:
+		split = true
+	default:
+		return false, fmt.Errorf("casbin: request_definition must have 3 (sub, obj, act) or 4 (sub, type, id, act) fields, got %d", len(r.Tokens))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	replaced := a.enforcer != nil
+	a.enforcer, a.split, a.stamp = e, split, stamp
+	return replaced, nil
+}
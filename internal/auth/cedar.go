@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cedar-policy/cedar-go"
+)
+
+type CedarAuthorizer struct {
+	notifier
+	stopper
+
+	policyPath   string
+	entitiesPath string
+	principal    cedar.EntityUID
+
+	mu       sync.RWMutex
+	policies *cedar.PolicySet
+	entities cedar.EntityMap
+	stamp    string
+}
+
+func NewCedar(policyPath, entitiesPath, subject string) (*CedarAuthorizer, error) {
+	typ, id, ok := strings.Cut(strings.TrimSpace(subject), ":")
+	if !ok || typ == "" || id == "" {
+		return nil, fmt.Errorf("cedar needs a subject of the form type:id, got %q", subject)
+	}
+	a := &CedarAuthorizer{
+		policyPath:   policyPath,
+		entitiesPath: entitiesPath,
+		principal:    cedar.NewEntityUID(cedar.EntityType(typ), cedar.String(id)),
+	}
+	if _, err := a.load(true); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *CedarAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := a.Decide(c)
+	return allowed
+}
+
+func (a *CedarAuthorizer) Decide(c CandidateKey) (bool, bool) {
+	req := cedar.Request{
+		Principal: a.principal,
+		Action:    cedar.NewEntityUID("Action", cedar.String(c.Permission)),
+		Resource:  cedar.NewEntityUID(cedar.EntityType(c.ObjectType), cedar.String(c.ObjectID)),
+	}
+	if c.Context != "" {
+		if err := json.Unmarshal([]byte(c.Context), &req.Context); err != nil {
+			return false, false
+		}
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	decision, diag := a.policies.IsAuthorized(a.entities, req)
+	return decision == cedar.Allow, len(diag.Reasons) > 0
+}
+
+func (a *CedarAuthorizer) StartReconcile(interval time.Duration) {
+	a.loop(interval, func() {
+		if changed, err := a.load(false); err == nil && changed {
+			a.notify()
+		}
+	})
+}
+
+func (a *CedarAuthorizer) Reload() error {
+	changed, err := a.load(true)
+	if err == nil && changed {
+		a.notify()
+	}
+	return err
+}
+
+func (a *CedarAuthorizer) Ping() error {
+	_, err := filesStamp(a.policyPath, a.entitiesPath)
+	return err
+}
+
+func (a *CedarAuthorizer) Close() error {
+	a.stop()
+	return nil
+}
+
+func filesStamp(paths ...string) (string, error) {
+	var b strings.Builder
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		st, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%d/%d;", st.Size(), st.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+func (a *CedarAuthorizer) load(force bool) (bool, error) {
+	stamp, err := filesStamp(a.policyPath, a.entitiesPath)
+	if err != nil {
+		return false, err
+	}
+	a.mu.RLock()
+	same := a.policies != nil && stamp == a.stamp
+	a.mu.RUnlock()
+	if same && !force {
+		return false, nil
+	}
+	src, err := os.ReadFile(a.policyPath)
+	if err != nil {
+		return false, err
+	}
+	policies, err := cedar.NewPolicySetFromBytes(a.policyPath, src)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", a.policyPath, err)
+	}
+	entities := cedar.EntityMap{}
+	if a.entitiesPath != "" {
+		b, err := os.ReadFile(a.entitiesPath)
+		if err != nil {
+			return false, err
+		}
+		if err := json.Unmarshal(b, &entities); err != nil {
+			return false, fmt.Errorf("%s: %w", a.entitiesPath, err)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	replaced := a.policies != nil
+	a.policies, a.entities, a.stamp = policies, entities, stamp
+	return replaced, nil
+}
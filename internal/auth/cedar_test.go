@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCedarAuthorizerEvaluatesPoliciesWithEntities(t *testing.T) {
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, "policy.cedar")
+	entitiesPath := filepath.Join(dir, "entities.json")
+	writeFile := func(path, body string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(policyPath, `
+permit (principal in team::"analysts", action == Action::"read", resource in tenant::"eu");
+permit (principal, action == Action::"read", resource == metric_row::"public");
+forbid (principal, action, resource) when { context has restricted && context.restricted };
+`)
+	writeFile(entitiesPath, `[
+  {"uid": {"type": "user", "id": "alice"}, "attrs": {}, "parents": [{"type": "team", "id": "analysts"}]},
+  {"uid": {"type": "team", "id": "analysts"}, "attrs": {}, "parents": []},
+  {"uid": {"type": "metric_row", "id": "orders_1"}, "attrs": {}, "parents": [{"type": "tenant", "id": "eu"}]}
+]`)
+
+	a, err := NewCedar(policyPath, entitiesPath, "user:alice")
+	if err != nil {
+		t.Fatalf("new cedar auth: %v", err)
+	}
+	defer a.Close()
+	for _, tc := range []struct {
+		c    CandidateKey
+		want bool
+	}{
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}, true},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}, false},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "public", Permission: "read"}, true},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "write"}, false},
+		{CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Context: `{"restricted":true}`}, false},
+	} {
+		if got := a.IsAllowed(tc.c); got != tc.want {
+			t.Fatalf("%+v: got %v, want %v", tc.c, got, tc.want)
+		}
+	}
+
+	notified := make(chan struct{}, 1)
+	cancel := a.Subscribe(func() {
+		select {
+		case notified <- struct{}{}:
+		default:
+		}
+	})
+	defer cancel()
+	a.StartReconcile(10 * time.Millisecond)
+	writeFile(entitiesPath, `[
+  {"uid": {"type": "user", "id": "alice"}, "attrs": {}, "parents": [{"type": "team", "id": "analysts"}]},
+  {"uid": {"type": "metric_row", "id": "orders_2"}, "attrs": {}, "parents": [{"type": "tenant", "id": "eu"}]}
+]`)
+	select {
+	case <-notified:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconcile did not notify on a changed entities file")
+	}
+	if !a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}) {
+		t.Fatal("expected reloaded entities to allow orders_2")
+	}
+
+	if _, err := NewCedar(policyPath, entitiesPath, "alice"); err == nil {
+		t.Fatal("expected a subject without a type to be rejected")
+	}
+}
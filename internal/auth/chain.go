@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type Decider interface {
+	Decide(CandidateKey) (allowed, ok bool)
+}
+
+type ChainLink struct {
+	Name string
+	Authorizer
+}
+
+type Chain struct {
+	links   []ChainLink
+	subject string
+
+	mu      sync.Mutex
+	audit   io.Writer
+	decided map[string]int64
+}
+
+const chainUndecided = "none"
+
+func NewChain(subject string, audit io.Writer, links ...ChainLink) *Chain {
+	return &Chain{links: links, subject: subject, audit: audit, decided: map[string]int64{}}
+}
+
+func (ch *Chain) IsAllowed(c CandidateKey) bool {
+	allowed, _ := ch.IsAllowedCtx(context.Background(), c)
+	return allowed
+}
+
+func (ch *Chain) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	allowed, by, err := ch.decide(ctx, c)
+	if ctx.Err() == nil {
+		ch.record(c, allowed, by, err)
+	}
+	return allowed, err
+}
+
+func (ch *Chain) decide(ctx context.Context, c CandidateKey) (bool, string, error) {
+	var lastErr error
+	for _, l := range ch.links {
+		if err := ctx.Err(); err != nil {
+			return false, chainUndecided, err
+		}
+		switch a := l.Authorizer.(type) {
+		case ContextAuthorizer:
+			allowed, err := a.IsAllowedCtx(ctx, c)
+			if err == nil {
+				return allowed, l.Name, nil
+			}
+			lastErr = fmt.Errorf("%s: %w", l.Name, err)
+		case Decider:
+			if allowed, ok := a.Decide(c); ok {
+				return allowed, l.Name, nil
+			}
+		default:
+			return a.IsAllowed(c), l.Name, nil
+		}
+	}
+	return false, chainUndecided, lastErr
+}
+
+type auditEntry struct {
+	Time      time.Time    `json:"time"`
+	Subject   string       `json:"subject,omitempty"`
+	Candidate CandidateKey `json:"candidate"`
+	Allowed   bool         `json:"allowed"`
+	DecidedBy string       `json:"decided_by"`
+	Error     string       `json:"error,omitempty"`
+}
+
+func (ch *Chain) record(c CandidateKey, allowed bool, by string, failed error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.decided[by]++
+	if ch.audit == nil {
+		return
+	}
+	e := auditEntry{Time: time.Now().UTC(), Subject: ch.subject, Candidate: c, Allowed: allowed, DecidedBy: by}
+	if failed != nil {
+		e.Error = failed.Error()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	_, _ = ch.audit.Write(append(b, '\n'))
+}
+
+func (ch *Chain) Subscribe(fn func()) func() {
+	cancels := make([]func(), 0, len(ch.links))
+	for _, l := range ch.links {
+		cancels = append(cancels, Subscribe(l.Authorizer, fn))
+	}
+	return func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+func (ch *Chain) StartReconcile(interval time.Duration) {
+	for _, l := range ch.links {
+		if r, ok := l.Authorizer.(Reconciler); ok {
+			r.StartReconcile(interval)
+		}
+	}
+}
+
+func (ch *Chain) Reload() error {
+	var errs []error
+	for _, l := range ch.links {
+		if err := Reload(l.Authorizer); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ch *Chain) Ping() error {
+	var errs []error
+	for _, l := range ch.links {
+		err := Ping(l.Authorizer)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", l.Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (ch *Chain) Availability() map[string]any {
+	ch.mu.Lock()
+	decided := make(map[string]int64, len(ch.decided))
+	for k, v := range ch.decided {
+		decided[k] = v
+	}
+	ch.mu.Unlock()
+	st := map[string]any{"decided_by": decided}
+	for _, l := range ch.links {
+		if a := Availability(l.Authorizer); a != nil {
+			st[l.Name] = a
+		}
+	}
+	return st
+}
+
+func (ch *Chain) Close() error {
+	var errs []error
+	for _, l := range ch.links {
+		if cl, ok := l.Authorizer.(io.Closer); ok {
+			errs = append(errs, cl.Close())
+		}
+	}
+	if cl, ok := ch.audit.(io.Closer); ok {
+		errs = append(errs, cl.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type flakyBackend map[string]bool
+
+func (f flakyBackend) IsAllowed(c CandidateKey) bool { return f[c.ObjectID] }
+
+func (f flakyBackend) Decide(c CandidateKey) (bool, bool) {
+	allowed, ok := f[c.ObjectID]
+	return allowed, ok
+}
+
+func TestChainFirstDefinitiveAnswerWins(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "perm.json")
+	if err := os.WriteFile(p, []byte(`{"allow":[{"object_type":"metric_row","object_id":"b"},{"object_type":"metric_row","object_id":"c"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewFromPermissionsFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit bytes.Buffer
+	primary := flakyBackend{"a": true, "b": false}
+	ch := NewChain("user:alice", &audit, ChainLink{Name: "spicedb", Authorizer: primary}, ChainLink{Name: "file", Authorizer: file})
+	for id, want := range map[string]bool{
+		"a": true,  // primary allows
+		"b": false, // primary denies; the file is not asked
+		"c": true,  // primary declines, the file allows
+		"d": false, // both decline
+	} {
+		if got := ch.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"}); got != want {
+			t.Fatalf("%s: got %v, want %v", id, got, want)
+		}
+	}
+
+	by := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("audit line %q: %v", line, err)
+		}
+		if e.Subject != "user:alice" {
+			t.Fatalf("audit subject = %q", e.Subject)
+		}
+		by[e.Candidate.ObjectID] = e.DecidedBy
+	}
+	want := map[string]string{"a": "spicedb", "b": "spicedb", "c": "file", "d": "none"}
+	for id, name := range want {
+		if by[id] != name {
+			t.Fatalf("%s decided by %q, want %q (%v)", id, by[id], name, by)
+		}
+	}
+	decided := ch.Availability()["decided_by"].(map[string]int64)
+	if decided["spicedb"] != 2 || decided["file"] != 1 || decided["none"] != 1 {
+		t.Fatalf("decided_by = %v", decided)
+	}
+
+	// A file first overrides the primary for the rows it allows.
+	override := NewChain("user:alice", nil, ChainLink{Name: "file", Authorizer: file}, ChainLink{Name: "spicedb", Authorizer: primary})
+	if !override.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "b", Permission: "read"}) {
+		t.Fatal("expected the file allow-list to override the primary's deny")
+	}
+	if !override.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "a", Permission: "read"}) {
+		t.Fatal("expected rows the file does not list to fall through")
+	}
+}
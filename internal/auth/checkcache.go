@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type checkCache[K comparable] struct {
+	ttl, negativeTTL time.Duration
+	staleTTL         time.Duration
+	maxEntries       int
+	now              func() time.Time
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[K]*list.Element
+}
+
+type checkEntry[K comparable] struct {
+	key     K
+	allowed bool
+	expires time.Time
+	checked time.Time
+}
+
+func (e *checkEntry[K]) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func (c *checkCache[K]) dead(e *checkEntry[K], now time.Time) bool {
+	return e.expired(now) && !now.Before(e.checked.Add(c.staleTTL))
+}
+
+func newCheckCache[K comparable](ttl, negativeTTL time.Duration, maxEntries int) *checkCache[K] {
+	return &checkCache[K]{ttl: ttl, negativeTTL: negativeTTL, maxEntries: maxEntries, now: time.Now, ll: list.New(), items: map[K]*list.Element{}}
+}
+
+func (c *checkCache[K]) get(k K) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		return false, false
+	}
+	e := el.Value.(*checkEntry[K])
+	if now := c.now(); e.expired(now) {
+		if c.dead(e, now) {
+			c.remove(el)
+		}
+		return false, false
+	}
+	c.ll.MoveToFront(el)
+	return e.allowed, true
+}
+
+func (c *checkCache[K]) stale(k K) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		return false, false
+	}
+	e := el.Value.(*checkEntry[K])
+	if !c.now().Before(e.checked.Add(c.staleTTL)) {
+		return false, false
+	}
+	return e.allowed, true
+}
+
+func (c *checkCache[K]) put(k K, allowed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ttl := c.ttl
+	if !allowed {
+		ttl = c.negativeTTL
+	}
+	now := c.now()
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+	if el, ok := c.items[k]; ok {
+		e := el.Value.(*checkEntry[K])
+		e.allowed, e.expires, e.checked = allowed, expires, now
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[k] = c.ll.PushFront(&checkEntry[K]{key: k, allowed: allowed, expires: expires, checked: now})
+	for c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *checkCache[K]) update(k K, allowed bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*checkEntry[K])
+	changed := e.allowed != allowed
+	e.allowed, e.checked = allowed, c.now()
+	return changed
+}
+
+func (c *checkCache[K]) keys() []K {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	out := make([]K, 0, len(c.items))
+	for k, el := range c.items {
+		if !el.Value.(*checkEntry[K]).expired(now) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func (c *checkCache[K]) evictExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for el := c.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if c.dead(el.Value.(*checkEntry[K]), now) {
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+func (c *checkCache[K]) removeIf(match func(K) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, el := range c.items {
+		if match(k) {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *checkCache[K]) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	clear(c.items)
+}
+
+func (c *checkCache[K]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+func (c *checkCache[K]) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*checkEntry[K]).key)
+}
+
+func (c *checkCache[K]) sweepInterval() time.Duration {
+	switch {
+	case c.ttl <= 0:
+		return c.negativeTTL
+	case c.negativeTTL <= 0:
+		return c.ttl
+	}
+	return min(c.ttl, c.negativeTTL)
+}
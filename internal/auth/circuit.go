@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errCircuitOpen = errors.New("spicedb circuit breaker is open")
+
+type circuit struct {
+	retries   int
+	backoff   time.Duration
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+	opens    int64
+	rejected int64
+	retried  int64
+}
+
+// A request abandoned because ctx ended is not held against SpiceDB.
+func (c *circuit) do(ctx context.Context, fn func() error) error {
+	if err := c.allow(); err != nil {
+		return err
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil || attempt >= c.retries || !transient(err) || !c.wait(ctx, attempt) {
+			break
+		}
+	}
+	c.record(err, ctx.Err() != nil)
+	return err
+}
+
+func (c *circuit) wait(ctx context.Context, attempt int) bool {
+	c.mu.Lock()
+	c.retried++
+	c.mu.Unlock()
+	t := time.NewTimer(jitter(c.backoff << attempt))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (c *circuit) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.openedAt.IsZero() {
+		return nil
+	}
+	if !c.probing && time.Since(c.openedAt) >= c.cooldown {
+		c.probing = true
+		return nil
+	}
+	c.rejected++
+	return errCircuitOpen
+}
+
+func (c *circuit) record(err error, abandoned bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+	switch {
+	case abandoned:
+	case err == nil || !transient(err):
+		// A rejected request still shows SpiceDB is up.
+		c.failures = 0
+		c.openedAt = time.Time{}
+	case !c.openedAt.IsZero():
+		c.openedAt = time.Now()
+	default:
+		c.failures++
+		if c.threshold > 0 && c.failures >= c.threshold {
+			c.openedAt = time.Now()
+			c.opens++
+		}
+	}
+}
+
+func (c *circuit) status() map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := "closed"
+	switch {
+	case c.probing:
+		state = "half_open"
+	case !c.openedAt.IsZero():
+		state = "open"
+	}
+	return map[string]any{
+		"state":    state,
+		"opens":    c.opens,
+		"rejected": c.rejected,
+		"retries":  c.retried,
+	}
+}
+
+type statusError struct {
+	path   string
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "spicedb " + e.path + " failed: " + e.status
+}
+
+func transient(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests || se.code == http.StatusRequestTimeout
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.Unknown:
+			return true
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"sync"
+)
+
+type ContextAuthorizer interface {
+	IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error)
+}
+
+func IsAllowedCtx(ctx context.Context, az Authorizer, c CandidateKey) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if a, ok := az.(ContextAuthorizer); ok {
+		return a.IsAllowedCtx(ctx, c)
+	}
+	return az.IsAllowed(c), nil
+}
+
+func WithContext(ctx context.Context, az Authorizer) (Authorizer, func() error) {
+	b := &boundAuthorizer{ctx: ctx, az: az}
+	if _, ok := az.(BatchAuthorizer); ok {
+		return &boundBatchAuthorizer{b}, b.failure
+	}
+	return b, b.failure
+}
+
+type boundAuthorizer struct {
+	ctx context.Context
+	az  Authorizer
+
+	mu  sync.Mutex
+	err error
+}
+
+func (b *boundAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, err := IsAllowedCtx(b.ctx, b.az, c)
+	if err != nil {
+		b.fail(err)
+	}
+	return allowed
+}
+
+func (b *boundAuthorizer) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *boundAuthorizer) failure() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *boundAuthorizer) Suppressed(c CandidateKey) bool {
+	s, ok := b.az.(Suppressor)
+	return ok && s.Suppressed(c)
+}
+
+func (b *boundAuthorizer) RowSuppressed() {
+	if s, ok := b.az.(Suppressor); ok {
+		s.RowSuppressed()
+	}
+}
+
+type boundBatchAuthorizer struct {
+	*boundAuthorizer
+}
+
+func (b *boundBatchAuthorizer) IsAllowedBatch(cands []CandidateKey) []bool {
+	out, err := isAllowedBatchCtx(b.ctx, b.az, cands)
+	if err != nil {
+		b.fail(err)
+	}
+	return out
+}
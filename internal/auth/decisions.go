@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+type DecisionCache struct {
+	cache *checkCache[decisionKey]
+	sweep stopper
+}
+
+type decisionKey struct {
+	subject string
+	c       CandidateKey
+}
+
+func NewDecisionCache(ttl, negativeTTL time.Duration, maxEntries int) *DecisionCache {
+	d := &DecisionCache{cache: newCheckCache[decisionKey](ttl, negativeTTL, maxEntries)}
+	d.sweep.loop(d.cache.sweepInterval(), d.cache.evictExpired)
+	return d
+}
+
+func (d *DecisionCache) Wrap(subject string, az Authorizer) Authorizer {
+	if d == nil {
+		return az
+	}
+	return &cachedAuthorizer{forwarder: forwarder{az}, d: d, subject: subject}
+}
+
+func (d *DecisionCache) Forget(subject string) {
+	d.cache.removeIf(func(k decisionKey) bool { return k.subject == subject })
+}
+
+func (d *DecisionCache) Clear() {
+	d.cache.reset()
+}
+
+func (d *DecisionCache) Len() int {
+	return d.cache.len()
+}
+
+func (d *DecisionCache) Close() error {
+	if d != nil {
+		d.sweep.stop()
+	}
+	return nil
+}
+
+func (d *DecisionCache) get(k decisionKey) (bool, bool) {
+	return d.cache.get(k)
+}
+
+func (d *DecisionCache) put(k decisionKey, allowed bool) {
+	d.cache.put(k, allowed)
+}
+
+type cachedAuthorizer struct {
+	forwarder
+	d       *DecisionCache
+	subject string
+}
+
+func (a *cachedAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := a.IsAllowedCtx(context.Background(), c)
+	return allowed
+}
+
+func (a *cachedAuthorizer) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	k := decisionKey{a.subject, c}
+	if allowed, ok := a.d.get(k); ok {
+		return allowed, nil
+	}
+	allowed, err := IsAllowedCtx(ctx, a.Authorizer, c)
+	if err != nil {
+		return false, err
+	}
+	a.d.put(k, allowed)
+	return allowed, nil
+}
+
+func (a *cachedAuthorizer) IsAllowedBatch(cands []CandidateKey) []bool {
+	out, _ := a.IsAllowedBatchCtx(context.Background(), cands)
+	return out
+}
+
+// Only the grants of a failed batch are kept; any of its denials may be a failure.
+func (a *cachedAuthorizer) IsAllowedBatchCtx(ctx context.Context, cands []CandidateKey) ([]bool, error) {
+	return decideBatch(cands, func(c CandidateKey) (bool, bool) {
+		return a.d.get(decisionKey{a.subject, c})
+	}, func(rest []CandidateKey) ([]bool, error) {
+		out, err := isAllowedBatchCtx(ctx, a.Authorizer, rest)
+		for i, c := range rest {
+			if out[i] || err == nil {
+				a.d.put(decisionKey{a.subject, c}, out[i])
+			}
+		}
+		return out, err
+	})
+}
+
+func (a *cachedAuthorizer) Subscribe(fn func()) func() {
+	return Subscribe(a.Authorizer, func() {
+		a.d.Forget(a.subject)
+		fn()
+	})
+}
+
+func (a *cachedAuthorizer) Reload() error {
+	err := Reload(a.Authorizer)
+	a.d.Forget(a.subject)
+	return err
+}
@@ -0,0 +1,416 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ExportAuthorizer struct {
+	notifier
+	stopper
+
+	live     *SpiceDBAuthorizer
+	roots    []string
+	interval time.Duration
+	client   *http.Client
+
+	mu       sync.RWMutex
+	covered  map[typeName]bool
+	allowed  map[CandidateKey]struct{}
+	exported time.Time
+}
+
+type typeName struct{ typ, name string }
+
+func NewSpiceDBExport(live *SpiceDBAuthorizer, objectTypes []string, interval time.Duration) *ExportAuthorizer {
+	return &ExportAuthorizer{
+		live:     live,
+		roots:    objectTypes,
+		interval: interval,
+		client:   &http.Client{Timeout: exportTimeout},
+	}
+}
+
+func (e *ExportAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := e.IsAllowedCtx(context.Background(), c)
+	return allowed
+}
+
+func (e *ExportAuthorizer) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	e.mu.RLock()
+	covered := e.covered[typeName{c.ObjectType, c.Permission}]
+	_, allowed := e.allowed[CandidateKey{ObjectType: c.ObjectType, ObjectID: c.ObjectID, Permission: c.Permission}]
+	e.mu.RUnlock()
+	if covered {
+		return allowed, nil
+	}
+	return e.live.IsAllowedCtx(ctx, c)
+}
+
+func (e *ExportAuthorizer) IsAllowedBatch(cands []CandidateKey) []bool {
+	out, _ := e.IsAllowedBatchCtx(context.Background(), cands)
+	return out
+}
+
+func (e *ExportAuthorizer) IsAllowedBatchCtx(ctx context.Context, cands []CandidateKey) ([]bool, error) {
+	return decideBatch(cands, func(c CandidateKey) (bool, bool) {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		_, allowed := e.allowed[CandidateKey{ObjectType: c.ObjectType, ObjectID: c.ObjectID, Permission: c.Permission}]
+		return allowed, e.covered[typeName{c.ObjectType, c.Permission}]
+	}, func(rest []CandidateKey) ([]bool, error) {
+		return e.live.IsAllowedBatchCtx(ctx, rest)
+	})
+}
+
+func (e *ExportAuthorizer) Subscribe(fn func()) func() {
+	cancelSnapshot := e.notifier.Subscribe(fn)
+	cancelLive := e.live.Subscribe(fn)
+	return func() {
+		cancelSnapshot()
+		cancelLive()
+	}
+}
+
+func (e *ExportAuthorizer) StartReconcile(interval time.Duration) {
+	e.live.StartReconcile(interval)
+	e.loop(e.interval, func() {
+		if changed, err := e.Refresh(); err == nil && changed {
+			e.notify()
+		}
+	})
+}
+
+func (e *ExportAuthorizer) Reload() error {
+	if err := e.live.Reload(); err != nil {
+		return err
+	}
+	changed, err := e.Refresh()
+	if err == nil && changed {
+		e.notify()
+	}
+	return err
+}
+
+func (e *ExportAuthorizer) Ping() error { return e.live.Ping() }
+
+func (e *ExportAuthorizer) Availability() map[string]any { return e.live.Availability() }
+
+func (e *ExportAuthorizer) Close() error {
+	e.stop()
+	return e.live.Close()
+}
+
+func (e *ExportAuthorizer) Exported() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.exported
+}
+
+func (e *ExportAuthorizer) Refresh() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	text, err := e.readSchema(ctx)
+	if err != nil {
+		return false, err
+	}
+	schema := parseSchema(text)
+	var rels []relationship
+	covered := map[typeName]bool{}
+	exact := schema.exact()
+	for _, typ := range schema.closure(e.roots) {
+		r, err := e.export(ctx, typ)
+		if err != nil {
+			return false, err
+		}
+		rels = append(rels, r...)
+		for k, ok := range exact {
+			if ok && k.typ == typ {
+				covered[k] = true
+			}
+		}
+	}
+	allowed := map[CandidateKey]struct{}{}
+	for k := range evaluate(schema, rels, e.live.subject) {
+		if covered[typeName{k.ObjectType, k.Permission}] {
+			allowed[k] = struct{}{}
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	changed := !e.exported.IsZero() && (!sameSet(e.allowed, allowed) || !maps.Equal(e.covered, covered))
+	e.covered, e.allowed, e.exported = covered, allowed, time.Now()
+	return changed, nil
+}
+
+type relationship struct {
+	Resource objectRef  `json:"resource"`
+	Relation string     `json:"relation"`
+	Subject  subjectRef `json:"subject"`
+	Caveat   any        `json:"optionalCaveat,omitempty"`
+}
+
+func (e *ExportAuthorizer) readSchema(ctx context.Context) (string, error) {
+	if e.live.grpc != nil {
+		return e.live.readSchemaGRPC(ctx)
+	}
+	resp, err := e.live.post(ctx, e.client, "/v1/schema/read", map[string]any{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var sr struct {
+		SchemaText string `json:"schemaText"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return "", fmt.Errorf("spicedb schema: %w", err)
+	}
+	return sr.SchemaText, nil
+}
+
+func (e *ExportAuthorizer) export(ctx context.Context, typ string) ([]relationship, error) {
+	if e.live.grpc != nil {
+		return e.live.exportGRPC(ctx, typ)
+	}
+	resp, err := e.live.post(ctx, e.client, "/v1/relationships/exportbulk", map[string]any{
+		"consistency":                e.live.consistencyJSON(),
+		"optionalRelationshipFilter": map[string]string{"resourceType": typ},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out []relationship
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 0, 64<<10), 64<<20)
+	for sc.Scan() {
+		var msg struct {
+			Result struct {
+				Relationships []relationship `json:"relationships"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("spicedb export %s: %w", typ, err)
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("spicedb export %s: %s", typ, msg.Error.Message)
+		}
+		for _, r := range msg.Result.Relationships {
+			// Caveats are evaluated by SpiceDB at check time, not here.
+			if r.Caveat == nil {
+				out = append(out, r)
+			}
+		}
+	}
+	return out, sc.Err()
+}
+
+type schemaDef struct {
+	relations   map[string]relationDef
+	permissions map[string][]permTerm
+	unsupported map[string]bool
+}
+
+type relationDef struct {
+	subjects []subjectType
+	caveated bool
+}
+
+type subjectType struct{ typ, relation string }
+
+type permTerm struct{ name, arrow string }
+
+type schemaDefs map[string]*schemaDef
+
+var (
+	schemaComment    = regexp.MustCompile(`(?s)/\*.*?\*/|//[^\n]*`)
+	schemaDefinition = regexp.MustCompile(`(?s)definition\s+([\w/]+)\s*\{(.*?)\n?\}`)
+	schemaRelation   = regexp.MustCompile(`(?m)^\s*relation\s+(\w+)\s*:\s*(.+?)\s*$`)
+	schemaPermission = regexp.MustCompile(`(?m)^\s*permission\s+(\w+)\s*=\s*(.+?)\s*$`)
+	schemaTerm       = regexp.MustCompile(`^(\w+)(?:->(\w+))?$`)
+)
+
+func parseSchema(text string) schemaDefs {
+	defs := schemaDefs{}
+	text = schemaComment.ReplaceAllString(text, "")
+	for _, m := range schemaDefinition.FindAllStringSubmatch(text, -1) {
+		d := &schemaDef{relations: map[string]relationDef{}, permissions: map[string][]permTerm{}, unsupported: map[string]bool{}}
+		for _, r := range schemaRelation.FindAllStringSubmatch(m[2], -1) {
+			var rd relationDef
+			for _, st := range strings.Split(r[2], "|") {
+				st = strings.TrimSpace(st)
+				if strings.Contains(st, " with ") {
+					rd.caveated = true
+					st = strings.TrimSpace(st[:strings.Index(st, " with ")])
+				}
+				typ, rel, _ := strings.Cut(strings.TrimSuffix(st, ":*"), "#")
+				rd.subjects = append(rd.subjects, subjectType{typ: typ, relation: rel})
+			}
+			d.relations[r[1]] = rd
+		}
+		for _, p := range schemaPermission.FindAllStringSubmatch(m[2], -1) {
+			var terms []permTerm
+			for _, t := range strings.Split(strings.Join(strings.Fields(p[2]), ""), "+") {
+				tm := schemaTerm.FindStringSubmatch(t)
+				if tm == nil {
+					terms = nil
+					d.unsupported[p[1]] = true
+					break
+				}
+				terms = append(terms, permTerm{name: tm[1], arrow: tm[2]})
+			}
+			d.permissions[p[1]] = terms
+		}
+		defs[m[1]] = d
+	}
+	return defs
+}
+
+func (s schemaDefs) closure(roots []string) []string {
+	seen := map[string]bool{}
+	queue := append([]string{}, roots...)
+	for len(queue) > 0 {
+		typ := queue[0]
+		queue = queue[1:]
+		d, ok := s[typ]
+		if !ok || seen[typ] {
+			continue
+		}
+		seen[typ] = true
+		for _, rd := range d.relations {
+			for _, st := range rd.subjects {
+				queue = append(queue, st.typ)
+			}
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for typ := range seen {
+		// Types without relations (e.g. user) have nothing to export.
+		if len(s[typ].relations) > 0 {
+			out = append(out, typ)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (s schemaDefs) exact() map[typeName]bool {
+	exact := map[typeName]bool{}
+	for typ, d := range s {
+		for name, rd := range d.relations {
+			exact[typeName{typ, name}] = !rd.caveated
+		}
+		for name := range d.permissions {
+			exact[typeName{typ, name}] = !d.unsupported[name]
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		demote := func(k typeName) {
+			if exact[k] {
+				exact[k] = false
+				changed = true
+			}
+		}
+		for typ, d := range s {
+			for name, rd := range d.relations {
+				for _, st := range rd.subjects {
+					if st.relation != "" && !exact[typeName{st.typ, st.relation}] {
+						demote(typeName{typ, name})
+					}
+				}
+			}
+			for name, terms := range d.permissions {
+				for _, t := range terms {
+					if !exact[typeName{typ, t.name}] {
+						demote(typeName{typ, name})
+						continue
+					}
+					if t.arrow == "" {
+						continue
+					}
+					rd, ok := d.relations[t.name]
+					if !ok {
+						demote(typeName{typ, name})
+						continue
+					}
+					for _, st := range rd.subjects {
+						target, ok := s[st.typ]
+						if !ok {
+							continue
+						}
+						_, isRel := target.relations[t.arrow]
+						_, isPerm := target.permissions[t.arrow]
+						if (isRel || isPerm) && !exact[typeName{st.typ, t.arrow}] {
+							demote(typeName{typ, name})
+						}
+					}
+				}
+			}
+		}
+	}
+	return exact
+}
+
+func evaluate(s schemaDefs, rels []relationship, subject subjectRef) map[CandidateKey]struct{} {
+	has := map[CandidateKey]struct{}{}
+	holds := func(typ, id, name string) bool {
+		_, ok := has[CandidateKey{ObjectType: typ, ObjectID: id, Permission: name}]
+		return ok
+	}
+	byRelation := map[typeName][]relationship{}
+	for _, r := range rels {
+		k := typeName{r.Resource.ObjectType, r.Relation}
+		byRelation[k] = append(byRelation[k], r)
+	}
+	for changed := true; changed; {
+		changed = false
+		add := func(typ, id, name string) {
+			k := CandidateKey{ObjectType: typ, ObjectID: id, Permission: name}
+			if _, ok := has[k]; !ok {
+				has[k] = struct{}{}
+				changed = true
+			}
+		}
+		for _, r := range rels {
+			sub := r.Subject
+			direct := sub.Object.ObjectType == subject.Object.ObjectType && sub.OptionalRelation == subject.OptionalRelation &&
+				(sub.Object.ObjectID == subject.Object.ObjectID || sub.Object.ObjectID == "*")
+			if direct || (sub.OptionalRelation != "" && holds(sub.Object.ObjectType, sub.Object.ObjectID, sub.OptionalRelation)) {
+				add(r.Resource.ObjectType, r.Resource.ObjectID, r.Relation)
+			}
+		}
+		for typ, d := range s {
+			for name, terms := range d.permissions {
+				for _, t := range terms {
+					if t.arrow == "" {
+						for k := range has {
+							if k.ObjectType == typ && k.Permission == t.name {
+								add(typ, k.ObjectID, name)
+							}
+						}
+						continue
+					}
+					for _, r := range byRelation[typeName{typ, t.name}] {
+						if holds(r.Subject.Object.ObjectType, r.Subject.Object.ObjectID, t.arrow) {
+							add(typ, r.Resource.ObjectID, name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return has
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+const groupMemberPrefix = "group:"
+
+func memberships(groups map[string][]string, subject string) (map[string]bool, error) {
+	parents := map[string][]string{}
+	for name, members := range groups {
+		for _, m := range members {
+			m = strings.TrimSpace(m)
+			if g, ok := strings.CutPrefix(m, groupMemberPrefix); ok {
+				if _, defined := groups[g]; !defined {
+					return nil, fmt.Errorf("group %q lists undefined group %q", name, g)
+				}
+			}
+			parents[m] = append(parents[m], name)
+		}
+	}
+	in := map[string]bool{}
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return in, nil
+	}
+	queue := append([]string(nil), parents[subject]...)
+	for len(queue) > 0 {
+		g := queue[0]
+		queue = queue[1:]
+		if in[g] {
+			continue
+		}
+		in[g] = true
+		queue = append(queue, parents[groupMemberPrefix+g]...)
+	}
+	return in, nil
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type HTTPConfig struct {
+	URL              string
+	Subject          string
+	Token            string
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+	CacheMaxEntries  int
+}
+
+type HTTPAuthorizer struct {
+	notifier
+	stopper
+
+	client  *http.Client
+	url     string
+	token   string
+	subject string
+	opa     bool
+
+	cache *checkCache[CandidateKey]
+	sweep stopper
+}
+
+func NewHTTP(cfg HTTPConfig) (*HTTPAuthorizer, error) {
+	u, err := parseAuthURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTP(cfg, u), nil
+}
+
+func NewOPA(cfg HTTPConfig, decision string) (*HTTPAuthorizer, error) {
+	u, err := parseAuthURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	decision = strings.Trim(strings.TrimSpace(decision), "/")
+	if decision == "" {
+		return nil, fmt.Errorf("opa decision path is required")
+	}
+	u = u.JoinPath("v1", "data", decision)
+	a := newHTTP(cfg, u)
+	a.opa = true
+	return a, nil
+}
+
+func parseAuthURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid auth url %q, expected http(s)://host/path", raw)
+	}
+	return u, nil
+}
+
+func newHTTP(cfg HTTPConfig, u *url.URL) *HTTPAuthorizer {
+	a := &HTTPAuthorizer{
+		client:  &http.Client{Timeout: checkTimeout},
+		url:     u.String(),
+		token:   strings.TrimSpace(cfg.Token),
+		subject: strings.TrimSpace(cfg.Subject),
+		cache:   newCheckCache[CandidateKey](cfg.CacheTTL, cfg.NegativeCacheTTL, cfg.CacheMaxEntries),
+	}
+	a.sweep.loop(a.cache.sweepInterval(), a.cache.evictExpired)
+	return a
+}
+
+func (a *HTTPAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := a.IsAllowedCtx(context.Background(), c)
+	return allowed
+}
+
+func (a *HTTPAuthorizer) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	if allowed, ok := a.cache.get(c); ok {
+		return allowed, nil
+	}
+	allowed, err := a.checkRemote(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	a.cache.put(c, allowed)
+	return allowed, nil
+}
+
+func (a *HTTPAuthorizer) StartReconcile(interval time.Duration) {
+	a.loop(interval, func() {
+		changed := false
+		for _, k := range a.cache.keys() {
+			if allowed, err := a.checkRemote(context.Background(), k); err == nil && a.cache.update(k, allowed) {
+				changed = true
+			}
+		}
+		if changed {
+			a.notify()
+		}
+	})
+}
+
+func (a *HTTPAuthorizer) Close() error {
+	a.stop()
+	a.sweep.stop()
+	return nil
+}
+
+type httpCheckRequest struct {
+	Subject       string          `json:"subject"`
+	ObjectType    string          `json:"object_type"`
+	ObjectID      string          `json:"object_id"`
+	Permission    string          `json:"permission"`
+	CaveatContext json.RawMessage `json:"caveat_context,omitempty"`
+}
+
+func (a *HTTPAuthorizer) checkRemote(ctx context.Context, c CandidateKey) (bool, error) {
+	body := httpCheckRequest{Subject: a.subject, ObjectType: c.ObjectType, ObjectID: c.ObjectID, Permission: c.Permission}
+	if c.Context != "" {
+		body.CaveatContext = json.RawMessage(c.Context)
+	}
+	var payload any = body
+	if a.opa {
+		payload = map[string]any{"input": body}
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("auth callout: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		Allowed *bool            `json:"allowed"`
+		Result  *json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, fmt.Errorf("auth callout: %w", err)
+	}
+	if a.opa {
+		if out.Result == nil {
+			return false, nil
+		}
+		var allowed bool
+		if err := json.Unmarshal(*out.Result, &allowed); err != nil {
+			return false, fmt.Errorf("opa decision is not a boolean: %s", *out.Result)
+		}
+		return allowed, nil
+	}
+	if out.Allowed == nil {
+		return false, fmt.Errorf("auth callout: response has no allowed field")
+	}
+	return *out.Allowed, nil
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPAuthorizerPostsChecksAndCaches(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	allowed := map[string]bool{"orders_1": true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req httpCheckRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Subject != "user:alice" || req.ObjectType != "metric_row" || req.Permission != "read" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if req.ObjectID == "broken" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		calls++
+		ok := allowed[req.ObjectID]
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]bool{"allowed": ok})
+	}))
+	defer srv.Close()
+
+	a, err := NewHTTP(HTTPConfig{URL: srv.URL, Subject: "user:alice", Token: "s3cret", CacheTTL: time.Minute, NegativeCacheTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("new http auth: %v", err)
+	}
+	defer a.Close()
+	for id, want := range map[string]bool{"orders_1": true, "orders_2": false, "broken": false} {
+		if got := a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"}); got != want {
+			t.Fatalf("%s: got %v, want %v", id, got, want)
+		}
+	}
+	a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"})
+	mu.Lock()
+	if calls != 2 {
+		t.Fatalf("expected cached answers to skip the service, got %d calls", calls)
+	}
+	allowed["orders_2"] = true
+	mu.Unlock()
+
+	notified := make(chan struct{}, 1)
+	cancel := a.Subscribe(func() {
+		select {
+		case notified <- struct{}{}:
+		default:
+		}
+	})
+	defer cancel()
+	a.StartReconcile(10 * time.Millisecond)
+	select {
+	case <-notified:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconcile did not notify on a changed answer")
+	}
+	if !a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}) {
+		t.Fatal("expected reconciled grant to be allowed")
+	}
+
+	if _, err := NewHTTP(HTTPConfig{URL: "ftp://example.com"}); err == nil {
+		t.Fatal("expected non-http url to be rejected")
+	}
+}
+
+func TestOPAAuthorizerEvaluatesDecisionPath(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/data/metricfs/allow" {
+			http.NotFound(w, r)
+			return
+		}
+		var body struct {
+			Input httpCheckRequest `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch body.Input.ObjectID {
+		case "orders_1":
+			json.NewEncoder(w).Encode(map[string]any{"result": body.Input.Subject == "user:alice"})
+		case "orders_2":
+			json.NewEncoder(w).Encode(map[string]any{"result": "yes"})
+		default:
+			// An undefined rule has no result.
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+
+	a, err := NewOPA(HTTPConfig{URL: srv.URL, Subject: "user:alice"}, "/metricfs/allow")
+	if err != nil {
+		t.Fatalf("new opa auth: %v", err)
+	}
+	defer a.Close()
+	for id, want := range map[string]bool{"orders_1": true, "orders_2": false, "orders_3": false} {
+		if got := a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"}); got != want {
+			t.Fatalf("%s: got %v, want %v", id, got, want)
+		}
+	}
+}
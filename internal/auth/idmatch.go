@@ -0,0 +1,114 @@
+package auth
+
+import "strings"
+
+type idPattern struct {
+	ObjectType string
+	Permission string
+	Pattern    string
+}
+
+type idMatchers map[TypePermission]*idMatcher
+
+type idMatcher struct {
+	prefixes prefixTrie
+	globs    []string
+}
+
+func newIDMatchers(patterns map[idPattern]struct{}) idMatchers {
+	if len(patterns) == 0 {
+		return nil
+	}
+	m := idMatchers{}
+	for p := range patterns {
+		k := TypePermission{ObjectType: p.ObjectType, Permission: p.Permission}
+		im := m[k]
+		if im == nil {
+			im = &idMatcher{}
+			m[k] = im
+		}
+		if prefix, ok := strings.CutSuffix(p.Pattern, "*"); ok && !strings.Contains(prefix, "*") {
+			im.prefixes.add(prefix)
+		} else {
+			im.globs = append(im.globs, p.Pattern)
+		}
+	}
+	return m
+}
+
+func (m idMatchers) match(c CandidateKey) bool {
+	for _, typ := range []string{c.ObjectType, ""} {
+		im := m[TypePermission{ObjectType: typ, Permission: c.Permission}]
+		if im == nil {
+			continue
+		}
+		if im.prefixes.match(c.ObjectID) {
+			return true
+		}
+		for _, g := range im.globs {
+			if wildcardMatch(g, c.ObjectID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type prefixTrie struct {
+	end  bool
+	next map[byte]*prefixTrie
+}
+
+func (t *prefixTrie) add(prefix string) {
+	for i := 0; i < len(prefix); i++ {
+		if t.next == nil {
+			t.next = map[byte]*prefixTrie{}
+		}
+		n := t.next[prefix[i]]
+		if n == nil {
+			n = &prefixTrie{}
+			t.next[prefix[i]] = n
+		}
+		t = n
+	}
+	t.end = true
+}
+
+func (t *prefixTrie) match(s string) bool {
+	for i := 0; ; i++ {
+		if t.end {
+			return true
+		}
+		if i == len(s) {
+			return false
+		}
+		if t = t.next[s[i]]; t == nil {
+			return false
+		}
+	}
+}
+
+func wildcardMatch(pattern, s string) bool {
+	star, mark := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+func impliedPermissions(implies map[string][]string, p string) []string {
+	out := []string{p}
+	for i := 0; i < len(out); i++ {
+		for _, q := range implies[out[i]] {
+			if q = strings.TrimSpace(q); !slices.Contains(out, q) {
+				out = append(out, q)
+			}
+		}
+	}
+	return out
+}
+
+func checkImplies(implies map[string][]string) error {
+	for p, qs := range implies {
+		for _, name := range append([]string{p}, qs...) {
+			if name = strings.TrimSpace(name); name == "" || strings.Contains(name, PermissionSeparator) {
+				return fmt.Errorf("implies: invalid permission %q", name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type TypePermission struct {
+	ObjectType string
+	Permission string
+}
+
+type LookupAuthorizer struct {
+	notifier
+	stopper
+
+	live   *SpiceDBAuthorizer
+	pairs  []TypePermission
+	client *http.Client
+
+	mu          sync.RWMutex
+	covered     map[TypePermission]bool
+	allowed     map[CandidateKey]struct{}
+	conditional map[CandidateKey]struct{}
+	looked      time.Time
+}
+
+func NewSpiceDBLookup(live *SpiceDBAuthorizer, pairs []TypePermission) *LookupAuthorizer {
+	return &LookupAuthorizer{live: live, pairs: pairs, client: &http.Client{Timeout: exportTimeout}}
+}
+
+func (l *LookupAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := l.IsAllowedCtx(context.Background(), c)
+	return allowed
+}
+
+func (l *LookupAuthorizer) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	if allowed, ok := l.lookup(c); ok {
+		return allowed, nil
+	}
+	return l.live.IsAllowedCtx(ctx, c)
+}
+
+func (l *LookupAuthorizer) IsAllowedBatch(cands []CandidateKey) []bool {
+	out, _ := l.IsAllowedBatchCtx(context.Background(), cands)
+	return out
+}
+
+func (l *LookupAuthorizer) IsAllowedBatchCtx(ctx context.Context, cands []CandidateKey) ([]bool, error) {
+	return decideBatch(cands, l.lookup, func(rest []CandidateKey) ([]bool, error) {
+		return l.live.IsAllowedBatchCtx(ctx, rest)
+	})
+}
+
+func (l *LookupAuthorizer) lookup(c CandidateKey) (bool, bool) {
+	c.Context = ""
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.covered[TypePermission{c.ObjectType, c.Permission}] {
+		return false, false
+	}
+	if _, ok := l.conditional[c]; ok {
+		return false, false
+	}
+	_, allowed := l.allowed[c]
+	return allowed, true
+}
+
+func (l *LookupAuthorizer) Subscribe(fn func()) func() {
+	cancelLookup := l.notifier.Subscribe(fn)
+	cancelLive := l.live.Subscribe(fn)
+	return func() {
+		cancelLookup()
+		cancelLive()
+	}
+}
+
+func (l *LookupAuthorizer) StartReconcile(interval time.Duration) {
+	l.live.StartReconcile(interval)
+	l.loop(interval, func() {
+		if changed, err := l.Refresh(); err == nil && changed {
+			l.notify()
+		}
+	})
+}
+
+func (l *LookupAuthorizer) Reload() error {
+	if err := l.live.Reload(); err != nil {
+		return err
+	}
+	changed, err := l.Refresh()
+	if err == nil && changed {
+		l.notify()
+	}
+	return err
+}
+
+func (l *LookupAuthorizer) Ping() error { return l.live.Ping() }
+
+func (l *LookupAuthorizer) Availability() map[string]any { return l.live.Availability() }
+
+func (l *LookupAuthorizer) Close() error {
+	l.stop()
+	return l.live.Close()
+}
+
+func (l *LookupAuthorizer) LookedUp() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.looked
+}
+
+func (l *LookupAuthorizer) Refresh() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	allowed := map[CandidateKey]struct{}{}
+	conditional := map[CandidateKey]struct{}{}
+	covered := map[TypePermission]bool{}
+	for _, p := range l.pairs {
+		res, err := l.lookupResources(ctx, p)
+		if err != nil {
+			return false, err
+		}
+		for _, r := range res {
+			c := CandidateKey{ObjectType: p.ObjectType, ObjectID: r.id, Permission: p.Permission}
+			if r.conditional {
+				conditional[c] = struct{}{}
+			} else {
+				allowed[c] = struct{}{}
+			}
+		}
+		covered[p] = true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed := !l.looked.IsZero() && (!sameSet(l.allowed, allowed) || !sameSet(l.conditional, conditional) || !maps.Equal(l.covered, covered))
+	l.covered, l.allowed, l.conditional, l.looked = covered, allowed, conditional, time.Now()
+	return changed, nil
+}
+
+type lookedUpResource struct {
+	id          string
+	conditional bool
+}
+
+func (l *LookupAuthorizer) lookupResources(ctx context.Context, p TypePermission) ([]lookedUpResource, error) {
+	if l.live.grpc != nil {
+		return l.live.lookupResourcesGRPC(ctx, p)
+	}
+	body := map[string]any{
+		"consistency":        l.live.consistencyJSON(),
+		"resourceObjectType": p.ObjectType,
+		"permission":         p.Permission,
+		"subject":            l.live.subject,
+	}
+	if len(l.live.context) > 0 {
+		body["context"] = l.live.context
+	}
+	resp, err := l.live.post(ctx, l.client, "/v1/permissions/resources", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out []lookedUpResource
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 0, 64<<10), 64<<20)
+	for sc.Scan() {
+		var msg struct {
+			Result struct {
+				ResourceObjectID string `json:"resourceObjectId"`
+				Permissionship   string `json:"permissionship"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("spicedb lookup %s#%s: %w", p.ObjectType, p.Permission, err)
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("spicedb lookup %s#%s: %s", p.ObjectType, p.Permission, msg.Error.Message)
+		}
+		out = append(out, lookedUpResource{
+			id:          msg.Result.ResourceObjectID,
+			conditional: msg.Result.Permissionship == "LOOKUP_PERMISSIONSHIP_CONDITIONAL_PERMISSION",
+		})
+	}
+	return out, sc.Err()
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+type ChangeNotifier interface {
+	Subscribe(fn func()) (cancel func())
+}
+
+type Reconciler interface {
+	StartReconcile(interval time.Duration)
+}
+
+type Reloader interface {
+	Reload() error
+}
+
+func Reload(az Authorizer) error {
+	if r, ok := az.(Reloader); ok {
+		return r.Reload()
+	}
+	return nil
+}
+
+type Pinger interface {
+	Ping() error
+}
+
+func Ping(az Authorizer) error {
+	if p, ok := az.(Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+func Subscribe(az Authorizer, fn func()) func() {
+	if n, ok := az.(ChangeNotifier); ok {
+		return n.Subscribe(fn)
+	}
+	return func() {}
+}
+
+type notifier struct {
+	mu   sync.Mutex
+	next int
+	subs map[int]func()
+}
+
+func (n *notifier) Subscribe(fn func()) func() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subs == nil {
+		n.subs = map[int]func(){}
+	}
+	id := n.next
+	n.next++
+	n.subs[id] = fn
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subs, id)
+	}
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	fns := make([]func(), 0, len(n.subs))
+	for _, fn := range n.subs {
+		fns = append(fns, fn)
+	}
+	n.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+type forwarder struct {
+	Authorizer
+}
+
+func (f forwarder) Subscribe(fn func()) func() { return Subscribe(f.Authorizer, fn) }
+
+func (f forwarder) StartReconcile(interval time.Duration) {
+	if r, ok := f.Authorizer.(Reconciler); ok {
+		r.StartReconcile(interval)
+	}
+}
+
+func (f forwarder) Reload() error { return Reload(f.Authorizer) }
+
+func (f forwarder) Ping() error { return Ping(f.Authorizer) }
+
+func (f forwarder) Availability() map[string]any { return Availability(f.Authorizer) }
+
+func (f forwarder) Close() error {
+	if cl, ok := f.Authorizer.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+type stopper struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (s *stopper) stop() {
+	s.once.Do(func() {
+		if s.ch != nil {
+			close(s.ch)
+		}
+	})
+}
+
+func (s *stopper) loop(interval time.Duration, fn func()) {
+	if interval <= 0 {
+		return
+	}
+	s.ch = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				fn()
+			}
+		}
+	}(s.ch)
+}
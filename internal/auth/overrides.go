@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type Overrides struct {
+	notifier
+	stopper
+
+	path string
+
+	mu      sync.RWMutex
+	allow   map[objectKey]map[string]struct{}
+	deny    map[objectKey]map[string]struct{}
+	modTime time.Time
+	size    int64
+	loaded  time.Time
+	err     error
+}
+
+type overridesDoc struct {
+	ForceAllow []CandidateKey `json:"force_allow"`
+	ForceDeny  []CandidateKey `json:"force_deny"`
+}
+
+func NewOverrides(path string) (*Overrides, error) {
+	o := &Overrides{path: path}
+	if _, err := o.reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Overrides) Start(interval time.Duration) {
+	o.loop(interval, func() {
+		changed, err := o.reload()
+		o.mu.Lock()
+		o.err = err
+		o.mu.Unlock()
+		if changed {
+			o.notify()
+		}
+	})
+}
+
+func (o *Overrides) Reload() error {
+	o.mu.Lock()
+	o.loaded = time.Time{}
+	o.mu.Unlock()
+	changed, err := o.reload()
+	o.mu.Lock()
+	o.err = err
+	o.mu.Unlock()
+	if changed {
+		o.notify()
+	}
+	return err
+}
+
+func (o *Overrides) Close() error {
+	o.stop()
+	return nil
+}
+
+func (o *Overrides) reload() (bool, error) {
+	st, err := os.Stat(o.path)
+	if err != nil {
+		return false, err
+	}
+	o.mu.RLock()
+	same := !o.loaded.IsZero() && st.Size() == o.size && st.ModTime().Equal(o.modTime)
+	o.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	b, err := os.ReadFile(o.path)
+	if err != nil {
+		return false, err
+	}
+	var doc overridesDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return false, fmt.Errorf("%s: %w", o.path, err)
+	}
+	allow, err := overrideSet(doc.ForceAllow)
+	if err != nil {
+		return false, fmt.Errorf("%s: force_allow: %w", o.path, err)
+	}
+	deny, err := overrideSet(doc.ForceDeny)
+	if err != nil {
+		return false, fmt.Errorf("%s: force_deny: %w", o.path, err)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.allow, o.deny = allow, deny
+	o.modTime, o.size, o.loaded = st.ModTime(), st.Size(), time.Now()
+	return true, nil
+}
+
+func overrideSet(keys []CandidateKey) (map[objectKey]map[string]struct{}, error) {
+	out := map[objectKey]map[string]struct{}{}
+	for _, k := range keys {
+		if k.ObjectType == "" || k.ObjectID == "" {
+			return nil, fmt.Errorf("entries need object_type and object_id")
+		}
+		ok := objectKey{k.ObjectType, k.ObjectID}
+		if out[ok] == nil {
+			out[ok] = map[string]struct{}{}
+		}
+		out[ok][k.Permission] = struct{}{}
+	}
+	return out, nil
+}
+
+func matchOverride(set map[objectKey]map[string]struct{}, c CandidateKey) bool {
+	perms, ok := set[objectKey{c.ObjectType, c.ObjectID}]
+	if !ok {
+		return false
+	}
+	_, all := perms[""]
+	_, exact := perms[c.Permission]
+	return all || exact
+}
+
+func (o *Overrides) Status() map[string]any {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	st := map[string]any{"path": o.path, "force_allow": countOverrides(o.allow), "force_deny": countOverrides(o.deny), "loaded_at": o.loaded}
+	if o.err != nil {
+		st["error"] = o.err.Error()
+	}
+	return st
+}
+
+func countOverrides(set map[objectKey]map[string]struct{}) int {
+	n := 0
+	for _, perms := range set {
+		n += len(perms)
+	}
+	return n
+}
+
+func (o *Overrides) Wrap(az Authorizer) Authorizer {
+	return &overrideAuthorizer{forwarder: forwarder{az}, o: o}
+}
+
+type overrideAuthorizer struct {
+	forwarder
+	o *Overrides
+}
+
+func (a *overrideAuthorizer) IsAllowed(c CandidateKey) bool {
+	if allowed, ok := a.override(c); ok {
+		return allowed
+	}
+	return a.Authorizer.IsAllowed(c)
+}
+
+func (a *overrideAuthorizer) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	if allowed, ok := a.override(c); ok {
+		return allowed, nil
+	}
+	return IsAllowedCtx(ctx, a.Authorizer, c)
+}
+
+func (a *overrideAuthorizer) override(c CandidateKey) (allowed, ok bool) {
+	a.o.mu.RLock()
+	deny, allow := matchOverride(a.o.deny, c), matchOverride(a.o.allow, c)
+	a.o.mu.RUnlock()
+	return allow && !deny, deny || allow
+}
+
+func (a *overrideAuthorizer) IsAllowedBatch(cands []CandidateKey) []bool {
+	out, _ := a.IsAllowedBatchCtx(context.Background(), cands)
+	return out
+}
+
+func (a *overrideAuthorizer) IsAllowedBatchCtx(ctx context.Context, cands []CandidateKey) ([]bool, error) {
+	a.o.mu.RLock()
+	deny, allow := a.o.deny, a.o.allow
+	a.o.mu.RUnlock()
+	return decideBatch(cands, func(c CandidateKey) (bool, bool) {
+		switch {
+		case matchOverride(deny, c):
+			return false, true
+		case matchOverride(allow, c):
+			return true, true
+		}
+		return false, false
+	}, func(rest []CandidateKey) ([]bool, error) {
+		return isAllowedBatchCtx(ctx, a.Authorizer, rest)
+	})
+}
+
+func (a *overrideAuthorizer) Suppressed(c CandidateKey) bool {
+	a.o.mu.RLock()
+	deny := matchOverride(a.o.deny, c)
+	a.o.mu.RUnlock()
+	if deny {
+		return true
+	}
+	if s, ok := a.Authorizer.(Suppressor); ok {
+		return s.Suppressed(c)
+	}
+	return false
+}
+
+func (a *overrideAuthorizer) RowSuppressed() {
+	if s, ok := a.Authorizer.(Suppressor); ok {
+		s.RowSuppressed()
+	}
+}
+
+func (a *overrideAuthorizer) Subscribe(fn func()) func() {
+	cancelOverrides := a.o.Subscribe(fn)
+	cancelInner := Subscribe(a.Authorizer, fn)
+	return func() {
+		cancelOverrides()
+		cancelInner()
+	}
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+func decodePermissionsDoc(path string, b []byte) (permissionsDoc, error) {
+	var doc permissionsDoc
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err := yaml.Unmarshal(b, &doc)
+		return doc, err
+	case ".csv":
+		return decodePermissionsCSV(b)
+	}
+	err := json.Unmarshal(b, &doc)
+	return doc, err
+}
+
+var csvColumns = map[string]func(*permissionEntry) *string{
+	"subject":          func(e *permissionEntry) *string { return &e.Subject },
+	"object_type":      func(e *permissionEntry) *string { return &e.ObjectType },
+	"object_id":        func(e *permissionEntry) *string { return &e.ObjectID },
+	"object_id_prefix": func(e *permissionEntry) *string { return &e.ObjectIDPrefix },
+	"permission":       func(e *permissionEntry) *string { return &e.Permission },
+}
+
+func decodePermissionsCSV(b []byte) (permissionsDoc, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err == io.EOF {
+		return permissionsDoc{}, nil
+	}
+	if err != nil {
+		return permissionsDoc{}, err
+	}
+	fields := make([]func(*permissionEntry) *string, len(header))
+	seen := map[string]bool{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		f, ok := csvColumns[name]
+		if !ok {
+			return permissionsDoc{}, fmt.Errorf("unknown csv column %q", name)
+		}
+		if seen[name] {
+			return permissionsDoc{}, fmt.Errorf("duplicate csv column %q", name)
+		}
+		seen[name], fields[i] = true, f
+	}
+	if !seen["object_type"] || !seen["object_id"] && !seen["object_id_prefix"] {
+		return permissionsDoc{}, fmt.Errorf("csv header needs object_type and object_id or object_id_prefix")
+	}
+	var doc permissionsDoc
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return doc, nil
+		}
+		if err != nil {
+			return permissionsDoc{}, err
+		}
+		var e permissionEntry
+		for i, v := range rec {
+			*fields[i](&e) = strings.TrimSpace(v)
+		}
+		doc.Allow = append(doc.Allow, e)
+	}
+}
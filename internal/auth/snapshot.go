@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const snapshotVersion = 1
+
+type Snapshot struct {
+	Version   int                `json:"version"`
+	Subject   string             `json:"subject,omitempty"`
+	TakenAt   time.Time          `json:"taken_at"`
+	Decisions []SnapshotDecision `json:"decisions"`
+}
+
+type SnapshotDecision struct {
+	CandidateKey
+	Allowed bool `json:"allowed"`
+}
+
+func TakeSnapshot(ctx context.Context, az Authorizer, subject string, cands []CandidateKey) (*Snapshot, error) {
+	keys := splitCandidates(cands)
+	allowed, err := isAllowedBatchCtx(ctx, az, keys)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{Version: snapshotVersion, Subject: subject, TakenAt: time.Now().UTC(), Decisions: make([]SnapshotDecision, len(keys))}
+	for i, k := range keys {
+		s.Decisions[i] = SnapshotDecision{CandidateKey: k, Allowed: allowed[i]}
+	}
+	slices.SortFunc(s.Decisions, func(a, b SnapshotDecision) int {
+		return cmp.Or(
+			cmp.Compare(a.ObjectType, b.ObjectType),
+			cmp.Compare(a.ObjectID, b.ObjectID),
+			cmp.Compare(a.Permission, b.Permission),
+			cmp.Compare(a.Context, b.Context),
+		)
+	})
+	return s, nil
+}
+
+func splitCandidates(cands []CandidateKey) []CandidateKey {
+	seen := map[CandidateKey]struct{}{}
+	var keys []CandidateKey
+	for _, c := range cands {
+		for _, p := range strings.Split(c.Permission, PermissionSeparator) {
+			k := CandidateKey{ObjectType: c.ObjectType, ObjectID: c.ObjectID, Permission: p, Context: c.Context}
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+func (s *Snapshot) Write(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type SnapshotAuthorizer struct {
+	notifier
+	stopper
+
+	path    string
+	subject string
+
+	mu      sync.RWMutex
+	m       map[CandidateKey]bool
+	takenAt time.Time
+	stamp   string
+}
+
+func NewSnapshot(path, subject string) (*SnapshotAuthorizer, error) {
+	a := &SnapshotAuthorizer{path: path, subject: strings.TrimSpace(subject)}
+	if _, err := a.load(true); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *SnapshotAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := a.Decide(c)
+	return allowed
+}
+
+func (a *SnapshotAuthorizer) Decide(c CandidateKey) (bool, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	allowed, ok := a.m[c]
+	return allowed, ok
+}
+
+func (a *SnapshotAuthorizer) StartReconcile(interval time.Duration) {
+	a.loop(interval, func() {
+		if changed, err := a.load(false); err == nil && changed {
+			a.notify()
+		}
+	})
+}
+
+func (a *SnapshotAuthorizer) Reload() error {
+	changed, err := a.load(true)
+	if err == nil && changed {
+		a.notify()
+	}
+	return err
+}
+
+func (a *SnapshotAuthorizer) Ping() error {
+	_, err := filesStamp(a.path)
+	return err
+}
+
+func (a *SnapshotAuthorizer) Availability() map[string]any {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return map[string]any{"snapshot_taken_at": a.takenAt, "snapshot_decisions": len(a.m)}
+}
+
+func (a *SnapshotAuthorizer) Close() error {
+	a.stop()
+	return nil
+}
+
+func (a *SnapshotAuthorizer) load(force bool) (bool, error) {
+	stamp, err := filesStamp(a.path)
+	if err != nil {
+		return false, err
+	}
+	a.mu.RLock()
+	same := a.m != nil && stamp == a.stamp
+	a.mu.RUnlock()
+	if same && !force {
+		return false, nil
+	}
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return false, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return false, fmt.Errorf("%s: %w", a.path, err)
+	}
+	if s.Version != snapshotVersion {
+		return false, fmt.Errorf("%s: unsupported snapshot version %d", a.path, s.Version)
+	}
+	if a.subject != "" && s.Subject != "" && s.Subject != a.subject {
+		return false, fmt.Errorf("%s: snapshot was taken for %s, not %s", a.path, s.Subject, a.subject)
+	}
+	m := make(map[CandidateKey]bool, len(s.Decisions))
+	for _, d := range s.Decisions {
+		m[d.CandidateKey] = d.Allowed
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	replaced := a.m != nil
+	a.m, a.takenAt, a.stamp = m, s.TakenAt, stamp
+	return replaced, nil
+}
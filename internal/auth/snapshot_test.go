@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotServesRecordedDecisions(t *testing.T) {
+	dir := t.TempDir()
+	permsPath := filepath.Join(dir, "perms.json")
+	if err := os.WriteFile(permsPath, []byte(`{"allow": [
+  {"object_type": "metric_row", "object_id": "orders_1", "permission": "read"},
+  {"object_type": "metric_row", "object_id": "orders_1", "permission": "export"}
+]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	live, err := New(permsPath, "user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cand := func(id, perm string) CandidateKey {
+		return CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: perm}
+	}
+	snap, err := TakeSnapshot(context.Background(), live, "user:alice", []CandidateKey{
+		cand("orders_1", "read+export"), cand("orders_2", "read"), cand("orders_1", "read"),
+	})
+	if err != nil {
+		t.Fatalf("take snapshot: %v", err)
+	}
+	if len(snap.Decisions) != 3 {
+		t.Fatalf("snapshot has %d decisions, want 3: %+v", len(snap.Decisions), snap.Decisions)
+	}
+	path := filepath.Join(dir, "snap.json")
+	if err := snap.Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewSnapshot(path, "user:alice")
+	if err != nil {
+		t.Fatalf("new snapshot auth: %v", err)
+	}
+	defer a.Close()
+	if !Allowed(a, cand("orders_1", "read+export")) || !a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}) {
+		t.Fatalf("expected recorded grants")
+	}
+	if allowed, ok := a.Decide(cand("orders_2", "read")); allowed || !ok {
+		t.Fatalf("recorded denial = %v, %v", allowed, ok)
+	}
+	if allowed, ok := a.Decide(cand("orders_3", "read")); allowed || ok {
+		t.Fatalf("uncovered candidate = %v, %v; want declined", allowed, ok)
+	}
+	if _, err := NewSnapshot(path, "user:bob"); err == nil {
+		t.Fatalf("expected a snapshot taken for alice to be refused for bob")
+	}
+}
@@ -4,31 +4,67 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 	"time"
+
+	"github.com/authzed/authzed-go/v1"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/henneberger/metrics-fs/internal/faults"
+	"github.com/henneberger/metrics-fs/pkg/enums"
 )
 
 type SpiceDBConfig struct {
-	Endpoint    string
-	Token       string
-	Subject     string
-	Consistency string
+	Endpoint         string
+	Token            string
+	TokenFile        string
+	TokenRefresh     time.Duration
+	TokenJWT         bool
+	Subject          string
+	Consistency      string
+	Transport        string
+	Insecure         bool
+	CAFile           string
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+	CacheMaxEntries  int
+	ZedTokenFile     string
+	OnUnavailable    string
+	StaleTTL         time.Duration
+	CaveatContext    map[string]any
+	Retries          int
+	RetryBackoff     time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
 }
 
+const checkTimeout = 2 * time.Second
+
 type SpiceDBAuthorizer struct {
-	client *http.Client
-	url    string
-	token  string
+	notifier
+	stopper
+
+	client   *http.Client
+	endpoint string
+	bearer   *bearerToken
+	grpc     *authzed.Client
 
 	subject     subjectRef
-	consistency map[string]any
+	consistency enums.Consistency
+	tokens      *zedTokens
+	context     map[string]any
 
-	mu    sync.RWMutex
-	cache map[CandidateKey]bool
+	cache   *checkCache[CandidateKey]
+	sweep   stopper
+	rotate  stopper
+	avail   availability
+	circuit circuit
+	flight  singleflight.Group
 }
 
 func NewSpiceDB(cfg SpiceDBConfig) (*SpiceDBAuthorizer, error) {
@@ -36,67 +72,270 @@ func NewSpiceDB(cfg SpiceDBConfig) (*SpiceDBAuthorizer, error) {
 	if endpoint == "" {
 		return nil, fmt.Errorf("spicedb endpoint is required")
 	}
-	if !strings.Contains(endpoint, "://") {
-		endpoint = "http://" + endpoint
-	}
-	parsed, err := url.Parse(endpoint)
+	transport, err := enums.ParseSpiceDBTransport(cfg.Transport)
 	if err != nil {
-		return nil, fmt.Errorf("invalid spicedb endpoint %q: %w", cfg.Endpoint, err)
-	}
-	if parsed.Host == "" {
-		return nil, fmt.Errorf("invalid spicedb endpoint %q", cfg.Endpoint)
+		return nil, err
 	}
-	if strings.TrimSpace(cfg.Token) == "" {
-		return nil, fmt.Errorf("spicedb token is required")
+	bearer, err := newBearerToken(cfg.Token, cfg.TokenFile, cfg.TokenJWT)
+	if err != nil {
+		return nil, err
 	}
 	subject, err := parseSubject(cfg.Subject)
 	if err != nil {
 		return nil, err
 	}
-	consistency, err := parseConsistency(cfg.Consistency)
+	consistency, err := enums.ParseConsistency(cfg.Consistency)
 	if err != nil {
 		return nil, err
 	}
-	return &SpiceDBAuthorizer{
+	onUnavailable, err := enums.ParseUnavailableMode(cfg.OnUnavailable)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := loadZedTokens(cfg.ZedTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("spicedb zedtoken: %w", err)
+	}
+	a := &SpiceDBAuthorizer{
 		client: &http.Client{
-			Timeout: 2 * time.Second,
+			Timeout: checkTimeout,
 		},
-		url:         strings.TrimRight(endpoint, "/") + "/v1/permissions/check",
-		token:       cfg.Token,
+		bearer:      bearer,
 		subject:     subject,
 		consistency: consistency,
-		cache:       map[CandidateKey]bool{},
-	}, nil
+		tokens:      tokens,
+		context:     cfg.CaveatContext,
+		cache:       newCheckCache[CandidateKey](cfg.CacheTTL, cfg.NegativeCacheTTL, cfg.CacheMaxEntries),
+		avail:       availability{mode: onUnavailable, staleTTL: cfg.StaleTTL},
+		circuit:     circuit{retries: cfg.Retries, backoff: cfg.RetryBackoff, threshold: cfg.BreakerThreshold, cooldown: cfg.BreakerCooldown},
+	}
+	if a.avail.servesStale() {
+		a.cache.staleTTL = cfg.StaleTTL
+	}
+	if transport == enums.SpiceDBTransportGRPC {
+		if a.grpc, err = dialSpiceDB(endpoint, cfg, bearer); err != nil {
+			return nil, err
+		}
+		a.startBackground(cfg.TokenRefresh)
+		return a, nil
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spicedb endpoint %q: %w", cfg.Endpoint, err)
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("invalid spicedb endpoint %q", cfg.Endpoint)
+	}
+	a.endpoint = strings.TrimRight(endpoint, "/")
+	a.startBackground(cfg.TokenRefresh)
+	return a, nil
+}
+
+func (a *SpiceDBAuthorizer) startBackground(refresh time.Duration) {
+	a.sweep.loop(a.cache.sweepInterval(), a.cache.evictExpired)
+	if a.bearer.path != "" && refresh > 0 {
+		a.rotate.loop(refresh, func() { _, _ = a.bearer.refresh() })
+	}
 }
 
 func (a *SpiceDBAuthorizer) Close() error {
-	return nil
+	a.stop()
+	a.sweep.stop()
+	a.rotate.stop()
+	err := a.tokens.flush()
+	if a.grpc != nil {
+		if cerr := a.grpc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
-func (a *SpiceDBAuthorizer) IsAllowed(c CandidateKey) bool {
-	if c.Permission == "" {
-		c.Permission = "read"
+func (a *SpiceDBAuthorizer) Reload() error {
+	if _, err := a.bearer.refresh(); err != nil {
+		return err
 	}
-	if c.ObjectType == "" || c.ObjectID == "" {
-		return false
+	changed, err := a.tokens.reload()
+	if err != nil || !changed {
+		return err
 	}
-	a.mu.RLock()
-	allowed, ok := a.cache[c]
-	a.mu.RUnlock()
-	if ok {
-		return allowed
+	if a.reconcile() {
+		a.notify()
 	}
+	return nil
+}
 
-	allowed, err := a.checkRemote(c)
+func (a *SpiceDBAuthorizer) Ping() error {
+	if a.grpc != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+		_, err := a.readSchemaGRPC(ctx)
+		return err
+	}
+	resp, err := a.post(context.Background(), a.client, "/v1/schema/read", struct{}{})
 	if err != nil {
-		return false
+		return err
 	}
-	a.mu.Lock()
-	a.cache[c] = allowed
-	a.mu.Unlock()
+	return resp.Body.Close()
+}
+
+func (a *SpiceDBAuthorizer) StartReconcile(interval time.Duration) {
+	a.loop(interval, func() {
+		_, _ = a.tokens.reload()
+		if a.reconcile() {
+			a.notify()
+		}
+	})
+}
+
+func (a *SpiceDBAuthorizer) reconcile() bool {
+	changed := false
+	for _, k := range a.cache.keys() {
+		allowed, err := a.checkRemote(context.Background(), k)
+		a.avail.observe(err)
+		if err != nil {
+			continue
+		}
+		if a.cache.update(k, allowed) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (a *SpiceDBAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := a.IsAllowedCtx(context.Background(), c)
 	return allowed
 }
 
+func (a *SpiceDBAuthorizer) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	if c.ObjectType == "" || c.ObjectID == "" || c.Permission == "" {
+		return false, nil
+	}
+	if allowed, ok := a.cache.get(c); ok {
+		return allowed, nil
+	}
+
+	allowed, err := a.checkShared(ctx, c)
+	if err != nil && ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		if allowed, stale := a.unavailable(c); stale {
+			return allowed, nil
+		}
+		return false, err
+	}
+	return allowed, nil
+}
+
+var errCheckAbandoned = errors.New("spicedb check abandoned")
+
+func (a *SpiceDBAuthorizer) checkShared(ctx context.Context, c CandidateKey) (bool, error) {
+	key := strings.Join([]string{c.ObjectType, c.ObjectID, c.Permission, c.Context}, "\x00")
+	for {
+		ch := a.flight.DoChan(key, func() (any, error) {
+			allowed, err := a.checkRemote(ctx, c)
+			if err != nil && ctx.Err() != nil {
+				return false, errCheckAbandoned
+			}
+			a.avail.observe(err)
+			if err == nil {
+				a.cache.put(c, allowed)
+			}
+			return allowed, err
+		})
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case r := <-ch:
+			if r.Err == errCheckAbandoned && ctx.Err() == nil {
+				continue
+			}
+			return r.Val.(bool), r.Err
+		}
+	}
+}
+
+func (a *SpiceDBAuthorizer) unavailable(c CandidateKey) (allowed, stale bool) {
+	if a.avail.servesStale() {
+		if allowed, ok := a.cache.stale(c); ok {
+			a.avail.decided(true)
+			return allowed, true
+		}
+	}
+	a.avail.decided(false)
+	return false, false
+}
+
+func (a *SpiceDBAuthorizer) Availability() map[string]any {
+	st := a.avail.status()
+	st["circuit"] = a.circuit.status()
+	if exp := a.bearer.expires(); !exp.IsZero() {
+		st["token_expires_at"] = exp
+	}
+	return st
+}
+
+const bulkCheckSize = 100
+
+func (a *SpiceDBAuthorizer) IsAllowedBatch(cands []CandidateKey) []bool {
+	out, _ := a.IsAllowedBatchCtx(context.Background(), cands)
+	return out
+}
+
+func (a *SpiceDBAuthorizer) IsAllowedBatchCtx(ctx context.Context, cands []CandidateKey) ([]bool, error) {
+	return decideBatch(cands, func(c CandidateKey) (bool, bool) {
+		if c.ObjectType == "" || c.ObjectID == "" || c.Permission == "" {
+			return false, true
+		}
+		return a.cache.get(c)
+	}, func(rest []CandidateKey) ([]bool, error) {
+		out := make([]bool, 0, len(rest))
+		var first error
+		failed := func(c CandidateKey, err error) {
+			allowed, stale := a.unavailable(c)
+			if !stale && first == nil {
+				first = err
+			}
+			out = append(out, allowed)
+		}
+		for len(rest) > 0 {
+			n := min(len(rest), bulkCheckSize)
+			chunk := rest[:n]
+			rest = rest[n:]
+			results, err := a.checkBulkRemote(ctx, chunk)
+			if err != nil && ctx.Err() != nil {
+				return append(out, make([]bool, len(chunk)+len(rest))...), ctx.Err()
+			}
+			a.avail.observe(err)
+			if err != nil {
+				for _, c := range chunk {
+					failed(c, err)
+				}
+				continue
+			}
+			for i, r := range results {
+				if r.err != nil {
+					failed(chunk[i], r.err)
+					continue
+				}
+				a.cache.put(chunk[i], r.allowed)
+				out = append(out, r.allowed)
+			}
+		}
+		return out, first
+	})
+}
+
+type checkResult struct {
+	allowed bool
+	err     error
+}
+
 type objectRef struct {
 	ObjectType string `json:"objectType"`
 	ObjectID   string `json:"objectId"`
@@ -112,45 +351,164 @@ type checkPermissionRequest struct {
 	Resource    objectRef      `json:"resource"`
 	Permission  string         `json:"permission"`
 	Subject     subjectRef     `json:"subject"`
+	Context     map[string]any `json:"context,omitempty"`
 }
 
 type checkPermissionResponse struct {
-	Permissionship string `json:"permissionship"`
+	CheckedAt      zedToken `json:"checkedAt"`
+	Permissionship string   `json:"permissionship"`
+}
+
+type zedToken struct {
+	Token string `json:"token"`
 }
 
-func (a *SpiceDBAuthorizer) checkRemote(c CandidateKey) (bool, error) {
+func (a *SpiceDBAuthorizer) checkRemote(ctx context.Context, c CandidateKey) (allowed bool, err error) {
+	err = a.circuit.do(ctx, func() error {
+		allowed, err = a.sendCheck(ctx, c)
+		return err
+	})
+	return allowed, err
+}
+
+func (a *SpiceDBAuthorizer) sendCheck(ctx context.Context, c CandidateKey) (bool, error) {
+	if err := faults.Inject(faults.SpiceDBCheck); err != nil {
+		return false, err
+	}
+	if a.grpc != nil {
+		return a.checkGRPC(ctx, c)
+	}
 	body := checkPermissionRequest{
-		Consistency: a.consistency,
+		Consistency: a.consistencyJSON(),
 		Resource: objectRef{
 			ObjectType: c.ObjectType,
 			ObjectID:   c.ObjectID,
 		},
 		Permission: c.Permission,
 		Subject:    a.subject,
+		Context:    a.caveatContext(c),
 	}
-	b, err := json.Marshal(body)
+	resp, err := a.post(ctx, a.client, "/v1/permissions/check", body)
 	if err != nil {
 		return false, err
 	}
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, a.url, bytes.NewReader(b))
-	if err != nil {
+	defer resp.Body.Close()
+	var out checkPermissionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
 		return false, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+a.token)
-	resp, err := a.client.Do(req)
+	a.tokens.observe(out.CheckedAt.Token)
+	return out.Permissionship == "PERMISSIONSHIP_HAS_PERMISSION", nil
+}
+
+type checkBulkRequest struct {
+	Consistency map[string]any      `json:"consistency,omitempty"`
+	Items       []checkBulkItemJSON `json:"items"`
+}
+
+type checkBulkItemJSON struct {
+	Resource   objectRef      `json:"resource"`
+	Permission string         `json:"permission"`
+	Subject    subjectRef     `json:"subject"`
+	Context    map[string]any `json:"context,omitempty"`
+}
+
+type checkBulkResponse struct {
+	CheckedAt zedToken `json:"checkedAt"`
+	Pairs     []struct {
+		Item  *checkPermissionResponse `json:"item"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"pairs"`
+}
+
+func (a *SpiceDBAuthorizer) checkBulkRemote(ctx context.Context, cands []CandidateKey) (results []checkResult, err error) {
+	err = a.circuit.do(ctx, func() error {
+		results, err = a.sendCheckBulk(ctx, cands)
+		return err
+	})
+	return results, err
+}
+
+func (a *SpiceDBAuthorizer) sendCheckBulk(ctx context.Context, cands []CandidateKey) ([]checkResult, error) {
+	if err := faults.Inject(faults.SpiceDBCheck); err != nil {
+		return nil, err
+	}
+	if a.grpc != nil {
+		return a.checkBulkGRPC(ctx, cands)
+	}
+	body := checkBulkRequest{Consistency: a.consistencyJSON()}
+	for _, c := range cands {
+		body.Items = append(body.Items, checkBulkItemJSON{
+			Resource:   objectRef{ObjectType: c.ObjectType, ObjectID: c.ObjectID},
+			Permission: c.Permission,
+			Subject:    a.subject,
+			Context:    a.caveatContext(c),
+		})
+	}
+	resp, err := a.post(ctx, a.client, "/v1/permissions/checkbulk", body)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("spicedb check failed: %s", resp.Status)
-	}
-	var out checkPermissionResponse
+	var out checkBulkResponse
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return false, err
+		return nil, err
 	}
-	return out.Permissionship == "PERMISSIONSHIP_HAS_PERMISSION", nil
+	a.tokens.observe(out.CheckedAt.Token)
+	if len(out.Pairs) != len(cands) {
+		return nil, fmt.Errorf("spicedb checkbulk: %d results for %d items", len(out.Pairs), len(cands))
+	}
+	results := make([]checkResult, len(cands))
+	for i, p := range out.Pairs {
+		switch {
+		case p.Error != nil:
+			results[i].err = fmt.Errorf("spicedb checkbulk: %s", p.Error.Message)
+		case p.Item != nil:
+			results[i].allowed = p.Item.Permissionship == "PERMISSIONSHIP_HAS_PERMISSION"
+		}
+	}
+	return results, nil
+}
+
+func (a *SpiceDBAuthorizer) caveatContext(c CandidateKey) map[string]any {
+	var row map[string]any
+	if c.Context != "" {
+		_ = json.Unmarshal([]byte(c.Context), &row)
+	}
+	if len(row) == 0 {
+		return a.context
+	}
+	if len(a.context) == 0 {
+		return row
+	}
+	out := make(map[string]any, len(a.context)+len(row))
+	maps.Copy(out, a.context)
+	maps.Copy(out, row)
+	return out
+}
+
+func (a *SpiceDBAuthorizer) post(ctx context.Context, client *http.Client, path string, body any) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+a.bearer.get())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &statusError{path: path, code: resp.StatusCode, status: resp.Status}
+	}
+	return resp, nil
 }
 
 func parseSubject(raw string) (subjectRef, error) {
@@ -179,17 +537,16 @@ func parseSubject(raw string) (subjectRef, error) {
 	}, nil
 }
 
-func parseConsistency(raw string) (map[string]any, error) {
-	mode := strings.TrimSpace(strings.ToLower(raw))
-	if mode == "" {
-		mode = "minimize_latency"
-	}
-	switch mode {
-	case "minimize_latency":
-		return map[string]any{"minimizeLatency": true}, nil
-	case "fully_consistent":
-		return map[string]any{"fullyConsistent": true}, nil
+func (a *SpiceDBAuthorizer) consistencyJSON() map[string]any {
+	switch a.consistency {
+	case enums.ConsistencyFullyConsistent:
+		return map[string]any{"fullyConsistent": true}
+	case enums.ConsistencyAtLeastAsFresh:
+		if tok := a.tokens.get(); tok != "" {
+			return map[string]any{"atLeastAsFresh": zedToken{Token: tok}}
+		}
+		return map[string]any{"fullyConsistent": true}
 	default:
-		return nil, fmt.Errorf("unsupported spicedb consistency mode %q", raw)
+		return map[string]any{"minimizeLatency": true}
 	}
 }
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/authzed/grpcutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/henneberger/metrics-fs/pkg/enums"
+)
+
+const exportTimeout = 5 * time.Minute
+
+func dialSpiceDB(endpoint string, cfg SpiceDBConfig, token *bearerToken) (*authzed.Client, error) {
+	if _, rest, ok := strings.Cut(endpoint, "://"); ok {
+		endpoint = rest
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+	if endpoint == "" || strings.Contains(endpoint, "/") {
+		return nil, fmt.Errorf("invalid spicedb grpc endpoint %q, expected host:port", cfg.Endpoint)
+	}
+	var opts []grpc.DialOption
+	switch {
+	case cfg.Insecure:
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithPerRPCCredentials(bearerCredentials{token: token}))
+	case cfg.CAFile != "":
+		certs, err := grpcutil.WithCustomCerts(grpcutil.VerifyCA, cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("spicedb ca file: %w", err)
+		}
+		opts = append(opts, certs, grpc.WithPerRPCCredentials(bearerCredentials{token: token, secure: true}))
+	default:
+		certs, err := grpcutil.WithSystemCerts(grpcutil.VerifyCA)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, certs, grpc.WithPerRPCCredentials(bearerCredentials{token: token, secure: true}))
+	}
+	return authzed.NewClient(endpoint, opts...)
+}
+
+func (a *SpiceDBAuthorizer) checkGRPC(ctx context.Context, c CandidateKey) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	resp, err := a.grpc.CheckPermission(ctx, &v1.CheckPermissionRequest{
+		Consistency: a.grpcConsistency(),
+		Resource:    &v1.ObjectReference{ObjectType: c.ObjectType, ObjectId: c.ObjectID},
+		Permission:  c.Permission,
+		Subject:     grpcSubject(a.subject),
+		Context:     grpcContext(a.caveatContext(c)),
+	})
+	if err != nil {
+		return false, fmt.Errorf("spicedb CheckPermission: %w", err)
+	}
+	a.tokens.observe(resp.CheckedAt.GetToken())
+	return resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION, nil
+}
+
+func (a *SpiceDBAuthorizer) checkBulkGRPC(ctx context.Context, cands []CandidateKey) ([]checkResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	req := &v1.CheckBulkPermissionsRequest{Consistency: a.grpcConsistency()}
+	subject := grpcSubject(a.subject)
+	for _, c := range cands {
+		req.Items = append(req.Items, &v1.CheckBulkPermissionsRequestItem{
+			Resource:   &v1.ObjectReference{ObjectType: c.ObjectType, ObjectId: c.ObjectID},
+			Permission: c.Permission,
+			Subject:    subject,
+			Context:    grpcContext(a.caveatContext(c)),
+		})
+	}
+	resp, err := a.grpc.CheckBulkPermissions(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("spicedb CheckBulkPermissions: %w", err)
+	}
+	a.tokens.observe(resp.CheckedAt.GetToken())
+	if len(resp.Pairs) != len(cands) {
+		return nil, fmt.Errorf("spicedb CheckBulkPermissions: %d results for %d items", len(resp.Pairs), len(cands))
+	}
+	results := make([]checkResult, len(cands))
+	for i, p := range resp.Pairs {
+		if e := p.GetError(); e != nil {
+			results[i].err = fmt.Errorf("spicedb CheckBulkPermissions: %s", e.GetMessage())
+			continue
+		}
+		results[i].allowed = p.GetItem().GetPermissionship() == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	}
+	return results, nil
+}
+
+func (a *SpiceDBAuthorizer) readSchemaGRPC(ctx context.Context) (string, error) {
+	resp, err := a.grpc.ReadSchema(ctx, &v1.ReadSchemaRequest{})
+	if err != nil {
+		return "", fmt.Errorf("spicedb ReadSchema: %w", err)
+	}
+	return resp.SchemaText, nil
+}
+
+func (a *SpiceDBAuthorizer) exportGRPC(ctx context.Context, typ string) ([]relationship, error) {
+	stream, err := a.grpc.ExportBulkRelationships(ctx, &v1.ExportBulkRelationshipsRequest{
+		Consistency:                a.grpcConsistency(),
+		OptionalRelationshipFilter: &v1.RelationshipFilter{ResourceType: typ},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("spicedb export %s: %w", typ, err)
+	}
+	var out []relationship
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("spicedb export %s: %w", typ, err)
+		}
+		for _, r := range msg.Relationships {
+			// Caveats are evaluated by SpiceDB at check time, not here.
+			if r.OptionalCaveat != nil {
+				continue
+			}
+			out = append(out, relationship{
+				Resource: objectRef{ObjectType: r.Resource.GetObjectType(), ObjectID: r.Resource.GetObjectId()},
+				Relation: r.Relation,
+				Subject: subjectRef{
+					Object:           objectRef{ObjectType: r.Subject.GetObject().GetObjectType(), ObjectID: r.Subject.GetObject().GetObjectId()},
+					OptionalRelation: r.Subject.GetOptionalRelation(),
+				},
+			})
+		}
+	}
+}
+
+func (a *SpiceDBAuthorizer) lookupResourcesGRPC(ctx context.Context, p TypePermission) ([]lookedUpResource, error) {
+	stream, err := a.grpc.LookupResources(ctx, &v1.LookupResourcesRequest{
+		Consistency:        a.grpcConsistency(),
+		ResourceObjectType: p.ObjectType,
+		Permission:         p.Permission,
+		Subject:            grpcSubject(a.subject),
+		Context:            grpcContext(a.context),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("spicedb lookup %s#%s: %w", p.ObjectType, p.Permission, err)
+	}
+	var out []lookedUpResource
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("spicedb lookup %s#%s: %w", p.ObjectType, p.Permission, err)
+		}
+		out = append(out, lookedUpResource{
+			id:          msg.ResourceObjectId,
+			conditional: msg.Permissionship == v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_CONDITIONAL_PERMISSION,
+		})
+	}
+}
+
+func (a *SpiceDBAuthorizer) grpcConsistency() *v1.Consistency {
+	switch a.consistency {
+	case enums.ConsistencyFullyConsistent:
+		return &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}}
+	case enums.ConsistencyAtLeastAsFresh:
+		if tok := a.tokens.get(); tok != "" {
+			return &v1.Consistency{Requirement: &v1.Consistency_AtLeastAsFresh{AtLeastAsFresh: &v1.ZedToken{Token: tok}}}
+		}
+		return &v1.Consistency{Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true}}
+	}
+	return &v1.Consistency{Requirement: &v1.Consistency_MinimizeLatency{MinimizeLatency: true}}
+}
+
+func grpcContext(m map[string]any) *structpb.Struct {
+	if len(m) == 0 {
+		return nil
+	}
+	s, err := structpb.NewStruct(m)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func grpcSubject(s subjectRef) *v1.SubjectReference {
+	return &v1.SubjectReference{
+		Object:           &v1.ObjectReference{ObjectType: s.Object.ObjectType, ObjectId: s.Object.ObjectID},
+		OptionalRelation: s.OptionalRelation,
+	}
+}
@@ -1,9 +1,21 @@
 package auth
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/henneberger/metrics-fs/pkg/authtest"
 )
 
 func TestParseSubject(t *testing.T) {
@@ -38,28 +50,29 @@ func TestParseSubject(t *testing.T) {
 }
 
 func TestParseConsistency(t *testing.T) {
-	if _, err := parseConsistency("minimize_latency"); err != nil {
-		t.Fatalf("minimize_latency should be valid: %v", err)
-	}
-	if _, err := parseConsistency("fully_consistent"); err != nil {
-		t.Fatalf("fully_consistent should be valid: %v", err)
+	for mode, want := range map[string]string{
+		"minimize_latency":  `{"minimizeLatency":true}`,
+		"fully_consistent":  `{"fullyConsistent":true}`,
+		"at_least_as_fresh": `{"fullyConsistent":true}`,
+	} {
+		az, err := NewSpiceDB(SpiceDBConfig{Endpoint: "http://127.0.0.1:1", Token: "t", Subject: "user:alice", Consistency: mode})
+		if err != nil {
+			t.Fatalf("%s should be valid: %v", mode, err)
+		}
+		if b, _ := json.Marshal(az.consistencyJSON()); string(b) != want {
+			t.Fatalf("%s: consistency %s, want %s", mode, b, want)
+		}
+		az.Close()
 	}
-	if _, err := parseConsistency("at_least_as_fresh"); err == nil {
+	if _, err := NewSpiceDB(SpiceDBConfig{Endpoint: "http://127.0.0.1:1", Token: "t", Subject: "user:alice", Consistency: "at_exact_snapshot"}); err == nil {
 		t.Fatalf("expected unsupported consistency error")
 	}
 }
 
 func TestSpiceDBAuthorizerCachesByCandidate(t *testing.T) {
-	calls := 0
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		calls++
-		if got := r.Header.Get("Authorization"); got != "Bearer token" {
-			t.Fatalf("unexpected authorization header: %q", got)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		_, _ = w.Write([]byte(`{"permissionship":"PERMISSIONSHIP_HAS_PERMISSION"}`))
-	}))
+	srv := authtest.NewServer("token")
 	defer srv.Close()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
 
 	az, err := NewSpiceDB(SpiceDBConfig{
 		Endpoint:    srv.URL,
@@ -77,7 +90,783 @@ func TestSpiceDBAuthorizerCachesByCandidate(t *testing.T) {
 	if !az.IsAllowed(c) {
 		t.Fatalf("expected allowed on cached check")
 	}
-	if calls != 1 {
+	if calls := len(srv.Checks()); calls != 1 {
 		t.Fatalf("expected 1 remote call, got %d", calls)
 	}
 }
+
+func TestSpiceDBAuthorizerDeniesOnFailure(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	srv.SetUnavailable(true)
+
+	az, err := NewSpiceDB(SpiceDBConfig{Endpoint: srv.URL, Token: "token", Subject: "user:alice"})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	if az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}) {
+		t.Fatalf("expected fail-closed deny while spicedb is unavailable")
+	}
+	if az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}) {
+		t.Fatalf("expected deny for ungranted object")
+	}
+}
+
+func TestSpiceDBContextChecksReportFailures(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+
+	az, err := NewSpiceDB(SpiceDBConfig{Endpoint: srv.URL, Token: "token", Subject: "user:alice"})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer az.Close()
+	cached := NewDecisionCache(time.Minute, time.Minute, 0).Wrap("user:alice", az)
+	granted := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}
+	denied := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}
+
+	srv.SetLatency(300 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	start := time.Now()
+	_, err = IsAllowedCtx(ctx, cached, granted)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("cancelled check: err=%v after %s", err, time.Since(start))
+	}
+	if _, err := isAllowedBatchCtx(ctx, cached, []CandidateKey{granted}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled batch: err=%v", err)
+	}
+	if Availability(az)["unavailable"] == true {
+		t.Fatalf("a cancelled check marked spicedb unavailable")
+	}
+	srv.SetLatency(0)
+
+	srv.SetUnavailable(true)
+	if allowed, err := IsAllowedCtx(context.Background(), cached, granted); allowed || err == nil {
+		t.Fatalf("check while unavailable = %v, %v; want a failure", allowed, err)
+	}
+	got, err := isAllowedBatchCtx(context.Background(), cached, []CandidateKey{granted, denied})
+	if err == nil || got[0] || got[1] {
+		t.Fatalf("batch while unavailable = %v, %v; want a failure", got, err)
+	}
+	srv.SetUnavailable(false)
+
+	// Failures were not cached as denials.
+	if allowed, err := IsAllowedCtx(context.Background(), cached, granted); !allowed || err != nil {
+		t.Fatalf("check after recovery = %v, %v", allowed, err)
+	}
+	if allowed, err := IsAllowedCtx(context.Background(), cached, denied); allowed || err != nil {
+		t.Fatalf("denied check after recovery = %v, %v", allowed, err)
+	}
+}
+
+func TestSpiceDBRetriesAndCircuitBreaker(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	for i := 0; i < 6; i++ {
+		srv.Grant(fmt.Sprintf("metric_row:orders_%d", i), "read", "user:alice")
+	}
+	az, err := NewSpiceDB(SpiceDBConfig{
+		Endpoint: srv.URL, Token: "token", Subject: "user:alice",
+		Retries: 2, RetryBackoff: time.Millisecond, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer az.Close()
+	cand := func(i int) CandidateKey {
+		return CandidateKey{ObjectType: "metric_row", ObjectID: fmt.Sprintf("orders_%d", i), Permission: "read"}
+	}
+	requests := func() int { return len(srv.Checks()) }
+
+	srv.FailNext(1, http.StatusServiceUnavailable)
+	if allowed, err := az.IsAllowedCtx(context.Background(), cand(0)); !allowed || err != nil || requests() != 2 {
+		t.Fatalf("transient failure: %v, %v after %d requests, want a grant after one retry", allowed, err, requests())
+	}
+	srv.FailNext(1, http.StatusForbidden)
+	if _, err := az.IsAllowedCtx(context.Background(), cand(1)); err == nil || requests() != 3 {
+		t.Fatalf("rejected request: err=%v after %d requests, want no retry", err, requests())
+	}
+	if allowed, _ := az.IsAllowedCtx(context.Background(), cand(1)); !allowed {
+		t.Fatalf("expected grant once spicedb accepts the request")
+	}
+	// Rejections are answers, not outages: they never open the circuit.
+	for _, code := range []int{http.StatusBadRequest, http.StatusForbidden, http.StatusBadRequest} {
+		srv.FailNext(1, code)
+		if _, err := az.IsAllowedCtx(context.Background(), cand(5)); err == nil || errors.Is(err, errCircuitOpen) {
+			t.Fatalf("%d: err=%v, want the rejection itself", code, err)
+		}
+	}
+	if st := az.Availability()["circuit"].(map[string]any); st["state"] != "closed" || st["opens"] != int64(0) {
+		t.Fatalf("4xx responses opened the circuit: %v", st)
+	}
+
+	srv.SetUnavailable(true)
+	for i := 2; i < 4; i++ {
+		if _, err := az.IsAllowedCtx(context.Background(), cand(i)); err == nil {
+			t.Fatalf("expected failure while spicedb is down")
+		}
+	}
+	before := requests()
+	if _, err := az.IsAllowedCtx(context.Background(), cand(4)); !errors.Is(err, errCircuitOpen) || requests() != before {
+		t.Fatalf("open breaker: err=%v, %d requests sent", err, requests()-before)
+	}
+	if st := az.Availability()["circuit"].(map[string]any); st["state"] != "open" || st["opens"] != int64(1) || st["retries"] != int64(5) {
+		t.Fatalf("circuit status = %v", st)
+	}
+
+	srv.SetUnavailable(false)
+	time.Sleep(60 * time.Millisecond)
+	if allowed, err := az.IsAllowedCtx(context.Background(), cand(4)); !allowed || err != nil {
+		t.Fatalf("probe after cooldown = %v, %v", allowed, err)
+	}
+	if st := az.Availability()["circuit"].(map[string]any); st["state"] != "closed" {
+		t.Fatalf("circuit did not close: %v", st)
+	}
+}
+
+func TestSpiceDBSharesConcurrentChecks(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	srv.SetLatency(50 * time.Millisecond)
+	az, err := NewSpiceDB(SpiceDBConfig{Endpoint: srv.URL, Token: "token", Subject: "user:alice"})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer az.Close()
+	c := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !az.IsAllowed(c) {
+				t.Errorf("expected grant")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(srv.Checks()); n != 1 {
+		t.Fatalf("%d check requests for 20 concurrent checks, want 1", n)
+	}
+
+	// A check joining one whose sender gives up sends its own.
+	c.ObjectID = "orders_2"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := az.IsAllowedCtx(ctx, c)
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if allowed, err := az.IsAllowedCtx(context.Background(), c); allowed || err != nil {
+		t.Fatalf("joined check after its sender gave up = %v, %v", allowed, err)
+	}
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("abandoned check: %v", err)
+	}
+	if n := len(srv.Checks()); n != 3 {
+		t.Fatalf("%d check requests, want 3", n)
+	}
+}
+
+func TestSpiceDBRereadsRotatedTokenFile(t *testing.T) {
+	srv := authtest.NewServer("key-1")
+	defer srv.Close()
+	grpcAddr := srv.ServeGRPC()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	path := filepath.Join(t.TempDir(), "token")
+	write := func(token string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, cfg := range []SpiceDBConfig{
+		{Endpoint: srv.URL, TokenFile: path, Subject: "user:alice"},
+		{Endpoint: grpcAddr, TokenFile: path, Subject: "user:alice", Transport: "grpc", Insecure: true},
+	} {
+		srv.SetToken("key-1")
+		write("key-1")
+		az, err := NewSpiceDB(cfg)
+		if err != nil {
+			t.Fatalf("new spicedb auth: %v", err)
+		}
+		if err := az.Ping(); err != nil {
+			t.Fatalf("%s: ping with the first key: %v", cfg.Transport, err)
+		}
+		srv.SetToken("key-2")
+		if err := az.Ping(); err == nil {
+			t.Fatalf("%s: expected the old key to be refused", cfg.Transport)
+		}
+		// A different size guarantees the file looks changed.
+		write("key-22")
+		srv.SetToken("key-22")
+		if err := az.Reload(); err != nil {
+			t.Fatalf("%s: reload: %v", cfg.Transport, err)
+		}
+		if err := az.Ping(); err != nil {
+			t.Fatalf("%s: ping after rotation: %v", cfg.Transport, err)
+		}
+		az.Close()
+	}
+
+	if _, err := NewSpiceDB(SpiceDBConfig{Endpoint: srv.URL, TokenFile: filepath.Join(t.TempDir(), "missing"), Subject: "user:alice"}); err == nil {
+		t.Fatalf("expected a missing token file to fail")
+	}
+}
+
+func TestSpiceDBKubernetesTokenRefreshesBeforeExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	jwt := func(sub string, iat, exp time.Time) string {
+		enc := base64.RawURLEncoding.EncodeToString
+		claims := fmt.Sprintf(`{"sub":%q,"iat":%d,"exp":%d}`, sub, iat.Unix(), exp.Unix())
+		return enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(claims)) + ".sig"
+	}
+	write := func(token string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	mtime := now.Add(-time.Hour)
+	fresh := jwt("a", now.Add(-time.Minute), now.Add(time.Hour))
+	write(fresh, mtime)
+	b, err := newBearerToken("", path, true)
+	if err != nil {
+		t.Fatalf("load token: %v", err)
+	}
+	if b.get() != fresh || !b.expires().Equal(time.Unix(now.Add(time.Hour).Unix(), 0)) {
+		t.Fatalf("token %q expiring %v", b.get(), b.expires())
+	}
+	// Same size and mtime: not re-read while the token is young...
+	next := jwt("b", now.Add(-time.Minute), now.Add(time.Hour))
+	write(next, mtime)
+	if changed, err := b.refresh(); changed || err != nil {
+		t.Fatalf("young token re-read: %v, %v", changed, err)
+	}
+	// ...but re-read once it is past 80% of its lifetime.
+	b.mu.Lock()
+	b.refreshAt = now.Add(-time.Second)
+	b.mu.Unlock()
+	if changed, err := b.refresh(); !changed || err != nil || b.get() != next {
+		t.Fatalf("aging token not re-read: %v, %v", changed, err)
+	}
+
+	write(jwt("c", now.Add(-time.Hour), now.Add(-time.Minute)), now)
+	if _, err := b.refresh(); err == nil || b.get() != next {
+		t.Fatalf("expired token accepted: %v", err)
+	}
+	write("not-a-jwt", now.Add(time.Minute))
+	if _, err := newBearerToken("", path, true); err == nil {
+		t.Fatalf("expected a non-JWT token to be refused")
+	}
+}
+
+func TestSpiceDBBatchUsesCheckBulk(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	grpcAddr := srv.ServeGRPC()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	srv.Grant("metric_row:orders_3", "read", "user:alice")
+
+	for _, cfg := range []SpiceDBConfig{
+		{Endpoint: srv.URL, Token: "token", Subject: "user:alice"},
+		{Endpoint: grpcAddr, Token: "token", Subject: "user:alice", Transport: "grpc", Insecure: true},
+	} {
+		az, err := NewSpiceDB(cfg)
+		if err != nil {
+			t.Fatalf("new spicedb auth: %v", err)
+		}
+		checks, bulks := len(srv.Checks()), srv.BulkChecks()
+		var cands []CandidateKey
+		for i := 0; i < 150; i++ {
+			cands = append(cands, CandidateKey{ObjectType: "metric_row", ObjectID: fmt.Sprintf("orders_%d", i), Permission: "read"})
+		}
+		// The first item fails on its own: it is denied and left uncached.
+		srv.FailNext(1, http.StatusServiceUnavailable)
+		got := az.IsAllowedBatch(cands)
+		if got[0] || !got[1] || got[2] || !got[3] {
+			t.Fatalf("%s: batch decisions = %v", cfg.Transport, got[:4])
+		}
+		if n := srv.BulkChecks() - bulks; n != 2 {
+			t.Fatalf("%s: %d bulk requests for 150 candidates, want 2", cfg.Transport, n)
+		}
+		if az.IsAllowed(cands[0]) || !az.IsAllowed(cands[1]) || az.IsAllowed(cands[2]) {
+			t.Fatalf("%s: decisions changed after the batch", cfg.Transport)
+		}
+		if n := len(srv.Checks()) - checks; n != 151 {
+			t.Fatalf("%s: %d checks, want 150 in bulk and 1 retry of the failed item", cfg.Transport, n)
+		}
+		az.Close()
+	}
+}
+
+func TestSpiceDBReconcileNotifiesOnRevoke(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+
+	az, err := NewSpiceDB(SpiceDBConfig{Endpoint: srv.URL, Token: "token", Subject: "user:alice"})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	notified := 0
+	cancel := az.Subscribe(func() { notified++ })
+	defer cancel()
+	c := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}
+	if !az.IsAllowed(c) {
+		t.Fatalf("expected allowed before revoke")
+	}
+	if az.reconcile() {
+		t.Fatalf("expected no change without relationship updates")
+	}
+	srv.Revoke("metric_row:orders_1", "read", "user:alice")
+	if !az.reconcile() {
+		t.Fatalf("expected reconcile to observe the revoke")
+	}
+	if az.IsAllowed(c) {
+		t.Fatalf("expected denied after reconcile")
+	}
+	az.notify()
+	if notified != 1 {
+		t.Fatalf("expected subscriber notified once, got %d", notified)
+	}
+}
+
+func TestSpiceDBExportEvaluatesUnionPermissionsLocally(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	srv.SetSchema(`
+definition user {}
+
+// Teams nest through member->member.
+definition team {
+	relation member: user | team#member
+}
+
+definition namespace {
+	relation viewer: team#member | user:*
+	relation parent: namespace
+	permission read = viewer + parent->read
+}
+
+definition metric_row {
+	relation viewer: user
+	relation banned: user
+	relation parent_namespace: namespace
+	permission read = viewer + parent_namespace->read
+	permission export = read - banned
+}
+`)
+	srv.Relate("team:eng", "member", "user:alice")
+	srv.Relate("team:data", "member", "team:eng#member")
+	srv.Relate("namespace:acme", "viewer", "team:data#member")
+	srv.Relate("namespace:child", "parent", "namespace:acme")
+	srv.Relate("metric_row:r1", "parent_namespace", "namespace:child")
+	srv.Relate("metric_row:r2", "viewer", "user:bob")
+	srv.Relate("namespace:public", "viewer", "user:*")
+	srv.Relate("metric_row:r3", "parent_namespace", "namespace:public")
+	srv.Grant("metric_row:r1", "export", "user:alice")
+
+	live, err := NewSpiceDB(SpiceDBConfig{Endpoint: srv.URL, Token: "token", Subject: "user:alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	az := NewSpiceDBExport(live, []string{"metric_row"}, time.Minute)
+	if _, err := az.Refresh(); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if srv.Exports() != 3 {
+		t.Fatalf("expected metric_row, namespace, and team exported, got %d exports", srv.Exports())
+	}
+	for id, want := range map[string]bool{"r1": true, "r2": false, "r3": true, "r4": false} {
+		if got := az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"}); got != want {
+			t.Fatalf("read %s = %v, want %v", id, got, want)
+		}
+	}
+	if len(srv.Checks()) != 0 {
+		t.Fatalf("union permissions should not reach the live API: %v", srv.Checks())
+	}
+	if !az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "r1", Permission: "export"}) || len(srv.Checks()) != 1 {
+		t.Fatalf("exclusion permissions should be checked live")
+	}
+
+	srv.Unrelate("team:eng", "member", "user:alice")
+	changed, err := az.Refresh()
+	if err != nil || !changed {
+		t.Fatalf("refresh after revoke: changed=%v err=%v", changed, err)
+	}
+	if az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "r1", Permission: "read"}) {
+		t.Fatalf("expected r1 denied after the team membership was removed")
+	}
+
+	srv.SetUnavailable(true)
+	if _, err := az.Refresh(); err == nil {
+		t.Fatalf("expected refresh error while spicedb is down")
+	}
+	if !az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "r3", Permission: "read"}) {
+		t.Fatalf("a failed export should keep the last snapshot")
+	}
+}
+
+func TestSpiceDBGRPCTransport(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	addr := srv.ServeGRPC()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	srv.SetSchema(`
+definition user {}
+
+definition metric_row {
+	relation viewer: user
+	permission read = viewer
+}
+`)
+	srv.Relate("metric_row:r1", "viewer", "user:alice")
+
+	bad, err := NewSpiceDB(SpiceDBConfig{Endpoint: addr, Token: "wrong", Subject: "user:alice", Transport: "grpc", Insecure: true})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer bad.Close()
+	if err := bad.Ping(); err == nil {
+		t.Fatalf("expected ping with a wrong token to fail")
+	}
+
+	live, err := NewSpiceDB(SpiceDBConfig{Endpoint: "grpc://" + addr, Token: "token", Subject: "user:alice", Transport: "grpc", Insecure: true})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer live.Close()
+	if err := live.Ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if !live.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}) {
+		t.Fatalf("expected granted row allowed over grpc")
+	}
+	if live.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}) {
+		t.Fatalf("expected ungranted row denied over grpc")
+	}
+	if got := srv.Checks(); len(got) != 2 || got[0].Subject != "user:alice" {
+		t.Fatalf("checks = %+v", got)
+	}
+
+	az := NewSpiceDBExport(live, []string{"metric_row"}, time.Minute)
+	if _, err := az.Refresh(); err != nil {
+		t.Fatalf("refresh over grpc: %v", err)
+	}
+	if !az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "r1", Permission: "read"}) || len(srv.Checks()) != 2 {
+		t.Fatalf("expected r1 allowed from the grpc export without a live check")
+	}
+
+	srv.SetUnavailable(true)
+	if live.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_3", Permission: "read"}) {
+		t.Fatalf("expected fail-closed deny while spicedb is unavailable")
+	}
+}
+
+func TestSpiceDBLookupAnswersFromLookedUpSets(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	grpcAddr := srv.ServeGRPC()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	srv.Grant("metric_row:orders_3", "read", "user:alice")
+	srv.Grant("metric_row:orders_2", "read", "user:bob")
+	srv.Grant("metric_row:orders_2", "export", "user:alice")
+
+	for _, cfg := range []SpiceDBConfig{
+		{Endpoint: srv.URL, Token: "token", Subject: "user:alice"},
+		{Endpoint: grpcAddr, Token: "token", Subject: "user:alice", Transport: "grpc", Insecure: true},
+	} {
+		live, err := NewSpiceDB(cfg)
+		if err != nil {
+			t.Fatalf("new spicedb auth: %v", err)
+		}
+		az := NewSpiceDBLookup(live, []TypePermission{{ObjectType: "metric_row", Permission: "read"}})
+		checks := len(srv.Checks())
+		if !az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "export"}) {
+			t.Fatalf("%s: expected a live check before the first lookup", cfg.Transport)
+		}
+		if _, err := az.Refresh(); err != nil {
+			t.Fatalf("%s: refresh: %v", cfg.Transport, err)
+		}
+		for id, want := range map[string]bool{"orders_1": true, "orders_2": false, "orders_3": true, "orders_4": false} {
+			if got := az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"}); got != want {
+				t.Fatalf("%s: %s allowed = %v, want %v", cfg.Transport, id, got, want)
+			}
+		}
+		if n := len(srv.Checks()) - checks; n != 1 {
+			t.Fatalf("%s: %d live checks, want only the one before the lookup", cfg.Transport, n)
+		}
+
+		changed := make(chan struct{}, 1)
+		cancel := az.Subscribe(func() { changed <- struct{}{} })
+		srv.Revoke("metric_row:orders_3", "read", "user:alice")
+		if err := az.Reload(); err != nil {
+			t.Fatalf("%s: reload: %v", cfg.Transport, err)
+		}
+		select {
+		case <-changed:
+		default:
+			t.Fatalf("%s: expected a notification after the lookup changed", cfg.Transport)
+		}
+		if az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_3", Permission: "read"}) {
+			t.Fatalf("%s: expected revoked row denied after reload", cfg.Transport)
+		}
+		cancel()
+		srv.Grant("metric_row:orders_3", "read", "user:alice")
+		az.Close()
+	}
+	if n := srv.Lookups(); n != 4 {
+		t.Fatalf("lookups = %d, want 4", n)
+	}
+}
+
+func TestSpiceDBCheckCacheExpiresAndEvicts(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newCheckCache[CandidateKey](time.Minute, 10*time.Second, 2)
+	c.now = func() time.Time { return now }
+	a := CandidateKey{ObjectType: "metric_row", ObjectID: "a", Permission: "read"}
+	b := CandidateKey{ObjectType: "metric_row", ObjectID: "b", Permission: "read"}
+	d := CandidateKey{ObjectType: "metric_row", ObjectID: "d", Permission: "read"}
+	c.put(a, true)
+	c.put(b, false)
+	now = now.Add(10 * time.Second)
+	if _, ok := c.get(b); ok {
+		t.Fatalf("denied result should expire after the negative ttl")
+	}
+	if allowed, ok := c.get(a); !ok || !allowed {
+		t.Fatalf("allowed result should outlive the negative ttl")
+	}
+	if c.update(b, true) {
+		t.Fatalf("update must not revive an evicted result")
+	}
+
+	c.put(b, true)
+	c.get(a)
+	c.put(d, true)
+	if _, ok := c.get(b); ok || c.len() != 2 {
+		t.Fatalf("least recently used result should be evicted past max entries, len=%d", c.len())
+	}
+
+	now = now.Add(50 * time.Second)
+	c.evictExpired()
+	if _, ok := c.items[d]; !ok || c.len() != 1 {
+		t.Fatalf("evictExpired should drop a and keep d, len=%d", c.len())
+	}
+
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	az, err := NewSpiceDB(SpiceDBConfig{Endpoint: srv.URL, Token: "token", Subject: "user:alice", NegativeCacheTTL: time.Millisecond})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer az.Close()
+	k := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}
+	if az.IsAllowed(k) {
+		t.Fatalf("expected deny before the grant")
+	}
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	time.Sleep(5 * time.Millisecond)
+	if !az.IsAllowed(k) {
+		t.Fatalf("expected the grant to be seen once the denial expired")
+	}
+}
+
+func TestSpiceDBAtLeastAsFreshPersistsZedToken(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	path := filepath.Join(t.TempDir(), "index", "spicedb.zedtoken")
+	cfg := SpiceDBConfig{Endpoint: srv.URL, Token: "token", Subject: "user:alice", Consistency: "at_least_as_fresh", ZedTokenFile: path}
+	c := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}
+
+	az, err := NewSpiceDB(cfg)
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	if !az.IsAllowed(c) {
+		t.Fatalf("expected allowed")
+	}
+	if got := srv.FreshTokens(); len(got) != 0 {
+		t.Fatalf("expected a fully consistent first check without a token, sent %v", got)
+	}
+	first := srv.ZedToken()
+	srv.Grant("metric_row:orders_2", "read", "user:alice")
+	if !az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}) {
+		t.Fatalf("expected allowed")
+	}
+	if got := srv.FreshTokens(); !slices.Equal(got, []string{first}) {
+		t.Fatalf("expected the observed token %q sent, got %v", first, got)
+	}
+	az.Close()
+	b, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(b)) != srv.ZedToken() {
+		t.Fatalf("expected close to persist %q, got %q (%v)", srv.ZedToken(), b, err)
+	}
+
+	az, err = NewSpiceDB(cfg)
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer az.Close()
+	notified := 0
+	cancel := az.Subscribe(func() { notified++ })
+	defer cancel()
+	if !az.IsAllowed(c) {
+		t.Fatalf("expected allowed")
+	}
+	if got := srv.FreshTokens(); got[len(got)-1] != srv.ZedToken() {
+		t.Fatalf("expected the persisted token sent after restart, got %v", got)
+	}
+
+	srv.Revoke("metric_row:orders_1", "read", "user:alice")
+	if err := os.WriteFile(path, []byte(srv.ZedToken()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := az.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if az.IsAllowed(c) || notified != 1 {
+		t.Fatalf("expected reload of a newer token to re-check and notify, notified %d", notified)
+	}
+	if got := srv.FreshTokens(); got[len(got)-1] != srv.ZedToken() {
+		t.Fatalf("expected the written token sent on re-check, got %v", got)
+	}
+}
+
+func TestRevocationReachesThroughMountStack(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	backend, err := NewSpiceDB(SpiceDBConfig{
+		Endpoint: srv.URL, Token: "token", Subject: "user:alice",
+		CacheTTL: time.Minute, NegativeCacheTTL: 10 * time.Second, CacheMaxEntries: 100,
+	})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer backend.Close()
+	decisions := NewDecisionCache(time.Minute, 10*time.Second, 100)
+	defer decisions.Close()
+	now := time.Now()
+	clock := func() time.Time { return now }
+	backend.cache.now, decisions.cache.now = clock, clock
+	ts, _ := NewTombstones("", "")
+	p := filepath.Join(t.TempDir(), "overrides.json")
+	if err := os.WriteFile(p, []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := NewOverrides(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overrides.Close()
+	az := overrides.Wrap(ts.Wrap(decisions.Wrap("user:alice", backend)))
+
+	granted := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}
+	denied := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}
+	if !az.IsAllowed(granted) || az.IsAllowed(denied) {
+		t.Fatalf("expected orders_1 allowed and orders_2 denied")
+	}
+	srv.Revoke("metric_row:orders_1", "read", "user:alice")
+	srv.Grant("metric_row:orders_2", "read", "user:alice")
+	if !az.IsAllowed(granted) || az.IsAllowed(denied) {
+		t.Fatalf("expected cached decisions within both ttls")
+	}
+	now = now.Add(11 * time.Second)
+	if got := isAllowedBatch(az, []CandidateKey{granted, denied}); !slices.Equal(got, []bool{true, true}) {
+		t.Fatalf("expected the new grant past the negative ttl and the old grant still cached, got %v", got)
+	}
+	now = now.Add(time.Minute)
+	if az.IsAllowed(granted) {
+		t.Fatalf("expected the revocation visible past the positive ttl")
+	}
+}
+
+func TestSpiceDBServeStaleWithinTTL(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	srv.Grant("metric_row:orders_1", "read", "user:alice")
+	az, err := NewSpiceDB(SpiceDBConfig{
+		Endpoint: srv.URL, Token: "token", Subject: "user:alice",
+		CacheTTL: time.Minute, NegativeCacheTTL: time.Minute,
+		OnUnavailable: "serve_stale", StaleTTL: 10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("new spicedb auth: %v", err)
+	}
+	defer az.Close()
+	now := time.Now()
+	az.cache.now = func() time.Time { return now }
+	granted := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}
+	denied := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_2", Permission: "read"}
+	unseen := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_3", Permission: "read"}
+	if !az.IsAllowed(granted) || az.IsAllowed(denied) {
+		t.Fatalf("expected live decisions while spicedb is up")
+	}
+
+	now = now.Add(2 * time.Minute)
+	srv.SetUnavailable(true)
+	if !az.IsAllowed(granted) {
+		t.Fatalf("expected the expired grant served stale")
+	}
+	if got := az.IsAllowedBatch([]CandidateKey{granted, denied, unseen}); !slices.Equal(got, []bool{true, false, false}) {
+		t.Fatalf("expected stale results and a deny for the unseen candidate, got %v", got)
+	}
+	st := az.Availability()
+	if st["unavailable"] != true || st["stale_decisions"] != int64(3) || st["denied_unavailable"] != int64(1) {
+		t.Fatalf("unexpected availability %v", st)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if az.IsAllowed(granted) {
+		t.Fatalf("expected deny once the result is older than the stale ttl")
+	}
+	srv.SetUnavailable(false)
+	if !az.IsAllowed(granted) || az.Availability()["unavailable"] != false {
+		t.Fatalf("expected live checks to resume, got %v", az.Availability())
+	}
+}
+
+func TestSpiceDBSendsCaveatContext(t *testing.T) {
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	addr := srv.ServeGRPC()
+	srv.GrantWithCaveat("metric_row:orders_1", "read", "user:alice", func(ctx map[string]any) bool {
+		return ctx["tenant"] == "acme" && ctx["ip"] == "10.0.0.1"
+	})
+	for _, cfg := range []SpiceDBConfig{
+		{Endpoint: srv.URL, Token: "token", Subject: "user:alice"},
+		{Endpoint: addr, Token: "token", Subject: "user:alice", Transport: "grpc", Insecure: true},
+	} {
+		cfg.CaveatContext = map[string]any{"tenant": "acme", "ip": "0.0.0.0"}
+		az, err := NewSpiceDB(cfg)
+		if err != nil {
+			t.Fatalf("new spicedb auth: %v", err)
+		}
+		inside := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read", Context: `{"ip":"10.0.0.1"}`}
+		outside := CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read", Context: `{"ip":"192.0.2.1"}`}
+		if !az.IsAllowed(inside) || az.IsAllowed(outside) {
+			t.Fatalf("%s: expected the row context, over the static one, to decide the caveat", cfg.Transport)
+		}
+		if got := az.IsAllowedBatch([]CandidateKey{outside, inside}); !slices.Equal(got, []bool{false, true}) {
+			t.Fatalf("%s: expected bulk checks to carry the context, got %v", cfg.Transport, got)
+		}
+		if az.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}) {
+			t.Fatalf("%s: expected the static context alone not to satisfy the caveat", cfg.Transport)
+		}
+		az.Close()
+	}
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const SQLiteSchema = `CREATE TABLE IF NOT EXISTS allow (
+	object_type TEXT NOT NULL,
+	object_id   TEXT NOT NULL,
+	permission  TEXT NOT NULL DEFAULT 'read',
+	subject     TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS allow_lookup ON allow (object_type, object_id, permission, subject);`
+
+const sqliteCheck = `SELECT 1 FROM allow WHERE object_type = ? AND object_id = ? AND permission = ? AND subject IN (?, '') LIMIT 1`
+
+type SQLiteAuthorizer struct {
+	notifier
+	stopper
+
+	path    string
+	subject string
+
+	mu      sync.RWMutex
+	db      *sql.DB
+	check   *sql.Stmt
+	modTime time.Time
+	size    int64
+}
+
+func NewSQLite(path, subject string) (*SQLiteAuthorizer, error) {
+	if path == "" {
+		return nil, fmt.Errorf("--auth-db is required")
+	}
+	a := &SQLiteAuthorizer{path: path, subject: strings.TrimSpace(subject)}
+	if _, err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *SQLiteAuthorizer) IsAllowed(c CandidateKey) bool {
+	allowed, _ := a.IsAllowedCtx(context.Background(), c)
+	return allowed
+}
+
+func (a *SQLiteAuthorizer) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var one int
+	err := a.check.QueryRowContext(ctx, c.ObjectType, c.ObjectID, c.Permission, a.subject).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (a *SQLiteAuthorizer) StartReconcile(interval time.Duration) {
+	a.loop(interval, func() {
+		if changed, err := a.open(); err == nil && changed {
+			a.notify()
+		}
+	})
+}
+
+func (a *SQLiteAuthorizer) Reload() error {
+	a.mu.Lock()
+	a.size = -1
+	a.mu.Unlock()
+	changed, err := a.open()
+	if err == nil && changed {
+		a.notify()
+	}
+	return err
+}
+
+func (a *SQLiteAuthorizer) Ping() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return probe(a.check, a.subject)
+}
+
+func probe(check *sql.Stmt, subject string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	var one int
+	err := check.QueryRowContext(ctx, "", "", "", subject).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+func (a *SQLiteAuthorizer) Close() error {
+	a.stop()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.db.Close()
+}
+
+func (a *SQLiteAuthorizer) open() (bool, error) {
+	st, err := os.Stat(a.path)
+	if err != nil {
+		return false, err
+	}
+	a.mu.RLock()
+	same := a.db != nil && st.Size() == a.size && st.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	db, err := sql.Open("sqlite", "file:"+a.path+"?mode=ro")
+	if err != nil {
+		return false, err
+	}
+	check, err := db.Prepare(sqliteCheck)
+	if err == nil {
+		err = probe(check, a.subject)
+	}
+	if err != nil {
+		db.Close()
+		return false, fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.mu.Lock()
+	old := a.db
+	a.db, a.check, a.modTime, a.size = db, check, st.ModTime(), st.Size()
+	a.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return old != nil, nil
+}
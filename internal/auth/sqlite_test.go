@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeAllowDB(t *testing.T, path string, rows ...[4]string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(SQLiteSchema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	for _, r := range rows {
+		if _, err := db.Exec(`INSERT INTO allow (object_type, object_id, permission, subject) VALUES (?, ?, ?, ?)`, r[0], r[1], r[2], r[3]); err != nil {
+			t.Fatalf("insert %v: %v", r, err)
+		}
+	}
+}
+
+func TestSQLiteAuthorizerQueriesAllowTable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "grants.db")
+	writeAllowDB(t, path,
+		[4]string{"metric_row", "orders_1", "read", "user:alice"},
+		[4]string{"metric_row", "orders_2", "read", "user:bob"},
+		[4]string{"metric_row", "public", "read", ""},
+	)
+	a, err := NewSQLite(path, "user:alice")
+	if err != nil {
+		t.Fatalf("open sqlite auth: %v", err)
+	}
+	defer a.Close()
+	if err := a.Ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	for id, want := range map[string]bool{"orders_1": true, "orders_2": false, "public": true, "orders_3": false} {
+		if got := a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: id, Permission: "read"}); got != want {
+			t.Fatalf("%s: got %v, want %v", id, got, want)
+		}
+	}
+
+	notified := 0
+	cancel := a.Subscribe(func() { notified++ })
+	defer cancel()
+	next := filepath.Join(dir, "next.db")
+	writeAllowDB(t, next, [4]string{"metric_row", "orders_3", "read", "user:alice"})
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if notified != 1 || a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_1", Permission: "read"}) ||
+		!a.IsAllowed(CandidateKey{ObjectType: "metric_row", ObjectID: "orders_3", Permission: "read"}) {
+		t.Fatalf("expected the replaced database to be reopened and subscribers notified, notified %d", notified)
+	}
+
+	empty := filepath.Join(dir, "empty.db")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSQLite(empty, "user:alice"); err == nil {
+		t.Fatalf("expected a database without the allow table to be rejected")
+	}
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync/atomic"
+)
+
+type Suppressor interface {
+	Suppressed(CandidateKey) bool
+	RowSuppressed()
+}
+
+type objectKey struct {
+	objectType string
+	objectID   string
+}
+
+type Tombstones struct {
+	ids        map[objectKey]struct{}
+	permission string
+	suppressed atomic.Uint64
+}
+
+type tombstonesDoc struct {
+	Suppress []CandidateKey `json:"suppress"`
+}
+
+func NewTombstones(path, permission string) (*Tombstones, error) {
+	t := &Tombstones{ids: map[objectKey]struct{}{}, permission: permission}
+	if path == "" {
+		return t, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc tombstonesDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	for _, k := range doc.Suppress {
+		t.ids[objectKey{k.ObjectType, k.ObjectID}] = struct{}{}
+	}
+	return t, nil
+}
+
+func (t *Tombstones) Len() int { return len(t.ids) }
+
+func (t *Tombstones) SuppressedRows() uint64 { return t.suppressed.Load() }
+
+func (t *Tombstones) Wrap(az Authorizer) Authorizer {
+	return &tombstoneAuthorizer{forwarder: forwarder{az}, t: t}
+}
+
+type tombstoneAuthorizer struct {
+	forwarder
+	t *Tombstones
+}
+
+func (a *tombstoneAuthorizer) Suppressed(c CandidateKey) bool {
+	if _, ok := a.t.ids[objectKey{c.ObjectType, c.ObjectID}]; ok {
+		return true
+	}
+	if a.t.permission == "" {
+		return false
+	}
+	return a.Authorizer.IsAllowed(CandidateKey{ObjectType: c.ObjectType, ObjectID: c.ObjectID, Permission: a.t.permission})
+}
+
+func (a *tombstoneAuthorizer) IsAllowedCtx(ctx context.Context, c CandidateKey) (bool, error) {
+	return IsAllowedCtx(ctx, a.Authorizer, c)
+}
+
+func (a *tombstoneAuthorizer) IsAllowedBatch(cands []CandidateKey) []bool {
+	return isAllowedBatch(a.Authorizer, cands)
+}
+
+func (a *tombstoneAuthorizer) IsAllowedBatchCtx(ctx context.Context, cands []CandidateKey) ([]bool, error) {
+	return isAllowedBatchCtx(ctx, a.Authorizer, cands)
+}
+
+func (a *tombstoneAuthorizer) RowSuppressed() { a.t.suppressed.Add(1) }
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/henneberger/metrics-fs/pkg/enums"
+)
+
+type AvailabilityReporter interface {
+	Availability() map[string]any
+}
+
+func Availability(az Authorizer) map[string]any {
+	if r, ok := az.(AvailabilityReporter); ok {
+		return r.Availability()
+	}
+	return nil
+}
+
+type availability struct {
+	mode     enums.UnavailableMode
+	staleTTL time.Duration
+
+	mu       sync.Mutex
+	since    time.Time
+	lastErr  error
+	failures int64
+	stale    int64
+	denied   int64
+}
+
+func (v *availability) observe(err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err == nil {
+		v.since = time.Time{}
+		return
+	}
+	if v.since.IsZero() {
+		v.since = time.Now()
+	}
+	v.lastErr = err
+	v.failures++
+}
+
+func (v *availability) servesStale() bool {
+	return v.mode == enums.UnavailableServeStale && v.staleTTL > 0
+}
+
+func (v *availability) decided(stale bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if stale {
+		v.stale++
+	} else {
+		v.denied++
+	}
+}
+
+func (v *availability) status() map[string]any {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	st := map[string]any{
+		"mode":               string(v.mode),
+		"stale_ttl":          v.staleTTL.String(),
+		"unavailable":        !v.since.IsZero(),
+		"failed_requests":    v.failures,
+		"stale_decisions":    v.stale,
+		"denied_unavailable": v.denied,
+	}
+	if !v.since.IsZero() {
+		st["unavailable_since"] = v.since
+	}
+	if v.lastErr != nil {
+		st["last_error"] = v.lastErr.Error()
+	}
+	return st
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const zedTokenSaveInterval = time.Second
+
+type zedTokens struct {
+	path string
+
+	mu    sync.Mutex
+	token string
+	saved time.Time
+	dirty bool
+}
+
+func loadZedTokens(path string) (*zedTokens, error) {
+	z := &zedTokens{path: path}
+	_, err := z.reload()
+	return z, err
+}
+
+func (z *zedTokens) get() string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.token
+}
+
+func (z *zedTokens) observe(tok string) {
+	if tok == "" {
+		return
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if tok == z.token {
+		return
+	}
+	z.token, z.dirty = tok, true
+	if time.Since(z.saved) >= zedTokenSaveInterval {
+		_ = z.saveLocked()
+	}
+}
+
+func (z *zedTokens) flush() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.saveLocked()
+}
+
+func (z *zedTokens) reload() (bool, error) {
+	if z.path == "" {
+		return false, nil
+	}
+	b, err := os.ReadFile(z.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	tok := strings.TrimSpace(string(b))
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if tok == "" || tok == z.token {
+		return false, nil
+	}
+	z.token, z.dirty = tok, false
+	return true, nil
+}
+
+func (z *zedTokens) saveLocked() error {
+	if z.path == "" || !z.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(z.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(z.path), ".zedtoken-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(z.token + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), z.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	z.saved, z.dirty = time.Now(), false
+	return nil
+}
@@ -0,0 +1,120 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/projector"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+type Canary struct {
+	Path     string
+	Expected string
+	Webhook  string
+	Interval time.Duration
+
+	cfg    options.Options
+	client *http.Client
+
+	mu     sync.Mutex
+	last   Result
+	drifts uint64
+}
+
+type Result struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Expected string    `json:"expected_sha256"`
+	Actual   string    `json:"actual_sha256,omitempty"`
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func New(path, expected string, cfg options.Options) *Canary {
+	return &Canary{
+		Path:     path,
+		Expected: strings.ToLower(strings.TrimSpace(expected)),
+		cfg:      cfg,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *Canary) Check(az auth.Authorizer) Result {
+	r := Result{Time: time.Now().UTC(), Path: c.Path, Expected: c.Expected}
+	var b bytes.Buffer
+	if err := projector.RenderFiltered(c.Path, c.cfg, az, &b); err != nil {
+		r.Error = err.Error()
+	} else {
+		sum := sha256.Sum256(b.Bytes())
+		r.Actual = hex.EncodeToString(sum[:])
+		r.OK = r.Actual == c.Expected
+	}
+	c.mu.Lock()
+	c.last = r
+	if !r.OK {
+		c.drifts++
+	}
+	c.mu.Unlock()
+	return r
+}
+
+func (c *Canary) Run(ctx context.Context, az auth.Authorizer) {
+	if c.Interval <= 0 {
+		return
+	}
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if r := c.Check(az); !r.OK {
+				c.alert(r)
+			}
+		}
+	}
+}
+
+func (c *Canary) Status() map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]any{"last": c.last, "drifts": c.drifts}
+}
+
+func (r Result) String() string {
+	if r.Error != "" {
+		return fmt.Sprintf("canary %s failed: %s", r.Path, r.Error)
+	}
+	return fmt.Sprintf("canary %s drifted: sha256 %s, expected %s", r.Path, r.Actual, r.Expected)
+}
+
+func (c *Canary) alert(r Result) {
+	fmt.Fprintf(os.Stderr, "metricfs: %s\n", r)
+	c.cfg.Warnings.Add(warnings.KindCanaryDrift, c.Path, 0, "%s", r)
+	if c.Webhook == "" {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Post(c.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		c.cfg.Warnings.Add(warnings.KindCanaryDrift, c.Path, 0, "canary webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,69 @@
+package canary
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+)
+
+func TestCheckAndAlert(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	path := filepath.Join(dir, "canary.jsonl.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	zw := gzip.NewWriter(f)
+	_, _ = zw.Write([]byte("{\"id\":\"a\"}\n"))
+	_ = zw.Close()
+	_ = f.Close()
+
+	got := make(chan Result, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res Result
+		_ = json.NewDecoder(r.Body).Decode(&res)
+		got <- res
+	}))
+	defer srv.Close()
+
+	cfg := options.New(options.WithSourceDir(dir))
+	const emptySHA = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	c := New(path, emptySHA, cfg)
+	if r := c.Check(auth.NewDenyAll()); !r.OK {
+		t.Fatalf("expected empty render to match, got %+v", r)
+	}
+
+	c = New(path, "00", cfg)
+	c.Webhook = srv.URL
+	r := c.Check(auth.NewDenyAll())
+	if r.OK || r.Actual != emptySHA {
+		t.Fatalf("expected drift, got %+v", r)
+	}
+	c.alert(r)
+	if res := <-got; res.Expected != "00" || res.Actual != emptySHA {
+		t.Fatalf("unexpected webhook payload %+v", res)
+	}
+	if c.Status()["drifts"] != uint64(1) {
+		t.Fatalf("expected one drift, got %v", c.Status())
+	}
+}
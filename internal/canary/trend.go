@@ -0,0 +1,182 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+const maxTrendAlerts = 50
+
+type Trend struct {
+	Threshold float64
+	Webhook   string
+	Interval  time.Duration
+
+	cfg    options.Options
+	client *http.Client
+
+	mu      sync.Mutex
+	percent map[string]float64
+	alerts  []Shift
+	shifts  uint64
+	sampled time.Time
+}
+
+type Shift struct {
+	Time        time.Time `json:"time"`
+	Path        string    `json:"path"`
+	Previous    float64   `json:"previous_percent"`
+	Current     float64   `json:"current_percent"`
+	VisibleRows int       `json:"visible_rows"`
+	Rows        int       `json:"rows"`
+}
+
+func NewTrend(threshold float64, cfg options.Options) *Trend {
+	return &Trend{
+		Threshold: threshold,
+		cfg:       cfg,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		percent:   map[string]float64{},
+	}
+}
+
+func (t *Trend) Sample(az auth.Authorizer) ([]Shift, error) {
+	now := time.Now().UTC()
+	cur := map[string]Shift{}
+	err := filepath.WalkDir(t.cfg.SourceDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if t.cfg.Excluded(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(strings.ToLower(d.Name()), ".jsonl") {
+			return nil
+		}
+		fi, err := indexer.BuildOrLoad(path, t.cfg)
+		if err != nil || fi.Passthrough || len(fi.Lines) == 0 {
+			return nil
+		}
+		s := Shift{Time: now, Path: path, Rows: len(fi.Lines)}
+		memo := indexer.NewFileMemo(fi, az)
+		for _, ln := range fi.Lines {
+			if memo.Visible(ln.Decision, ln.Candidates) {
+				s.VisibleRows++
+			}
+		}
+		s.Current = 100 * float64(s.VisibleRows) / float64(s.Rows)
+		cur[path] = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []Shift
+	for path, s := range cur {
+		prev, ok := t.percent[path]
+		t.percent[path] = s.Current
+		if !ok || math.Abs(s.Current-prev) < t.Threshold {
+			continue
+		}
+		s.Previous = prev
+		out = append(out, s)
+	}
+	// Deleted files drop out rather than alerting.
+	for path := range t.percent {
+		if _, ok := cur[path]; !ok {
+			delete(t.percent, path)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	t.shifts += uint64(len(out))
+	t.alerts = append(t.alerts, out...)
+	if len(t.alerts) > maxTrendAlerts {
+		t.alerts = t.alerts[len(t.alerts)-maxTrendAlerts:]
+	}
+	t.sampled = now
+	return out, nil
+}
+
+func (t *Trend) Run(ctx context.Context, az auth.Authorizer) {
+	if t.Interval <= 0 {
+		return
+	}
+	if _, err := t.Sample(az); err != nil {
+		t.cfg.Warnings.Add(warnings.KindVisibilityShift, t.cfg.SourceDir, 0, "visibility sample: %v", err)
+	}
+	tk := time.NewTicker(t.Interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tk.C:
+			shifts, err := t.Sample(az)
+			if err != nil {
+				t.cfg.Warnings.Add(warnings.KindVisibilityShift, t.cfg.SourceDir, 0, "visibility sample: %v", err)
+			}
+			for _, s := range shifts {
+				t.alert(s)
+			}
+		}
+	}
+}
+
+func (t *Trend) Status() map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	files := make(map[string]float64, len(t.percent))
+	for path, p := range t.percent {
+		files[path] = p
+	}
+	return map[string]any{
+		"threshold_percent": t.Threshold,
+		"sampled":           t.sampled,
+		"files":             files,
+		"shifts":            t.shifts,
+		"recent":            append([]Shift{}, t.alerts...),
+	}
+}
+
+func (s Shift) String() string {
+	return fmt.Sprintf("visibility of %s moved from %.1f%% to %.1f%% (%d of %d rows)", s.Path, s.Previous, s.Current, s.VisibleRows, s.Rows)
+}
+
+func (t *Trend) alert(s Shift) {
+	fmt.Fprintf(os.Stderr, "metricfs: %s\n", s)
+	t.cfg.Warnings.Add(warnings.KindVisibilityShift, s.Path, 0, "%s", s)
+	if t.Webhook == "" {
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	resp, err := t.client.Post(t.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.cfg.Warnings.Add(warnings.KindVisibilityShift, s.Path, 0, "visibility webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
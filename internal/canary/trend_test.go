@@ -0,0 +1,65 @@
+package canary
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+)
+
+func TestTrendReportsVisibilityShifts(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		".metricfs-map.yaml": "version: 1\nrules:\n  - match:\n      glob: \"*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n",
+		"rows.jsonl":         "{\"id\":\"a\"}\n{\"id\":\"b\"}\n{\"id\":\"c\"}\n{\"id\":\"d\"}\n",
+		"other.jsonl":        "{\"id\":\"a\"}\n{\"id\":\"z\"}\n",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allow := func(ids ...string) auth.Authorizer {
+		body := `{"allow":[`
+		for i, id := range ids {
+			if i > 0 {
+				body += ","
+			}
+			body += `{"object_type":"metric_row","object_id":"` + id + `","permission":"read"}`
+		}
+		perm := filepath.Join(dir, "perm.json")
+		if err := os.WriteFile(perm, []byte(body+`]}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		az, err := auth.NewFromPermissionsFile(perm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return az
+	}
+	cfg := options.New(options.WithSourceDir(src), options.WithIndex(filepath.Join(dir, "idx"), 1))
+	tr := NewTrend(30, cfg)
+	if shifts, err := tr.Sample(allow("a", "b")); err != nil || len(shifts) != 0 {
+		t.Fatalf("baseline: %v %v", shifts, err)
+	}
+	// rows.jsonl: 50% -> 100%; other.jsonl stays at 50%.
+	shifts, err := tr.Sample(allow("a", "b", "c", "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shifts) != 1 || shifts[0].Path != filepath.Join(src, "rows.jsonl") || shifts[0].Previous != 50 || shifts[0].Current != 100 || shifts[0].VisibleRows != 4 {
+		t.Fatalf("shifts %+v", shifts)
+	}
+	if shifts, err := tr.Sample(allow("a", "b", "c")); err != nil || len(shifts) != 0 {
+		t.Fatalf("small move: %v %v", shifts, err)
+	}
+	if tr.Status()["shifts"] != uint64(1) {
+		t.Fatalf("status %v", tr.Status())
+	}
+}
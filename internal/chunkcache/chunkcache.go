@@ -0,0 +1,106 @@
+package chunkcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+type Key struct {
+	Path  string
+	Size  int64
+	MTime int64
+	Start int64
+	End   int64
+}
+
+type Stats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	BytesSaved uint64 `json:"bytes_saved"`
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	MaxBytes   int64  `json:"max_bytes"`
+}
+
+type entry struct {
+	key  Key
+	data []byte
+}
+
+// A nil *Cache is valid and caches nothing.
+type Cache struct {
+	mu    sync.Mutex
+	max   int64
+	ll    *list.List
+	items map[Key]*list.Element
+	stats Stats
+}
+
+func New(maxBytes int64) *Cache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &Cache{max: maxBytes, ll: list.New(), items: map[Key]*list.Element{}}
+}
+
+// Callers must not modify the result.
+func (c *Cache) Get(k Key) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	data := el.Value.(*entry).data
+	c.stats.Hits++
+	c.stats.BytesSaved += uint64(len(data))
+	return data, true
+}
+
+func (c *Cache) Put(k Key, data []byte) {
+	if c == nil || int64(len(data)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[k]; ok {
+		return
+	}
+	c.items[k] = c.ll.PushFront(&entry{key: k, data: data})
+	c.stats.Bytes += int64(len(data))
+	for c.stats.Bytes > c.max {
+		oldest := c.ll.Back()
+		e := oldest.Value.(*entry)
+		c.ll.Remove(oldest)
+		delete(c.items, e.key)
+		c.stats.Bytes -= int64(len(e.data))
+	}
+}
+
+func (c *Cache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = map[Key]*list.Element{}
+	c.stats.Bytes = 0
+}
+
+func (c *Cache) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.items)
+	s.MaxBytes = c.max
+	return s
+}
@@ -0,0 +1,37 @@
+package chunkcache
+
+import "testing"
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(10)
+	a := Key{Path: "f", Start: 0, End: 4}
+	b := Key{Path: "f", Start: 4, End: 8}
+	d := Key{Path: "f", Start: 8, End: 12}
+	c.Put(a, []byte("aaaa"))
+	c.Put(b, []byte("bbbb"))
+	if _, ok := c.Get(a); !ok {
+		t.Fatalf("expected a cached")
+	}
+	c.Put(d, []byte("dddd"))
+	if _, ok := c.Get(b); ok {
+		t.Fatalf("expected b evicted as least recently used")
+	}
+	if got, ok := c.Get(d); !ok || string(got) != "dddd" {
+		t.Fatalf("expected d cached, got %q %v", got, ok)
+	}
+	s := c.Stats()
+	if s.Hits != 2 || s.Misses != 1 || s.BytesSaved != 8 || s.Bytes != 8 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
+
+func TestNilCacheIsNoop(t *testing.T) {
+	var c *Cache
+	c.Put(Key{}, []byte("x"))
+	if _, ok := c.Get(Key{}); ok {
+		t.Fatalf("nil cache should never hit")
+	}
+	if New(0) != nil {
+		t.Fatalf("zero size should disable the cache")
+	}
+}
@@ -0,0 +1,144 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Split must return every byte of r in some record, framing included.
+type RecordCodec interface {
+	Split(r io.Reader) Records
+	Decode(record []byte) ([]byte, error)
+}
+
+type Records interface {
+	Next() ([]byte, error)
+}
+
+const (
+	JSONL              = "jsonl"
+	LengthPrefixedJSON = "length_prefixed_json"
+	SyslogJSON         = "syslog_json"
+)
+
+const MaxRecordBytes = 64 << 20
+
+var (
+	mu     sync.RWMutex
+	codecs = map[string]RecordCodec{
+		JSONL:              lines{decode: trimNewline},
+		LengthPrefixedJSON: lengthPrefixed{},
+		SyslogJSON:         lines{decode: syslogPayload},
+	}
+)
+
+func Register(name string, c RecordCodec) {
+	mu.Lock()
+	defer mu.Unlock()
+	codecs[name] = c
+}
+
+func Lookup(name string) (RecordCodec, error) {
+	if name == "" {
+		name = JSONL
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		names := make([]string, 0, len(codecs))
+		for n := range codecs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown codec %q, registered: %v", name, names)
+	}
+	return c, nil
+}
+
+func Default() RecordCodec {
+	c, _ := Lookup(JSONL)
+	return c
+}
+
+type lines struct {
+	decode func([]byte) ([]byte, error)
+}
+
+func (l lines) Split(r io.Reader) Records {
+	return lineRecords{bufio.NewReaderSize(r, 1<<20)}
+}
+
+func (l lines) Decode(record []byte) ([]byte, error) {
+	return l.decode(record)
+}
+
+type lineRecords struct {
+	br *bufio.Reader
+}
+
+func (r lineRecords) Next() ([]byte, error) {
+	line, err := r.br.ReadBytes('\n')
+	if len(line) > 0 && (err == nil || err == io.EOF) {
+		return line, nil
+	}
+	return nil, err
+}
+
+func trimNewline(record []byte) ([]byte, error) {
+	return bytes.TrimRight(record, "\r\n"), nil
+}
+
+func syslogPayload(record []byte) ([]byte, error) {
+	record = bytes.TrimRight(record, "\r\n")
+	i := bytes.IndexByte(record, '{')
+	if i < 0 {
+		return nil, errors.New("syslog record carries no JSON object")
+	}
+	return record[i:], nil
+}
+
+type lengthPrefixed struct{}
+
+func (lengthPrefixed) Split(r io.Reader) Records {
+	return &prefixedRecords{br: bufio.NewReaderSize(r, 1<<20)}
+}
+
+func (lengthPrefixed) Decode(record []byte) ([]byte, error) {
+	if len(record) < 4 || uint64(binary.BigEndian.Uint32(record)) != uint64(len(record)-4) {
+		return nil, errors.New("truncated length-prefixed record")
+	}
+	return record[4:], nil
+}
+
+type prefixedRecords struct {
+	br *bufio.Reader
+}
+
+func (r *prefixedRecords) Next() ([]byte, error) {
+	head := make([]byte, 4)
+	n, err := io.ReadFull(r.br, head)
+	if n == 0 {
+		return nil, err
+	}
+	if err != nil {
+		return head[:n], nil
+	}
+	size := binary.BigEndian.Uint32(head)
+	if size > MaxRecordBytes {
+		return nil, fmt.Errorf("length-prefixed record of %d bytes exceeds %d", size, MaxRecordBytes)
+	}
+	rec := make([]byte, 4+int(size))
+	copy(rec, head)
+	m, err := io.ReadFull(r.br, rec[4:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return rec[:4+m], nil
+}
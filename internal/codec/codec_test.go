@@ -0,0 +1,39 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSyslogJSONSplitsLinesAndStripsHeader(t *testing.T) {
+	c, err := Lookup(SyslogJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := "<34>1 2024-01-01T00:00:00Z host app - - - {\"id\":\"a\"}\nno payload\n"
+	recs := c.Split(bytes.NewReader([]byte(in)))
+	var got []string
+	for {
+		rec, err := recs.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(rec))
+	}
+	if len(got) != 2 || got[0]+got[1] != in {
+		t.Fatalf("records %q", got)
+	}
+	if doc, err := c.Decode([]byte(got[0])); err != nil || string(doc) != `{"id":"a"}` {
+		t.Fatalf("decode %q %v", doc, err)
+	}
+	if _, err := c.Decode([]byte(got[1])); err == nil {
+		t.Fatal("expected an error for a line without JSON")
+	}
+	if _, err := Lookup("nope"); err == nil {
+		t.Fatal("expected unknown codec error")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build faults
+// +build faults
+
+package faults
+
+import (
+	"fmt"
+	"os"
+)
+
+func init() {
+	spec := os.Getenv("METRICFS_FAULTS")
+	if spec == "" {
+		return
+	}
+	parsed, err := Parse(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "metricfs: ignoring METRICFS_FAULTS: %v\n", err)
+		return
+	}
+	for point, f := range parsed {
+		Set(point, f)
+	}
+}
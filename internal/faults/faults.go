@@ -0,0 +1,128 @@
+package faults
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SpiceDBCheck = "spicedb.check"
+	SourceRead   = "source.read"
+	IndexLoad    = "index.load"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+type Fault struct {
+	Latency   time.Duration
+	ErrorRate float64
+	Err       error
+	Corrupt   bool
+}
+
+var (
+	active   atomic.Bool
+	mu       sync.RWMutex
+	registry = map[string]Fault{}
+)
+
+func Set(point string, f Fault) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[point] = f
+	active.Store(true)
+}
+
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	registry = map[string]Fault{}
+	active.Store(false)
+}
+
+func lookup(point string) (Fault, bool) {
+	if !active.Load() {
+		return Fault{}, false
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	f, ok := registry[point]
+	return f, ok
+}
+
+func Inject(point string) error {
+	f, ok := lookup(point)
+	if !ok {
+		return nil
+	}
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	if f.ErrorRate > 0 || f.Err != nil {
+		if f.ErrorRate == 0 || rand.Float64() < f.ErrorRate {
+			err := f.Err
+			if err == nil {
+				err = ErrInjected
+			}
+			return fmt.Errorf("%s: %w", point, err)
+		}
+	}
+	return nil
+}
+
+func Corrupt(point string, b []byte) []byte {
+	f, ok := lookup(point)
+	if !ok || !f.Corrupt || len(b) == 0 {
+		return b
+	}
+	out := append([]byte(nil), b...)
+	return out[:len(out)/2]
+}
+
+func Parse(spec string) (map[string]Fault, error) {
+	out := map[string]Fault{}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		point, directives, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q, expected point=directives", part)
+		}
+		var f Fault
+		for _, d := range strings.Split(directives, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(d), ":")
+			switch name {
+			case "latency":
+				dur, err := time.ParseDuration(val)
+				if err != nil {
+					return nil, fmt.Errorf("invalid latency in %q: %w", part, err)
+				}
+				f.Latency = dur
+			case "error":
+				rate := 1.0
+				if val != "" {
+					r, err := strconv.ParseFloat(val, 64)
+					if err != nil || r < 0 || r > 1 {
+						return nil, fmt.Errorf("invalid error rate in %q", part)
+					}
+					rate = r
+				}
+				f.ErrorRate = rate
+			case "corrupt":
+				f.Corrupt = true
+			default:
+				return nil, fmt.Errorf("unknown fault directive %q", name)
+			}
+		}
+		out[strings.TrimSpace(point)] = f
+	}
+	return out, nil
+}
@@ -0,0 +1,42 @@
+package faults
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseSpec(t *testing.T) {
+	got, err := Parse("spicedb.check=latency:5ms,error:0.5;index.load=corrupt")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got[SpiceDBCheck].Latency != 5*time.Millisecond || got[SpiceDBCheck].ErrorRate != 0.5 {
+		t.Fatalf("unexpected spicedb fault: %#v", got[SpiceDBCheck])
+	}
+	if !got[IndexLoad].Corrupt {
+		t.Fatalf("expected index corruption fault")
+	}
+	if _, err := Parse("spicedb.check=explode"); err == nil {
+		t.Fatalf("expected unknown directive error")
+	}
+}
+
+func TestInjectAndReset(t *testing.T) {
+	defer Reset()
+	if err := Inject(SourceRead); err != nil {
+		t.Fatalf("no fault registered, got %v", err)
+	}
+	Set(SourceRead, Fault{ErrorRate: 1})
+	if err := Inject(SourceRead); !errors.Is(err, ErrInjected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	Set(IndexLoad, Fault{Corrupt: true})
+	if got := Corrupt(IndexLoad, []byte("{}")); string(got) == "{}" {
+		t.Fatalf("expected corrupted bytes")
+	}
+	Reset()
+	if err := Inject(SourceRead); err != nil {
+		t.Fatalf("expected reset to clear faults, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+const ControlDirName = ".metricfs"
+
+type controlFile func() ([]byte, error)
+
+type controlDirNode struct {
+	fs.Inode
+	readOnlyDir
+	cfg   Config
+	files map[string]controlFile
+}
+
+func newControlDir(cfg Config, src *authSource) *controlDirNode {
+	files := map[string]controlFile{
+		"warnings.jsonl": func() ([]byte, error) {
+			var b bytes.Buffer
+			err := cfg.Warnings.WriteJSONL(&b)
+			return b.Bytes(), err
+		},
+	}
+	if cfg.ChunkCache != nil {
+		files["chunk_cache.json"] = func() ([]byte, error) {
+			b, err := json.Marshal(cfg.ChunkCache.Stats())
+			return append(b, '\n'), err
+		}
+	}
+	if t := src.tombstones; t != nil {
+		files["tombstones.json"] = func() ([]byte, error) {
+			b, err := json.Marshal(map[string]any{
+				"tombstones":      t.Len(),
+				"suppressed_rows": t.SuppressedRows(),
+			})
+			return append(b, '\n'), err
+		}
+	}
+	if o := src.overrides; o != nil {
+		files["overrides.json"] = func() ([]byte, error) {
+			b, err := json.Marshal(o.Status())
+			return append(b, '\n'), err
+		}
+	}
+	if auth.Availability(src.def) != nil {
+		files["authz.json"] = func() ([]byte, error) {
+			b, err := json.Marshal(auth.Availability(src.def))
+			return append(b, '\n'), err
+		}
+	}
+	files["write_rejections.json"] = func() ([]byte, error) {
+		b, err := json.Marshal(writeRejections(src.guard))
+		return append(b, '\n'), err
+	}
+	if c := src.canary; c != nil {
+		files["canary.json"] = func() ([]byte, error) {
+			b, err := json.Marshal(c.Status())
+			return append(b, '\n'), err
+		}
+	}
+	if t := src.trend; t != nil {
+		files["visibility_trend.json"] = func() ([]byte, error) {
+			b, err := json.Marshal(t.Status())
+			return append(b, '\n'), err
+		}
+	}
+	return &controlDirNode{readOnlyDir: readOnlyDir{guard: src.guard, path: ControlDirName}, cfg: cfg, files: files}
+}
+
+func (c *controlDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	gen, ok := c.files[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	data, err := gen()
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	file := &memFileNode{attrs: newAttrs(c.cfg), noCache: c.cfg.NoKernelCache, guard: c.guard, data: data}
+	entryAttr(ctx, file, out)
+	return c.NewInode(ctx, file, fs.StableAttr{Mode: syscall.S_IFREG}), 0
+}
+
+func (c *controlDirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = syscall.S_IFDIR | 0o555
+	out.Uid, out.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+	newAttrs(c.cfg).apply(&out.Attr)
+	return 0
+}
+
+func (c *controlDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		out = append(out, fuse.DirEntry{Name: name, Mode: syscall.S_IFREG})
+	}
+	return fs.NewListDirStream(out), 0
+}
+
+var _ fs.NodeLookuper = (*controlDirNode)(nil)
+var _ fs.NodeReaddirer = (*controlDirNode)(nil)
+var _ fs.NodeGetattrer = (*controlDirNode)(nil)
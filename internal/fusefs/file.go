@@ -0,0 +1,412 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+type memFileNode struct {
+	fs.Inode
+	attrs   attrs
+	noCache bool
+	direct  bool
+	guard   *writeGuard
+	src     *authSource
+	imp     *Impersonation
+	source  string
+	render  func(auth.Authorizer) ([]byte, error)
+	size    func(auth.Authorizer) (int64, error)
+	open    func(auth.Authorizer) (*indexer.VisibleReader, error)
+	append  func(auth.Authorizer, []byte) error
+
+	mu    sync.Mutex
+	data  []byte
+	stale bool
+	sizes map[auth.Authorizer]int64
+}
+
+type fileHandle struct {
+	node     *memFileNode
+	mu       sync.Mutex
+	subject  string
+	base     []byte
+	reader   *indexer.VisibleReader
+	data     []byte
+	writer   auth.Authorizer
+	pending  []byte
+	file     *os.File
+	fileSize int64
+	az       auth.Authorizer
+}
+
+func (h *fileHandle) PassthroughFd() (int, bool) {
+	if h.file == nil {
+		return 0, false
+	}
+	return int(h.file.Fd()), true
+}
+
+func (h *fileHandle) view() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.data != nil {
+		return h.data
+	}
+	return h.base
+}
+
+func (h *fileHandle) streamed() *indexer.VisibleReader {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.data != nil {
+		return nil
+	}
+	return h.reader
+}
+
+func (h *fileHandle) size() int64 {
+	if h.file != nil {
+		return h.fileSize
+	}
+	if r := h.streamed(); r != nil {
+		return r.Size()
+	}
+	return int64(len(h.view()))
+}
+
+func (h *fileHandle) Release(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reader != nil {
+		_ = h.reader.Close()
+		h.reader = nil
+	}
+	if h.file != nil {
+		_ = h.file.Close()
+		h.file = nil
+	}
+	return 0
+}
+
+func (n *memFileNode) current(ctx context.Context) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stale && n.render != nil {
+		data, keep, err := n.renderCtx(ctx, n.src.def)
+		if err != nil || !keep {
+			return data, err
+		}
+		n.data, n.stale = data, false
+	}
+	return n.data, nil
+}
+
+func (n *memFileNode) renderCtx(ctx context.Context, az auth.Authorizer) (data []byte, keep bool, err error) {
+	bound, failure := auth.WithContext(ctx, az)
+	data, err = n.render(bound)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err := failure(); err != nil {
+		n.src.warnings.Add(warnings.KindAuthzFailed, n.source, 0, "authorization checks failed, their rows were withheld: %v", err)
+		return data, false, nil
+	}
+	return data, true, nil
+}
+
+func (n *memFileNode) invalidate() {
+	n.mu.Lock()
+	if !n.src.perCaller() {
+		n.stale = true
+	}
+	n.sizes = nil
+	n.mu.Unlock()
+	_ = n.NotifyContent(0, 0)
+	if name, parent := n.Parent(); parent != nil {
+		_ = parent.NotifyEntry(name)
+	}
+}
+
+func (n *memFileNode) refresh(data []byte, rendered bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if rendered {
+		n.data, n.stale = data, false
+	}
+	n.sizes = nil
+}
+
+func (n *memFileNode) OnForget() {
+	n.src.untrack(n)
+}
+
+func (n *memFileNode) cacheFlag() uint32 {
+	if n.noCache {
+		return fuse.FOPEN_DIRECT_IO
+	}
+	return fuse.FOPEN_KEEP_CACHE
+}
+
+func (n *memFileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if n.render == nil {
+		if errno := n.guard.open(flags, ControlDirName); errno != 0 {
+			return nil, 0, errno
+		}
+		return nil, n.cacheFlag(), 0
+	}
+	h := &fileHandle{node: n}
+	if n.append == nil || flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		if errno := n.guard.open(flags, n.source); errno != 0 {
+			return nil, 0, errno
+		}
+	}
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		if flags&syscall.O_APPEND == 0 || flags&syscall.O_TRUNC != 0 {
+			return nil, 0, syscall.EPERM
+		}
+		az, errno := n.src.forCaller(ctx)
+		if errno != 0 {
+			return nil, 0, errno
+		}
+		h.writer = az
+		if flags&syscall.O_ACCMODE == syscall.O_WRONLY {
+			return h, fuse.FOPEN_DIRECT_IO, 0
+		}
+	}
+	az := n.src.def
+	if n.src.perCaller() {
+		var errno syscall.Errno
+		if az, errno = n.src.forCaller(ctx); errno != 0 {
+			return nil, 0, errno
+		}
+	}
+	h.az = az
+	var err error
+	switch {
+	case n.direct:
+		if h.file, err = os.Open(n.source); err == nil {
+			var st os.FileInfo
+			if st, err = h.file.Stat(); err == nil {
+				h.fileSize = st.Size()
+			} else {
+				_ = h.file.Close()
+			}
+		}
+	case n.open != nil:
+		h.reader, err = n.open(az)
+	case n.src.perCaller():
+		h.base, _, err = n.renderCtx(ctx, az)
+	default:
+		h.base, err = n.current(ctx)
+	}
+	if ctx.Err() != nil {
+		return nil, 0, syscall.EINTR
+	}
+	if err != nil {
+		n.src.warnings.Add(warnings.KindFileSkipped, n.source, 0, "read failed, served as EIO: %v", err)
+		return nil, 0, syscall.EIO
+	}
+	if n.imp == nil && !n.src.perCaller() && h.writer == nil {
+		return h, n.cacheFlag(), 0
+	}
+	// Per-handle views must not be served from the shared page cache.
+	return h, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (n *memFileNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	var data []byte
+	if h, ok := fh.(*fileHandle); ok {
+		if h.file != nil {
+			if off >= h.fileSize {
+				return fuse.ReadResultData(nil), 0
+			}
+			dest = dest[:min(int64(len(dest)), h.fileSize-off)]
+			release := n.src.throttle(h.az)
+			n, err := h.file.ReadAt(dest, off)
+			release()
+			if err != nil && err != io.EOF {
+				return nil, syscall.EIO
+			}
+			return fuse.ReadResultData(dest[:n]), 0
+		}
+		if r := h.streamed(); r != nil {
+			release := n.src.throttle(h.az)
+			n, err := r.ReadAt(dest, off)
+			release()
+			if err != nil && err != io.EOF {
+				return nil, syscall.EIO
+			}
+			return fuse.ReadResultData(dest[:n]), 0
+		}
+		data = h.view()
+	} else {
+		n.mu.Lock()
+		data = n.data
+		n.mu.Unlock()
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	if off >= end {
+		return fuse.ReadResultData(nil), 0
+	}
+	return fuse.ReadResultData(data[off:end]), 0
+}
+
+func (n *memFileNode) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	h, ok := fh.(*fileHandle)
+	if !ok || h.writer == nil {
+		return 0, syscall.EBADF
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = append(h.pending, data...)
+	i := bytes.LastIndexByte(h.pending, '\n')
+	if i < 0 {
+		return uint32(len(data)), 0
+	}
+	rows := h.pending[:i+1]
+	if errno := n.appendRows(h.writer, rows); errno != 0 {
+		h.pending = nil
+		return 0, errno
+	}
+	h.pending = append([]byte(nil), h.pending[i+1:]...)
+	return uint32(len(data)), 0
+}
+
+func (n *memFileNode) Flush(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	h, ok := fh.(*fileHandle)
+	if !ok || h.writer == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.pending) == 0 {
+		return 0
+	}
+	rows := append(h.pending, '\n')
+	h.pending = nil
+	return n.appendRows(h.writer, rows)
+}
+
+func (n *memFileNode) appendRows(az auth.Authorizer, rows []byte) syscall.Errno {
+	if err := n.append(az, rows); err != nil {
+		if errors.Is(err, indexer.ErrAppendDenied) {
+			return syscall.EACCES
+		}
+		n.src.warnings.Add(warnings.KindFileSkipped, n.source, 0, "append failed, served as EIO: %v", err)
+		return syscall.EIO
+	}
+	// Notifying the kernel inside the write request can deadlock on the inode.
+	go n.invalidate()
+	return 0
+}
+
+func (n *memFileNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = syscall.S_IFREG | 0o444
+	if n.append != nil {
+		out.Mode |= 0o200
+	}
+	out.Nlink = 1
+	out.Uid, out.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+	n.attrs.apply(&out.Attr)
+	mtime := time.Now()
+	var st os.FileInfo
+	if n.source != "" {
+		var err error
+		if st, err = os.Stat(n.source); err == nil {
+			mtime = st.ModTime()
+		}
+	}
+	out.SetTimes(nil, &mtime, &mtime)
+	if h, ok := fh.(*fileHandle); ok {
+		out.Size = uint64(h.size())
+		return 0
+	}
+	if n.direct {
+		if st == nil {
+			return syscall.ENOENT
+		}
+		out.Size = uint64(st.Size())
+		return 0
+	}
+	if n.open == nil && (!n.src.perCaller() || n.size == nil) {
+		data, err := n.current(ctx)
+		if err != nil {
+			return syscall.EIO
+		}
+		out.Size = uint64(len(data))
+		return 0
+	}
+	if !n.src.perCaller() {
+		size, err := n.cachedSize(n.src.def)
+		if err != nil {
+			return syscall.EIO
+		}
+		out.Size = uint64(size)
+		return 0
+	}
+	// Sizes differ per caller, so the kernel must not cache them.
+	out.SetTimeout(0)
+	if caller, ok := fuse.FromContext(ctx); ok {
+		out.Uid, out.Gid = caller.Uid, caller.Gid
+		n.attrs.apply(&out.Attr)
+	}
+	az, errno := n.src.forCaller(ctx)
+	if errno != 0 {
+		// Unmapped callers cannot open the file; report it as empty.
+		out.Size = 0
+		return 0
+	}
+	size, err := n.cachedSize(az)
+	if err != nil {
+		return syscall.EIO
+	}
+	out.Size = uint64(size)
+	return 0
+}
+
+func (n *memFileNode) cachedSize(az auth.Authorizer) (int64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if size, ok := n.sizes[az]; ok {
+		return size, nil
+	}
+	size, err := n.size(az)
+	if err != nil {
+		return 0, err
+	}
+	if n.sizes == nil {
+		n.sizes = map[auth.Authorizer]int64{}
+	}
+	n.sizes[az] = size
+	return size, nil
+}
+
+var _ fs.NodeOpener = (*memFileNode)(nil)
+var _ fs.NodeReader = (*memFileNode)(nil)
+var _ fs.NodeGetattrer = (*memFileNode)(nil)
+var _ fs.NodeOnForgetter = (*memFileNode)(nil)
+var _ fs.FilePassthroughFder = (*fileHandle)(nil)
+var _ fs.NodeWriter = (*memFileNode)(nil)
+var _ fs.NodeFlusher = (*memFileNode)(nil)
+var _ fs.FileReleaser = (*fileHandle)(nil)
@@ -4,52 +4,101 @@
 package fusefs
 
 import (
-	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/henneberger/metrics-fs/internal/auth"
-	"github.com/henneberger/metrics-fs/internal/projector"
+	"github.com/henneberger/metrics-fs/internal/canary"
+	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/vtree"
+	"github.com/henneberger/metrics-fs/internal/warnings"
 )
 
-type Config struct {
-	SourceDir          string
-	MountDir           string
-	MapperFileName     string
-	MapperInherit      bool
-	MissingMapperMode  string
-	MissingResource    string
-	IndexDir           string
-	IndexFormatVersion int
-	AllowOther         bool
-	ReadOnly           bool
-}
+type Config = options.Options
 
 type Server struct {
-	cfg Config
-	az  auth.Authorizer
+	cfg         Config
+	src         *authSource
+	imp         *Impersonation
+	watchSource bool
 }
 
 func New(cfg Config, az auth.Authorizer) *Server {
-	return &Server{cfg: cfg, az: az}
+	if cfg.Warnings == nil {
+		cfg.Warnings = warnings.New()
+	}
+	src := &authSource{def: az, warnings: cfg.Warnings, guard: newWriteGuard(cfg), handles: indexer.NewHandles(cfg.OpenFiles)}
+	src.reads = newReadLimiter(cfg.MaxConcurrentReads, cfg.MaxSubjectReads)
+	return &Server{cfg: cfg, src: src}
+}
+
+func (s *Server) EnableImpersonation(imp Impersonation) {
+	s.imp = &imp
+}
+
+func (s *Server) EnableSubjectMap(m *SubjectMap, newAuthorizer func(subject string) (auth.Authorizer, error)) {
+	s.src.subjects = m
+	s.src.newAuthorizer = newAuthorizer
+}
+
+func (s *Server) EnableTombstones(t *auth.Tombstones) {
+	s.src.tombstones = t
+	s.src.def = t.Wrap(s.src.def)
+}
+
+func (s *Server) EnableOverrides(o *auth.Overrides) {
+	s.src.overrides = o
+	s.src.def = o.Wrap(s.src.def)
+}
+
+func (s *Server) EnableCanary(c *canary.Canary) {
+	s.src.canary = c
+}
+
+func (s *Server) EnableVisibilityTrend(t *canary.Trend) {
+	s.src.trend = t
+}
+
+func (s *Server) EnableSourceWatch() {
+	s.watchSource = true
+}
+
+func (s *Server) Reload() error {
+	var errs []error
+	for _, az := range s.src.authorizers() {
+		if err := auth.Reload(az); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.src.invalidateAll()
+	return errors.Join(errs...)
 }
 
 func (s *Server) MountAndServe(ctx context.Context) error {
-	root := &dirNode{cfg: s.cfg, az: s.az, sourcePath: s.cfg.SourceDir}
-	opts := &fs.Options{
-		MountOptions: fuse.MountOptions{
-			AllowOther: s.cfg.AllowOther,
-			Name:       "metricfs",
-			FsName:     "metricfs",
-			Options:    []string{"ro"},
-		},
+	defer s.src.close()
+	if err := checkPlatform(); err != nil {
+		return err
 	}
+	if s.src.canary != nil {
+		if r := s.src.canary.Check(s.src.def); !r.OK {
+			return fmt.Errorf("startup self-test: %s", r)
+		}
+	}
+	s.src.mu.Lock()
+	s.src.watch(s.src.def)
+	s.src.mu.Unlock()
+	root := newDirNode(s.cfg, s.src, s.imp, s.cfg.SourceDir)
+	opts := s.mountOptions()
+	opts.RootStableAttr = &fs.StableAttr{Mode: syscall.S_IFDIR, Ino: stableIno(s.cfg.SourceDir, inoDir)}
 	server, err := fs.Mount(s.cfg.MountDir, root, opts)
 	if err != nil {
 		return err
@@ -61,9 +110,22 @@ func (s *Server) MountAndServe(ctx context.Context) error {
 		close(done)
 	}()
 
+	if s.src.canary != nil {
+		go s.src.canary.Run(ctx, s.src.def)
+	}
+	if s.src.trend != nil {
+		go s.src.trend.Run(ctx, s.src.def)
+	}
+	if s.watchSource {
+		if sw, err := newSourceWatcher(s.cfg, s.src); err != nil {
+			s.cfg.Warnings.Add(warnings.KindSourceWatch, s.cfg.SourceDir, 0, "source changes need a remount: %v", err)
+		} else {
+			go sw.run(ctx)
+		}
+	}
 	select {
 	case <-ctx.Done():
-		_ = server.Unmount()
+		_ = unmount(server, s.cfg.MountDir)
 		<-done
 		return nil
 	case <-done:
@@ -71,54 +133,176 @@ func (s *Server) MountAndServe(ctx context.Context) error {
 	}
 }
 
+func (s *Server) mountOptions() *fs.Options {
+	opts := &fs.Options{
+		MountOptions: fuse.MountOptions{
+			AllowOther: s.cfg.AllowOther,
+			Name:       "metricfs",
+			FsName:     "metricfs",
+		},
+	}
+	if !s.cfg.NoKernelCache {
+		entry := s.cfg.EntryTimeout
+		opts.EntryTimeout = &entry
+		// Per-UID sizes use a zero attr timeout, which a mount-wide one would replace.
+		if !s.src.perCaller() {
+			attr := s.cfg.AttrTimeout
+			opts.AttrTimeout = &attr
+		}
+	}
+	// The kernel queues requests past max_background instead of sending them at once.
+	opts.MaxBackground = s.cfg.MaxConcurrentReads
+	opts.MaxReadAhead = s.cfg.MaxReadahead
+	if s.cfg.ReadOnly {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+	if s.cfg.MountUID >= 0 || s.cfg.MountGID >= 0 || s.cfg.FileMode != 0 || s.cfg.DirMode != 0 {
+		// The presented owner and modes only restrict access if the kernel checks them.
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "default_permissions")
+	}
+	platformOptions(&opts.MountOptions, s.cfg)
+	return opts
+}
+
 type dirNode struct {
 	fs.Inode
+	readOnlyDir
 	cfg        Config
-	az         auth.Authorizer
+	src        *authSource
+	imp        *Impersonation
 	sourcePath string
 }
 
+func newDirNode(cfg Config, src *authSource, imp *Impersonation, sourcePath string) *dirNode {
+	return &dirNode{
+		readOnlyDir: readOnlyDir{guard: src.guard, path: sourcePath},
+		cfg:         cfg,
+		src:         src,
+		imp:         imp,
+		sourcePath:  sourcePath,
+	}
+}
+
 type resolvedEntry struct {
-	name      string
-	source    string
-	isDir     bool
-	projected bool
+	vtree.Entry
+	control bool
 }
 
 func (d *dirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	entries, err := d.resolveEntries()
-	if err != nil {
-		return nil, syscall.EIO
+	entries, errno := d.visibleEntries(ctx)
+	if errno != 0 {
+		return nil, errno
 	}
 	ent, ok := entries[name]
 	if !ok {
 		return nil, syscall.ENOENT
 	}
-	if ent.isDir {
-		ch := &dirNode{cfg: d.cfg, az: d.az, sourcePath: ent.source}
-		return d.NewInode(ctx, ch, fs.StableAttr{Mode: syscall.S_IFDIR}), 0
+	return d.lookupEntry(ctx, ent, out)
+}
+
+func (d *dirNode) lookupEntry(ctx context.Context, ent resolvedEntry, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if ent.control {
+		ctl := newControlDir(d.cfg, d.src)
+		entryAttr(ctx, ctl, out)
+		return d.NewInode(ctx, ctl, fs.StableAttr{Mode: syscall.S_IFDIR}), 0
 	}
-	data, err := d.fileData(ent)
-	if err != nil {
-		return nil, syscall.EIO
+	ino := entryIno(ent.Entry)
+	// Reuse the child cached under the same inode number: one node per source.
+	prev := d.GetChild(ent.Name)
+	if prev != nil && (ino == 0 || prev.StableAttr().Ino != ino) {
+		prev = nil
+	}
+	if ent.Dir {
+		if prev != nil {
+			entryAttr(ctx, prev.Operations().(fs.NodeGetattrer), out)
+			return prev, 0
+		}
+		ch := newDirNode(d.cfg, d.src, d.imp, ent.Source)
+		entryAttr(ctx, ch, out)
+		return d.NewInode(ctx, ch, fs.StableAttr{Mode: syscall.S_IFDIR, Ino: ino}), 0
+	}
+	// Per-UID inodes are shared, so rows are rendered at open time for the caller.
+	streamable := vtree.Streamable(d.cfg, ent.Entry)
+	// Large unfiltered files are read from the source per handle.
+	direct := false
+	if d.cfg.PassthroughMin > 0 && ent.Raw() {
+		st, err := os.Stat(ent.Source)
+		direct = err == nil && st.Size() >= d.cfg.PassthroughMin
+	}
+	rendered := !d.src.perCaller() && !streamable && !direct
+	var data []byte
+	if rendered {
+		var err error
+		data, err = d.fileData(ent, d.src.def)
+		if err != nil {
+			d.cfg.Warnings.Add(warnings.KindFileSkipped, ent.Source, 0, "read failed, served as EIO: %v", err)
+			return nil, syscall.EIO
+		}
+	}
+	if prev != nil {
+		if n, ok := prev.Operations().(*memFileNode); ok {
+			n.refresh(data, rendered)
+			entryAttr(ctx, n, out)
+			return prev, 0
+		}
 	}
 	file := &memFileNode{
-		MemRegularFile: fs.MemRegularFile{
-			Data: data,
-			Attr: fuse.Attr{
-				Mode: 0o444,
-				Size: uint64(len(data)),
-			},
+		attrs:   newAttrs(d.cfg),
+		guard:   d.src.guard,
+		noCache: d.cfg.NoKernelCache,
+		direct:  direct,
+		data:    data,
+		src:     d.src,
+		imp:     d.imp,
+		source:  ent.Source,
+		render: func(az auth.Authorizer) ([]byte, error) {
+			return d.fileData(ent, az)
+		},
+		size: func(az auth.Authorizer) (int64, error) {
+			return d.fileSize(ent, az)
 		},
 	}
-	return d.NewInode(ctx, file, fs.StableAttr{Mode: syscall.S_IFREG}), 0
+	if streamable {
+		file.open = func(az auth.Authorizer) (*indexer.VisibleReader, error) {
+			defer d.src.throttle(az)()
+			return indexer.NewVisibleReader(d.src.handles, ent.Source, d.cfg, az)
+		}
+		file.size = func(az auth.Authorizer) (int64, error) {
+			r, err := file.open(az)
+			if err != nil {
+				return 0, err
+			}
+			defer r.Close()
+			return r.Size(), nil
+		}
+	}
+	if !d.cfg.ReadOnly && ent.Plain() {
+		file.append = func(az auth.Authorizer, rows []byte) error {
+			_, err := indexer.Append(ent.Source, d.cfg, az, rows)
+			return err
+		}
+	}
+	d.src.track(file)
+	entryAttr(ctx, file, out)
+	return d.NewInode(ctx, file, fs.StableAttr{Mode: syscall.S_IFREG, Ino: ino}), 0
+}
+
+func entryAttr(ctx context.Context, n fs.NodeGetattrer, out *fuse.EntryOut) {
+	var a fuse.AttrOut
+	if n.Getattr(ctx, nil, &a) == 0 {
+		out.Attr = a.Attr
+	}
 }
 
 func (d *dirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	entries, err := d.resolveEntries()
-	if err != nil {
-		return nil, syscall.EIO
+	entries, errno := d.visibleEntries(ctx)
+	if errno != 0 {
+		return nil, errno
 	}
+	return fs.NewListDirStream(dirEntries(entries)), 0
+}
+
+func dirEntries(entries map[string]resolvedEntry) []fuse.DirEntry {
 	names := make([]string, 0, len(entries))
 	for name := range entries {
 		names = append(names, name)
@@ -126,18 +310,59 @@ func (d *dirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	sort.Strings(names)
 
 	out := make([]fuse.DirEntry, 0, len(entries))
-	for _, name := range names {
+	for i, name := range names {
 		e := entries[name]
 		mode := uint32(syscall.S_IFREG)
-		if e.isDir {
+		if e.Dir || e.control {
 			mode = syscall.S_IFDIR
 		}
 		out = append(out, fuse.DirEntry{
-			Name: e.name,
+			Name: e.Name,
 			Mode: mode,
+			Off:  uint64(i + 1),
 		})
 	}
-	return fs.NewListDirStream(out), 0
+	return out
+}
+
+func (d *dirNode) OpendirHandle(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	entries, errno := d.visibleEntries(ctx)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	return &dirHandle{dir: d, entries: entries, list: dirEntries(entries)}, 0, 0
+}
+
+type dirHandle struct {
+	dir     *dirNode
+	entries map[string]resolvedEntry
+	list    []fuse.DirEntry
+	pos     int
+}
+
+func (h *dirHandle) Readdirent(ctx context.Context) (*fuse.DirEntry, syscall.Errno) {
+	if h.pos >= len(h.list) {
+		return nil, 0
+	}
+	de := h.list[h.pos]
+	h.pos++
+	return &de, 0
+}
+
+func (h *dirHandle) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	if off > uint64(len(h.list)) {
+		off = uint64(len(h.list))
+	}
+	h.pos = int(off)
+	return 0
+}
+
+func (h *dirHandle) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ent, ok := h.entries[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return h.dir.lookupEntry(ctx, ent, out)
 }
 
 func (d *dirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
@@ -146,63 +371,220 @@ func (d *dirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOu
 		return syscall.ENOENT
 	}
 	out.Mode = uint32(st.Mode().Perm()) | syscall.S_IFDIR
+	out.Uid, out.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+	newAttrs(d.cfg).apply(&out.Attr)
 	return 0
 }
 
-func (d *dirNode) fileData(ent resolvedEntry) ([]byte, error) {
-	lower := strings.ToLower(ent.source)
-	if !ent.projected && !strings.HasSuffix(lower, ".jsonl") {
-		return os.ReadFile(ent.source)
+type attrs struct {
+	uid, gid  int
+	file, dir os.FileMode
+}
+
+func newAttrs(cfg Config) attrs {
+	return attrs{uid: cfg.MountUID, gid: cfg.MountGID, file: cfg.FileMode, dir: cfg.DirMode}
+}
+
+func (a attrs) apply(out *fuse.Attr) {
+	mode := a.file
+	if out.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		mode = a.dir
 	}
-	var b bytes.Buffer
-	if err := projector.RenderFiltered(ent.source, projector.Options{
-		SourceDir:         d.cfg.SourceDir,
-		MapperFileName:    d.cfg.MapperFileName,
-		MapperInherit:     d.cfg.MapperInherit,
-		MissingMapperMode: d.cfg.MissingMapperMode,
-		MissingResource:   d.cfg.MissingResource,
-		IndexDir:          d.cfg.IndexDir,
-		FormatVersion:     d.cfg.IndexFormatVersion,
-	}, d.az, &b); err != nil {
-		return nil, err
+	if a.uid >= 0 {
+		out.Uid = uint32(a.uid)
 	}
-	return b.Bytes(), nil
+	if a.gid >= 0 {
+		out.Gid = uint32(a.gid)
+	}
+	if mode != 0 {
+		out.Mode = out.Mode&syscall.S_IFMT | uint32(mode.Perm())
+	}
+}
+
+func (d *dirNode) fileData(ent resolvedEntry, az auth.Authorizer) ([]byte, error) {
+	defer d.src.throttle(az)()
+	return vtree.Render(d.cfg, ent.Entry, az)
+}
+
+func (d *dirNode) fileSize(ent resolvedEntry, az auth.Authorizer) (int64, error) {
+	defer d.src.throttle(az)()
+	return vtree.Size(d.cfg, ent.Entry, az)
 }
 
-func (d *dirNode) resolveEntries() (map[string]resolvedEntry, error) {
-	dirEntries, err := os.ReadDir(d.sourcePath)
+func (d *dirNode) visibleEntries(ctx context.Context) (map[string]resolvedEntry, syscall.Errno) {
+	entries, err := vtree.List(d.cfg, d.sourcePath)
 	if err != nil {
-		return nil, err
-	}
-	out := map[string]resolvedEntry{}
-	for _, e := range dirEntries {
-		source := filepath.Join(d.sourcePath, e.Name())
-		if e.IsDir() {
-			out[e.Name()] = resolvedEntry{
-				name:   e.Name(),
-				source: source,
-				isDir:  true,
-			}
-			continue
+		return nil, syscall.EIO
+	}
+	if d.cfg.HideEmptyFiles {
+		az, errno := d.src.forCaller(ctx)
+		if errno != 0 {
+			return nil, errno
 		}
-		vname, projected := projector.VirtualJSONLName(e.Name())
-		if existing, ok := out[vname]; ok && !existing.projected {
-			continue
+		release := d.src.throttle(az)
+		vtree.HideEmpty(d.cfg, entries, az)
+		release()
+	}
+	out := make(map[string]resolvedEntry, len(entries)+1)
+	for name, e := range entries {
+		out[name] = resolvedEntry{Entry: e}
+	}
+	if filepath.Clean(d.sourcePath) == filepath.Clean(d.cfg.SourceDir) {
+		if _, ok := out[ControlDirName]; !ok {
+			out[ControlDirName] = resolvedEntry{Entry: vtree.Entry{Name: ControlDirName}, control: true}
 		}
-		out[vname] = resolvedEntry{
-			name:      vname,
-			source:    source,
-			isDir:     false,
-			projected: projected,
+	}
+	return out, 0
+}
+
+type authSource struct {
+	def           auth.Authorizer
+	warnings      *warnings.Collector
+	subjects      *SubjectMap
+	newAuthorizer func(subject string) (auth.Authorizer, error)
+	tombstones    *auth.Tombstones
+	overrides     *auth.Overrides
+	canary        *canary.Canary
+	trend         *canary.Trend
+	guard         *writeGuard
+	handles       *indexer.Handles
+	reads         *readLimiter
+
+	mu      sync.Mutex
+	bySubj  map[string]auth.Authorizer
+	cancels []func()
+
+	nodesMu sync.Mutex
+	nodes   map[*memFileNode]struct{}
+
+	usageMu sync.Mutex
+	usages  map[auth.Authorizer]usage
+}
+
+func (a *authSource) watch(az auth.Authorizer) {
+	a.cancels = append(a.cancels, auth.Subscribe(az, a.invalidateAll))
+}
+
+func (a *authSource) track(n *memFileNode) {
+	a.nodesMu.Lock()
+	defer a.nodesMu.Unlock()
+	if a.nodes == nil {
+		a.nodes = map[*memFileNode]struct{}{}
+	}
+	a.nodes[n] = struct{}{}
+}
+
+func (a *authSource) untrack(n *memFileNode) {
+	if a == nil {
+		return
+	}
+	a.nodesMu.Lock()
+	defer a.nodesMu.Unlock()
+	delete(a.nodes, n)
+}
+
+func (a *authSource) invalidateAll() {
+	a.invalidateSources(func(string) bool { return true })
+}
+
+func (a *authSource) invalidateSources(match func(source string) bool) {
+	a.usageMu.Lock()
+	a.usages = nil
+	a.usageMu.Unlock()
+	a.nodesMu.Lock()
+	nodes := make([]*memFileNode, 0, len(a.nodes))
+	for n := range a.nodes {
+		if match(n.source) {
+			nodes = append(nodes, n)
 		}
 	}
-	return out, nil
+	a.nodesMu.Unlock()
+	for _, n := range nodes {
+		n.invalidate()
+	}
+}
+
+func (a *authSource) throttle(az auth.Authorizer) func() {
+	if a == nil {
+		return func() {}
+	}
+	return a.reads.acquire(az)
+}
+
+func (a *authSource) perCaller() bool {
+	return a != nil && a.subjects != nil
+}
+
+func (a *authSource) forCaller(ctx context.Context) (auth.Authorizer, syscall.Errno) {
+	if !a.perCaller() {
+		return a.def, 0
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return nil, syscall.EACCES
+	}
+	subject, ok := a.subjects.Subject(caller.Uid, caller.Gid)
+	if !ok {
+		return nil, syscall.EACCES
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if az, ok := a.bySubj[subject]; ok {
+		return az, 0
+	}
+	az, err := a.newAuthorizer(subject)
+	if err != nil {
+		a.warnings.Add(warnings.KindFileSkipped, "", 0, "authorizer for %s: %v", subject, err)
+		return nil, syscall.EIO
+	}
+	if a.bySubj == nil {
+		a.bySubj = map[string]auth.Authorizer{}
+	}
+	az = a.wrap(az)
+	a.watch(az)
+	a.bySubj[subject] = az
+	return az, 0
 }
 
-type memFileNode struct {
-	fs.MemRegularFile
+func (a *authSource) wrap(az auth.Authorizer) auth.Authorizer {
+	if a.tombstones != nil {
+		az = a.tombstones.Wrap(az)
+	}
+	if a.overrides != nil {
+		az = a.overrides.Wrap(az)
+	}
+	return az
+}
+
+func (a *authSource) authorizers() []auth.Authorizer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := []auth.Authorizer{a.def}
+	for _, az := range a.bySubj {
+		out = append(out, az)
+	}
+	return out
+}
+
+func (a *authSource) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, cancel := range a.cancels {
+		cancel()
+	}
+	a.cancels = nil
+	for _, az := range a.bySubj {
+		if cl, ok := az.(interface{ Close() error }); ok {
+			_ = cl.Close()
+		}
+	}
+	a.bySubj = nil
 }
 
 var _ fs.NodeGetattrer = (*dirNode)(nil)
 var _ fs.NodeLookuper = (*dirNode)(nil)
 var _ fs.NodeReaddirer = (*dirNode)(nil)
+var _ fs.NodeOpendirHandler = (*dirNode)(nil)
+var _ fs.FileReaddirenter = (*dirHandle)(nil)
+var _ fs.FileLookuper = (*dirHandle)(nil)
+var _ fs.FileSeekdirer = (*dirHandle)(nil)
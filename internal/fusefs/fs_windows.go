@@ -6,22 +6,15 @@ package fusefs
 import (
 	"context"
 	"errors"
+	"os"
+	"time"
 
 	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/canary"
+	"github.com/henneberger/metrics-fs/internal/options"
 )
 
-type Config struct {
-	SourceDir          string
-	MountDir           string
-	MapperFileName     string
-	MapperInherit      bool
-	MissingMapperMode  string
-	MissingResource    string
-	IndexDir           string
-	IndexFormatVersion int
-	AllowOther         bool
-	ReadOnly           bool
-}
+type Config = options.Options
 
 type Server struct {
 	cfg Config
@@ -32,8 +25,41 @@ func New(cfg Config, az auth.Authorizer) *Server {
 	return &Server{cfg: cfg, az: az}
 }
 
+func (s *Server) EnableImpersonation(imp Impersonation) {}
+
+func (s *Server) EnableSubjectMap(m *SubjectMap, newAuthorizer func(subject string) (auth.Authorizer, error)) {
+}
+
+func (s *Server) EnableTombstones(t *auth.Tombstones) {}
+
+func (s *Server) EnableOverrides(o *auth.Overrides) {}
+
+func (s *Server) EnableCanary(c *canary.Canary) {}
+
+func (s *Server) EnableVisibilityTrend(t *canary.Trend) {}
+
+func (s *Server) EnableSourceWatch() {}
+
+func (s *Server) Reload() error { return nil }
+
+func (s *Server) Health(timeout time.Duration) []HealthCheck {
+	return []HealthCheck{{Name: "fuse", Err: errors.New("fuse mount is not supported on windows")}}
+}
+
 func (s *Server) MountAndServe(ctx context.Context) error {
 	_ = s
 	_ = ctx
 	return errors.New("fuse mount is not supported on windows; use metricfs render")
 }
+
+func PrepareMountDir(dir string, create bool) error {
+	return nil
+}
+
+func Unmount(dir string, lazy bool) error {
+	return errors.New("fuse mount is not supported on windows")
+}
+
+func Impersonate(f *os.File, subject string) error {
+	return errors.New("impersonation is not supported on windows")
+}
@@ -0,0 +1,6 @@
+package fusefs
+
+type HealthCheck struct {
+	Name string
+	Err  error
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+func TestHealthReportsEachFailedCheck(t *testing.T) {
+	dir := t.TempDir()
+	perms := filepath.Join(dir, "perms.json")
+	if err := os.WriteFile(perms, []byte(`{"allow": []}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	az, err := auth.NewFromPermissionsFile(perms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{MountDir: mnt, IndexDir: filepath.Join(dir, "idx")}, az)
+	failed := func() map[string]error {
+		out := map[string]error{}
+		for _, ch := range s.Health(time.Second) {
+			if ch.Err != nil {
+				out[ch.Name] = ch.Err
+			}
+		}
+		return out
+	}
+	// Nothing is mounted on mnt, so only the FUSE check fails.
+	if got := failed(); len(got) != 1 || got["fuse"] == nil {
+		t.Fatalf("failed checks = %v, want only fuse", got)
+	}
+	if err := os.Remove(perms); err != nil {
+		t.Fatal(err)
+	}
+	// A file where the index dir should be cannot hold index entries.
+	if err := os.RemoveAll(filepath.Join(dir, "idx")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "idx"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := failed(); got["authorizer"] == nil || got["index_cache"] == nil {
+		t.Fatalf("failed checks = %v, want authorizer and index_cache", got)
+	}
+}
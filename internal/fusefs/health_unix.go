@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/indexer"
+)
+
+func (s *Server) Health(timeout time.Duration) []HealthCheck {
+	checks := []HealthCheck{{Name: "fuse", Err: s.checkMount(timeout)}}
+	var azErr error
+	for _, az := range s.src.authorizers() {
+		if azErr = auth.Ping(az); azErr != nil {
+			break
+		}
+	}
+	checks = append(checks, HealthCheck{Name: "authorizer", Err: azErr})
+	return append(checks, HealthCheck{Name: "index_cache", Err: indexer.CheckStore(s.cfg)})
+}
+
+// A live mount answers in time and sits on a different device than its parent.
+func (s *Server) checkMount(timeout time.Duration) error {
+	type result struct {
+		root, parent syscall.Stat_t
+		err          error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		if r.err = syscall.Stat(filepath.Dir(s.cfg.MountDir), &r.parent); r.err == nil {
+			r.err = syscall.Stat(s.cfg.MountDir, &r.root)
+		}
+		done <- r
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		if r.root.Dev == r.parent.Dev {
+			return errors.New("not mounted")
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("stat %s did not answer within %s", s.cfg.MountDir, timeout)
+	}
+}
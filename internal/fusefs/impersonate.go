@@ -0,0 +1,34 @@
+package fusefs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+type Impersonation struct {
+	Check         auth.CandidateKey
+	NewAuthorizer func(subject string) (auth.Authorizer, error)
+}
+
+const DefaultImpersonationCheck = "metricfs:mount#impersonate"
+
+const MaxImpersonationSubject = 256
+
+const (
+	IoctlImpersonate        = 1<<30 | MaxImpersonationSubject<<16 | 'M'<<8 | 1
+	IoctlClearImpersonation = 'M'<<8 | 2
+)
+
+func parseSubject(b []byte) (string, error) {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	subject := strings.TrimSpace(string(b))
+	typ, id, ok := strings.Cut(subject, ":")
+	if !ok || typ == "" || id == "" {
+		return "", fmt.Errorf("invalid subject %q, expected type:id", subject)
+	}
+	return subject, nil
+}
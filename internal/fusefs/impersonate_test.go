@@ -0,0 +1,83 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+type allowIDs map[string]bool
+
+func (a allowIDs) IsAllowed(c auth.CandidateKey) bool { return a[c.ObjectID] }
+
+func TestImpersonationIoctl(t *testing.T) {
+	ctx := context.Background()
+	check, err := auth.ParseCandidateKey(DefaultImpersonationCheck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp := &Impersonation{
+		Check: check,
+		NewAuthorizer: func(subject string) (auth.Authorizer, error) {
+			return allowIDs{subject: true}, nil
+		},
+	}
+	newHandle := func(mountAz auth.Authorizer, imp *Impersonation) *fileHandle {
+		src := &authSource{def: mountAz, warnings: warnings.New()}
+		n := &memFileNode{src: src, imp: imp, source: "/src/a.jsonl", render: func(az auth.Authorizer) ([]byte, error) {
+			if az.IsAllowed(auth.CandidateKey{ObjectID: "user:bob"}) {
+				return []byte("bob\n"), nil
+			}
+			return []byte("mount\n"), nil
+		}}
+		return &fileHandle{node: n, base: []byte("mount\n")}
+	}
+	payload := func(subject string) []byte {
+		b := make([]byte, MaxImpersonationSubject)
+		copy(b, subject)
+		return b
+	}
+
+	// Disabled: both ioctls are unknown.
+	h := newHandle(allowIDs{"a": true}, nil)
+	for _, cmd := range []uint32{IoctlImpersonate, IoctlClearImpersonation} {
+		if _, errno := h.Ioctl(ctx, cmd, 0, payload("user:bob"), nil); errno != syscall.ENOTTY {
+			t.Fatalf("disabled ioctl %#x: got %v, want ENOTTY", cmd, errno)
+		}
+	}
+
+	h = newHandle(allowIDs{"a": true}, imp)
+	if h.file, err = os.Open(os.DevNull); err != nil {
+		t.Fatal(err)
+	}
+	defer h.file.Close()
+	if _, errno := h.Ioctl(ctx, IoctlImpersonate, 0, payload("user:bob"), nil); errno != syscall.ENOTTY {
+		t.Fatalf("direct handle: got %v, want ENOTTY", errno)
+	}
+
+	h = newHandle(allowIDs{"a": true}, imp)
+	if _, errno := h.Ioctl(ctx, IoctlImpersonate, 0, payload("user:bob"), nil); errno != syscall.EPERM {
+		t.Fatalf("unprivileged mount: got %v, want EPERM", errno)
+	}
+	if got := string(h.view()); got != "mount\n" {
+		t.Fatalf("view after EPERM = %q", got)
+	}
+
+	h = newHandle(allowIDs{check.ObjectID: true}, imp)
+	if _, errno := h.Ioctl(ctx, IoctlImpersonate, 0, payload("user:bob"), nil); errno != 0 {
+		t.Fatalf("impersonate: %v", errno)
+	}
+	if got := string(h.view()); got != "bob\n" || h.subject != "user:bob" {
+		t.Fatalf("impersonated view = %q as %q", got, h.subject)
+	}
+	if _, errno := h.Ioctl(ctx, IoctlClearImpersonation, 0, nil, nil); errno != 0 || string(h.view()) != "mount\n" {
+		t.Fatalf("clear: %v, view %q", errno, h.view())
+	}
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+func Impersonate(f *os.File, subject string) error {
+	if len(subject) >= MaxImpersonationSubject {
+		return fmt.Errorf("subject longer than %d bytes", MaxImpersonationSubject-1)
+	}
+	var buf [MaxImpersonationSubject]byte
+	copy(buf[:], subject)
+	return ioctl(f, IoctlImpersonate, uintptr(unsafe.Pointer(&buf[0])))
+}
+
+func ClearImpersonation(f *os.File) error {
+	return ioctl(f, IoctlClearImpersonation, 0)
+}
+
+func ioctl(f *os.File, cmd uint32, arg uintptr) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(cmd), arg)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (h *fileHandle) Ioctl(ctx context.Context, cmd uint32, arg uint64, input []byte, output []byte) (int32, syscall.Errno) {
+	n := h.node
+	if cmd != IoctlImpersonate && cmd != IoctlClearImpersonation {
+		return 0, syscall.ENOTTY
+	}
+	// Direct handles read their source descriptor whatever the view.
+	if n.imp == nil || h.file != nil {
+		return 0, syscall.ENOTTY
+	}
+	switch cmd {
+	case IoctlImpersonate:
+		az, errno := n.src.forCaller(ctx)
+		if errno != 0 {
+			return 0, errno
+		}
+		allowed, err := auth.IsAllowedCtx(ctx, az, n.imp.Check)
+		if err != nil {
+			return 0, syscall.EIO
+		}
+		if !allowed {
+			return 0, syscall.EPERM
+		}
+		subject, err := parseSubject(input)
+		if err != nil {
+			return 0, syscall.EINVAL
+		}
+		target, err := n.imp.NewAuthorizer(subject)
+		if err != nil {
+			return 0, syscall.EIO
+		}
+		target = n.src.wrap(target)
+		data, err := n.render(target)
+		if cl, ok := target.(interface{ Close() error }); ok {
+			_ = cl.Close()
+		}
+		if err != nil {
+			return 0, syscall.EIO
+		}
+		h.mu.Lock()
+		h.subject, h.data = subject, data
+		h.mu.Unlock()
+		return 0, 0
+	default:
+		h.mu.Lock()
+		h.subject, h.data = "", nil
+		h.mu.Unlock()
+		return 0, 0
+	}
+}
+
+var _ fs.FileIoctler = (*fileHandle)(nil)
@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"syscall"
+
+	"github.com/henneberger/metrics-fs/internal/vtree"
+)
+
+const (
+	inoRows byte = iota
+	inoDir
+	inoSchema
+	inoVisibility
+	inoGzip
+)
+
+func stableIno(source string, kind byte) uint64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(source, &st); err != nil {
+		return 0
+	}
+	var b [17]byte
+	binary.LittleEndian.PutUint64(b[0:], uint64(st.Dev))
+	binary.LittleEndian.PutUint64(b[8:], uint64(st.Ino))
+	b[16] = kind
+	h := fnv.New64a()
+	h.Write(b[:])
+	ino := h.Sum64() &^ (1 << 63)
+	if ino == 0 {
+		ino = 1
+	}
+	return ino
+}
+
+func entryIno(e vtree.Entry) uint64 {
+	kind := inoRows
+	switch {
+	case e.Dir:
+		kind = inoDir
+	case e.Schema:
+		kind = inoSchema
+	case e.Visibility:
+		kind = inoVisibility
+	case e.Gzip:
+		kind = inoGzip
+	}
+	return stableIno(e.Source, kind)
+}
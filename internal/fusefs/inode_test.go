@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStableInoFollowsTheSourceFile(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.jsonl")
+	if err := os.WriteFile(p, []byte("{}\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	ino := stableIno(p, inoRows)
+	if ino == 0 || ino&(1<<63) != 0 {
+		t.Fatalf("ino %#x should be non-zero with the high bit clear", ino)
+	}
+	if again := stableIno(p, inoRows); again != ino {
+		t.Fatalf("ino changed between calls: %#x != %#x", again, ino)
+	}
+	if stableIno(p, inoSchema) == ino {
+		t.Fatalf("schema sidecar should not share the rows inode")
+	}
+	if err := os.WriteFile(p, []byte("{}\n{}\n"), 0o644); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	if got := stableIno(p, inoRows); got != ino {
+		t.Fatalf("in-place rewrite changed ino: %#x != %#x", got, ino)
+	}
+	// Replacing the file by rename is a new file.
+	tmp := filepath.Join(dir, "a.tmp")
+	if err := os.WriteFile(tmp, []byte("{}\n"), 0o644); err != nil {
+		t.Fatalf("write tmp: %v", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if got := stableIno(p, inoRows); got == ino {
+		t.Fatalf("replaced file kept ino %#x", got)
+	}
+	if got := stableIno(filepath.Join(dir, "missing"), inoRows); got != 0 {
+		t.Fatalf("missing source should leave ino to go-fuse, got %#x", got)
+	}
+}
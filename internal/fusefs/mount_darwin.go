@@ -0,0 +1,70 @@
+//go:build darwin
+// +build darwin
+
+package fusefs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var macFUSEHelpers = []string{
+	"/Library/Filesystems/macfuse.fs/Contents/Resources/mount_macfuse",
+	"/Library/Filesystems/osxfuse.fs/Contents/Resources/mount_osxfuse",
+}
+
+func checkPlatform() error {
+	for _, p := range macFUSEHelpers {
+		if _, err := os.Stat(p); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("mounting on macOS requires macFUSE (brew install --cask macfuse); fuse-t is not supported")
+}
+
+func platformOptions(o *fuse.MountOptions, cfg Config) {
+	o.Options = append(o.Options, "volname="+volumeName(cfg), "noappledouble", "noapplexattr")
+}
+
+func volumeName(cfg Config) string {
+	if cfg.VolumeName != "" {
+		return cfg.VolumeName
+	}
+	return "metricfs-" + filepath.Base(cfg.SourceDir)
+}
+
+// Finder and Spotlight keep macFUSE volumes busy, hence the forced fallback.
+func unmount(server *fuse.Server, dir string) error {
+	if err := server.Unmount(); err == nil {
+		return nil
+	}
+	return exec.Command("diskutil", "unmount", "force", dir).Run()
+}
+
+func unmountDir(dir string, lazy bool) error {
+	if err := exec.Command("umount", dir).Run(); err == nil {
+		return nil
+	}
+	if !lazy {
+		return exec.Command("diskutil", "unmount", dir).Run()
+	}
+	return exec.Command("diskutil", "unmount", "force", dir).Run()
+}
+
+func staleMount(dir string) bool {
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "metricfs on "+dir+" (") {
+			return true
+		}
+	}
+	return false
+}
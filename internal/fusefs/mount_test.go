@@ -0,0 +1,66 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/options"
+)
+
+func TestMountOptions(t *testing.T) {
+	cfg := options.New(
+		options.WithSourceDir("/data/metrics"),
+		options.WithModes(0o440, 0),
+		options.WithCacheTimeouts(5*time.Second, time.Second),
+	)
+	opts := New(cfg, nil).mountOptions()
+	for _, want := range []string{"ro", "default_permissions"} {
+		if !slices.Contains(opts.MountOptions.Options, want) {
+			t.Fatalf("missing %q in %v", want, opts.MountOptions.Options)
+		}
+	}
+	if opts.AttrTimeout == nil || *opts.AttrTimeout != 5*time.Second || *opts.EntryTimeout != time.Second {
+		t.Fatalf("unexpected timeouts: attr=%v entry=%v", opts.AttrTimeout, opts.EntryTimeout)
+	}
+	darwin := []string{"volname=metricfs-metrics", "noappledouble", "noapplexattr"}
+	for _, o := range darwin {
+		if got := slices.Contains(opts.MountOptions.Options, o); got != (runtime.GOOS == "darwin") {
+			t.Fatalf("%s: option %q present=%v", runtime.GOOS, o, got)
+		}
+	}
+
+	cfg = cfg.With(options.WithReadOnly(false), options.WithModes(0, 0), options.WithNoKernelCache(true), options.WithVolumeName("Metrics"))
+	opts = New(cfg, nil).mountOptions()
+	if slices.Contains(opts.MountOptions.Options, "ro") || slices.Contains(opts.MountOptions.Options, "default_permissions") {
+		t.Fatalf("unexpected options %v", opts.MountOptions.Options)
+	}
+	if opts.AttrTimeout != nil || opts.EntryTimeout != nil {
+		t.Fatalf("--no-kernel-cache should leave timeouts unset")
+	}
+	if runtime.GOOS == "darwin" && !slices.Contains(opts.MountOptions.Options, "volname=Metrics") {
+		t.Fatalf("volume name not applied: %v", opts.MountOptions.Options)
+	}
+}
+
+func TestPrepareMountDirCreatesMissingDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "a", "mnt")
+	if err := PrepareMountDir(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("created without create: %v", err)
+	}
+	if err := PrepareMountDir(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		t.Fatalf("not created: %v", err)
+	}
+}
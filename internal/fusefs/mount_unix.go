@@ -0,0 +1,75 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package fusefs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func checkPlatform() error {
+	return nil
+}
+
+func platformOptions(o *fuse.MountOptions, cfg Config) {}
+
+func unmount(server *fuse.Server, dir string) error {
+	return server.Unmount()
+}
+
+func unmountDir(dir string, lazy bool) error {
+	cmds := [][]string{{"fusermount3", "-u"}, {"fusermount", "-u"}, {"umount"}}
+	if lazy {
+		cmds = [][]string{{"fusermount3", "-u", "-z"}, {"fusermount", "-u", "-z"}, {"umount", "-l"}}
+	}
+	var err error
+	for _, c := range cmds {
+		var out []byte
+		out, err = exec.Command(c[0], append(c[1:], dir)...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*exec.Error); !ok {
+			return fmt.Errorf("%s: %s", c[0], strings.TrimSpace(string(out)))
+		}
+	}
+	return err
+}
+
+func staleMount(dir string) bool {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 3 && fields[0] == "metricfs" && unescapeMount(fields[1]) == dir && strings.HasPrefix(fields[2], "fuse") {
+			return true
+		}
+	}
+	return false
+}
+
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+func PrepareMountDir(dir string, create bool) error {
+	_, err := os.Stat(dir)
+	if errors.Is(err, syscall.ENOTCONN) {
+		abs, _ := filepath.Abs(dir)
+		if !staleMount(abs) {
+			return fmt.Errorf("mount dir %s is a disconnected mount that is not metricfs's", dir)
+		}
+		if err := unmountDir(abs, true); err != nil {
+			return fmt.Errorf("unmount stale mount at %s: %w", dir, err)
+		}
+		_, err = os.Stat(dir)
+	}
+	if errors.Is(err, os.ErrNotExist) && create {
+		return os.MkdirAll(dir, 0o755)
+	}
+	return nil
+}
+
+func Unmount(dir string, lazy bool) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	return unmountDir(abs, lazy)
+}
@@ -0,0 +1,151 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+type writeGuard struct {
+	readOnly bool
+	strict   bool
+	warnings *warnings.Collector
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newWriteGuard(cfg Config) *writeGuard {
+	return &writeGuard{readOnly: cfg.ReadOnly, strict: cfg.StrictReadOnly, warnings: cfg.Warnings}
+}
+
+func (g *writeGuard) reject(op, path string) syscall.Errno {
+	g.mu.Lock()
+	if g.counts == nil {
+		g.counts = map[string]int64{}
+	}
+	g.counts[op]++
+	g.mu.Unlock()
+	if g.strict {
+		g.warnings.Add(warnings.KindWriteRejected, path, 0, "%s rejected: mount is read-only", op)
+	}
+	if g.readOnly {
+		return syscall.EROFS
+	}
+	return syscall.EPERM
+}
+
+// Linux honours O_TRUNC even with O_RDONLY.
+func (g *writeGuard) open(flags uint32, path string) syscall.Errno {
+	switch {
+	case flags&syscall.O_ACCMODE == syscall.O_WRONLY:
+		return g.reject("open_wronly", path)
+	case flags&syscall.O_ACCMODE == syscall.O_RDWR:
+		return g.reject("open_rdwr", path)
+	case g.strict && flags&syscall.O_TRUNC != 0:
+		return g.reject("open_trunc", path)
+	}
+	return 0
+}
+
+func (g *writeGuard) Counts() map[string]int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make(map[string]int64, len(g.counts))
+	for op, n := range g.counts {
+		out[op] = n
+	}
+	return out
+}
+
+type readOnlyDir struct {
+	guard *writeGuard
+	path  string
+}
+
+func (r readOnlyDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	return nil, nil, 0, r.guard.reject("create", r.path)
+}
+
+func (r readOnlyDir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return nil, r.guard.reject("mkdir", r.path)
+}
+
+func (r readOnlyDir) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return nil, r.guard.reject("mknod", r.path)
+}
+
+func (r readOnlyDir) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return nil, r.guard.reject("symlink", r.path)
+}
+
+func (r readOnlyDir) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return nil, r.guard.reject("link", r.path)
+}
+
+func (r readOnlyDir) Unlink(ctx context.Context, name string) syscall.Errno {
+	return r.guard.reject("unlink", r.path)
+}
+
+func (r readOnlyDir) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return r.guard.reject("rmdir", r.path)
+}
+
+func (r readOnlyDir) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	return r.guard.reject("rename", r.path)
+}
+
+func (r readOnlyDir) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return r.guard.reject("setattr", r.path)
+}
+
+func (r readOnlyDir) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return r.guard.reject("setxattr", r.path)
+}
+
+func (r readOnlyDir) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return r.guard.reject("removexattr", r.path)
+}
+
+func (n *memFileNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return n.guard.reject("setattr", n.source)
+}
+
+func (n *memFileNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return n.guard.reject("setxattr", n.source)
+}
+
+func (n *memFileNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return n.guard.reject("removexattr", n.source)
+}
+
+func writeRejections(g *writeGuard) map[string]any {
+	counts := g.Counts()
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	return map[string]any{"strict": g.strict, "total": total, "by_op": counts}
+}
+
+var _ fs.NodeCreater = (*dirNode)(nil)
+var _ fs.NodeMkdirer = (*dirNode)(nil)
+var _ fs.NodeMknoder = (*dirNode)(nil)
+var _ fs.NodeSymlinker = (*dirNode)(nil)
+var _ fs.NodeLinker = (*dirNode)(nil)
+var _ fs.NodeUnlinker = (*dirNode)(nil)
+var _ fs.NodeRmdirer = (*dirNode)(nil)
+var _ fs.NodeRenamer = (*dirNode)(nil)
+var _ fs.NodeSetattrer = (*dirNode)(nil)
+var _ fs.NodeSetxattrer = (*dirNode)(nil)
+var _ fs.NodeRemovexattrer = (*dirNode)(nil)
+var _ fs.NodeMkdirer = (*controlDirNode)(nil)
+var _ fs.NodeSetattrer = (*memFileNode)(nil)
+var _ fs.NodeSetxattrer = (*memFileNode)(nil)
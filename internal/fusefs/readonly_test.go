@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+func TestReadOnlyRejectsWriteClassOps(t *testing.T) {
+	ctx := context.Background()
+	for _, strict := range []bool{false, true} {
+		w := warnings.New()
+		cfg := options.New(options.WithWarnings(w), options.WithStrictReadOnly(strict))
+		src := &authSource{warnings: w, guard: newWriteGuard(cfg)}
+		dir := newDirNode(cfg, src, nil, "/src")
+		file := &memFileNode{guard: src.guard, src: src, source: "/src/a.jsonl", render: func(auth.Authorizer) ([]byte, error) {
+			return []byte("{}\n"), nil
+		}}
+		control := &memFileNode{guard: src.guard, data: []byte("{}\n")}
+
+		dirOps := map[string]syscall.Errno{
+			"mkdir":  func() syscall.Errno { _, e := dir.Mkdir(ctx, "x", 0o755, nil); return e }(),
+			"create": func() syscall.Errno { _, _, _, e := dir.Create(ctx, "x", 0, 0o644, nil); return e }(),
+			"rename": dir.Rename(ctx, "a.jsonl", dir, "b.jsonl", 0),
+			"unlink": dir.Unlink(ctx, "a.jsonl"),
+			"rmdir":  dir.Rmdir(ctx, "x"),
+		}
+		for op, errno := range dirOps {
+			if errno != syscall.EROFS {
+				t.Fatalf("strict=%v %s: got %v, want EROFS", strict, op, errno)
+			}
+		}
+		if errno := file.Setattr(ctx, nil, nil, nil); errno != syscall.EROFS {
+			t.Fatalf("strict=%v setattr: got %v", strict, errno)
+		}
+		if errno := file.Setxattr(ctx, "user.x", nil, 0); errno != syscall.EROFS {
+			t.Fatalf("strict=%v setxattr: got %v", strict, errno)
+		}
+		for _, flags := range []uint32{syscall.O_WRONLY, syscall.O_RDWR, syscall.O_WRONLY | syscall.O_APPEND} {
+			if _, _, errno := file.Open(ctx, flags); errno != syscall.EROFS {
+				t.Fatalf("strict=%v open %#x: got %v", strict, flags, errno)
+			}
+			if _, _, errno := control.Open(ctx, flags); errno != syscall.EROFS {
+				t.Fatalf("strict=%v control open %#x: got %v", strict, flags, errno)
+			}
+		}
+		_, _, errno := file.Open(ctx, syscall.O_RDONLY|syscall.O_TRUNC)
+		if strict && errno != syscall.EROFS {
+			t.Fatalf("strict O_TRUNC open: got %v", errno)
+		}
+		if !strict && errno != 0 {
+			t.Fatalf("O_TRUNC read open: got %v", errno)
+		}
+
+		want := int64(13)
+		if strict {
+			want++
+		}
+		if got := writeRejections(src.guard)["total"]; got != want {
+			t.Fatalf("strict=%v rejections = %v, want %d", strict, got, want)
+		}
+		if got := w.Counts()[warnings.KindWriteRejected] > 0; got != strict {
+			t.Fatalf("strict=%v recorded warnings = %v", strict, got)
+		}
+	}
+}
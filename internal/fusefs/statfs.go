@@ -0,0 +1,72 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/vtree"
+)
+
+const usageTTL = 30 * time.Second
+
+type usage struct {
+	size, files int64
+	at          time.Time
+}
+
+func (d *dirNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(d.cfg.SourceDir, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStatfsT(&st)
+	az, errno := d.src.forCaller(ctx)
+	if errno != 0 {
+		return errno
+	}
+	u, err := d.src.usage(d.cfg, az)
+	if err != nil {
+		return syscall.EIO
+	}
+	if out.Bsize == 0 {
+		return 0
+	}
+	used := (uint64(u.size) + uint64(out.Bsize) - 1) / uint64(out.Bsize)
+	out.Bfree = 0
+	if used < out.Blocks {
+		out.Bfree = out.Blocks - used
+	}
+	out.Bavail = min(out.Bavail, out.Bfree)
+	out.Ffree = 0
+	if uint64(u.files) < out.Files {
+		out.Ffree = out.Files - uint64(u.files)
+	}
+	return 0
+}
+
+func (a *authSource) usage(cfg Config, az auth.Authorizer) (usage, error) {
+	a.usageMu.Lock()
+	defer a.usageMu.Unlock()
+	if u, ok := a.usages[az]; ok && time.Since(u.at) < usageTTL {
+		return u, nil
+	}
+	size, files, err := vtree.Usage(cfg, cfg.SourceDir, az)
+	if err != nil {
+		return usage{}, err
+	}
+	u := usage{size: size, files: files, at: time.Now()}
+	if a.usages == nil {
+		a.usages = map[auth.Authorizer]usage{}
+	}
+	a.usages[az] = u
+	return u, nil
+}
+
+var _ fs.NodeStatfser = (*dirNode)(nil)
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+)
+
+func TestStatfsReportsFilteredBytesAsUsed(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		".metricfs-map.yaml": "version: 1\nrules:\n  - match:\n      glob: \"*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n",
+		"sub/rows.jsonl":     "{\"id\":\"a\"}\n{\"id\":\"b\"}\n",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	perm := filepath.Join(dir, "perm.json")
+	if err := os.WriteFile(perm, []byte(`{"allow":[{"object_type":"metric_row","object_id":"b","permission":"read"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	az, err := auth.NewFromPermissionsFile(perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := options.New(options.WithSourceDir(src), options.WithIndex(filepath.Join(dir, "idx"), 1))
+	s := New(cfg, az)
+	root := newDirNode(cfg, s.src, nil, src)
+
+	var out fuse.StatfsOut
+	if errno := root.Statfs(context.Background(), &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Blocks == 0 || out.Bsize == 0 {
+		t.Fatalf("no source capacity: %+v", out)
+	}
+	if used := out.Blocks - out.Bfree; used != 1 {
+		t.Fatalf("used blocks = %d, want 1", used)
+	}
+	u, err := s.src.usage(cfg, az)
+	want := int64(len(files[".metricfs-map.yaml"]) + len("{\"id\":\"b\"}\n"))
+	if err != nil || u.size != want || u.files != 2 {
+		t.Fatalf("usage %+v %v", u, err)
+	}
+	s.src.invalidateAll()
+	if s.src.usages != nil {
+		t.Fatalf("permission change must drop cached usage")
+	}
+}
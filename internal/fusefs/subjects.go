@@ -0,0 +1,60 @@
+package fusefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type SubjectMap struct {
+	UIDs map[uint32]string
+	GIDs map[uint32]string
+}
+
+type subjectMapDoc struct {
+	UIDs map[string]string `json:"uids"`
+	GIDs map[string]string `json:"gids"`
+}
+
+func LoadSubjectMap(path string) (*SubjectMap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc subjectMapDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	m := &SubjectMap{}
+	if m.UIDs, err = parseIDMap("uids", doc.UIDs); err != nil {
+		return nil, err
+	}
+	if m.GIDs, err = parseIDMap("gids", doc.GIDs); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseIDMap(field string, in map[string]string) (map[uint32]string, error) {
+	out := make(map[uint32]string, len(in))
+	for k, subject := range in {
+		id, err := strconv.ParseUint(k, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid id %q", field, k)
+		}
+		if _, err := parseSubject([]byte(subject)); err != nil {
+			return nil, fmt.Errorf("%s[%s]: %w", field, k, err)
+		}
+		out[uint32(id)] = subject
+	}
+	return out, nil
+}
+
+func (m *SubjectMap) Subject(uid, gid uint32) (string, bool) {
+	if s, ok := m.UIDs[uid]; ok {
+		return s, true
+	}
+	s, ok := m.GIDs[gid]
+	return s, ok
+}
@@ -0,0 +1,34 @@
+package fusefs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSubjectMap(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "subjects.json")
+	if err := os.WriteFile(p, []byte(`{"uids":{"1000":"user:alice"},"gids":{"2000":"user:analysts"}}`), 0o644); err != nil {
+		t.Fatalf("write subject map: %v", err)
+	}
+	m, err := LoadSubjectMap(p)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if s, ok := m.Subject(1000, 2000); !ok || s != "user:alice" {
+		t.Fatalf("uid should win over gid, got %q %v", s, ok)
+	}
+	if s, ok := m.Subject(1001, 2000); !ok || s != "user:analysts" {
+		t.Fatalf("expected gid fallback, got %q %v", s, ok)
+	}
+	if _, ok := m.Subject(1001, 2001); ok {
+		t.Fatalf("unmapped caller should not resolve")
+	}
+
+	if err := os.WriteFile(p, []byte(`{"uids":{"alice":"user:alice"}}`), 0o644); err != nil {
+		t.Fatalf("write subject map: %v", err)
+	}
+	if _, err := LoadSubjectMap(p); err == nil {
+		t.Fatalf("expected invalid uid error")
+	}
+}
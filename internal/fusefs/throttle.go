@@ -0,0 +1,86 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"sync"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+type readLimiter struct {
+	total, perView int
+
+	mu      sync.Mutex
+	running int
+	byView  map[auth.Authorizer]int
+	waiting map[auth.Authorizer][]chan struct{}
+	order   []auth.Authorizer
+}
+
+func newReadLimiter(total, perView int) *readLimiter {
+	if total <= 0 && perView <= 0 {
+		return nil
+	}
+	return &readLimiter{total: total, perView: perView, byView: map[auth.Authorizer]int{}, waiting: map[auth.Authorizer][]chan struct{}{}}
+}
+
+func (l *readLimiter) acquire(az auth.Authorizer) func() {
+	if l == nil {
+		return func() {}
+	}
+	l.mu.Lock()
+	if len(l.waiting[az]) == 0 && l.free(az) {
+		l.take(az)
+		l.mu.Unlock()
+		return func() { l.release(az) }
+	}
+	ch := make(chan struct{})
+	if len(l.waiting[az]) == 0 {
+		l.order = append(l.order, az)
+	}
+	l.waiting[az] = append(l.waiting[az], ch)
+	l.mu.Unlock()
+	<-ch
+	return func() { l.release(az) }
+}
+
+func (l *readLimiter) free(az auth.Authorizer) bool {
+	return (l.total <= 0 || l.running < l.total) && (l.perView <= 0 || l.byView[az] < l.perView)
+}
+
+func (l *readLimiter) take(az auth.Authorizer) {
+	l.running++
+	l.byView[az]++
+}
+
+func (l *readLimiter) release(az auth.Authorizer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	if l.byView[az]--; l.byView[az] == 0 {
+		delete(l.byView, az)
+	}
+	// One waiter per view in turn; a served view goes to the back of the line.
+	for i := 0; i < len(l.order); {
+		next := l.order[i]
+		if !l.free(next) {
+			i++
+			continue
+		}
+		q := l.waiting[next]
+		l.take(next)
+		close(q[0])
+		l.order = append(l.order[:i], l.order[i+1:]...)
+		if len(q) == 1 {
+			delete(l.waiting, next)
+		} else {
+			l.waiting[next] = q[1:]
+			l.order = append(l.order, next)
+		}
+		if l.total > 0 && l.running >= l.total {
+			return
+		}
+	}
+}
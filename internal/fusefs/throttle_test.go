@@ -0,0 +1,118 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+type namedView string
+
+func (namedView) IsAllowed(auth.CandidateKey) bool { return true }
+
+func TestThrottleBoundsConcurrentReads(t *testing.T) {
+	s := New(Config{MaxConcurrentReads: 2}, auth.NewDenyAll())
+	if s.mountOptions().MaxBackground != 2 {
+		t.Fatalf("max_background not passed to the kernel")
+	}
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.src.throttle(namedView("a"))()
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p != 2 {
+		t.Fatalf("peak concurrency %d, want 2", p)
+	}
+	New(Config{}, auth.NewDenyAll()).src.throttle(namedView("a"))()
+}
+
+func TestReadLimiterSharesSlotsBetweenSubjects(t *testing.T) {
+	l := newReadLimiter(1, 0)
+	scan, interactive := namedView("scan"), namedView("interactive")
+	held := l.acquire(scan)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(v namedView) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := l.acquire(v)
+			mu.Lock()
+			order = append(order, string(v))
+			mu.Unlock()
+			release()
+		}()
+	}
+	waiters := func() int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		n := 0
+		for _, q := range l.waiting {
+			n += len(q)
+		}
+		return n
+	}
+	for i := 0; i < 5; i++ {
+		enqueue(scan)
+	}
+	for waiters() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	enqueue(interactive)
+	for waiters() < 6 {
+		time.Sleep(time.Millisecond)
+	}
+	held()
+	wg.Wait()
+	if len(order) != 6 || (order[0] != "interactive" && order[1] != "interactive") {
+		t.Fatalf("interactive read waited behind the scan: %v", order)
+	}
+
+	// A per-subject bound leaves slots for other subjects.
+	l = newReadLimiter(3, 1)
+	held = l.acquire(scan)
+	done := make(chan struct{})
+	go func() {
+		l.acquire(interactive)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("second subject blocked by the first subject's slot")
+	}
+	blocked := make(chan struct{})
+	go func() {
+		l.acquire(scan)()
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+		t.Fatalf("subject exceeded its per-subject bound")
+	case <-time.After(20 * time.Millisecond):
+	}
+	held()
+	<-blocked
+}
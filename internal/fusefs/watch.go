@@ -0,0 +1,143 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+const sourceDebounce = 100 * time.Millisecond
+
+type sourceWatcher struct {
+	cfg Config
+	src *authSource
+	w   *fsnotify.Watcher
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+	timer   *time.Timer
+
+	flushMu sync.Mutex
+	indexes map[string]*indexer.FileIndex
+}
+
+func newSourceWatcher(cfg Config, src *authSource) (*sourceWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	sw := &sourceWatcher{cfg: cfg, src: src, w: w, pending: map[string]struct{}{}, indexes: map[string]*indexer.FileIndex{}}
+	if err := sw.add(cfg.SourceDir); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *sourceWatcher) add(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && sw.cfg.Excluded(path) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			return sw.w.Add(path)
+		}
+		return nil
+	})
+}
+
+func (sw *sourceWatcher) run(ctx context.Context) {
+	defer sw.w.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			sw.mu.Lock()
+			if sw.timer != nil {
+				sw.timer.Stop()
+			}
+			sw.mu.Unlock()
+			return
+		case ev, ok := <-sw.w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod || sw.cfg.Excluded(ev.Name) {
+				continue
+			}
+			if ev.Has(fsnotify.Create) {
+				if st, err := os.Stat(ev.Name); err == nil && st.IsDir() {
+					if err := sw.add(ev.Name); err != nil {
+						sw.cfg.Warnings.Add(warnings.KindSourceWatch, ev.Name, 0, "watch: %v", err)
+					}
+				}
+			}
+			sw.queue(ev.Name)
+		case err, ok := <-sw.w.Errors:
+			if !ok {
+				return
+			}
+			sw.cfg.Warnings.Add(warnings.KindSourceWatch, "", 0, "watch: %v", err)
+		}
+	}
+}
+
+func (sw *sourceWatcher) queue(path string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.pending[path] = struct{}{}
+	if sw.timer == nil {
+		sw.timer = time.AfterFunc(sourceDebounce, sw.flush)
+	}
+}
+
+func (sw *sourceWatcher) flush() {
+	sw.mu.Lock()
+	paths := sw.pending
+	sw.pending, sw.timer = map[string]struct{}{}, nil
+	sw.mu.Unlock()
+	sw.flushMu.Lock()
+	defer sw.flushMu.Unlock()
+	for path := range paths {
+		sw.refresh(path)
+	}
+}
+
+func (sw *sourceWatcher) refresh(path string) {
+	if filepath.Base(path) == sw.cfg.MapperFileName {
+		// A mapper edit can change the rule of every file below it.
+		dir := filepath.Dir(path) + string(filepath.Separator)
+		for p := range sw.indexes {
+			if strings.HasPrefix(p, dir) {
+				delete(sw.indexes, p)
+			}
+		}
+		sw.src.invalidateSources(func(s string) bool { return strings.HasPrefix(s, dir) })
+		return
+	}
+	st, err := os.Stat(path)
+	if err != nil || st.IsDir() || !strings.HasSuffix(strings.ToLower(path), ".jsonl") {
+		delete(sw.indexes, path)
+	} else if fi, err := indexer.Grow(path, sw.indexes[path], sw.cfg); err != nil {
+		sw.cfg.Warnings.Add(warnings.KindSourceWatch, path, 0, "reindex: %v", err)
+		delete(sw.indexes, path)
+	} else {
+		sw.indexes[path] = fi
+	}
+	sw.src.invalidateSources(func(s string) bool { return s == path })
+}
@@ -0,0 +1,79 @@
+//go:build !windows
+// +build !windows
+
+package fusefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+func TestSourceWatcherReindexesNewAndAppendedFiles(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mapperDoc := "version: 1\nrules:\n  - match:\n      glob: \"**/*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n"
+	if err := os.WriteFile(filepath.Join(src, ".metricfs-map.yaml"), []byte(mapperDoc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := warnings.New()
+	cfg := options.New(options.WithSourceDir(src), options.WithIndex(filepath.Join(dir, "idx"), 1), options.WithWarnings(w))
+	sw, err := newSourceWatcher(cfg, &authSource{warnings: w})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sw.run(ctx)
+
+	lines := func(path string) int {
+		sw.flushMu.Lock()
+		defer sw.flushMu.Unlock()
+		if fi := sw.indexes[path]; fi != nil {
+			return len(fi.Lines)
+		}
+		return -1
+	}
+	waitFor := func(path string, want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for lines(path) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: indexed %d lines, want %d (warnings %v)", path, lines(path), want, w.Counts())
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	sub := filepath.Join(src, "new", "day")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * sourceDebounce)
+	path := filepath.Join(sub, "rows.jsonl")
+	if err := os.WriteFile(path, []byte("{\"id\":\"a\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(path, 1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("{\"id\":\"b\"}\n")
+	_ = f.Close()
+	waitFor(path, 2)
+
+	fi, err := indexer.BuildOrLoad(path, cfg)
+	if err != nil || len(fi.Lines) != 2 {
+		t.Fatalf("stored index: %v %v", fi, err)
+	}
+}
@@ -0,0 +1,169 @@
+package golden
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/projector"
+)
+
+const (
+	SourceDirName      = "source"
+	PermissionsDirName = "permissions"
+	GoldenDirName      = "golden"
+)
+
+type Mismatch struct {
+	Subject string
+	Path    string
+	Reason  string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s/%s: %s", m.Subject, m.Path, m.Reason)
+}
+
+func Record(fixtures string, opts options.Options) (int, error) {
+	outputs, err := render(fixtures, opts)
+	if err != nil {
+		return 0, err
+	}
+	goldenDir := filepath.Join(fixtures, GoldenDirName)
+	if err := os.RemoveAll(goldenDir); err != nil {
+		return 0, err
+	}
+	for key, data := range outputs {
+		p := filepath.Join(goldenDir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return 0, err
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			return 0, err
+		}
+	}
+	return len(outputs), nil
+}
+
+func Check(fixtures string, opts options.Options) ([]Mismatch, error) {
+	outputs, err := render(fixtures, opts)
+	if err != nil {
+		return nil, err
+	}
+	goldenDir := filepath.Join(fixtures, GoldenDirName)
+	recorded := map[string][]byte{}
+	err = filepath.WalkDir(goldenDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(goldenDir, path)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		recorded[filepath.ToSlash(rel)] = b
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read golden outputs: %w", err)
+	}
+
+	var out []Mismatch
+	for key, got := range outputs {
+		want, ok := recorded[key]
+		switch {
+		case !ok:
+			out = append(out, mismatch(key, "not recorded"))
+		case !bytes.Equal(got, want):
+			out = append(out, mismatch(key, fmt.Sprintf("output differs (%d bytes recorded, %d bytes rendered)", len(want), len(got))))
+		}
+	}
+	for key := range recorded {
+		if _, ok := outputs[key]; !ok {
+			out = append(out, mismatch(key, "recorded but no longer rendered"))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].String() < out[j].String() })
+	return out, nil
+}
+
+func mismatch(key, reason string) Mismatch {
+	subject, path, _ := strings.Cut(key, "/")
+	return Mismatch{Subject: subject, Path: path, Reason: reason}
+}
+
+func render(fixtures string, opts options.Options) (map[string][]byte, error) {
+	sourceDir := filepath.Join(fixtures, SourceDirName)
+	if st, err := os.Stat(sourceDir); err != nil || !st.IsDir() {
+		return nil, fmt.Errorf("fixtures source dir invalid: %s", sourceDir)
+	}
+	permFiles, err := filepath.Glob(filepath.Join(fixtures, PermissionsDirName, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(permFiles) == 0 {
+		return nil, fmt.Errorf("no permissions files in %s", filepath.Join(fixtures, PermissionsDirName))
+	}
+	sources, err := datasetFiles(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.With(options.WithSourceDir(sourceDir), options.WithIndex("", opts.IndexFormatVersion))
+
+	out := map[string][]byte{}
+	for _, pf := range permFiles {
+		subject := strings.TrimSuffix(filepath.Base(pf), ".json")
+		az, err := auth.NewFromPermissionsFile(pf, auth.WithDefaultPermission(opts.DefaultPermission))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pf, err)
+		}
+		for _, src := range sources {
+			var b bytes.Buffer
+			if err := projector.RenderFiltered(src, opts, az, &b); err != nil {
+				return nil, fmt.Errorf("render %s for %s: %w", src, subject, err)
+			}
+			rel, err := filepath.Rel(sourceDir, src)
+			if err != nil {
+				return nil, err
+			}
+			vname, _ := projector.VirtualJSONLName(filepath.Base(rel))
+			key := subject + "/" + filepath.ToSlash(filepath.Join(filepath.Dir(rel), vname))
+			if _, dup := out[key]; dup {
+				return nil, fmt.Errorf("fixture %s projects onto an existing virtual name %s", rel, vname)
+			}
+			out[key] = b.Bytes()
+		}
+	}
+	return out, nil
+}
+
+func datasetFiles(sourceDir string) ([]string, error) {
+	var out []string
+	err := filepath.WalkDir(sourceDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		lower := strings.ToLower(d.Name())
+		if strings.HasSuffix(lower, ".jsonl") || strings.HasSuffix(lower, ".jsonl.gz") || strings.HasSuffix(lower, ".jsonl.tar.gz") {
+			out = append(out, path)
+		}
+		return nil
+	})
+	sort.Strings(out)
+	return out, err
+}
@@ -0,0 +1,63 @@
+package golden
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/options"
+)
+
+func TestRecordThenCheck(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, SourceDirName)
+	perms := filepath.Join(dir, PermissionsDirName)
+	for _, d := range []string{src, perms} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	mapperYAML := `version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`
+	writeFile(t, filepath.Join(src, ".metricfs-map.yaml"), mapperYAML)
+	writeFile(t, filepath.Join(src, "rows.jsonl"), "{\"id\":\"a\"}\n{\"id\":\"b\"}\n")
+	writeFile(t, filepath.Join(perms, "alice.json"), `{"allow":[{"object_type":"metric_row","object_id":"a"}]}`)
+
+	opts := options.New()
+	n, err := Record(dir, opts)
+	if err != nil || n != 1 {
+		t.Fatalf("record: n=%d err=%v", n, err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, GoldenDirName, "alice", "rows.jsonl"))
+	if err != nil || string(got) != "{\"id\":\"a\"}\n" {
+		t.Fatalf("unexpected golden output %q, %v", got, err)
+	}
+	if mm, err := Check(dir, opts); err != nil || len(mm) != 0 {
+		t.Fatalf("expected clean check, got %v, %v", mm, err)
+	}
+
+	writeFile(t, filepath.Join(perms, "alice.json"), `{"allow":[{"object_type":"metric_row","object_id":"b"}]}`)
+	mm, err := Check(dir, opts)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(mm) != 1 || mm[0].Subject != "alice" || mm[0].Path != "rows.jsonl" {
+		t.Fatalf("expected one mismatch for alice/rows.jsonl, got %v", mm)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,152 @@
+package httpserve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/vtree"
+)
+
+type Options = options.Options
+
+type Server struct {
+	cfg           Options
+	key           []byte
+	newAuthorizer func(subject string) (auth.Authorizer, error)
+	now           func() time.Time
+
+	mu    sync.Mutex
+	views map[string]*vtree.View
+	azs   []auth.Authorizer
+}
+
+func New(cfg Options, key []byte, newAuthorizer func(subject string) (auth.Authorizer, error)) *Server {
+	return &Server{cfg: cfg, key: key, newAuthorizer: newAuthorizer, now: time.Now, views: map[string]*vtree.View{}}
+}
+
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.views {
+		v.Close()
+	}
+	for _, az := range s.azs {
+		if cl, ok := az.(io.Closer); ok {
+			_ = cl.Close()
+		}
+	}
+	s.views, s.azs = map[string]*vtree.View{}, nil
+}
+
+func (s *Server) view(subject string) (*vtree.View, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.views[subject]; ok {
+		return v, nil
+	}
+	az, err := s.newAuthorizer(subject)
+	if err != nil {
+		return nil, err
+	}
+	v := vtree.NewView(s.cfg, az)
+	s.views[subject] = v
+	s.azs = append(s.azs, az)
+	return v, nil
+}
+
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+type dirEntry struct {
+	Name  string    `json:"name"`
+	Dir   bool      `json:"dir"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/share/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	token, p, _ := strings.Cut(rest, "/")
+	sh, err := Verify(s.key, token, s.now())
+	switch {
+	case errors.Is(err, ErrExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	p = vtree.Clean(p)
+	if !sh.Allows(p) {
+		http.NotFound(w, r)
+		return
+	}
+	v, err := s.view(sh.Subject)
+	if err != nil {
+		http.Error(w, "authorizer unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// Every response is one subject's filtered view.
+	w.Header().Set("Cache-Control", "private, no-store")
+	fi, err := v.Stat(p)
+	if err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	if fi.IsDir() {
+		infos, err := v.ReadDir(p)
+		if err != nil {
+			writeErr(w, r, err)
+			return
+		}
+		out := make([]dirEntry, 0, len(infos))
+		for _, fi := range infos {
+			out = append(out, dirEntry{Name: fi.Name(), Dir: fi.IsDir(), Size: fi.Size(), MTime: fi.ModTime().UTC()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	}
+	data, err := v.Read(p)
+	if err != nil {
+		writeErr(w, r, err)
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), bytes.NewReader(data))
+}
+
+func writeErr(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, "read failed", http.StatusInternalServerError)
+}
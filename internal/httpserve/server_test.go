@@ -0,0 +1,85 @@
+package httpserve
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/pkg/authtest"
+)
+
+func TestShareLinksServeSubjectViewUnderPrefix(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	for _, d := range []string{"orders", "secret"} {
+		if err := os.MkdirAll(filepath.Join(src, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		".metricfs-map.yaml": "version: 1\nrules:\n  - match:\n      glob: \"**/*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n",
+		"orders/rows.jsonl":  "{\"id\":\"a\"}\n{\"id\":\"b\"}\n",
+		"secret/rows.jsonl":  "{\"id\":\"a\"}\n",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spice := authtest.NewServer("token")
+	defer spice.Close()
+	spice.Grant("metric_row:a", "read", "user:alice")
+
+	key := []byte(strings.Repeat("k", MinKeyBytes))
+	cfg := options.New(options.WithSourceDir(src), options.WithIndex(filepath.Join(dir, "idx"), 1))
+	srv := New(cfg, key, func(subject string) (auth.Authorizer, error) {
+		return auth.NewSpiceDB(auth.SpiceDBConfig{Endpoint: spice.URL, Token: "token", Subject: subject})
+	})
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	token, err := Sign(key, Share{Subject: "user:alice", Prefix: "orders", Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("/share/" + token + "/orders/rows.jsonl"); code != 200 || body != "{\"id\":\"a\"}\n" {
+		t.Fatalf("shared file: %d %q", code, body)
+	}
+	code, body := get("/share/" + token + "/orders")
+	var ents []dirEntry
+	if code != 200 || json.Unmarshal([]byte(body), &ents) != nil || len(ents) == 0 || ents[0].Name != "rows.jsonl" {
+		t.Fatalf("shared dir: %d %s", code, body)
+	}
+	if code, _ := get("/share/" + token + "/secret/rows.jsonl"); code != http.StatusNotFound {
+		t.Fatalf("outside prefix: %d", code)
+	}
+	if code, _ := get("/share/" + token + "/orders/../secret/rows.jsonl"); code != http.StatusNotFound {
+		t.Fatalf("dot-dot out of prefix: %d", code)
+	}
+	if code, _ := get("/share/" + token[:len(token)-2] + "xx/orders/rows.jsonl"); code != http.StatusForbidden {
+		t.Fatalf("tampered token: %d", code)
+	}
+	expired, _ := Sign(key, Share{Subject: "user:alice", Prefix: "/", Expires: time.Now().Add(-time.Minute)})
+	if code, _ := get("/share/" + expired + "/orders/rows.jsonl"); code != http.StatusGone {
+		t.Fatalf("expired token: %d", code)
+	}
+}
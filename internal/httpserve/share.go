@@ -0,0 +1,90 @@
+package httpserve
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/vtree"
+)
+
+const MinKeyBytes = 32
+
+var (
+	ErrBadToken = errors.New("invalid share token")
+	ErrExpired  = errors.New("share link expired")
+)
+
+type Share struct {
+	Subject string    `json:"sub"`
+	Prefix  string    `json:"prefix"`
+	Expires time.Time `json:"exp"`
+}
+
+func (s Share) Allows(p string) bool {
+	return s.Prefix == "/" || p == s.Prefix || strings.HasPrefix(p, s.Prefix+"/")
+}
+
+func LoadKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) < MinKeyBytes {
+		return nil, fmt.Errorf("share key must be at least %d bytes, got %d", MinKeyBytes, len(b))
+	}
+	return b, nil
+}
+
+func Sign(key []byte, s Share) (string, error) {
+	typ, id, ok := strings.Cut(s.Subject, ":")
+	if !ok || typ == "" || id == "" {
+		return "", fmt.Errorf("invalid subject %q, expected type:id", s.Subject)
+	}
+	s.Prefix = vtree.Clean(s.Prefix)
+	s.Expires = s.Expires.UTC().Truncate(time.Second)
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac(key, payload)), nil
+}
+
+func Verify(key []byte, token string, now time.Time) (Share, error) {
+	enc := base64.RawURLEncoding
+	p, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Share{}, ErrBadToken
+	}
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return Share{}, ErrBadToken
+	}
+	got, err := enc.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac(key, payload)) {
+		return Share{}, ErrBadToken
+	}
+	var s Share
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return Share{}, ErrBadToken
+	}
+	if !now.Before(s.Expires) {
+		return Share{}, ErrExpired
+	}
+	return s, nil
+}
+
+func mac(key, payload []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(payload)
+	return m.Sum(nil)
+}
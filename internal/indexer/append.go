@@ -0,0 +1,203 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/mapper"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/schema"
+	"github.com/henneberger/metrics-fs/pkg/enums"
+)
+
+var ErrAppendDenied = errors.New("append denied")
+
+var appendLocks sync.Map
+
+func Append(sourcePath string, opts Options, az auth.Authorizer, data []byte) (*FileIndex, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[len(data)-1] != '\n' {
+		return nil, fmt.Errorf("appended data must end with a newline")
+	}
+	writeRule, err := mapper.ResolveRuleForFile(sourcePath, opts.With(options.WithOperation(enums.OperationWrite)).MapperConfig())
+	if err != nil {
+		return nil, err
+	}
+	if writeRule == nil {
+		return nil, fmt.Errorf("%w: no mapper rule for %s", ErrAppendDenied, sourcePath)
+	}
+	if !writeRule.JSONL() {
+		return nil, fmt.Errorf("%w: %s uses the %s codec; only jsonl files accept appends", ErrAppendDenied, sourcePath, writeRule.Rule.Codec)
+	}
+	rows := bytes.SplitAfter(data, []byte("\n"))
+	rows = rows[:len(rows)-1]
+	for i, row := range rows {
+		cands, err := mapper.EvaluateLine(writeRule, bytes.TrimRight(row, "\r\n"))
+		if err != nil || len(cands) == 0 {
+			return nil, fmt.Errorf("%w: row %d has no candidates", ErrAppendDenied, i+1)
+		}
+		for _, c := range cands {
+			if !auth.Allowed(az, c) {
+				return nil, fmt.Errorf("%w: row %d: %s:%s#%s", ErrAppendDenied, i+1, c.ObjectType, c.ObjectID, c.Permission)
+			}
+		}
+	}
+
+	mu, _ := appendLocks.LoadOrStore(sourcePath, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	fi, err := BuildOrLoad(sourcePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(sourcePath, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() != fi.Size {
+		// Changed behind the index; rebuild instead of extending.
+		fi = nil
+	}
+	prefix := []byte{}
+	if st.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, st.Size()-1); err != nil {
+			return nil, err
+		}
+		if last[0] != '\n' {
+			prefix = []byte("\n")
+		}
+	}
+	if _, err := f.Write(append(prefix, data...)); err != nil {
+		return nil, err
+	}
+	if fi == nil {
+		return BuildOrLoad(sourcePath, opts)
+	}
+	if st, err = f.Stat(); err != nil {
+		return nil, err
+	}
+	return extend(fi, opts, st, rows, int64(len(prefix)))
+}
+
+func extend(fi *FileIndex, opts Options, st os.FileInfo, rows [][]byte, prefix int64) (*FileIndex, error) {
+	rule, err := mapper.ResolveRuleForFile(fi.SourcePath, opts.MapperConfig())
+	if err != nil {
+		return nil, err
+	}
+	out := *fi
+	out.Size, out.MtimeUnix, out.BuiltAt = st.Size(), st.ModTime().UnixNano(), time.Now().UTC()
+	out.Header = newHeader(rule, "")
+	out.Lines = append([]LineIndex(nil), fi.Lines...)
+	if n := len(out.Lines); n > 0 {
+		out.Lines[n-1].End += prefix
+	}
+	shapes := shapeTable{ids: map[string]int{}, list: append([]*schema.Schema(nil), fi.Shapes...)}
+	for i, s := range fi.Shapes {
+		if b, err := json.Marshal(s); err == nil {
+			shapes.ids[string(b)] = i + 1
+		}
+	}
+	guard := mapper.NewCandidateGuard(rule, fi.SourcePath)
+	offset := fi.Size + prefix
+	for _, row := range rows {
+		line := strings.TrimRight(string(row), "\r\n")
+		var cands []auth.CandidateKey
+		if rule != nil {
+			cands, err = mapper.EvaluateLine(rule, []byte(line))
+			if err != nil {
+				cands = nil
+			}
+			if cands, err = guard.Check(cands); err != nil {
+				return nil, err
+			}
+		}
+		ln := LineIndex{Start: offset, End: offset + int64(len(row)), Candidates: cands, Shape: shapes.add([]byte(line))}
+		if rule != nil {
+			ln.Decision = rule.Decision
+		}
+		out.Lines = append(out.Lines, ln)
+		offset = ln.End
+	}
+	out.Shapes = shapes.list
+	if store, _ := storeForRule(opts, rule); store != nil {
+		if key, err := storeKey(opts, store, out.SourcePath, nil, st, out.RuleHash); err == nil {
+			_ = save(store, key, &out)
+		}
+	}
+	return &out, nil
+}
+
+func Grow(sourcePath string, prev *FileIndex, opts Options) (*FileIndex, error) {
+	if prev != nil && !prev.Passthrough && prev.SourcePath == sourcePath {
+		if fi, err := grow(prev, opts); err != nil || fi != nil {
+			return fi, err
+		}
+	}
+	return BuildOrLoad(sourcePath, opts)
+}
+
+func grow(prev *FileIndex, opts Options) (*FileIndex, error) {
+	rule, err := mapper.ResolveRuleForFile(prev.SourcePath, opts.MapperConfig())
+	if err != nil || rule == nil || rule.RuleHash != prev.RuleHash || !rule.JSONL() {
+		return nil, err
+	}
+	f, err := os.Open(prev.SourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() <= prev.Size {
+		return nil, nil
+	}
+	if n := len(prev.Lines); n > 0 {
+		last := prev.Lines[n-1]
+		if last.End != prev.Size {
+			return nil, nil
+		}
+		buf := make([]byte, last.End-last.Start)
+		if _, err := f.ReadAt(buf, last.Start); err != nil {
+			return nil, err
+		}
+		if len(buf) == 0 || buf[len(buf)-1] != '\n' {
+			return nil, nil
+		}
+		cands, err := mapper.EvaluateLine(rule, bytes.TrimRight(buf, "\r\n"))
+		if err != nil {
+			cands = nil
+		}
+		if fmt.Sprint(cands) != fmt.Sprint(last.Candidates) {
+			return nil, nil
+		}
+	} else if prev.Size != 0 {
+		return nil, nil
+	}
+	tail := make([]byte, st.Size()-prev.Size)
+	if _, err := f.ReadAt(tail, prev.Size); err != nil {
+		return nil, err
+	}
+	rows := bytes.SplitAfter(tail, []byte("\n"))
+	if len(rows[len(rows)-1]) == 0 {
+		rows = rows[:len(rows)-1]
+	}
+	return extend(prev, opts, st, rows, 0)
+}
@@ -0,0 +1,259 @@
+package indexer
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/faults"
+)
+
+type OpenFile struct {
+	Index *FileIndex
+	f     *os.File
+	key   handleKey
+	refs  int
+	idle  *list.Element
+}
+
+type handleKey struct {
+	path        string
+	size, mtime int64
+}
+
+type Handles struct {
+	mu   sync.Mutex
+	max  int
+	open map[handleKey]*OpenFile
+	idle *list.List
+}
+
+func NewHandles(max int) *Handles {
+	if max <= 0 {
+		return nil
+	}
+	return &Handles{max: max, open: map[handleKey]*OpenFile{}, idle: list.New()}
+}
+
+// The index stays pinned to the version opened until Release.
+func (h *Handles) Open(sourcePath string, opts Options) (*OpenFile, error) {
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	key := handleKey{sourcePath, st.Size(), st.ModTime().UnixNano()}
+	if h != nil {
+		h.mu.Lock()
+		if of, ok := h.open[key]; ok {
+			if of.idle != nil {
+				h.idle.Remove(of.idle)
+				of.idle = nil
+			}
+			of.refs++
+			h.mu.Unlock()
+			_ = f.Close()
+			return of, nil
+		}
+		h.mu.Unlock()
+	}
+	fi, err := buildOrLoad(sourcePath, f, opts)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	of := &OpenFile{Index: fi, f: f, key: handleKey{sourcePath, fi.Size, fi.MtimeUnix}, refs: 1}
+	if h == nil {
+		return of, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cur, ok := h.open[of.key]; ok {
+		// Lost a race with another opener of the same version.
+		_ = f.Close()
+		if cur.idle != nil {
+			h.idle.Remove(cur.idle)
+			cur.idle = nil
+		}
+		cur.refs++
+		return cur, nil
+	}
+	h.open[of.key] = of
+	return of, nil
+}
+
+func (h *Handles) Release(of *OpenFile) {
+	if h != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.open[of.key] == of {
+			of.refs--
+			if of.refs == 0 {
+				of.idle = h.idle.PushFront(of)
+				h.evict()
+			}
+			return
+		}
+	}
+	_ = of.f.Close()
+}
+
+func (h *Handles) evict() {
+	for h.idle.Len() > h.max {
+		old := h.idle.Remove(h.idle.Back()).(*OpenFile)
+		old.idle = nil
+		delete(h.open, old.key)
+		_ = old.f.Close()
+	}
+}
+
+const (
+	readaheadBytes  = 1 << 20
+	sequentialReads = 2
+)
+
+type VisibleReader struct {
+	of       *OpenFile
+	handles  *Handles
+	segments [][2]int64
+	starts   []int64
+	size     int64
+
+	mu      sync.Mutex
+	last    int64
+	streak  int
+	windows []*readahead
+	fetches sync.WaitGroup
+}
+
+type readahead struct {
+	off  int64
+	n    int64
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+func NewVisibleReader(h *Handles, sourcePath string, opts Options, az auth.Authorizer) (*VisibleReader, error) {
+	of, err := h.Open(sourcePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	r := &VisibleReader{of: of, handles: h, segments: VisibleSegments(of.Index, az)}
+	r.starts = make([]int64, len(r.segments))
+	for i, seg := range r.segments {
+		r.starts[i] = r.size
+		r.size += seg[1] - seg[0]
+	}
+	return r, nil
+}
+
+func (r *VisibleReader) Size() int64 { return r.size }
+
+func (r *VisibleReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if w := r.hint(off, int64(len(p))); w != nil {
+		<-w.done
+		if end := min(off+int64(len(p)), r.size); w.err == nil && end <= w.off+int64(len(w.data)) {
+			n := copy(p, w.data[off-w.off:end-w.off])
+			if n < len(p) {
+				return n, io.EOF
+			}
+			return n, nil
+		}
+	}
+	return r.read(p, off)
+}
+
+func (r *VisibleReader) hint(off, n int64) *readahead {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	end := off + n
+	if off == r.last {
+		r.streak++
+	} else {
+		r.streak = 0
+	}
+	r.last = end
+	var hit *readahead
+	kept := r.windows[:0]
+	for _, w := range r.windows {
+		if w.off+w.n <= off || (r.streak == 0 && off < w.off) {
+			continue
+		}
+		if off >= w.off && off < w.off+w.n {
+			hit = w
+		}
+		kept = append(kept, w)
+	}
+	r.windows = kept
+	if r.streak < sequentialReads {
+		return hit
+	}
+	start := end
+	if len(r.windows) > 0 {
+		last := r.windows[len(r.windows)-1]
+		if end < last.off+last.n/2 {
+			return hit
+		}
+		start = last.off + last.n
+	}
+	if start >= r.size {
+		return hit
+	}
+	w := &readahead{off: start, n: min(readaheadBytes, r.size-start), done: make(chan struct{})}
+	r.windows = append(r.windows, w)
+	r.fetches.Add(1)
+	go func() {
+		defer r.fetches.Done()
+		defer close(w.done)
+		buf := make([]byte, w.n)
+		m, err := r.read(buf, w.off)
+		if err == io.EOF {
+			err = nil
+		}
+		w.data, w.err = buf[:m], err
+	}()
+	return hit
+}
+
+func (r *VisibleReader) read(p []byte, off int64) (int, error) {
+	i := sort.Search(len(r.starts), func(i int) bool { return r.starts[i] > off }) - 1
+	n := 0
+	for ; i < len(r.segments) && n < len(p); i++ {
+		seg := r.segments[i]
+		src := seg[0] + off + int64(n) - r.starts[i]
+		want := min(int64(len(p)-n), seg[1]-src)
+		if err := faults.Inject(faults.SourceRead); err != nil {
+			return n, err
+		}
+		m, err := r.of.f.ReadAt(p[n:n+int(want)], src)
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if int64(m) < want {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *VisibleReader) Close() error {
+	// Fetches in flight read from the file being released.
+	r.fetches.Wait()
+	r.handles.Release(r.of)
+	return nil
+}
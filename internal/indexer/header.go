@@ -0,0 +1,100 @@
+package indexer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/henneberger/metrics-fs/internal/indexstore"
+	"github.com/henneberger/metrics-fs/internal/mapper"
+)
+
+const headerHash = "sha256"
+
+type IndexHeader struct {
+	Layout        int          `json:"layout"`
+	Builder       string       `json:"builder"`
+	HashAlgorithm string       `json:"hash_algorithm"`
+	MapperFiles   []HashedFile `json:"mapper_files,omitempty"`
+	SourceHash    string       `json:"source_hash,omitempty"`
+}
+
+type HashedFile struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+func builderVersion() string {
+	v := "(unknown)"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		v = bi.Main.Version
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				v += " " + s.Value
+			}
+		}
+	}
+	return fmt.Sprintf("metricfs %s %s", v, runtime.Version())
+}
+
+func newHeader(rule *mapper.SelectedRule, sourceHash string) *IndexHeader {
+	h := &IndexHeader{Layout: indexLayout, Builder: builderVersion(), HashAlgorithm: headerHash, SourceHash: sourceHash}
+	if rule == nil {
+		return h
+	}
+	for _, p := range rule.MapperFiles {
+		f := HashedFile{Path: p}
+		if b, err := os.ReadFile(p); err == nil {
+			sum := sha256.Sum256(b)
+			f.Hash = hex.EncodeToString(sum[:])
+		}
+		h.MapperFiles = append(h.MapperFiles, f)
+	}
+	return h
+}
+
+func Cached(sourcePath string, opts Options) (*FileIndex, error) {
+	rule, err := mapper.ResolveRuleForFile(sourcePath, opts.MapperConfig())
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storeForRule(opts, rule)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf("%s is not cached (no index store or index: none): %w", sourcePath, indexstore.ErrNotFound)
+	}
+	ruleHash := "passthrough"
+	if rule != nil {
+		ruleHash = rule.RuleHash
+	}
+	key, err := storeKey(opts, store, sourcePath, nil, st, ruleHash)
+	if err != nil {
+		return nil, err
+	}
+	return loadFor(store, key, sourcePath, st, ruleHash)
+}
+
+func ReadIndexFile(path string) (*FileIndex, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fi FileIndex
+	if err := json.Unmarshal(b, &fi); err != nil {
+		return nil, fmt.Errorf("%s: not an index file: %w", path, err)
+	}
+	if fi.SourcePath == "" {
+		return nil, fmt.Errorf("%s: not an index file", path)
+	}
+	return &fi, nil
+}
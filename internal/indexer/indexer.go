@@ -1,75 +1,90 @@
 package indexer
 
 import (
-	"bufio"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/chunkcache"
+	"github.com/henneberger/metrics-fs/internal/faults"
+	"github.com/henneberger/metrics-fs/internal/indexstore"
 	"github.com/henneberger/metrics-fs/internal/mapper"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/schema"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+	"github.com/henneberger/metrics-fs/pkg/enums"
 )
 
+// Bump indexLayout whenever the persisted FileIndex shape changes.
+const indexLayout = 3
+
 type LineIndex struct {
 	Start      int64               `json:"start"`
 	End        int64               `json:"end"`
-	Decision   string              `json:"decision"`
+	Decision   enums.Decision      `json:"decision"`
 	Candidates []auth.CandidateKey `json:"candidates"`
+	Shape      int                 `json:"shape,omitempty"`
 }
 
 type FileIndex struct {
-	SourcePath  string      `json:"source_path"`
-	Size        int64       `json:"size"`
-	MtimeUnix   int64       `json:"mtime_unix"`
-	RuleHash    string      `json:"rule_hash"`
-	Passthrough bool        `json:"passthrough"`
-	BuiltAt     time.Time   `json:"built_at"`
-	Lines       []LineIndex `json:"lines"`
+	SourcePath  string            `json:"source_path"`
+	Size        int64             `json:"size"`
+	MtimeUnix   int64             `json:"mtime_unix"`
+	RuleHash    string            `json:"rule_hash"`
+	Passthrough bool              `json:"passthrough"`
+	BuiltAt     time.Time         `json:"built_at"`
+	Lines       []LineIndex       `json:"lines"`
+	Shapes      []*schema.Schema  `json:"shapes,omitempty"`
+	RowQuotas   []mapper.RowQuota `json:"row_quotas,omitempty"`
+	Codec       string            `json:"codec,omitempty"`
+	Header      *IndexHeader      `json:"header,omitempty"`
 }
 
-type Options struct {
-	SourceDir         string
-	MapperFileName    string
-	MapperInherit     bool
-	MissingMapperMode string
-	MissingResource   string
-	IndexDir          string
-	FormatVersion     int
-}
+type Options = options.Options
 
 func BuildOrLoad(sourcePath string, opts Options) (*FileIndex, error) {
-	rule, err := mapper.ResolveRuleForFile(sourcePath, mapper.Config{
-		SourceDir:         opts.SourceDir,
-		MapperFileName:    opts.MapperFileName,
-		InheritParent:     opts.MapperInherit,
-		MissingMapperMode: opts.MissingMapperMode,
-		DefaultMissingKey: opts.MissingResource,
-	})
+	f, err := os.Open(sourcePath)
 	if err != nil {
 		return nil, err
 	}
-	st, err := os.Stat(sourcePath)
+	defer f.Close()
+	return buildOrLoad(sourcePath, f, opts)
+}
+
+// Only st.Size() bytes of f are indexed, so appends during the build are not seen.
+func buildOrLoad(sourcePath string, f *os.File, opts Options) (*FileIndex, error) {
+	rule, err := mapper.ResolveRuleForFile(sourcePath, opts.MapperConfig())
 	if err != nil {
 		return nil, err
 	}
-	cachePath := ""
-	if opts.IndexDir != "" {
-		formatVersion := opts.FormatVersion
-		if formatVersion <= 0 {
-			formatVersion = 1
-		}
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	store, err := storeForRule(opts, rule)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := ""
+	if store != nil {
 		ruleHash := "passthrough"
 		if rule != nil {
 			ruleHash = rule.RuleHash
 		}
-		cachePath = cacheFilePath(opts.IndexDir, sourcePath, st.Size(), st.ModTime().UnixNano(), ruleHash, formatVersion)
-		if fi, err := load(cachePath); err == nil {
+		if cacheKey, err = storeKey(opts, store, sourcePath, f, st, ruleHash); err != nil {
+			return nil, err
+		}
+		if fi, err := loadFor(store, cacheKey, sourcePath, st, ruleHash); err == nil {
 			return fi, nil
 		}
 	}
@@ -81,56 +96,107 @@ func BuildOrLoad(sourcePath string, opts Options) (*FileIndex, error) {
 			RuleHash:    "passthrough",
 			Passthrough: true,
 			BuiltAt:     time.Now().UTC(),
+			Header:      newHeader(nil, ""),
 		}
-		if cachePath != "" {
-			_ = save(cachePath, fi)
+		if store != nil {
+			_ = save(store, cacheKey, fi)
 		}
 		return fi, nil
 	}
-	fi, err := build(sourcePath, st, rule)
+	if opts.IndexBuilder != nil && rule.Rule.Index != mapper.IndexNone {
+		fi, err := buildRemote(opts.IndexBuilder, sourcePath, st, rule)
+		if err == nil {
+			if store != nil {
+				_ = save(store, cacheKey, fi)
+			}
+			return fi, nil
+		}
+		opts.Warnings.Add(warnings.KindIndexFallback, sourcePath, 0, "index server: %v; built locally", err)
+	}
+	fi, err := build(f, sourcePath, st, rule)
 	if err != nil {
 		return nil, err
 	}
-	if cachePath != "" {
-		_ = save(cachePath, fi)
+	if store != nil {
+		_ = save(store, cacheKey, fi)
 	}
 	return fi, nil
 }
 
-func build(sourcePath string, st os.FileInfo, rule *mapper.SelectedRule) (*FileIndex, error) {
-	f, err := os.Open(sourcePath)
+func Warm(sourcePath string, opts Options) (bool, error) {
+	rule, err := mapper.ResolveRuleForFile(sourcePath, opts.MapperConfig())
+	if err != nil {
+		return false, err
+	}
+	if rule != nil && rule.Rule.Index == mapper.IndexNone {
+		return false, nil
+	}
+	_, err = BuildOrLoad(sourcePath, opts)
+	return err == nil, err
+}
+
+func buildRemote(b options.IndexBuilder, sourcePath string, st os.FileInfo, rule *mapper.SelectedRule) (*FileIndex, error) {
+	raw, err := b.BuildIndex(sourcePath)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	var fi FileIndex
+	if err := json.Unmarshal(raw, &fi); err != nil {
+		return nil, err
+	}
+	if fi.Size != st.Size() || fi.MtimeUnix != st.ModTime().UnixNano() {
+		return nil, fmt.Errorf("remote index is for a different version of the file")
+	}
+	if fi.RuleHash != rule.RuleHash {
+		return nil, fmt.Errorf("remote index rule hash %s differs from local %s", fi.RuleHash, rule.RuleHash)
+	}
+	fi.SourcePath = sourcePath
+	fi.RowQuotas = rule.Rule.RowQuotas
+	fi.Codec = rule.Rule.Codec
+	return &fi, nil
+}
 
-	br := bufio.NewReaderSize(f, 1<<20)
+func build(f *os.File, sourcePath string, st os.FileInfo, rule *mapper.SelectedRule) (*FileIndex, error) {
+	rc := rule.Codec()
+	sum := sha256.New()
+	records := rc.Split(io.TeeReader(io.NewSectionReader(f, 0, st.Size()), sum))
 	offset := int64(0)
+	lineNo := 0
 	lines := make([]LineIndex, 0, 1024)
+	shapes := shapeTable{ids: map[string]int{}}
+	guard := mapper.NewCandidateGuard(rule, sourcePath)
 	for {
-		chunk, err := br.ReadBytes('\n')
-		if err != nil && err != io.EOF {
+		rec, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
 			return nil, err
 		}
-		if len(chunk) > 0 {
-			start := offset
-			end := offset + int64(len(chunk))
-			lineTrim := strings.TrimRight(string(chunk), "\r\n")
-			cands, evalErr := mapper.EvaluateLine(rule, []byte(lineTrim))
-			if evalErr != nil {
-				cands = nil
-			}
-			lines = append(lines, LineIndex{
-				Start:      start,
-				End:        end,
-				Decision:   rule.Decision,
-				Candidates: cands,
-			})
-			offset = end
+		lineNo++
+		start := offset
+		end := offset + int64(len(rec))
+		doc, evalErr := rc.Decode(rec)
+		var cands []auth.CandidateKey
+		if evalErr == nil {
+			cands, evalErr = mapper.EvaluateLine(rule, doc)
 		}
-		if err == io.EOF {
-			break
+		if evalErr != nil {
+			rule.Warnings.Add(warnings.KindMalformedLine, sourcePath, lineNo, "%v", evalErr)
+			cands = nil
 		}
+		cands, guardErr := guard.Check(cands)
+		if guardErr != nil {
+			return nil, guardErr
+		}
+		lines = append(lines, LineIndex{
+			Start:      start,
+			End:        end,
+			Decision:   rule.Decision,
+			Candidates: cands,
+			Shape:      shapes.add(doc),
+		})
+		offset = end
 	}
 	return &FileIndex{
 		SourcePath: sourcePath,
@@ -139,17 +205,67 @@ func build(sourcePath string, st os.FileInfo, rule *mapper.SelectedRule) (*FileI
 		RuleHash:   rule.RuleHash,
 		BuiltAt:    time.Now().UTC(),
 		Lines:      lines,
+		Shapes:     shapes.list,
+		RowQuotas:  rule.Rule.RowQuotas,
+		Codec:      rule.Rule.Codec,
+		Header:     newHeader(rule, hex.EncodeToString(sum.Sum(nil))),
 	}, nil
 }
 
+type shapeTable struct {
+	ids  map[string]int
+	list []*schema.Schema
+}
+
+func (t *shapeTable) add(line []byte) int {
+	var doc any
+	if err := json.Unmarshal(line, &doc); err != nil {
+		return 0
+	}
+	s := schema.Infer(doc)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return 0
+	}
+	if id, ok := t.ids[string(b)]; ok {
+		return id
+	}
+	t.list = append(t.list, s)
+	id := len(t.list)
+	t.ids[string(b)] = id
+	return id
+}
+
+func VisibleSchema(fi *FileIndex, az auth.Authorizer) *schema.Schema {
+	seen := map[int]struct{}{}
+	memo := NewFileMemo(fi, az)
+	var out *schema.Schema
+	for _, ln := range fi.Lines {
+		// Row quotas must count every line, so none skip the memo.
+		if !memo.Visible(ln.Decision, ln.Candidates) {
+			continue
+		}
+		if ln.Shape <= 0 || ln.Shape > len(fi.Shapes) {
+			continue
+		}
+		if _, ok := seen[ln.Shape]; ok {
+			continue
+		}
+		seen[ln.Shape] = struct{}{}
+		out = schema.Merge(out, fi.Shapes[ln.Shape-1])
+	}
+	return out
+}
+
 func VisibleSegments(fi *FileIndex, az auth.Authorizer) [][2]int64 {
 	if fi.Passthrough {
 		return [][2]int64{{0, fi.Size}}
 	}
 	segments := make([][2]int64, 0)
+	memo := NewFileMemo(fi, az)
 	var current *[2]int64
 	for _, ln := range fi.Lines {
-		if isVisible(ln, az) {
+		if memo.Visible(ln.Decision, ln.Candidates) {
 			if current == nil {
 				seg := [2]int64{ln.Start, ln.End}
 				current = &seg
@@ -175,83 +291,232 @@ func VisibleSegments(fi *FileIndex, az auth.Authorizer) [][2]int64 {
 	return segments
 }
 
-func isVisible(ln LineIndex, az auth.Authorizer) bool {
-	if len(ln.Candidates) == 0 {
-		return false
-	}
-	if ln.Decision == "all" {
-		for _, c := range ln.Candidates {
-			if !az.IsAllowed(c) {
-				return false
-			}
+func FilterToWriter(fi *FileIndex, az auth.Authorizer, w io.Writer) error {
+	return CopyVisible(fi, az, nil, w)
+}
+
+const ChunkBytes = 64 << 10
+
+func VisibleChunks(fi *FileIndex, az auth.Authorizer) [][2]int64 {
+	var chunks [][2]int64
+	for _, seg := range VisibleSegments(fi, az) {
+		if fi.Passthrough {
+			chunks = append(chunks, seg)
+			continue
 		}
-		return true
-	}
-	for _, c := range ln.Candidates {
-		if az.IsAllowed(c) {
-			return true
+		start := seg[0]
+		for _, ln := range linesIn(fi, seg) {
+			if ln.Start > start && ln.Start/ChunkBytes != start/ChunkBytes {
+				chunks = append(chunks, [2]int64{start, ln.Start})
+				start = ln.Start
+			}
 		}
+		chunks = append(chunks, [2]int64{start, seg[1]})
 	}
-	return false
+	return chunks
 }
 
-func FilterToWriter(fi *FileIndex, az auth.Authorizer, w io.Writer) error {
+func linesIn(fi *FileIndex, seg [2]int64) []LineIndex {
+	i := sort.Search(len(fi.Lines), func(i int) bool { return fi.Lines[i].Start >= seg[0] })
+	j := sort.Search(len(fi.Lines), func(i int) bool { return fi.Lines[i].Start >= seg[1] })
+	return fi.Lines[i:j]
+}
+
+func CopyVisible(fi *FileIndex, az auth.Authorizer, cache *chunkcache.Cache, w io.Writer) error {
 	if fi.Passthrough {
 		f, err := os.Open(fi.SourcePath)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		_, err = io.Copy(w, f)
+		_, err = io.Copy(w, io.NewSectionReader(f, 0, fi.Size))
 		return err
 	}
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for _, c := range VisibleChunks(fi, az) {
+		key := chunkcache.Key{Path: fi.SourcePath, Size: fi.Size, MTime: fi.MtimeUnix, Start: c[0], End: c[1]}
+		buf, ok := cache.Get(key)
+		if !ok {
+			if f == nil {
+				var err error
+				if f, err = os.Open(fi.SourcePath); err != nil {
+					return err
+				}
+			}
+			if err := faults.Inject(faults.SourceRead); err != nil {
+				return err
+			}
+			buf = make([]byte, c[1]-c[0])
+			if _, err := f.ReadAt(buf, c[0]); err != nil && err != io.EOF {
+				return err
+			}
+			cache.Put(key, buf)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func FilterLines(fi *FileIndex, az auth.Authorizer, fn func(ln LineIndex, line []byte) error) error {
 	f, err := os.Open(fi.SourcePath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	memo := NewFileMemo(fi, az)
 	for _, ln := range fi.Lines {
-		if !isVisible(ln, az) {
+		if !memo.Visible(ln.Decision, ln.Candidates) {
 			continue
 		}
 		sz := ln.End - ln.Start
 		if sz <= 0 {
 			continue
 		}
+		if err := faults.Inject(faults.SourceRead); err != nil {
+			return err
+		}
 		buf := make([]byte, sz)
 		if _, err := f.ReadAt(buf, ln.Start); err != nil && err != io.EOF {
 			return err
 		}
-		if _, err := w.Write(buf); err != nil {
+		if err := fn(ln, buf); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func cacheFilePath(indexDir, sourcePath string, size int64, mtime int64, ruleHash string, formatVersion int) string {
-	k := fmt.Sprintf("%d|%s|%d|%d|%s", formatVersion, sourcePath, size, mtime, ruleHash)
+func storeFor(opts Options) indexstore.Store {
+	if opts.IndexStore != nil {
+		return opts.IndexStore
+	}
+	if opts.IndexDir != "" {
+		return indexstore.Dir(opts.IndexDir)
+	}
+	return nil
+}
+
+// Not a hex digest, so it never collides with an index key.
+const healthKey = ".metricfs-health"
+
+func CheckStore(opts Options) error {
+	store := storeFor(opts)
+	if store == nil {
+		return nil
+	}
+	return store.Put(healthKey, []byte(time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+var ruleStores sync.Map
+
+func storeForRule(opts Options, rule *mapper.SelectedRule) (indexstore.Store, error) {
+	if rule == nil || rule.Rule.Index == "" {
+		return storeFor(opts), nil
+	}
+	if rule.Rule.Index == mapper.IndexNone {
+		return nil, nil
+	}
+	if s, ok := ruleStores.Load(rule.Rule.Index); ok {
+		return s.(indexstore.Store), nil
+	}
+	s, err := indexstore.Open(rule.Rule.Index)
+	if err != nil {
+		return nil, fmt.Errorf("rule index %s: %w", rule.Rule.Index, err)
+	}
+	cur, _ := ruleStores.LoadOrStore(rule.Rule.Index, s)
+	return cur.(indexstore.Store), nil
+}
+
+func indexKey(opts Options, sourcePath string, size int64, mtime int64, ruleHash string) string {
+	formatVersion := opts.IndexFormatVersion
+	if formatVersion <= 0 {
+		formatVersion = 1
+	}
+	k := fmt.Sprintf("%d|%d|%s|%d|%d|%s", formatVersion, indexLayout, sourcePath, size, mtime, ruleHash)
 	h := sha1.Sum([]byte(k))
-	return filepath.Join(indexDir, hex.EncodeToString(h[:])+".json")
+	return hex.EncodeToString(h[:]) + ".json"
 }
 
-func save(path string, fi *FileIndex) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return err
+// Shared stores key on what every host sees alike: relative path and content.
+func storeKey(opts Options, store indexstore.Store, sourcePath string, f *os.File, st os.FileInfo, ruleHash string) (string, error) {
+	if _, local := store.(indexstore.Dir); local {
+		return indexKey(opts, sourcePath, st.Size(), st.ModTime().UnixNano(), ruleHash), nil
+	}
+	sum, err := contentDigest(sourcePath, f, st)
+	if err != nil {
+		return "", err
+	}
+	rel := sourcePath
+	if r, err := filepath.Rel(opts.SourceDir, sourcePath); err == nil && opts.SourceDir != "" && !strings.HasPrefix(r, "..") {
+		rel = filepath.ToSlash(r)
+	}
+	return indexKey(opts, rel+"@"+sum, st.Size(), 0, ruleHash), nil
+}
+
+func loadFor(store indexstore.Store, key, sourcePath string, st os.FileInfo, ruleHash string) (*FileIndex, error) {
+	fi, err := load(store, key)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size != st.Size() || fi.RuleHash != ruleHash {
+		return nil, fmt.Errorf("stored index %s is for a different file version or rule", key)
+	}
+	fi.SourcePath, fi.MtimeUnix = sourcePath, st.ModTime().UnixNano()
+	return fi, nil
+}
+
+type digestEntry struct {
+	size, mtime int64
+	sum         string
+}
+
+var digests sync.Map
+
+func contentDigest(sourcePath string, f *os.File, st os.FileInfo) (string, error) {
+	want := digestEntry{size: st.Size(), mtime: st.ModTime().UnixNano()}
+	if v, ok := digests.Load(sourcePath); ok {
+		if e := v.(digestEntry); e.size == want.size && e.mtime == want.mtime {
+			return e.sum, nil
+		}
+	}
+	if f == nil {
+		var err error
+		if f, err = os.Open(sourcePath); err != nil {
+			return "", err
+		}
+		defer f.Close()
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, st.Size())); err != nil {
+		return "", err
 	}
+	want.sum = hex.EncodeToString(h.Sum(nil))
+	digests.Store(sourcePath, want)
+	return want.sum, nil
+}
+
+func save(store indexstore.Store, key string, fi *FileIndex) error {
 	b, err := json.Marshal(fi)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, b, 0o644)
+	return store.Put(key, b)
 }
 
-func load(path string) (*FileIndex, error) {
-	b, err := os.ReadFile(path)
+func load(store indexstore.Store, key string) (*FileIndex, error) {
+	b, err := store.Get(key)
 	if err != nil {
 		return nil, err
 	}
+	b = faults.Corrupt(faults.IndexLoad, b)
 	var fi FileIndex
 	if err := json.Unmarshal(b, &fi); err != nil {
 		return nil, err
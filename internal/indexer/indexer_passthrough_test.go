@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/faults"
 )
 
 func TestPassthroughWhenMapperMissing(t *testing.T) {
@@ -37,3 +38,28 @@ func TestPassthroughWhenMapperMissing(t *testing.T) {
 		t.Fatalf("expected passthrough output %q, got %q", want, b.Bytes())
 	}
 }
+
+func TestCorruptIndexCacheIsRebuilt(t *testing.T) {
+	defer faults.Reset()
+	dir := t.TempDir()
+	p := filepath.Join(dir, "raw.jsonl")
+	if err := os.WriteFile(p, []byte("{\"x\":1}\n"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	opts := Options{
+		SourceDir:         dir,
+		MissingMapperMode: "passthrough",
+		IndexDir:          filepath.Join(dir, "index"),
+	}
+	if _, err := BuildOrLoad(p, opts); err != nil {
+		t.Fatalf("initial build: %v", err)
+	}
+	faults.Set(faults.IndexLoad, faults.Fault{Corrupt: true})
+	fi, err := BuildOrLoad(p, opts)
+	if err != nil {
+		t.Fatalf("build with corrupt cache: %v", err)
+	}
+	if !fi.Passthrough || fi.Size != 8 {
+		t.Fatalf("expected rebuilt passthrough index, got %#v", fi)
+	}
+}
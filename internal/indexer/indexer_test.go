@@ -2,9 +2,22 @@ package indexer
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/chunkcache"
+	"github.com/henneberger/metrics-fs/internal/indexstore"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+	"github.com/henneberger/metrics-fs/pkg/enums"
 )
 
 func TestFilterOrdersForAlice(t *testing.T) {
@@ -34,3 +47,812 @@ func TestFilterOrdersForAlice(t *testing.T) {
 		t.Fatalf("expected orders_2 filtered out: %s", out)
 	}
 }
+
+type countingAuthorizer struct {
+	calls int
+}
+
+func (c *countingAuthorizer) IsAllowed(k auth.CandidateKey) bool {
+	c.calls++
+	return k.ObjectID == "a"
+}
+
+func TestDecisionMemoReusesCandidateSets(t *testing.T) {
+	az := &countingAuthorizer{}
+	memo := NewDecisionMemo(az)
+	set := []auth.CandidateKey{
+		{ObjectType: "job", ObjectID: "b", Permission: "read"},
+		{ObjectType: "job", ObjectID: "a", Permission: "read"},
+	}
+	for i := 0; i < 100; i++ {
+		if !memo.Visible("any", set) {
+			t.Fatalf("expected any decision visible")
+		}
+		if memo.Visible("all", set) {
+			t.Fatalf("expected all decision hidden")
+		}
+	}
+	if az.calls != 3 {
+		t.Fatalf("expected 3 authorizer calls across both modes, got %d", az.calls)
+	}
+}
+
+func TestDecisionMemoSuppressesTombstonedRows(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "tombstones.json")
+	if err := os.WriteFile(p, []byte(`{"suppress":[{"object_type":"job","object_id":"b"}]}`), 0o644); err != nil {
+		t.Fatalf("write tombstones: %v", err)
+	}
+	ts, err := auth.NewTombstones(p, "")
+	if err != nil {
+		t.Fatalf("tombstones: %v", err)
+	}
+	memo := NewDecisionMemo(ts.Wrap(&countingAuthorizer{}))
+	allowedOnly := []auth.CandidateKey{{ObjectType: "job", ObjectID: "a", Permission: "read"}}
+	withTombstone := []auth.CandidateKey{
+		{ObjectType: "job", ObjectID: "a", Permission: "read"},
+		{ObjectType: "job", ObjectID: "b", Permission: "read"},
+	}
+	if !memo.Visible("any", allowedOnly) {
+		t.Fatalf("expected row without tombstoned candidates visible")
+	}
+	for i := 0; i < 2; i++ {
+		if memo.Visible("any", withTombstone) {
+			t.Fatalf("expected tombstoned row hidden despite allow")
+		}
+	}
+	if got := ts.SuppressedRows(); got != 2 {
+		t.Fatalf("expected 2 suppressed rows, got %d", got)
+	}
+}
+
+type idAuthorizer map[string]bool
+
+func (a idAuthorizer) IsAllowed(k auth.CandidateKey) bool { return a[k.ObjectID] }
+
+func TestCopyVisibleSharesChunksAcrossSubjects(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	var rows bytes.Buffer
+	pad := strings.Repeat("x", 1000)
+	for i := 0; i < 200; i++ {
+		id := "shared"
+		if i >= 150 {
+			id = fmt.Sprintf("own%d", i%2)
+		}
+		fmt.Fprintf(&rows, "{\"id\":%q,\"pad\":%q}\n", id, pad)
+	}
+	p := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(p, rows.Bytes(), 0o644); err != nil {
+		t.Fatalf("write rows: %v", err)
+	}
+	fi, err := BuildOrLoad(p, Options{SourceDir: dir, MissingMapperMode: "deny", MissingResource: "deny"})
+	if err != nil {
+		t.Fatalf("build index: %v", err)
+	}
+	cache := chunkcache.New(1 << 20)
+	var alice, bob, direct bytes.Buffer
+	if err := CopyVisible(fi, idAuthorizer{"shared": true, "own0": true}, cache, &alice); err != nil {
+		t.Fatalf("alice: %v", err)
+	}
+	if err := CopyVisible(fi, idAuthorizer{"shared": true, "own1": true}, cache, &bob); err != nil {
+		t.Fatalf("bob: %v", err)
+	}
+	if err := FilterToWriter(fi, idAuthorizer{"shared": true, "own1": true}, &direct); err != nil {
+		t.Fatalf("direct: %v", err)
+	}
+	if !bytes.Equal(bob.Bytes(), direct.Bytes()) {
+		t.Fatalf("cached render differs from direct render")
+	}
+	if s := cache.Stats(); s.Hits == 0 || s.BytesSaved < 100000 {
+		t.Fatalf("expected the shared prefix to be served from cache, got %+v", s)
+	}
+}
+
+func TestMalformedLinesAreWarned(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	p := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(p, []byte("{\"id\":\"a\"}\nnot json\n"), 0o644); err != nil {
+		t.Fatalf("write rows: %v", err)
+	}
+	warns := warnings.New()
+	if _, err := BuildOrLoad(p, Options{SourceDir: dir, MissingMapperMode: "deny", MissingResource: "deny", Warnings: warns}); err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	got := warns.Snapshot()
+	if len(got) != 1 || got[0].Kind != warnings.KindMalformedLine || got[0].Line != 2 {
+		t.Fatalf("expected malformed_line warning for line 2, got %#v", got)
+	}
+}
+
+func TestStaticCandidatesCheckOncePerFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match: {glob: "*.jsonl"}
+    static_candidates: ["dataset:a"]
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	p := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(p, []byte("{\"id\":1}\nplain text\n{\"id\":3}\n"), 0o644); err != nil {
+		t.Fatalf("write rows: %v", err)
+	}
+	fi, err := BuildOrLoad(p, Options{SourceDir: dir, MissingMapperMode: "deny", MissingResource: "deny"})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	az := &countingAuthorizer{}
+	if segs := VisibleSegments(fi, az); len(segs) != 1 || segs[0] != [2]int64{0, fi.Size} {
+		t.Fatalf("expected the whole file visible, got %v", segs)
+	}
+	if az.calls != 1 {
+		t.Fatalf("expected one authorizer call for the file, got %d", az.calls)
+	}
+}
+
+type permAuthorizer map[string]bool
+
+func (a permAuthorizer) IsAllowed(k auth.CandidateKey) bool { return a[k.ObjectID+"#"+k.Permission] }
+
+func TestAppendValidatesAndExtendsIndex(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	path := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(path, []byte(`{"id":"a","v":1}`), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	opts := Options{SourceDir: dir, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny", IndexDir: filepath.Join(dir, "index")}
+	writer := permAuthorizer{"a#write": true}
+	if _, err := Append(path, opts, writer, []byte("{\"id\":\"a\",\"v\":2}\n{\"id\":\"b\",\"v\":3}\n")); !errors.Is(err, ErrAppendDenied) {
+		t.Fatalf("expected append with a row for b denied, got %v", err)
+	}
+	if _, err := Append(path, opts, permAuthorizer{"a#read": true}, []byte("{\"id\":\"a\",\"v\":2}\n")); !errors.Is(err, ErrAppendDenied) {
+		t.Fatalf("expected read permission not to allow appends, got %v", err)
+	}
+	fi, err := Append(path, opts, writer, []byte("{\"id\":\"a\",\"v\":2}\n{\"id\":\"a\",\"v\":3}\n"))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	b, _ := os.ReadFile(path)
+	if string(b) != "{\"id\":\"a\",\"v\":1}\n{\"id\":\"a\",\"v\":2}\n{\"id\":\"a\",\"v\":3}\n" {
+		t.Fatalf("unexpected source after append: %q", b)
+	}
+	opts.IndexDir = ""
+	rebuilt, err := BuildOrLoad(path, opts)
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if fmt.Sprint(fi.Lines) != fmt.Sprint(rebuilt.Lines) || fi.Size != rebuilt.Size || len(fi.Shapes) != len(rebuilt.Shapes) {
+		t.Fatalf("extended index %+v differs from rebuilt %+v", fi.Lines, rebuilt.Lines)
+	}
+}
+
+func TestVisibilityCountsGrantingObjects(t *testing.T) {
+	cand := func(typ, id string) auth.CandidateKey {
+		return auth.CandidateKey{ObjectType: typ, ObjectID: id, Permission: "read"}
+	}
+	fi := &FileIndex{Lines: []LineIndex{
+		{Decision: enums.DecisionAny, Candidates: []auth.CandidateKey{cand("team", "a"), cand("job", "x")}},
+		{Decision: enums.DecisionAny, Candidates: []auth.CandidateKey{cand("team", "a"), cand("job", "y")}},
+		{Decision: enums.DecisionAny, Candidates: []auth.CandidateKey{cand("team", "b"), cand("job", "y")}},
+		{Decision: enums.DecisionAny, Candidates: []auth.CandidateKey{cand("team", "c")}},
+	}}
+	v := VisibilityOf(fi, idAuthorizer{"a": true, "y": true}, 2)
+	if v.VisibleRows != 3 {
+		t.Fatalf("visible rows = %d, want 3", v.VisibleRows)
+	}
+	if v.ObjectTypes["team"] != 2 || v.ObjectTypes["job"] != 2 {
+		t.Fatalf("unexpected object types %v", v.ObjectTypes)
+	}
+	want := []ObjectVisibility{{"job", "y", 2}, {"team", "a", 2}}
+	if fmt.Sprint(v.Objects) != fmt.Sprint(want) || v.TruncatedObjects != 0 {
+		t.Fatalf("objects = %v (truncated %d), want %v", v.Objects, v.TruncatedObjects, want)
+	}
+	for _, o := range VisibilityOf(fi, idAuthorizer{"a": true, "y": true, "b": true}, 1).Objects {
+		if o.ObjectID == "b" || o.ObjectID == "c" || o.ObjectID == "x" {
+			t.Fatalf("top-1 should drop %v", o)
+		}
+	}
+}
+
+func TestRowQuotasCapPreviewRowsPerObject(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    row_quotas:
+      - permission: "preview"
+        max_rows_per_object: 2
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	path := filepath.Join(dir, "rows.jsonl")
+	var src strings.Builder
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(&src, "{\"id\":\"a\",\"v\":%d}\n{\"id\":\"b\",\"v\":%d}\n", i, i)
+	}
+	if err := os.WriteFile(path, []byte(src.String()), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	fi, err := BuildOrLoad(path, Options{SourceDir: dir, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny"})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	var b bytes.Buffer
+	if err := FilterToWriter(fi, permAuthorizer{"a#read": true, "b#preview": true}, &b); err != nil {
+		t.Fatalf("filter: %v", err)
+	}
+	if got := strings.Count(b.String(), `"id":"a"`); got != 4 {
+		t.Fatalf("full read rows = %d, want 4", got)
+	}
+	if got := strings.Count(b.String(), `"id":"b"`); got != 2 || strings.Contains(b.String(), `{"id":"b","v":2}`) {
+		t.Fatalf("preview rows must be the first 2: %s", b.String())
+	}
+	var n int64
+	for _, seg := range VisibleSegments(fi, permAuthorizer{"a#read": true, "b#preview": true}) {
+		n += seg[1] - seg[0]
+	}
+	if n != int64(b.Len()) {
+		t.Fatalf("segments size %d, rendered %d", n, b.Len())
+	}
+}
+
+func TestGrowIndexesOnlyAppendedRows(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	path := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(path, []byte("{\"id\":\"a\"}\n"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	opts := Options{SourceDir: dir, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny"}
+	prev, err := BuildOrLoad(path, opts)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("{\"id\":\"b\"}\n{\"id\":\"c\"")
+	_ = f.Close()
+	grown, err := Grow(path, prev, opts)
+	if err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+	rebuilt, err := BuildOrLoad(path, opts)
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if fmt.Sprint(grown.Lines) != fmt.Sprint(rebuilt.Lines) || grown.Size != rebuilt.Size {
+		t.Fatalf("grown index %+v differs from rebuilt %+v", grown.Lines, rebuilt.Lines)
+	}
+
+	// A partial last row or a rewritten last row forces a rebuild.
+	if err := os.WriteFile(path, []byte("{\"id\":\"x\"}\n{\"id\":\"b\"}\n{\"id\":\"c\"}\n{\"id\":\"d\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := grow(grown, opts); err != nil || fi != nil {
+		t.Fatalf("grow over a partial row: %v %v", fi, err)
+	}
+	if err := os.WriteFile(path, []byte("{\"id\":\"z\"}\n{\"id\":\"y\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := grow(prev, opts); err != nil || fi != nil {
+		t.Fatalf("grow over a rewritten row: %v %v", fi, err)
+	}
+}
+
+func TestHandlesShareOpenFilesAndReadVisibleRows(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	var src strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&src, "{\"id\":\"%c\",\"n\":%d}\n", 'a'+i%3, i)
+	}
+	paths := []string{filepath.Join(dir, "one.jsonl"), filepath.Join(dir, "two.jsonl")}
+	for _, p := range paths {
+		if err := os.WriteFile(p, []byte(src.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{SourceDir: dir, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny"}
+	az := idAuthorizer{"a": true, "c": true}
+	h := NewHandles(1)
+
+	r1, err := NewVisibleReader(h, paths[0], opts, az)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewVisibleReader(h, paths[0], opts, az)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.of != r2.of {
+		t.Fatalf("readers of one file version must share the open file")
+	}
+	fi, _ := BuildOrLoad(paths[0], opts)
+	var want bytes.Buffer
+	if err := FilterToWriter(fi, az, &want); err != nil {
+		t.Fatal(err)
+	}
+	if r1.Size() != int64(want.Len()) {
+		t.Fatalf("size %d, want %d", r1.Size(), want.Len())
+	}
+	var got bytes.Buffer
+	buf := make([]byte, 7)
+	for off := int64(0); ; {
+		n, err := r1.ReadAt(buf, off)
+		got.Write(buf[:n])
+		off += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got.String() != want.String() {
+		t.Fatalf("streamed %q, want %q", got.String(), want.String())
+	}
+
+	_ = r1.Close()
+	_ = r2.Close()
+	r3, err := NewVisibleReader(h, paths[1], opts, az)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r3.Close()
+	if _, ok := h.open[r1.of.key]; ok || h.idle.Len() != 1 {
+		t.Fatalf("least recently released file must be closed beyond max")
+	}
+	if _, err := r1.of.f.Stat(); err == nil {
+		t.Fatalf("evicted file still open")
+	}
+}
+
+func TestRuleIndexRoutesOrSkipsTheStore(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	cold := filepath.Join(dir, "cold")
+	if err := os.MkdirAll(filepath.Join(src, "archive"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "archive/**"
+    index: "`+cold+`"
+    object_type: "metric_row"
+    permission: "read"
+    mapper: {kind: "json_pointer", pointer: "/id", canonical_template: "{value}"}
+  - match:
+      glob: "huge_*.jsonl"
+    index: none
+    object_type: "metric_row"
+    permission: "read"
+    mapper: {kind: "json_pointer", pointer: "/id", canonical_template: "{value}"}
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper: {kind: "json_pointer", pointer: "/id", canonical_template: "{value}"}
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	for _, name := range []string{"daily.jsonl", "huge_1.jsonl", "archive/old.jsonl"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte("{\"id\":\"a\"}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shared := filepath.Join(dir, "shared")
+	opts := Options{SourceDir: src, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny", IndexDir: shared}
+	count := func(d string) int {
+		ents, _ := os.ReadDir(d)
+		return len(ents)
+	}
+	for name, want := range map[string]bool{"daily.jsonl": true, "huge_1.jsonl": false, "archive/old.jsonl": true} {
+		warmed, err := Warm(filepath.Join(src, name), opts)
+		if err != nil || warmed != want {
+			t.Fatalf("warm %s: %v %v", name, warmed, err)
+		}
+	}
+	if count(shared) != 1 || count(cold) != 1 {
+		t.Fatalf("expected one index in each store, got shared=%d cold=%d", count(shared), count(cold))
+	}
+	fi, err := BuildOrLoad(filepath.Join(src, "huge_1.jsonl"), opts)
+	if err != nil || len(fi.Lines) != 1 {
+		t.Fatalf("unindexed build: %+v %v", fi, err)
+	}
+	if count(shared) != 1 {
+		t.Fatalf("index: none must not be stored, shared=%d", count(shared))
+	}
+}
+
+func TestWarmSinceSkipsFilesUnchangedSinceManifest(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeMapper := func(pointer string) {
+		if err := os.WriteFile(filepath.Join(src, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper: {kind: "json_pointer", pointer: "`+pointer+`", canonical_template: "{value}"}
+`), 0o644); err != nil {
+			t.Fatalf("write mapper: %v", err)
+		}
+	}
+	writeMapper("/id")
+	for _, name := range []string{"a.jsonl", "b.jsonl"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte("{\"id\":\"a\"}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{SourceDir: src, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny", IndexDir: filepath.Join(dir, "idx")}
+	run := func(prev *Manifest) (*Manifest, map[string]WarmResult) {
+		next, err := NewManifest(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]WarmResult{}
+		for _, name := range []string{"a.jsonl", "b.jsonl"} {
+			res, err := WarmSince(filepath.Join(src, name), opts, prev, next)
+			if err != nil {
+				t.Fatalf("warm %s: %v", name, err)
+			}
+			got[name] = res
+		}
+		return next, got
+	}
+	first, got := run(nil)
+	if got["a.jsonl"] != Warmed || got["b.jsonl"] != Warmed || first.Files["a.jsonl"].SHA256 == "" {
+		t.Fatalf("first run: %v %+v", got, first.Files)
+	}
+	path := filepath.Join(dir, "manifest.json")
+	if err := first.Write(path); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	prev, err := LoadManifest(path)
+	if err != nil {
+		t.Fatalf("load manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "b.jsonl"), []byte("{\"id\":\"a\"}\n{\"id\":\"b\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	second, got := run(prev)
+	if got["a.jsonl"] != Unchanged || got["b.jsonl"] != Warmed {
+		t.Fatalf("second run: %v", got)
+	}
+	if second.Files["a.jsonl"] != prev.Files["a.jsonl"] || second.Files["b.jsonl"].SHA256 == prev.Files["b.jsonl"].SHA256 {
+		t.Fatalf("manifest entries not carried or refreshed: %+v", second.Files)
+	}
+	writeMapper("/other")
+	if _, got = run(second); got["a.jsonl"] != Warmed || got["b.jsonl"] != Warmed {
+		t.Fatalf("a mapper change must rewarm every file: %v", got)
+	}
+}
+
+func TestVisibleReaderReadsAheadForSequentialReaders(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper: {kind: "json_pointer", pointer: "/id", canonical_template: "{value}"}
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	var src strings.Builder
+	for i := 0; i < 30000; i++ {
+		fmt.Fprintf(&src, "{\"id\":\"%c\",\"n\":%d}\n", 'a'+i%3, i)
+	}
+	p := filepath.Join(dir, "big.jsonl")
+	if err := os.WriteFile(p, []byte(src.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{SourceDir: dir, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny"}
+	az := idAuthorizer{"a": true, "c": true}
+	fi, err := BuildOrLoad(p, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := FilterToWriter(fi, az, &want); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewVisibleReader(nil, p, opts, az)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	buf := make([]byte, 4096)
+	if _, err := r.ReadAt(buf, r.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.windows) != 0 {
+		t.Fatalf("random read started %d readahead windows", len(r.windows))
+	}
+	var got bytes.Buffer
+	fetched := false
+	for off := int64(0); ; {
+		n, err := r.ReadAt(buf, off)
+		got.Write(buf[:n])
+		off += int64(n)
+		r.mu.Lock()
+		fetched = fetched || len(r.windows) > 0
+		r.mu.Unlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !fetched {
+		t.Fatalf("sequential reads never read ahead")
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("read-ahead view differs from the filtered file")
+	}
+}
+
+func TestIndexHeaderRecordsMapperAndSourceHashes(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mapperYAML := []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper: {kind: "json_pointer", pointer: "/id", canonical_template: "{value}"}
+`)
+	data := []byte("{\"id\":\"a\"}\n{\"id\":\"b\"}\n")
+	if err := os.WriteFile(filepath.Join(src, ".metricfs-map.yaml"), mapperYAML, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(src, "rows.jsonl")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{SourceDir: src, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny", IndexDir: filepath.Join(dir, "idx")}
+	if _, err := Cached(path, opts); !errors.Is(err, indexstore.ErrNotFound) {
+		t.Fatalf("Cached before build = %v, want ErrNotFound", err)
+	}
+	fi, err := BuildOrLoad(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := func(b []byte) string {
+		s := sha256.Sum256(b)
+		return hex.EncodeToString(s[:])
+	}
+	h := fi.Header
+	if h == nil || h.Layout != indexLayout || h.HashAlgorithm != "sha256" || h.SourceHash != sum(data) || h.Builder == "" {
+		t.Fatalf("header = %+v", h)
+	}
+	if len(h.MapperFiles) != 1 || h.MapperFiles[0].Path != filepath.Join(src, ".metricfs-map.yaml") || h.MapperFiles[0].Hash != sum(mapperYAML) {
+		t.Fatalf("mapper files = %+v", h.MapperFiles)
+	}
+	cached, err := Cached(path, opts)
+	if err != nil || cached.Header == nil || cached.Header.SourceHash != h.SourceHash {
+		t.Fatalf("Cached = %+v, %v", cached, err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "idx", "*"))
+	if len(files) != 1 {
+		t.Fatalf("index files = %v", files)
+	}
+	stored, err := ReadIndexFile(files[0])
+	if err != nil || stored.SourcePath != path || stored.Header == nil || stored.Header.SourceHash != h.SourceHash {
+		t.Fatalf("ReadIndexFile = %+v, %v", stored, err)
+	}
+	if _, err := ReadIndexFile(path); err == nil {
+		t.Fatal("ReadIndexFile accepted a source file")
+	}
+}
+
+func TestVisibleReaderServesTheVersionItOpened(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper: {kind: "json_pointer", pointer: "/id", canonical_template: "{value}"}
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	p := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(p, []byte("{\"id\":\"a\",\"n\":1}\n{\"id\":\"b\",\"n\":2}\n{\"id\":\"a\",\"n\":3}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{SourceDir: dir, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny"}
+	az := idAuthorizer{"a": true}
+	want := "{\"id\":\"a\",\"n\":1}\n{\"id\":\"a\",\"n\":3}\n"
+	h := NewHandles(4)
+	r, err := NewVisibleReader(h, p, opts, az)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	readAll := func() string {
+		buf := make([]byte, 1024)
+		n, err := r.ReadAt(buf, 0)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	// Neither an append nor a replacement may leak into the open reader.
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("{\"id\":\"a\",\"n\":4}\n{\"id\":\"a\""); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if got := readAll(); got != want || r.Size() != int64(len(want)) {
+		t.Fatalf("after append read %q (size %d), want %q", got, r.Size(), want)
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte("{\"id\":\"a\",\"n\":100000}\n{\"id\":\"a\",\"n\":200000}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(); got != want {
+		t.Fatalf("after replace read %q, want %q", got, want)
+	}
+	r2, err := NewVisibleReader(h, p, opts, az)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if r2.Size() != int64(len("{\"id\":\"a\",\"n\":100000}\n{\"id\":\"a\",\"n\":200000}\n")) {
+		t.Fatalf("new reader size %d", r2.Size())
+	}
+}
+
+type sharedStore struct {
+	m    map[string][]byte
+	puts int
+}
+
+func (s *sharedStore) Get(key string) ([]byte, error) {
+	b, ok := s.m[key]
+	if !ok {
+		return nil, indexstore.ErrNotFound
+	}
+	return b, nil
+}
+
+func (s *sharedStore) Put(key string, b []byte) error {
+	s.m[key] = b
+	s.puts++
+	return nil
+}
+
+func TestSharedStoreReusesIndexesAcrossHosts(t *testing.T) {
+	store := &sharedStore{m: map[string][]byte{}}
+	mapperYAML := "version: 1\nrules:\n  - match:\n      glob: \"*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n"
+	host := func(rows string, mtime time.Time) (Options, string) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(mapperYAML), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "rows.jsonl")
+		if err := os.WriteFile(path, []byte(rows), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return Options{SourceDir: dir, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", MissingResource: "deny", IndexStore: store}, path
+	}
+	rows := "{\"id\":\"a\"}\n{\"id\":\"b\"}\n"
+	optsA, pathA := host(rows, time.Unix(1000, 0))
+	optsB, pathB := host(rows, time.Unix(2000, 0))
+	if _, err := BuildOrLoad(pathA, optsA); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := BuildOrLoad(pathB, optsB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.puts != 1 {
+		t.Fatalf("second host built its own index: %d puts", store.puts)
+	}
+	if fi.SourcePath != pathB || fi.MtimeUnix != time.Unix(2000, 0).UnixNano() || len(fi.Lines) != 2 {
+		t.Fatalf("shared index not adopted for this host: %+v", fi)
+	}
+
+	// Same path and size, different content: a different key.
+	optsC, pathC := host("{\"id\":\"c\"}\n{\"id\":\"d\"}\n", time.Unix(2000, 0))
+	if fi, err = BuildOrLoad(pathC, optsC); err != nil {
+		t.Fatal(err)
+	}
+	if store.puts != 2 || fi.Lines[0].Candidates[0].ObjectID != "c" {
+		t.Fatalf("changed content reused a stale index: %d puts, %+v", store.puts, fi.Lines)
+	}
+}
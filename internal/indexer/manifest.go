@@ -0,0 +1,133 @@
+package indexer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/mapper"
+)
+
+const manifestVersion = 1
+
+type Manifest struct {
+	Version   int                      `json:"version"`
+	SourceDir string                   `json:"source_dir"`
+	CreatedAt time.Time                `json:"created_at"`
+	Files     map[string]ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Size      int64  `json:"size"`
+	MtimeUnix int64  `json:"mtime_unix"`
+	SHA256    string `json:"sha256"`
+	RuleHash  string `json:"rule_hash"`
+	Skipped   bool   `json:"skipped,omitempty"`
+}
+
+func NewManifest(sourceDir string) (*Manifest, error) {
+	abs, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{Version: manifestVersion, SourceDir: abs, CreatedAt: time.Now().UTC(), Files: map[string]ManifestEntry{}}, nil
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%s: manifest version %d, expected %d", path, m.Version, manifestVersion)
+	}
+	if m.Files == nil {
+		m.Files = map[string]ManifestEntry{}
+	}
+	return &m, nil
+}
+
+func (m *Manifest) Write(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type WarmResult int
+
+const (
+	Warmed WarmResult = iota
+	Unchanged
+	SkippedNoIndex
+)
+
+func WarmSince(sourcePath string, opts Options, prev, next *Manifest) (WarmResult, error) {
+	abs, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	rel, err := filepath.Rel(next.SourceDir, abs)
+	if err != nil {
+		return 0, err
+	}
+	rel = filepath.ToSlash(rel)
+	rule, err := mapper.ResolveRuleForFile(sourcePath, opts.MapperConfig())
+	if err != nil {
+		return 0, err
+	}
+	st, err := os.Stat(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	e := ManifestEntry{Size: st.Size(), MtimeUnix: st.ModTime().UnixNano(), RuleHash: "passthrough"}
+	if rule != nil {
+		e.RuleHash = rule.RuleHash
+		e.Skipped = rule.Rule.Index == mapper.IndexNone
+	}
+	if prev != nil {
+		if old, ok := prev.Files[rel]; ok && old.Size == e.Size && old.MtimeUnix == e.MtimeUnix && old.RuleHash == e.RuleHash && old.Skipped == e.Skipped {
+			next.Files[rel] = old
+			return Unchanged, nil
+		}
+	}
+	res := SkippedNoIndex
+	if !e.Skipped {
+		if _, err := BuildOrLoad(sourcePath, opts); err != nil {
+			return 0, err
+		}
+		res = Warmed
+	}
+	if e.SHA256, err = fileSHA256(sourcePath); err != nil {
+		return 0, err
+	}
+	next.Files[rel] = e
+	return res, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
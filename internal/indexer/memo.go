@@ -0,0 +1,188 @@
+package indexer
+
+import (
+	"strings"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/mapper"
+	"github.com/henneberger/metrics-fs/pkg/enums"
+)
+
+// Keys are the exact candidate tuples, not a digest, so a collision can never flip a decision.
+type DecisionMemo struct {
+	az, base   auth.Authorizer
+	sup        auth.Suppressor
+	m          map[string]bool
+	suppressed map[string]struct{}
+	sb         strings.Builder
+
+	quotas  []mapper.RowQuota
+	allowed map[auth.CandidateKey]bool
+	rows    map[auth.CandidateKey]int
+}
+
+func NewDecisionMemo(az auth.Authorizer) *DecisionMemo {
+	sup, _ := az.(auth.Suppressor)
+	return &DecisionMemo{az: az, base: az, sup: sup, m: map[string]bool{}, suppressed: map[string]struct{}{}}
+}
+
+func NewFileMemo(fi *FileIndex, az auth.Authorizer) *DecisionMemo {
+	d := NewDecisionMemo(az).WithRowQuotas(fi.RowQuotas)
+	if _, ok := az.(auth.BatchAuthorizer); !ok {
+		return d
+	}
+	seen := map[auth.CandidateKey]struct{}{}
+	var cands []auth.CandidateKey
+	for _, ln := range fi.Lines {
+		for _, c := range ln.Candidates {
+			if _, ok := seen[c]; !ok {
+				seen[c] = struct{}{}
+				cands = append(cands, c)
+			}
+		}
+	}
+	return d.Prefetch(cands)
+}
+
+func (d *DecisionMemo) Prefetch(cands []auth.CandidateKey) *DecisionMemo {
+	d.az = auth.Prefetch(d.base, cands)
+	return d
+}
+
+// Quota state is ordered: the memo must see every line of the pass in file order.
+func (d *DecisionMemo) WithRowQuotas(q []mapper.RowQuota) *DecisionMemo {
+	if len(q) > 0 {
+		d.quotas = q
+		d.allowed = map[auth.CandidateKey]bool{}
+		d.rows = map[auth.CandidateKey]int{}
+	}
+	return d
+}
+
+func (d *DecisionMemo) Visible(decision enums.Decision, cands []auth.CandidateKey) bool {
+	if len(cands) == 0 {
+		return false
+	}
+	if v := d.visible(decision, cands); v || len(d.quotas) == 0 {
+		return v
+	}
+	if _, ok := d.suppressed[d.key(decision, cands)]; ok {
+		return false
+	}
+	return d.quotaVisible(decision, cands)
+}
+
+func (d *DecisionMemo) visible(decision enums.Decision, cands []auth.CandidateKey) bool {
+	key := d.key(decision, cands)
+	v, ok := d.m[key]
+	if !ok {
+		v = evaluate(decision, cands, d.az)
+		if v && d.isSuppressed(cands) {
+			d.suppressed[key] = struct{}{}
+			v = false
+		}
+		d.m[key] = v
+	}
+	if _, ok := d.suppressed[key]; ok {
+		d.sup.RowSuppressed()
+	}
+	return v
+}
+
+func (d *DecisionMemo) quotaVisible(decision enums.Decision, cands []auth.CandidateKey) bool {
+	for _, q := range d.quotas {
+		objects := map[auth.CandidateKey]struct{}{}
+		for _, c := range cands {
+			c.Permission = q.Permission
+			ok, seen := d.allowed[c]
+			if !seen {
+				ok = auth.Allowed(d.az, c)
+				d.allowed[c] = ok
+			}
+			if ok {
+				objects[auth.CandidateKey{ObjectType: c.ObjectType, ObjectID: c.ObjectID}] = struct{}{}
+			} else if decision == enums.DecisionAll {
+				objects = nil
+				break
+			}
+		}
+		if len(objects) == 0 {
+			continue
+		}
+		if d.isSuppressed(cands) {
+			d.sup.RowSuppressed()
+			return false
+		}
+		for o := range objects {
+			if d.rows[o] >= q.MaxRowsPerObject {
+				return false
+			}
+		}
+		for o := range objects {
+			d.rows[o]++
+		}
+		return true
+	}
+	return false
+}
+
+func (d *DecisionMemo) isSuppressed(cands []auth.CandidateKey) bool {
+	if d.sup == nil {
+		return false
+	}
+	for _, c := range cands {
+		if d.sup.Suppressed(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DecisionMemo) key(decision enums.Decision, cands []auth.CandidateKey) string {
+	d.sb.Reset()
+	d.sb.WriteString(string(decision))
+	for _, c := range cands {
+		d.sb.WriteByte(0)
+		d.sb.WriteString(c.ObjectType)
+		d.sb.WriteByte(0)
+		d.sb.WriteString(c.ObjectID)
+		d.sb.WriteByte(0)
+		d.sb.WriteString(c.Permission)
+		d.sb.WriteByte(0)
+		d.sb.WriteString(c.Context)
+	}
+	return d.sb.String()
+}
+
+func GrantingCandidates(decision enums.Decision, cands []auth.CandidateKey, az auth.Authorizer) []auth.CandidateKey {
+	if decision == enums.DecisionAll {
+		return cands
+	}
+	out := []auth.CandidateKey{}
+	for _, c := range cands {
+		if auth.Allowed(az, c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func evaluate(decision enums.Decision, cands []auth.CandidateKey, az auth.Authorizer) bool {
+	if len(cands) == 0 {
+		return false
+	}
+	if decision == enums.DecisionAll {
+		for _, c := range cands {
+			if !auth.Allowed(az, c) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, c := range cands {
+		if auth.Allowed(az, c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package indexer
+
+import (
+	"sort"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+const DefaultVisibilityTopN = 20
+
+type Visibility struct {
+	VisibleRows      int                `json:"visible_rows"`
+	Passthrough      bool               `json:"passthrough,omitempty"`
+	ObjectTypes      map[string]int     `json:"object_types"`
+	Objects          []ObjectVisibility `json:"objects"`
+	TruncatedObjects int                `json:"truncated_objects,omitempty"`
+}
+
+type ObjectVisibility struct {
+	ObjectType string `json:"object_type"`
+	ObjectID   string `json:"object_id"`
+	Rows       int    `json:"rows"`
+}
+
+func VisibilityOf(fi *FileIndex, az auth.Authorizer, topN int) Visibility {
+	v := Visibility{ObjectTypes: map[string]int{}, Objects: []ObjectVisibility{}}
+	// Passthrough files have no mapper, so their rows carry no objects.
+	if fi.Passthrough {
+		v.Passthrough = true
+		return v
+	}
+	if topN <= 0 {
+		topN = DefaultVisibilityTopN
+	}
+	type object struct{ typ, id string }
+	rows := map[object]int{}
+	memo := NewFileMemo(fi, az)
+	for _, ln := range fi.Lines {
+		if !memo.Visible(ln.Decision, ln.Candidates) {
+			continue
+		}
+		v.VisibleRows++
+		seen := map[object]bool{}
+		types := map[string]bool{}
+		for _, c := range GrantingCandidates(ln.Decision, ln.Candidates, az) {
+			o := object{c.ObjectType, c.ObjectID}
+			if !seen[o] {
+				seen[o] = true
+				rows[o]++
+			}
+			if !types[c.ObjectType] {
+				types[c.ObjectType] = true
+				v.ObjectTypes[c.ObjectType]++
+			}
+		}
+	}
+	for o, n := range rows {
+		v.Objects = append(v.Objects, ObjectVisibility{ObjectType: o.typ, ObjectID: o.id, Rows: n})
+	}
+	sort.Slice(v.Objects, func(i, j int) bool {
+		a, b := v.Objects[i], v.Objects[j]
+		if a.Rows != b.Rows {
+			return a.Rows > b.Rows
+		}
+		if a.ObjectType != b.ObjectType {
+			return a.ObjectType < b.ObjectType
+		}
+		return a.ObjectID < b.ObjectID
+	})
+	if len(v.Objects) > topN {
+		v.TruncatedObjects = len(v.Objects) - topN
+		v.Objects = v.Objects[:topN]
+	}
+	return v
+}
@@ -0,0 +1,203 @@
+package indexrpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/authzed/grpcutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/options"
+)
+
+const (
+	ServiceName = "metricfs.v1.IndexService"
+	buildMethod = "/" + ServiceName + "/BuildOrLoad"
+)
+
+type BuildRequest struct {
+	Path string `json:"path"`
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)   { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(b []byte, v any) error { return json.Unmarshal(b, v) }
+func (jsonCodec) Name() string                    { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type indexService interface {
+	build(ctx context.Context, req *BuildRequest) (*indexer.FileIndex, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*indexService)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "BuildOrLoad",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(BuildRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			return srv.(indexService).build(ctx, req)
+		},
+	}},
+}
+
+type Server struct {
+	opts  options.Options
+	token string
+
+	mu       sync.Mutex
+	inflight map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	fi   *indexer.FileIndex
+	err  error
+}
+
+func NewServer(opts options.Options, token string) *Server {
+	return &Server{opts: opts, token: token, inflight: map[string]*flight{}}
+}
+
+func (s *Server) GRPC(certFile, keyFile string) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if certFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("index server tls: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	g := grpc.NewServer(opts...)
+	g.RegisterService(&serviceDesc, s)
+	return g, nil
+}
+
+func (s *Server) build(ctx context.Context, req *BuildRequest) (*indexer.FileIndex, error) {
+	if s.token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		got := md.Get("authorization")
+		if len(got) != 1 || subtle.ConstantTimeCompare([]byte(got[0]), []byte("Bearer "+s.token)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "invalid index server token")
+		}
+	}
+	rel := filepath.Clean(filepath.FromSlash(req.Path))
+	if req.Path == "" || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, status.Errorf(codes.InvalidArgument, "path %q must be relative to the source dir", req.Path)
+	}
+	path := filepath.Join(s.opts.SourceDir, rel)
+
+	s.mu.Lock()
+	f, ok := s.inflight[path]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		s.inflight[path] = f
+		s.mu.Unlock()
+		f.fi, f.err = indexer.BuildOrLoad(path, s.opts)
+		s.mu.Lock()
+		delete(s.inflight, path)
+		close(f.done)
+	}
+	s.mu.Unlock()
+	<-f.done
+	if f.err != nil {
+		return nil, status.Error(codes.Internal, f.err.Error())
+	}
+	return f.fi, nil
+}
+
+type Client struct {
+	conn      *grpc.ClientConn
+	sourceDir string
+	Timeout   time.Duration
+}
+
+type Transport struct {
+	Insecure bool
+	CAFile   string
+}
+
+func Dial(addr, sourceDir, token string, t Transport) (*Client, error) {
+	opts := []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name()))}
+	switch {
+	case t.Insecure:
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	case t.CAFile != "":
+		certs, err := grpcutil.WithCustomCerts(grpcutil.VerifyCA, t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("index server ca file: %w", err)
+		}
+		opts = append(opts, certs)
+	default:
+		certs, err := grpcutil.WithSystemCerts(grpcutil.VerifyCA)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, certs)
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerCredentials{token: token, secure: !t.Insecure}))
+	}
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("index server %s: %w", addr, err)
+	}
+	return &Client{conn: conn, sourceDir: sourceDir, Timeout: 5 * time.Minute}, nil
+}
+
+type bearerCredentials struct {
+	token  string
+	secure bool
+}
+
+func (c bearerCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c bearerCredentials) RequireTransportSecurity() bool { return c.secure }
+
+func (c *Client) BuildIndex(sourcePath string) ([]byte, error) {
+	root, err := filepath.Abs(c.sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	var out json.RawMessage
+	if err := c.conn.Invoke(ctx, buildMethod, &BuildRequest{Path: filepath.ToSlash(rel)}, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
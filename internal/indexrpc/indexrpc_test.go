@@ -0,0 +1,181 @@
+package indexrpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+func TestBuildOrLoadDelegatesToServer(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	path := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(path, []byte("{\"id\":\"a\"}\n{\"id\":\"b\"}\n"), 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+	serverOpts := options.New(options.WithSourceDir(dir), options.WithIndex(filepath.Join(t.TempDir(), "server"), 1))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv, err := NewServer(serverOpts, "secret").GRPC("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	client, err := Dial(lis.Addr().String(), dir, "secret", Transport{Insecure: true})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	warns := warnings.New()
+	remote, err := indexer.BuildOrLoad(path, options.New(options.WithSourceDir(dir), options.WithIndexBuilder(client), options.WithWarnings(warns)))
+	if err != nil || warns.Counts()[warnings.KindIndexFallback] != 0 {
+		t.Fatalf("build via server: %v, %v", err, warns.Counts())
+	}
+	local, err := indexer.BuildOrLoad(path, options.New(options.WithSourceDir(dir)))
+	if err != nil {
+		t.Fatalf("build locally: %v", err)
+	}
+	if remote.SourcePath != path || fmt.Sprint(remote.Lines) != fmt.Sprint(local.Lines) {
+		t.Fatalf("remote index %+v differs from local %+v", remote, local)
+	}
+
+	if _, err := client.BuildIndex(filepath.Join(dir, "..", "etc", "passwd.jsonl")); err == nil {
+		t.Fatalf("expected paths outside the source dir rejected")
+	}
+	bad, err := Dial(lis.Addr().String(), dir, "wrong", Transport{Insecure: true})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer bad.Close()
+	if _, err := bad.BuildIndex(path); err == nil {
+		t.Fatalf("expected wrong token rejected")
+	}
+}
+
+func TestTLSAndPlaintextOptIn(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSigned(t, t.TempDir())
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match: {glob: "*.jsonl"}
+    object_type: metric_row
+    permission: read
+    mapper: {kind: json_pointer, pointer: /id, canonical_template: "{value}"}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(path, []byte("{\"id\":\"a\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(certFile, keyFile string) string {
+		srv, err := NewServer(options.New(options.WithSourceDir(dir), options.WithIndex(t.TempDir(), 1)), "secret").GRPC(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() { _ = srv.Serve(lis) }()
+		t.Cleanup(srv.Stop)
+		return lis.Addr().String()
+	}
+	build := func(addr string, tr Transport) error {
+		client, err := Dial(addr, dir, "secret", tr)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		client.Timeout = 5 * time.Second
+		_, err = client.BuildIndex(path)
+		return err
+	}
+
+	secure := serve(certFile, keyFile)
+	if err := build(secure, Transport{CAFile: certFile}); err != nil {
+		t.Fatalf("build over tls: %v", err)
+	}
+	if err := build(secure, Transport{}); err == nil {
+		t.Fatalf("expected a certificate outside the system roots rejected")
+	}
+	if err := build(secure, Transport{Insecure: true}); err == nil {
+		t.Fatalf("expected a plaintext client rejected by a tls server")
+	}
+	// Without the opt-in the client never sends the token in the clear.
+	plain := serve("", "")
+	if err := build(plain, Transport{CAFile: certFile}); err == nil {
+		t.Fatalf("expected a tls client to refuse a plaintext server")
+	}
+	if err := build(plain, Transport{Insecure: true}); err != nil {
+		t.Fatalf("build over plaintext with opt-in: %v", err)
+	}
+	if _, err := NewServer(options.New(), "").GRPC(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Fatalf("expected a missing certificate rejected")
+	}
+}
+
+func writeSelfSigned(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "metricfs index server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
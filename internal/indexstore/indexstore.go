@@ -0,0 +1,54 @@
+package indexstore
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotFound = errors.New("index not found")
+
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, b []byte) error
+}
+
+func Open(raw string) (Store, error) {
+	if !strings.Contains(raw, "://") {
+		return Dir(raw), nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index store %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return Dir(u.Path), nil
+	case "s3":
+		return newS3(u)
+	case "redis":
+		return newRedis(u)
+	default:
+		return nil, fmt.Errorf("unsupported index store scheme %q (want file, s3, or redis)", u.Scheme)
+	}
+}
+
+type Dir string
+
+func (d Dir) Get(key string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(string(d), key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (d Dir) Put(key string, b []byte) error {
+	if err := os.MkdirAll(string(d), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(string(d), key), b, 0o644)
+}
@@ -0,0 +1,146 @@
+package indexstore
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func roundTrip(t *testing.T, s Store) {
+	t.Helper()
+	if _, err := s.Get("k.json"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.Put("k.json", []byte(`{"lines":[]}`)); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	b, err := s.Get("k.json")
+	if err != nil || string(b) != `{"lines":[]}` {
+		t.Fatalf("get = %q, %v", b, err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	s, err := Open(t.TempDir() + "/index")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	roundTrip(t, s)
+}
+
+func TestS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			b, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(b)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	s, err := Open("s3://bucket/fleet/indexes?region=eu-west-1&endpoint=" + url.QueryEscape(srv.URL))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	roundTrip(t, s)
+	if _, ok := objects["/bucket/fleet/indexes/k.json"]; !ok {
+		t.Fatalf("expected path-style object key, got %v", objects)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	var mu sync.Mutex
+	data := map[string]string{}
+	var cmds []string
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			args, err := readCommand(r)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			cmds = append(cmds, args[0])
+			switch args[0] {
+			case "GET":
+				v, ok := data[args[1]]
+				if ok {
+					_, _ = io.WriteString(conn, "$"+strconv.Itoa(len(v))+"\r\n"+v+"\r\n")
+				} else {
+					_, _ = io.WriteString(conn, "$-1\r\n")
+				}
+			case "SET":
+				data[args[1]] = args[2]
+				_, _ = io.WriteString(conn, "+OK\r\n")
+			default:
+				_, _ = io.WriteString(conn, "+OK\r\n")
+			}
+			mu.Unlock()
+		}
+	}()
+	s, err := Open("redis://:pw@" + ln.Addr().String() + "/2?ttl=1h")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	roundTrip(t, s)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := data["metricfs:index:k.json"]; !ok || strings.Join(cmds, ",") != "AUTH,SELECT,GET,SET,GET" {
+		t.Fatalf("unexpected redis traffic %v %v", cmds, data)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
@@ -0,0 +1,163 @@
+package indexstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Redis struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	TTL      time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedis(u *url.URL) (*Redis, error) {
+	r := &Redis{Addr: u.Host, Prefix: "metricfs:index:"}
+	if r.Addr == "" {
+		return nil, fmt.Errorf("redis index store needs host:port")
+	}
+	if !strings.Contains(r.Addr, ":") {
+		r.Addr += ":6379"
+	}
+	if u.User != nil {
+		r.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis db %q", db)
+		}
+		r.DB = n
+	}
+	q := u.Query()
+	if v := q.Get("ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis ttl %q: %w", v, err)
+		}
+		r.TTL = ttl
+	}
+	if q.Has("prefix") {
+		r.Prefix = q.Get("prefix")
+	}
+	return r, nil
+}
+
+func (r *Redis) Get(key string) ([]byte, error) {
+	v, err := r.do("GET", r.Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+func (r *Redis) Put(key string, b []byte) error {
+	args := []string{"SET", r.Prefix + key, string(b)}
+	if r.TTL > 0 {
+		args = append(args, "PX", strconv.FormatInt(r.TTL.Milliseconds(), 10))
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+func (r *Redis) do(args ...string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return nil, err
+		}
+	}
+	v, err := r.roundTrip(args...)
+	if err != nil {
+		if _, isReply := err.(redisError); !isReply {
+			r.conn.Close()
+			r.conn = nil
+		}
+	}
+	return v, err
+}
+
+func (r *Redis) connect() error {
+	conn, err := net.DialTimeout("tcp", r.Addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	r.conn, r.r = conn, bufio.NewReader(conn)
+	if r.Password != "" {
+		if _, err := r.roundTrip("AUTH", r.Password); err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	if r.DB != 0 {
+		if _, err := r.roundTrip("SELECT", strconv.Itoa(r.DB)); err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return fmt.Errorf("redis select: %w", err)
+		}
+	}
+	return nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (r *Redis) roundTrip(args ...string) ([]byte, error) {
+	_ = r.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(r.conn, b.String()); err != nil {
+		return nil, err
+	}
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,220 @@
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	PatternSequential = "sequential"
+	PatternRandom     = "random"
+)
+
+type Config struct {
+	MountDir  string
+	Readers   int
+	Pattern   string
+	Duration  time.Duration
+	BlockSize int
+}
+
+type Report struct {
+	Ops      int
+	Errors   int
+	Bytes    int64
+	Elapsed  time.Duration
+	P50      time.Duration
+	P95      time.Duration
+	P99      time.Duration
+	MaxLat   time.Duration
+	FirstErr error
+}
+
+func (r Report) MBps() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Elapsed.Seconds() / 1_000_000
+}
+
+func (r Report) ErrorRate() float64 {
+	if r.Ops == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Ops)
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("ops=%d errors=%d error_rate=%.4f bytes=%d elapsed=%s throughput_mbps=%.2f p50=%s p95=%s p99=%s max=%s",
+		r.Ops, r.Errors, r.ErrorRate(), r.Bytes, r.Elapsed.Round(time.Millisecond), r.MBps(), r.P50, r.P95, r.P99, r.MaxLat)
+}
+
+type sample struct {
+	lat   time.Duration
+	bytes int64
+	err   error
+}
+
+func Run(ctx context.Context, cfg Config) (Report, error) {
+	if cfg.Readers <= 0 {
+		cfg.Readers = 1
+	}
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = 128 << 10
+	}
+	if cfg.Pattern == "" {
+		cfg.Pattern = PatternSequential
+	}
+	if cfg.Pattern != PatternSequential && cfg.Pattern != PatternRandom {
+		return Report{}, fmt.Errorf("unsupported pattern %q, expected sequential|random", cfg.Pattern)
+	}
+	files, err := listFiles(cfg.MountDir)
+	if err != nil {
+		return Report{}, err
+	}
+	if len(files) == 0 {
+		return Report{}, fmt.Errorf("no files under %s", cfg.MountDir)
+	}
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	samples := make(chan sample, cfg.Readers*4)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < cfg.Readers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			buf := make([]byte, cfg.BlockSize)
+			for n := 0; ctx.Err() == nil; n++ {
+				var f string
+				if cfg.Pattern == PatternRandom {
+					f = files[rng.Intn(len(files))]
+				} else {
+					f = files[n%len(files)]
+				}
+				samples <- readOnce(f, cfg.Pattern, rng, buf)
+			}
+		}(start.UnixNano() + int64(i))
+	}
+	go func() {
+		wg.Wait()
+		close(samples)
+	}()
+
+	var rep Report
+	var lats latencyHistogram
+	for s := range samples {
+		rep.Ops++
+		rep.Bytes += s.bytes
+		lats.add(s.lat)
+		if s.err != nil {
+			rep.Errors++
+			if rep.FirstErr == nil {
+				rep.FirstErr = s.err
+			}
+		}
+	}
+	rep.Elapsed = time.Since(start)
+	rep.P50 = lats.percentile(0.50)
+	rep.P95 = lats.percentile(0.95)
+	rep.P99 = lats.percentile(0.99)
+	rep.MaxLat = lats.max
+	return rep, nil
+}
+
+func readOnce(path, pattern string, rng *rand.Rand, buf []byte) sample {
+	start := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		return sample{lat: time.Since(start), err: err}
+	}
+	defer f.Close()
+	var n int64
+	if pattern == PatternRandom {
+		st, serr := f.Stat()
+		if serr != nil {
+			return sample{lat: time.Since(start), err: serr}
+		}
+		off := int64(0)
+		if st.Size() > int64(len(buf)) {
+			off = rng.Int63n(st.Size() - int64(len(buf)))
+		}
+		m, rerr := f.ReadAt(buf, off)
+		n = int64(m)
+		if rerr != nil && rerr != io.EOF {
+			err = rerr
+		}
+	} else {
+		n, err = io.CopyBuffer(io.Discard, f, buf)
+	}
+	return sample{lat: time.Since(start), bytes: n, err: err}
+}
+
+const (
+	histMin   = time.Microsecond
+	histSteps = 8
+	histSize  = 32 * histSteps
+)
+
+type latencyHistogram struct {
+	counts [histSize]int64
+	n      int64
+	max    time.Duration
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	i := 0
+	if d > histMin {
+		i = int(math.Ceil(math.Log2(float64(d)/float64(histMin)) * histSteps))
+		if i >= histSize {
+			i = histSize - 1
+		}
+	}
+	h.counts[i]++
+	h.n++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := int64(float64(h.n-1)*p) + 1
+	var seen int64
+	for i, c := range h.counts {
+		if seen += c; seen >= rank && i < histSize-1 {
+			upper := time.Duration(float64(histMin) * math.Exp2(float64(i)/histSteps))
+			return min(upper, h.max)
+		}
+	}
+	return h.max
+}
+
+func listFiles(root string) ([]string, error) {
+	var out []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			out = append(out, path)
+		}
+		return nil
+	})
+	return out, err
+}
@@ -0,0 +1,45 @@
+package loadtest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunReportsThroughput(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.jsonl"), make([]byte, 4096), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, pattern := range []string{PatternSequential, PatternRandom} {
+		rep, err := Run(context.Background(), Config{MountDir: dir, Readers: 4, Pattern: pattern, Duration: 50 * time.Millisecond, BlockSize: 1024})
+		if err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		if rep.Ops == 0 || rep.Bytes == 0 || rep.Errors != 0 {
+			t.Fatalf("%s: unexpected report %s", pattern, rep)
+		}
+	}
+	if _, err := Run(context.Background(), Config{MountDir: dir, Pattern: "zigzag"}); err == nil {
+		t.Fatalf("expected unsupported pattern error")
+	}
+}
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	var h latencyHistogram
+	for i := 1; i <= 1000; i++ {
+		h.add(time.Duration(i) * time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{0.50: 500 * time.Millisecond, 0.99: 990 * time.Millisecond, 1: time.Second} {
+		got := h.percentile(p)
+		if got < want || float64(got) > float64(want)*1.1 {
+			t.Errorf("p%v = %s, want within 10%% above %s", p*100, got, want)
+		}
+	}
+	h.add(3 * time.Hour)
+	if h.max != 3*time.Hour || h.percentile(1) != 3*time.Hour {
+		t.Fatalf("max = %s, p100 = %s", h.max, h.percentile(1))
+	}
+}
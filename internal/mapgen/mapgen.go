@@ -0,0 +1,158 @@
+package mapgen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"gopkg.in/yaml.v3"
+)
+
+const maxDistinct = 10000
+
+type Field struct {
+	Pointer  string   `json:"pointer"`
+	Present  int      `json:"present"`
+	Distinct int      `json:"distinct"`
+	Rows     int      `json:"rows"`
+	Score    float64  `json:"score"`
+	Examples []string `json:"examples"`
+}
+
+func (f Field) Coverage() float64 {
+	if f.Rows == 0 {
+		return 0
+	}
+	return float64(f.Present) / float64(f.Rows)
+}
+
+func (f Field) Cardinality() float64 {
+	if f.Present == 0 {
+		return 0
+	}
+	return float64(f.Distinct) / float64(f.Present)
+}
+
+func Analyze(r io.Reader, maxRows int) ([]Field, int, error) {
+	type stat struct {
+		present  int
+		values   map[string]struct{}
+		examples []string
+	}
+	stats := map[string]*stat{}
+	rows := 0
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for sc.Scan() && (maxRows <= 0 || rows < maxRows) {
+		var doc any
+		if err := json.Unmarshal(sc.Bytes(), &doc); err != nil {
+			continue
+		}
+		if _, ok := doc.(map[string]any); !ok {
+			continue
+		}
+		rows++
+		walk(doc, "", func(ptr, v string) {
+			s := stats[ptr]
+			if s == nil {
+				s = &stat{values: map[string]struct{}{}}
+				stats[ptr] = s
+			}
+			s.present++
+			if len(s.values) < maxDistinct {
+				s.values[v] = struct{}{}
+			}
+			if len(s.examples) < 3 {
+				s.examples = append(s.examples, v)
+			}
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, rows, err
+	}
+	out := make([]Field, 0, len(stats))
+	for ptr, s := range stats {
+		f := Field{Pointer: ptr, Present: s.present, Distinct: len(s.values), Rows: rows, Examples: s.examples}
+		if f.Distinct <= 1 {
+			continue
+		}
+		f.Score = f.Coverage() * f.Cardinality()
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].Pointer < out[j].Pointer
+	})
+	return out, rows, nil
+}
+
+func walk(v any, ptr string, fn func(ptr, value string)) {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, child := range x {
+			walk(child, ptr+"/"+strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1"), fn)
+		}
+	case string:
+		if ptr != "" && strings.TrimSpace(x) != "" {
+			fn(ptr, x)
+		}
+	}
+}
+
+type Options struct {
+	Glob       string
+	ObjectType string
+	Permission string
+}
+
+func Generate(field Field, opts Options) ([]byte, error) {
+	if opts.Glob == "" {
+		opts.Glob = "*.jsonl"
+	}
+	if opts.ObjectType == "" {
+		opts.ObjectType = "metric_row"
+	}
+	if opts.Permission == "" {
+		opts.Permission = auth.DefaultPermission
+	}
+	type mapperSpec struct {
+		Kind              string `yaml:"kind"`
+		Pointer           string `yaml:"pointer"`
+		CanonicalTemplate string `yaml:"canonical_template"`
+	}
+	type rule struct {
+		Match struct {
+			Glob string `yaml:"glob"`
+		} `yaml:"match"`
+		ObjectType         string     `yaml:"object_type"`
+		Permission         string     `yaml:"permission"`
+		Mapper             mapperSpec `yaml:"mapper"`
+		MissingResourceKey string     `yaml:"missing_resource_key"`
+	}
+	r := rule{
+		ObjectType:         opts.ObjectType,
+		Permission:         opts.Permission,
+		Mapper:             mapperSpec{Kind: "json_pointer", Pointer: field.Pointer, CanonicalTemplate: opts.ObjectType + ":{value}"},
+		MissingResourceKey: "deny",
+	}
+	r.Match.Glob = opts.Glob
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(struct {
+		Version int    `yaml:"version"`
+		Rules   []rule `yaml:"rules"`
+	}{1, []rule{r}}); err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("# Generated by metricfs init-mapper: %s is present in %.0f%% of sampled rows\n# with %.0f%% distinct values. Review before use.\n",
+		field.Pointer, 100*field.Coverage(), 100*field.Cardinality())
+	return append([]byte(header), b.Bytes()...), nil
+}
@@ -0,0 +1,43 @@
+package mapgen
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/mapper"
+)
+
+func TestAnalyzeAndGenerate(t *testing.T) {
+	var sample strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&sample, `{"region":"r%d","meta":{"row_id":"orders_%d"},"value":%d}`+"\n", i%2, i, i)
+	}
+	sample.WriteString("not json\n")
+	fields, rows, err := Analyze(strings.NewReader(sample.String()), 0)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if rows != 20 || len(fields) != 2 || fields[0].Pointer != "/meta/row_id" || fields[0].Score != 1 {
+		t.Fatalf("expected /meta/row_id first of 2 fields over 20 rows, got %d %+v", rows, fields)
+	}
+
+	dir := t.TempDir()
+	b, err := Generate(fields[0], Options{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), b, 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	rule, err := mapper.ResolveRuleForFile(filepath.Join(dir, "orders.jsonl"), mapper.Config{SourceDir: dir})
+	if err != nil {
+		t.Fatalf("generated mapper does not resolve: %v\n%s", err, b)
+	}
+	cands, err := mapper.EvaluateLine(rule, []byte(`{"meta":{"row_id":"orders_7"}}`))
+	if err != nil || len(cands) != 1 || cands[0].ObjectID != "orders_7" || cands[0].ObjectType != "metric_row" {
+		t.Fatalf("unexpected candidates %+v, %v", cands, err)
+	}
+}
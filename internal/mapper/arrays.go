@@ -0,0 +1,81 @@
+package mapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+type arrayItem struct {
+	item any
+	vals map[string]any
+	spec *FromArraySpec
+}
+
+func expandArray(doc any, scope []any, spec *FromArraySpec, vals map[string]any, tr *lineTrace, out []arrayItem) ([]arrayItem, error) {
+	var arrV any
+	var ok bool
+	if len(scope) == 0 {
+		arrV, ok = resolveRootPointer(doc, spec.Pointer)
+	} else {
+		var err error
+		if arrV, ok, err = resolveScopedPointer(scope, spec.Pointer); err != nil {
+			return nil, fmt.Errorf("nested from_array pointer: %w", err)
+		}
+	}
+	if !ok {
+		tr.step("from_array %s: missing", spec.Pointer)
+		return out, nil
+	}
+	arr, ok := arrV.([]any)
+	if !ok {
+		tr.step("from_array %s: not an array", spec.Pointer)
+		return out, nil
+	}
+	tr.step("from_array %s: %d items", spec.Pointer, len(arr))
+	for _, item := range arr {
+		itemScope := append(scope[:len(scope):len(scope)], item)
+		itemVals := make(map[string]any, len(vals)+len(spec.Fields))
+		for k, v := range vals {
+			itemVals[k] = v
+		}
+		for k, p := range spec.Fields {
+			v, ok, err := resolveScopedPointer(itemScope, p)
+			if err != nil {
+				return nil, fmt.Errorf("from_array field pointer: %w", err)
+			}
+			if !ok {
+				tr.step("field %s %s: missing", k, p)
+				break
+			}
+			tr.step("field %s %s -> %v", k, p, v)
+			itemVals[k] = v
+		}
+		if spec.FromArray != nil {
+			var err error
+			if out, err = expandArray(doc, itemScope, spec.FromArray, itemVals, tr, out); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		out = append(out, arrayItem{item: item, vals: itemVals, spec: spec})
+	}
+	return out, nil
+}
+
+func resolveScopedPointer(scope []any, p string) (any, bool, error) {
+	rest, up := p, 0
+	for strings.HasPrefix(rest, "../") {
+		rest, up = rest[3:], up+1
+	}
+	if up > 0 {
+		rest = "./" + rest
+	}
+	if !strings.HasPrefix(rest, "./") {
+		return nil, false, fmt.Errorf("%q must start with ./ or ../", p)
+	}
+	if up >= len(scope) {
+		return nil, false, fmt.Errorf("%q reaches above the outermost from_array item", p)
+	}
+	v, ok := resolveItemPointer(scope[len(scope)-1-up], rest)
+	return v, ok, nil
+}
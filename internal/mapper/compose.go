@@ -0,0 +1,108 @@
+package mapper
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ComposeEmptyDeny = "deny"
+	ComposeEmptySkip = "skip"
+)
+
+type ComposeSpec struct {
+	Fields []ComposeField `yaml:"fields" json:"fields"`
+	Sep    string         `yaml:"sep" json:"sep,omitempty"`
+	Empty  string         `yaml:"empty" json:"empty,omitempty"`
+}
+
+type ComposeField struct {
+	Name      string `yaml:"name" json:"name"`
+	Lowercase bool   `yaml:"lowercase" json:"lowercase,omitempty"`
+	TrimSlash bool   `yaml:"trim_slash" json:"trim_slash,omitempty"`
+	TrimSpace bool   `yaml:"trim_space" json:"trim_space,omitempty"`
+}
+
+func (f *ComposeField) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		f.Name = n.Value
+		return nil
+	}
+	type plain ComposeField
+	return n.Decode((*plain)(f))
+}
+
+func (c *ComposeSpec) validate() error {
+	if len(c.Fields) == 0 {
+		return fmt.Errorf("compose needs fields")
+	}
+	for _, f := range c.Fields {
+		if strings.TrimSpace(f.Name) == "" {
+			return fmt.Errorf("compose field needs a name")
+		}
+	}
+	if c.Sep == "" && len(c.Fields) > 1 {
+		return fmt.Errorf("compose needs a sep to join %d fields", len(c.Fields))
+	}
+	switch c.Empty {
+	case "", ComposeEmptyDeny, ComposeEmptySkip:
+		return nil
+	default:
+		return fmt.Errorf("invalid compose.empty: %s", c.Empty)
+	}
+}
+
+func (c *ComposeSpec) join(lookup func(name string) string) (string, error) {
+	parts := make([]string, 0, len(c.Fields))
+	for _, f := range c.Fields {
+		v := lookup(f.Name)
+		if f.TrimSpace {
+			v = strings.TrimSpace(v)
+		}
+		if f.Lowercase {
+			v = strings.ToLower(v)
+		}
+		if f.TrimSlash {
+			v = strings.Trim(v, "/")
+		}
+		if v == "" {
+			if c.Empty == ComposeEmptySkip {
+				continue
+			}
+			return "", fmt.Errorf("empty compose component %s", f.Name)
+		}
+		if c.Sep != "" && strings.Contains(v, c.Sep) {
+			return "", fmt.Errorf("compose component %s %q contains sep %q", f.Name, v, c.Sep)
+		}
+		parts = append(parts, v)
+	}
+	return strings.Join(parts, c.Sep), nil
+}
+
+func validateCompose(r MappingRule) error {
+	check := func(c *ComposeSpec, tmpl string) error {
+		if c == nil {
+			return nil
+		}
+		if tmpl != "" {
+			return fmt.Errorf("compose and canonical_template are mutually exclusive")
+		}
+		return c.validate()
+	}
+	if err := check(r.Mapper.Compose, r.Mapper.CanonicalTemplate); err != nil {
+		return err
+	}
+	for _, e := range r.Mapper.Emit {
+		if err := check(e.Compose, e.CanonicalTemplate); err != nil {
+			return err
+		}
+		for fa := e.FromArray; fa != nil; fa = fa.FromArray {
+			if err := check(fa.Compose, fa.CanonicalTemplate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package mapper
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/henneberger/metrics-fs/pkg/enums"
+)
+
+type globMatcher struct {
+	fold bool
+}
+
+func newGlobMatcher(c enums.GlobCase) globMatcher {
+	switch c {
+	case enums.GlobCaseInsensitive:
+		return globMatcher{fold: true}
+	case enums.GlobCaseSensitive:
+		return globMatcher{}
+	}
+	return globMatcher{fold: runtime.GOOS == "windows" || runtime.GOOS == "darwin"}
+}
+
+func (g globMatcher) match(glob, mapperDir, file string) bool {
+	glob = normalizeGlob(glob)
+	rel := relToMapper(mapperDir, file)
+	if g.fold {
+		glob, rel = strings.ToLower(glob), strings.ToLower(rel)
+	}
+	if ok, _ := doublestar.Match(glob, rel); ok {
+		return true
+	}
+	ok, _ := doublestar.Match(glob, path.Base(rel))
+	return ok
+}
+
+func (g globMatcher) matchRule(m RuleMatch, mapperDir, sourceDir, file string) (map[string]string, bool) {
+	glob, pathGlob := strings.TrimSpace(m.Glob), strings.TrimSpace(m.PathGlob)
+	if glob == "" && pathGlob == "" && m.PathRegex == "" {
+		return nil, false
+	}
+	if glob != "" && !g.match(glob, mapperDir, file) {
+		return nil, false
+	}
+	rel := relToMapper(sourceDir, file)
+	if pathGlob != "" {
+		pattern := normalizeGlob(pathGlob)
+		if g.fold {
+			pattern, rel = strings.ToLower(pattern), strings.ToLower(rel)
+		}
+		if ok, _ := doublestar.Match(pattern, rel); !ok {
+			return nil, false
+		}
+	}
+	captures := map[string]string{}
+	if m.PathRegex != "" {
+		re := m.pathRe
+		if g.fold {
+			re = m.pathReFold
+		}
+		if re == nil {
+			return nil, false
+		}
+		sub := re.FindStringSubmatch(relToMapper(sourceDir, file))
+		if sub == nil {
+			return nil, false
+		}
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				captures[name] = sub[i]
+			}
+		}
+	}
+	excluded := false
+	for _, p := range m.Exclude {
+		p = strings.TrimSpace(p)
+		if include, ok := strings.CutPrefix(p, "!"); ok {
+			if excluded && g.match(include, mapperDir, file) {
+				excluded = false
+			}
+		} else if !excluded && g.match(p, mapperDir, file) {
+			excluded = true
+		}
+	}
+	return captures, !excluded
+}
+
+func (m *RuleMatch) compile() error {
+	if m.PathRegex == "" {
+		return nil
+	}
+	var err error
+	if m.pathRe, err = regexp.Compile(m.PathRegex); err != nil {
+		return fmt.Errorf("match.path_regex: %w", err)
+	}
+	m.pathReFold = regexp.MustCompile("(?i)" + m.PathRegex)
+	return nil
+}
+
+func pathVars(captures map[string]string, sourceDir, file string) map[string]string {
+	rel := relToMapper(sourceDir, file)
+	vars := make(map[string]string, len(captures)+3)
+	for k, v := range captures {
+		vars[k] = v
+	}
+	vars["__file"] = path.Base(rel)
+	vars["__path"] = rel
+	if dir := path.Dir(rel); dir != "." {
+		vars["__dir"] = dir
+	} else {
+		vars["__dir"] = ""
+	}
+	return vars
+}
+
+func (m RuleMatch) String() string {
+	switch {
+	case m.Glob != "":
+		return m.Glob
+	case m.PathGlob != "":
+		return m.PathGlob
+	default:
+		return m.PathRegex
+	}
+}
+
+func (g globMatcher) hash(ruleHash string) string {
+	if !g.fold {
+		return ruleHash
+	}
+	h := sha1.Sum([]byte(ruleHash + "|glob_case=insensitive"))
+	return hex.EncodeToString(h[:])
+}
+
+func normalizeGlob(glob string) string {
+	glob = strings.TrimSpace(glob)
+	if filepath.Separator == '\\' {
+		glob = strings.ReplaceAll(glob, `\`, "/")
+	}
+	glob = strings.TrimPrefix(glob, "./")
+	return strings.TrimLeft(glob, "/")
+}
+
+func relToMapper(mapperDir, file string) string {
+	rel, err := filepath.Rel(mapperDir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.Base(file)
+	}
+	return filepath.ToSlash(rel)
+}
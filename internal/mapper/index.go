@@ -0,0 +1,19 @@
+package mapper
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const IndexNone = "none"
+
+func validateIndex(r MappingRule) error {
+	switch idx := r.Index; {
+	case idx == "" || idx == IndexNone || strings.Contains(idx, "://"):
+		return nil
+	case !filepath.IsAbs(idx):
+		return fmt.Errorf("index must be none, an absolute directory, or a store URL, got %q", idx)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package mapper
+
+import (
+	"fmt"
+
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+const (
+	LimitWarn = "warn"
+	LimitDeny = "deny"
+)
+
+type LimitsSpec struct {
+	MaxCandidatesPerLine       int    `yaml:"max_candidates_per_line"`
+	MaxUniqueCandidatesPerFile int    `yaml:"max_unique_candidates_per_file"`
+	OnExceed                   string `yaml:"on_exceed"`
+}
+
+func validateLimits(l LimitsSpec) error {
+	if l.MaxCandidatesPerLine < 0 || l.MaxUniqueCandidatesPerFile < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	switch l.OnExceed {
+	case "", LimitWarn, LimitDeny:
+		return nil
+	default:
+		return fmt.Errorf("invalid limits.on_exceed: %s", l.OnExceed)
+	}
+}
+
+// CandidateGuard is not safe for concurrent use.
+type CandidateGuard struct {
+	path       string
+	limits     LimitsSpec
+	warnings   *warnings.Collector
+	unique     map[Candidate]struct{}
+	warnedLine bool
+	warnedFile bool
+}
+
+func NewCandidateGuard(rule *SelectedRule, path string) *CandidateGuard {
+	g := &CandidateGuard{path: path}
+	if rule != nil {
+		g.limits = rule.Rule.Limits
+		g.warnings = rule.Warnings
+	}
+	if g.limits.MaxUniqueCandidatesPerFile > 0 {
+		g.unique = map[Candidate]struct{}{}
+	}
+	return g
+}
+
+func (g *CandidateGuard) Check(cands []Candidate) ([]Candidate, error) {
+	deny := g.limits.OnExceed == LimitDeny
+	if max := g.limits.MaxCandidatesPerLine; max > 0 && len(cands) > max {
+		if deny {
+			return nil, nil
+		}
+		if !g.warnedLine {
+			g.warnedLine = true
+			g.warnings.Add(warnings.KindLimitExceeded, g.path, 0, "line emitted %d candidates, above max_candidates_per_line=%d", len(cands), max)
+		}
+	}
+	if g.unique != nil {
+		for _, c := range cands {
+			g.unique[c] = struct{}{}
+		}
+		if max := g.limits.MaxUniqueCandidatesPerFile; len(g.unique) > max {
+			if deny {
+				return nil, fmt.Errorf("%s: more than %d unique candidates, above max_unique_candidates_per_file", g.path, max)
+			}
+			if !g.warnedFile {
+				g.warnedFile = true
+				g.warnings.Add(warnings.KindLimitExceeded, g.path, 0, "more than %d unique candidates, above max_unique_candidates_per_file", max)
+			}
+			// Stop tracking once warned; the set would otherwise grow unbounded.
+			g.unique = nil
+		}
+	}
+	return cands, nil
+}
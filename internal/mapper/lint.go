@@ -0,0 +1,69 @@
+package mapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const expiresLayout = "2006-01-02"
+
+type Finding struct {
+	Path    string
+	Rule    int
+	Glob    string
+	Expired bool
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: rule %d (%s): %s", f.Path, f.Rule+1, f.Glob, f.Message)
+}
+
+func validateExpires(r MappingRule) error {
+	if r.Expires == "" {
+		return nil
+	}
+	if _, err := time.Parse(expiresLayout, r.Expires); err != nil {
+		return fmt.Errorf("expires must be a YYYY-MM-DD date, got %q", r.Expires)
+	}
+	return nil
+}
+
+func Lint(cfg Config, now time.Time) ([]Finding, error) {
+	cfg = defaults(cfg)
+	var out []Finding
+	err := filepath.WalkDir(cfg.SourceDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != cfg.MapperFileName {
+			return nil
+		}
+		rules, _, err := loadRules(path, false, map[string]bool{})
+		if err != nil {
+			return err
+		}
+		for i, r := range rules {
+			if err := validateExpires(r); err != nil {
+				return fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+			}
+			if r.Deprecated != "" {
+				out = append(out, Finding{Path: path, Rule: i, Glob: r.Match.String(), Message: "deprecated: " + r.Deprecated})
+			}
+			if r.Expires == "" {
+				continue
+			}
+			exp, _ := time.Parse(expiresLayout, r.Expires)
+			if !now.Before(exp) {
+				out = append(out, Finding{Path: path, Rule: i, Glob: r.Match.String(), Expired: true, Message: "expired on " + r.Expires})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
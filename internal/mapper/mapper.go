@@ -1,18 +1,24 @@
 package mapper
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 
-	"github.com/bmatcuk/doublestar/v4"
 	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/codec"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+	"github.com/henneberger/metrics-fs/pkg/enums"
 	"gopkg.in/yaml.v3"
 )
 
@@ -20,33 +26,75 @@ type Config struct {
 	SourceDir         string
 	MapperFileName    string
 	InheritParent     bool
-	MissingMapperMode string
-	DefaultMissingKey string
+	MissingMapperMode enums.MissingMapperMode
+	DefaultMissingKey enums.MissingResourceKey
+	Operation         enums.Operation
+	GlobCase          enums.GlobCase
+	Warnings          *warnings.Collector
+	Trace             io.Writer
+	DefaultPermission string
+}
+
+func (c Config) defaultPermission() string {
+	if c.DefaultPermission == "" {
+		return auth.DefaultPermission
+	}
+	return c.DefaultPermission
 }
 
 type MappingFile struct {
-	Version int           `yaml:"version"`
-	Extends string        `yaml:"extends"`
-	Rules   []MappingRule `yaml:"rules"`
+	Version  int           `yaml:"version"`
+	Extends  string        `yaml:"extends"`
+	Owner    string        `yaml:"owner"`
+	Defaults RuleDefaults  `yaml:"defaults"`
+	Rules    []MappingRule `yaml:"rules"`
+}
+
+type RuleDefaults struct {
+	ObjectType    string              `yaml:"object_type"`
+	Permission    string              `yaml:"permission"`
+	Normalize     NormalizeSpec       `yaml:"normalize"`
+	FallbackPaths map[string][]string `yaml:"fallback_paths"`
 }
 
 type MappingRule struct {
-	Match              RuleMatch  `yaml:"match"`
-	Decision           string     `yaml:"decision"`
-	ObjectType         string     `yaml:"object_type"`
-	Permission         string     `yaml:"permission"`
-	MissingResourceKey string     `yaml:"missing_resource_key"`
-	Mapper             MapperSpec `yaml:"mapper"`
+	Match                RuleMatch                `yaml:"match"`
+	Decision             enums.Decision           `yaml:"decision"`
+	ObjectType           string                   `yaml:"object_type"`
+	Permission           string                   `yaml:"permission"`
+	Permissions          []string                 `yaml:"permissions"`
+	OperationPermissions map[string][]string      `yaml:"operation_permissions"`
+	MissingResourceKey   enums.MissingResourceKey `yaml:"missing_resource_key"`
+	When                 *WhenSpec                `yaml:"when"`
+	Mapper               MapperSpec               `yaml:"mapper"`
+	Limits               LimitsSpec               `yaml:"limits"`
+	RowQuotas            []RowQuota               `yaml:"row_quotas"`
+	CaveatContext        map[string]string        `yaml:"caveat_context"`
+	StaticCandidates     []string                 `yaml:"static_candidates"`
+	Codec                string                   `yaml:"codec"`
+	Index                string                   `yaml:"index"`
+	Debug                bool                     `yaml:"debug"`
+	DebugSampleRate      float64                  `yaml:"debug_sample_rate"`
+	Expires              string                   `yaml:"expires"`
+	Deprecated           string                   `yaml:"deprecated"`
 }
 
 type RuleMatch struct {
-	Glob string `yaml:"glob"`
+	Glob      string   `yaml:"glob"`
+	PathGlob  string   `yaml:"path_glob"`
+	PathRegex string   `yaml:"path_regex"`
+	Exclude   []string `yaml:"exclude"`
+
+	pathRe, pathReFold *regexp.Regexp
 }
 
 type MapperSpec struct {
 	Kind              string              `yaml:"kind"`
 	Pointer           string              `yaml:"pointer"`
+	Pointers          []string            `yaml:"pointers"`
+	Pattern           string              `yaml:"pattern"`
 	CanonicalTemplate string              `yaml:"canonical_template"`
+	Compose           *ComposeSpec        `yaml:"compose"`
 	Fields            map[string]string   `yaml:"fields"`
 	FromArray         *FromArraySpec      `yaml:"from_array"`
 	Emit              []EmitSpec          `yaml:"emit"`
@@ -55,42 +103,83 @@ type MapperSpec struct {
 }
 
 type NormalizeSpec struct {
-	Lowercase bool `yaml:"lowercase"`
-	TrimSlash bool `yaml:"trim_slash"`
+	Lowercase       bool   `yaml:"lowercase"`
+	TrimSlash       bool   `yaml:"trim_slash"`
+	InvalidObjectID string `yaml:"invalid_object_id"`
 }
 
 type FromArraySpec struct {
 	Pointer           string            `yaml:"pointer"`
 	Fields            map[string]string `yaml:"fields"`
 	CanonicalTemplate string            `yaml:"canonical_template"`
+	Compose           *ComposeSpec      `yaml:"compose"`
+	FromArray         *FromArraySpec    `yaml:"from_array"`
 }
 
 type EmitSpec struct {
 	ObjectType        string            `yaml:"object_type"`
 	Permission        string            `yaml:"permission"`
+	Permissions       []string          `yaml:"permissions"`
 	Fields            map[string]string `yaml:"fields"`
 	FromArray         *FromArraySpec    `yaml:"from_array"`
 	CanonicalTemplate string            `yaml:"canonical_template"`
+	Compose           *ComposeSpec      `yaml:"compose"`
+	CaveatContext     map[string]string `yaml:"caveat_context"`
 }
 
 type SelectedRule struct {
-	Decision           string
-	MissingResourceKey string
+	Decision           enums.Decision
+	MissingResourceKey enums.MissingResourceKey
 	Rule               MappingRule
 	RuleHash           string
+	SourcePath         string
+	Warnings           *warnings.Collector
+	MapperFiles        []string
+
+	rc        codec.RecordCodec
+	re        *regexp.Regexp
+	static    []Candidate
+	vars      map[string]string
+	next      *SelectedRule
+	fallbacks sync.Map
+
+	trace *tracer
+}
+
+func (r *SelectedRule) warnFallback(ptr, format string, args ...any) {
+	if r.Warnings == nil {
+		return
+	}
+	if _, dup := r.fallbacks.LoadOrStore(ptr, struct{}{}); dup {
+		return
+	}
+	r.Warnings.Add(warnings.KindFallbackUsed, r.SourcePath, 0, format, args...)
+}
+
+func (r *SelectedRule) Codec() codec.RecordCodec {
+	if r == nil || r.rc == nil {
+		return codec.Default()
+	}
+	return r.rc
+}
+
+func (r *SelectedRule) JSONL() bool {
+	return r == nil || r.Rule.Codec == "" || r.Rule.Codec == codec.JSONL
 }
 
 type Candidate = auth.CandidateKey
 
+var ErrMalformedLine = errors.New("malformed JSON line")
+
 func defaults(cfg Config) Config {
 	if cfg.MapperFileName == "" {
 		cfg.MapperFileName = ".metricfs-map.yaml"
 	}
 	if cfg.MissingMapperMode == "" {
-		cfg.MissingMapperMode = "deny"
+		cfg.MissingMapperMode = enums.MissingMapperDeny
 	}
 	if cfg.DefaultMissingKey == "" {
-		cfg.DefaultMissingKey = "deny"
+		cfg.DefaultMissingKey = enums.MissingResourceDeny
 	}
 	return cfg
 }
@@ -119,55 +208,238 @@ func ResolveRuleForFile(filePath string, cfg Config) (*SelectedRule, error) {
 		dir = filepath.Dir(dir)
 	}
 	if mapperPath == "" {
-		if cfg.MissingMapperMode == "deny" {
+		if cfg.MissingMapperMode == enums.MissingMapperDeny {
 			return nil, fmt.Errorf("no mapper file found for %s", filePath)
 		}
+		cfg.Warnings.Add(warnings.KindRuleUnmatched, filePath, 0, "no mapper file found; serving unfiltered (missing-mapper=passthrough)")
 		return nil, nil
 	}
 
-	rules, ruleHash, err := loadRules(mapperPath, cfg.InheritParent, map[string]bool{})
+	loaded := map[string]bool{}
+	rules, ruleHash, err := loadRules(mapperPath, cfg.InheritParent, loaded)
 	if err != nil {
 		return nil, err
 	}
+	mapperFiles := make([]string, 0, len(loaded))
+	for p := range loaded {
+		mapperFiles = append(mapperFiles, p)
+	}
+	sort.Strings(mapperFiles)
 
+	globs := newGlobMatcher(cfg.GlobCase)
+	ruleHash = globs.hash(ruleHash)
+	var first, last *SelectedRule
 	for _, r := range rules {
-		glob := strings.TrimSpace(r.Match.Glob)
-		if glob == "" {
+		captures, ok := globs.matchRule(r.Match, filepath.Dir(mapperPath), absSource, absFile)
+		if !ok {
 			continue
 		}
-		relToMapper, err := filepath.Rel(filepath.Dir(mapperPath), absFile)
+		var sel *SelectedRule
+		sel, ruleHash, err = selectRule(r, ruleHash, cfg)
 		if err != nil {
-			relToMapper = filepath.Base(absFile)
-		}
-		relToMapper = filepath.ToSlash(relToMapper)
-		name := filepath.Base(absFile)
-		m1, _ := doublestar.Match(glob, relToMapper)
-		m2, _ := doublestar.Match(glob, name)
-		if !m1 && !m2 {
-			continue
+			return nil, err
 		}
-		decision := r.Decision
-		if decision == "" {
-			decision = "any"
+		sel.SourcePath, sel.MapperFiles = filePath, mapperFiles
+		sel.vars = pathVars(captures, absSource, absFile)
+		sel.trace = newTracer(sel.Rule, cfg.Trace, filePath)
+		if first == nil {
+			first = sel
+		} else {
+			last.next = sel
 		}
-		if decision != "any" && decision != "all" {
-			return nil, fmt.Errorf("invalid decision: %s", decision)
-		}
-		missing := r.MissingResourceKey
-		if missing == "" {
-			missing = cfg.DefaultMissingKey
+		last = sel
+		if r.When == nil {
+			break
 		}
-		if missing != "deny" && missing != "ignore" {
-			return nil, fmt.Errorf("invalid missing_resource_key: %s", missing)
+	}
+	if first != nil {
+		if p := cfg.defaultPermission(); p != auth.DefaultPermission {
+			h := sha1.Sum([]byte(ruleHash + "|default_permission=" + p))
+			ruleHash = hex.EncodeToString(h[:])
 		}
-		return &SelectedRule{Decision: decision, MissingResourceKey: missing, Rule: r, RuleHash: ruleHash}, nil
+		first.RuleHash = ruleHash
+		return first, nil
 	}
-	if cfg.MissingMapperMode == "deny" {
+	if cfg.MissingMapperMode == enums.MissingMapperDeny {
 		return nil, fmt.Errorf("no matching mapper rule for %s", filePath)
 	}
+	cfg.Warnings.Add(warnings.KindRuleUnmatched, filePath, 0, "no mapper rule in %s matches; serving unfiltered (missing-mapper=passthrough)", mapperPath)
 	return nil, nil
 }
 
+func selectRule(r MappingRule, ruleHash string, cfg Config) (*SelectedRule, string, error) {
+	decision, err := enums.ParseDecision(string(r.Decision))
+	if err != nil {
+		return nil, "", err
+	}
+	missingRaw := r.MissingResourceKey
+	if missingRaw == "" {
+		missingRaw = cfg.DefaultMissingKey
+	}
+	missing, err := enums.ParseMissingResourceKey(string(missingRaw))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := validateLimits(r.Limits); err != nil {
+		return nil, "", err
+	}
+	if err := validateInvalidIDPolicy(r.Mapper.Normalize.InvalidObjectID); err != nil {
+		return nil, "", err
+	}
+	if err := validateDebug(r); err != nil {
+		return nil, "", err
+	}
+	if err := validateExpires(r); err != nil {
+		return nil, "", err
+	}
+	if err := validateRowQuotas(r); err != nil {
+		return nil, "", err
+	}
+	if err := validateIndex(r); err != nil {
+		return nil, "", err
+	}
+	if err := validateWhen(r); err != nil {
+		return nil, "", err
+	}
+	if err := validateCompose(r); err != nil {
+		return nil, "", err
+	}
+	rc, err := codec.Lookup(r.Codec)
+	if err != nil {
+		return nil, "", err
+	}
+	re, err := compileRegex(r.Mapper)
+	if err != nil {
+		return nil, "", err
+	}
+	op, err := enums.ParseOperation(string(cfg.Operation))
+	if err != nil {
+		return nil, "", err
+	}
+	r, ruleHash, err = resolvePermissions(r, ruleHash, op, cfg.defaultPermission())
+	if err != nil {
+		return nil, "", err
+	}
+	static, err := staticCandidates(r, cfg.defaultPermission())
+	if err != nil {
+		return nil, "", err
+	}
+	return &SelectedRule{
+		Decision:           decision,
+		MissingResourceKey: missing,
+		Rule:               r,
+		RuleHash:           ruleHash,
+		Warnings:           cfg.Warnings,
+		rc:                 rc,
+		re:                 re,
+		static:             static,
+	}, ruleHash, nil
+}
+
+func ObjectTypes(cfg Config) ([]string, error) {
+	seen := map[string]bool{}
+	err := walkRules(cfg, func(r MappingRule) {
+		seen[r.ObjectType] = true
+		for _, e := range r.Mapper.Emit {
+			seen[e.ObjectType] = true
+		}
+		if statics, err := staticCandidates(r, cfg.defaultPermission()); err == nil {
+			for _, c := range statics {
+				seen[c.ObjectType] = true
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	delete(seen, "")
+	out := make([]string, 0, len(seen))
+	for t := range seen {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func ObjectPermissions(cfg Config) ([]auth.TypePermission, error) {
+	seen := map[auth.TypePermission]bool{}
+	add := func(typ string, perms ...string) {
+		if typ == "" {
+			return
+		}
+		for _, p := range perms {
+			for _, p := range strings.Split(p, auth.PermissionSeparator) {
+				if p = strings.TrimSpace(p); p == "" {
+					p = cfg.defaultPermission()
+				}
+				seen[auth.TypePermission{ObjectType: typ, Permission: p}] = true
+			}
+		}
+	}
+	err := walkRules(cfg, func(r MappingRule) {
+		var ops []string
+		for _, perms := range r.OperationPermissions {
+			ops = append(ops, perms...)
+		}
+		add(r.ObjectType, append(append([]string{r.Permission}, r.Permissions...), ops...)...)
+		for _, q := range r.RowQuotas {
+			add(r.ObjectType, q.Permission)
+		}
+		for _, sc := range r.StaticCandidates {
+			object, perm, named := strings.Cut(strings.TrimSpace(sc), "#")
+			typ, _, _ := strings.Cut(object, ":")
+			perms := append([]string{r.Permission}, r.Permissions...)
+			if named {
+				perms = []string{perm}
+			}
+			add(typ, append(perms, ops...)...)
+			for _, q := range r.RowQuotas {
+				add(typ, q.Permission)
+			}
+		}
+		for _, e := range r.Mapper.Emit {
+			add(e.ObjectType, append(append([]string{e.Permission}, e.Permissions...), ops...)...)
+			for _, q := range r.RowQuotas {
+				add(e.ObjectType, q.Permission)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]auth.TypePermission, 0, len(seen))
+	for tp := range seen {
+		out = append(out, tp)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ObjectType != out[j].ObjectType {
+			return out[i].ObjectType < out[j].ObjectType
+		}
+		return out[i].Permission < out[j].Permission
+	})
+	return out, nil
+}
+
+func walkRules(cfg Config, fn func(MappingRule)) error {
+	cfg = defaults(cfg)
+	return filepath.WalkDir(cfg.SourceDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != cfg.MapperFileName {
+			return nil
+		}
+		rules, _, err := loadRules(path, cfg.InheritParent, map[string]bool{})
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			fn(r)
+		}
+		return nil
+	})
+}
+
 func loadRules(path string, inherit bool, seen map[string]bool) ([]MappingRule, string, error) {
 	abs, err := filepath.Abs(path)
 	if err != nil {
@@ -182,16 +454,25 @@ func loadRules(path string, inherit bool, seen map[string]bool) ([]MappingRule,
 	if err != nil {
 		return nil, "", err
 	}
-	var mf MappingFile
-	if err := yaml.Unmarshal(b, &mf); err != nil {
-		return nil, "", err
-	}
-	if mf.Version != 1 {
-		return nil, "", fmt.Errorf("unsupported mapping version: %d", mf.Version)
+	docs, err := decodeMappingFiles(b)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", abs, err)
+	}
+	var rules []MappingRule
+	extends := ""
+	for _, mf := range docs {
+		for _, r := range mf.Rules {
+			if err := r.Match.compile(); err != nil {
+				return nil, "", fmt.Errorf("%s: %w", abs, err)
+			}
+			rules = append(rules, applyDefaults(r, mf.Defaults))
+		}
+		if strings.TrimSpace(mf.Extends) != "" {
+			extends = mf.Extends
+		}
 	}
-	rules := append([]MappingRule{}, mf.Rules...)
-	if inherit && strings.TrimSpace(mf.Extends) != "" {
-		parent := filepath.Clean(filepath.Join(filepath.Dir(abs), mf.Extends))
+	if inherit && strings.TrimSpace(extends) != "" {
+		parent := filepath.Clean(filepath.Join(filepath.Dir(abs), extends))
 		parentRules, _, err := loadRules(parent, inherit, seen)
 		if err != nil {
 			return nil, "", err
@@ -206,6 +487,65 @@ func loadRules(path string, inherit bool, seen map[string]bool) ([]MappingRule,
 	return rules, hex.EncodeToString(h[:]), nil
 }
 
+func decodeMappingFiles(b []byte) ([]MappingFile, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	var docs []MappingFile
+	extends := 0
+	for i := 1; ; i++ {
+		var node yaml.Node
+		if err := dec.Decode(&node); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(node.Content) == 0 || node.Content[0].Tag == "!!null" {
+			continue
+		}
+		var mf MappingFile
+		if err := node.Decode(&mf); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+		if mf.Version != 1 {
+			return nil, fmt.Errorf("document %d: unsupported mapping version: %d", i, mf.Version)
+		}
+		if strings.TrimSpace(mf.Extends) != "" {
+			extends++
+		}
+		docs = append(docs, mf)
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("unsupported mapping version: 0")
+	}
+	if extends > 1 {
+		return nil, fmt.Errorf("extends may be set by only one document")
+	}
+	return docs, nil
+}
+
+// Defaults are applied before hashing so moving a value into them keeps the rule hash.
+func applyDefaults(r MappingRule, d RuleDefaults) MappingRule {
+	if r.ObjectType == "" {
+		r.ObjectType = d.ObjectType
+	}
+	if r.Permission == "" && len(r.Permissions) == 0 {
+		r.Permission = d.Permission
+	}
+	if r.Mapper.Normalize == (NormalizeSpec{}) {
+		r.Mapper.Normalize = d.Normalize
+	}
+	if len(d.FallbackPaths) > 0 {
+		merged := make(map[string][]string, len(d.FallbackPaths)+len(r.Mapper.FallbackPaths))
+		for k, v := range d.FallbackPaths {
+			merged[k] = v
+		}
+		for k, v := range r.Mapper.FallbackPaths {
+			merged[k] = v
+		}
+		r.Mapper.FallbackPaths = merged
+	}
+	return r
+}
+
 func canonicalRules(rules []MappingRule) ([]byte, error) {
 	copyRules := make([]MappingRule, len(rules))
 	copy(copyRules, rules)
@@ -216,6 +556,12 @@ func canonicalRules(rules []MappingRule) ([]byte, error) {
 		if copyRules[i].Mapper.FallbackPaths != nil {
 			copyRules[i].Mapper.FallbackPaths = sortedSliceMap(copyRules[i].Mapper.FallbackPaths)
 		}
+		if copyRules[i].OperationPermissions != nil {
+			copyRules[i].OperationPermissions = sortedSliceMap(copyRules[i].OperationPermissions)
+		}
+		// Tracing and review metadata must not invalidate indexes.
+		copyRules[i].Debug, copyRules[i].DebugSampleRate = false, 0
+		copyRules[i].Expires, copyRules[i].Deprecated = "", ""
 	}
 	return json.Marshal(copyRules)
 }
@@ -251,53 +597,117 @@ func EvaluateLine(rule *SelectedRule, line []byte) ([]Candidate, error) {
 	if rule == nil {
 		return nil, errors.New("nil rule")
 	}
-	var doc any
-	if err := json.Unmarshal(line, &doc); err != nil {
-		if rule.MissingResourceKey == "deny" {
-			return nil, nil
-		}
+	rule, doc := rule.applicable(line)
+	if rule == nil {
 		return nil, nil
 	}
+	tr := rule.trace.sample()
+	if rule.Rule.When != nil {
+		tr.step("when %s holds", rule.Rule.When)
+	}
+	cands, err := evaluateLine(rule, line, doc, tr)
+	tr.done(cands, err)
+	return cands, err
+}
+
+func evaluateLine(rule *SelectedRule, line []byte, doc any, tr *lineTrace) ([]Candidate, error) {
+	static := rule.static
+	if static == nil && len(rule.Rule.StaticCandidates) > 0 {
+		var err error
+		if static, err = staticCandidates(rule.Rule, auth.DefaultPermission); err != nil {
+			return nil, err
+		}
+	}
+	if rule.staticOnly() {
+		tr.step("static candidates only")
+		return append([]Candidate(nil), static...), nil
+	}
 	ms := rule.Rule.Mapper
+	// A regex rule reads the raw line, so non-JSON lines still yield candidates.
+	if doc == nil && ms.Kind != KindRegex {
+		if err := json.Unmarshal(line, &doc); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedLine, err)
+		}
+	}
 	norm := ms.Normalize
 	fallback := ms.FallbackPaths
 
-	buildCandidate := func(objectType, permission, tmpl string, values map[string]any) (Candidate, bool) {
-		replaced := tmpl
-		for k, v := range values {
-			s := fmt.Sprintf("%v", v)
-			replaced = strings.ReplaceAll(replaced, "{"+k+"}", s)
-		}
-		for k := range values {
-			_ = k
-		}
-		for key, ptrs := range fallback {
-			needle := "{" + key + "}"
-			if strings.Contains(replaced, needle) {
-				for _, p := range ptrs {
-					if val, ok := resolveRootPointer(doc, p); ok {
-						s := strings.TrimSpace(fmt.Sprintf("%v", val))
-						if s != "" {
-							replaced = strings.ReplaceAll(replaced, needle, s)
-							break
-						}
-					}
+	fallbackValue := func(key string) (string, bool) {
+		for _, p := range fallback[key] {
+			if val, ok := resolveRootPointer(doc, p); ok {
+				s := strings.TrimSpace(fmt.Sprintf("%v", val))
+				if s != "" {
+					rule.warnFallback(key+"\x00"+p, "placeholder {%s} resolved from fallback pointer %s", key, p)
+					tr.step("fallback {%s} from %s -> %q", key, p, s)
+					return s, true
 				}
 			}
 		}
-		if strings.Contains(replaced, "{") || strings.Contains(replaced, "}") {
-			return Candidate{}, false
+		return "", false
+	}
+
+	buildCandidate := func(objectType, permission, tmpl string, compose *ComposeSpec, values map[string]any) (Candidate, bool) {
+		var replaced string
+		if compose != nil {
+			id, err := compose.join(func(name string) string {
+				if v, ok := values[name]; ok && v != nil {
+					return fmt.Sprintf("%v", v)
+				}
+				if v, ok := rule.vars[name]; ok {
+					return v
+				}
+				v, _ := fallbackValue(name)
+				return v
+			})
+			if err != nil {
+				tr.step("dropped: %v", err)
+				return Candidate{}, false
+			}
+			tr.step("compose -> %q", id)
+			replaced = id
+		} else {
+			replaced = tmpl
+			for k, v := range values {
+				s := fmt.Sprintf("%v", v)
+				replaced = strings.ReplaceAll(replaced, "{"+k+"}", s)
+			}
+			for k, v := range rule.vars {
+				replaced = strings.ReplaceAll(replaced, "{"+k+"}", v)
+			}
+			tr.step("template %q -> %q", tmpl, replaced)
+			for key := range fallback {
+				needle := "{" + key + "}"
+				if strings.Contains(replaced, needle) {
+					if s, ok := fallbackValue(key); ok {
+						replaced = strings.ReplaceAll(replaced, needle, s)
+					}
+				}
+			}
+			if strings.Contains(replaced, "{") || strings.Contains(replaced, "}") {
+				tr.step("dropped: unresolved placeholder in %q", replaced)
+				return Candidate{}, false
+			}
 		}
 		id := applyNormalize(replaced, norm)
+		if id != replaced {
+			tr.step("normalize %q -> %q", replaced, id)
+		}
 		prefix := objectType + ":"
 		if strings.HasPrefix(id, prefix) {
 			id = strings.TrimPrefix(id, prefix)
 		}
 		if id == "" {
+			tr.step("dropped: empty object id")
+			return Candidate{}, false
+		}
+		raw := id
+		id, ok := applyInvalidIDPolicy(id, norm.InvalidObjectID)
+		if !ok {
+			tr.step("dropped: invalid object id %q (invalid_object_id=%s)", raw, norm.InvalidObjectID)
 			return Candidate{}, false
 		}
-		if permission == "" {
-			permission = "read"
+		if id != raw {
+			tr.step("invalid_object_id=%s %q -> %q", norm.InvalidObjectID, raw, id)
 		}
 		return Candidate{ObjectType: objectType, ObjectID: id, Permission: permission}, true
 	}
@@ -305,46 +715,88 @@ func EvaluateLine(rule *SelectedRule, line []byte) ([]Candidate, error) {
 	out := []Candidate{}
 	switch ms.Kind {
 	case "json_pointer":
-		ptr := ms.Pointer
-		if !strings.HasPrefix(ptr, "/") {
-			return nil, fmt.Errorf("json_pointer pointer must start with /")
+		// A missing or empty value falls through to the next pointer.
+		ptrs := ms.Pointers
+		if ms.Pointer != "" || len(ptrs) == 0 {
+			ptrs = append([]string{ms.Pointer}, ptrs...)
 		}
-		val, ok := resolveRootPointer(doc, ptr)
+		var val any
+		found := false
+		for i, ptr := range ptrs {
+			if !strings.HasPrefix(ptr, "/") {
+				return nil, fmt.Errorf("json_pointer pointer must start with /")
+			}
+			v, ok := resolveRootPointer(doc, ptr)
+			if !ok {
+				tr.step("pointer %s: missing", ptr)
+				continue
+			}
+			if i < len(ptrs)-1 && (v == nil || strings.TrimSpace(fmt.Sprintf("%v", v)) == "") {
+				tr.step("pointer %s: empty", ptr)
+				continue
+			}
+			if i > 0 {
+				rule.warnFallback(ptr, "json_pointer value resolved from fallback pointer %s", ptr)
+			}
+			tr.step("pointer %s -> %v", ptr, v)
+			val, found = v, true
+			break
+		}
+		if !found {
+			return nil, nil
+		}
+		cand, ok := buildCandidate(rule.Rule.ObjectType, rule.Rule.Permission, ms.CanonicalTemplate, ms.Compose, map[string]any{"value": val})
+		if !ok {
+			return nil, nil
+		}
+		ctx, err := caveatContext(doc, nil, tr, rule.Rule.CaveatContext)
+		if err != nil {
+			return nil, err
+		}
+		cand.Context = ctx
+		out = append(out, cand)
+	case KindRegex:
+		re := rule.re
+		if re == nil {
+			var err error
+			if re, err = compileRegex(ms); err != nil {
+				return nil, err
+			}
+		}
+		vals, ok := regexValues(re, line)
 		if !ok {
+			tr.step("pattern %s: no match", ms.Pattern)
 			return nil, nil
 		}
-		cand, ok := buildCandidate(rule.Rule.ObjectType, rule.Rule.Permission, ms.CanonicalTemplate, map[string]any{"value": val})
+		tr.step("pattern %s -> %v", ms.Pattern, vals)
+		cand, ok := buildCandidate(rule.Rule.ObjectType, rule.Rule.Permission, ms.CanonicalTemplate, ms.Compose, vals)
 		if !ok {
 			return nil, nil
 		}
+		ctx, err := caveatContext(doc, nil, tr, rule.Rule.CaveatContext)
+		if err != nil {
+			return nil, err
+		}
+		cand.Context = ctx
 		out = append(out, cand)
 	case "multi_extract":
 		for _, e := range ms.Emit {
 			if e.FromArray != nil {
-				arrV, ok := resolveRootPointer(doc, e.FromArray.Pointer)
-				if !ok {
-					continue
+				items, err := expandArray(doc, nil, e.FromArray, nil, tr, nil)
+				if err != nil {
+					return nil, err
 				}
-				arr, ok := arrV.([]any)
-				if !ok {
-					continue
-				}
-				for _, item := range arr {
-					vals := map[string]any{}
-					for k, p := range e.FromArray.Fields {
-						if !strings.HasPrefix(p, "./") {
-							return nil, fmt.Errorf("from_array field pointer must start with ./")
-						}
-						v, ok := resolveItemPointer(item, p)
-						if !ok {
-							break
-						}
-						vals[k] = v
+				for _, it := range items {
+					cand, ok := buildCandidate(e.ObjectType, e.Permission, it.spec.CanonicalTemplate, it.spec.Compose, it.vals)
+					if !ok {
+						continue
 					}
-					cand, ok := buildCandidate(e.ObjectType, e.Permission, e.FromArray.CanonicalTemplate, vals)
-					if ok {
-						out = append(out, cand)
+					ctx, err := caveatContext(doc, it.item, tr, rule.Rule.CaveatContext, e.CaveatContext)
+					if err != nil {
+						return nil, err
 					}
+					cand.Context = ctx
+					out = append(out, cand)
 				}
 			} else {
 				vals := map[string]any{}
@@ -354,19 +806,30 @@ func EvaluateLine(rule *SelectedRule, line []byte) ([]Candidate, error) {
 					}
 					v, ok := resolveRootPointer(doc, p)
 					if !ok {
+						tr.step("field %s %s: missing", k, p)
 						break
 					}
+					tr.step("field %s %s -> %v", k, p, v)
 					vals[k] = v
 				}
-				cand, ok := buildCandidate(e.ObjectType, e.Permission, e.CanonicalTemplate, vals)
-				if ok {
-					out = append(out, cand)
+				cand, ok := buildCandidate(e.ObjectType, e.Permission, e.CanonicalTemplate, e.Compose, vals)
+				if !ok {
+					continue
+				}
+				ctx, err := caveatContext(doc, nil, tr, rule.Rule.CaveatContext, e.CaveatContext)
+				if err != nil {
+					return nil, err
 				}
+				cand.Context = ctx
+				out = append(out, cand)
 			}
 		}
 	default:
 		return nil, fmt.Errorf("unsupported mapper kind: %s", ms.Kind)
 	}
+	if len(out) > 0 {
+		out = append(out, static...)
+	}
 
 	uniq := map[Candidate]struct{}{}
 	res := make([]Candidate, 0, len(out))
@@ -380,6 +843,41 @@ func EvaluateLine(rule *SelectedRule, line []byte) ([]Candidate, error) {
 	return res, nil
 }
 
+func caveatContext(doc, item any, tr *lineTrace, fields ...map[string]string) (string, error) {
+	ctx := map[string]any{}
+	for _, m := range fields {
+		for name, p := range m {
+			var v any
+			var ok bool
+			switch {
+			case strings.HasPrefix(p, "/"):
+				v, ok = resolveRootPointer(doc, p)
+			case item != nil && strings.HasPrefix(p, "./"):
+				v, ok = resolveItemPointer(item, p)
+			case item != nil:
+				return "", fmt.Errorf("caveat_context pointer must start with / or ./")
+			default:
+				return "", fmt.Errorf("caveat_context pointer must start with /")
+			}
+			if !ok {
+				tr.step("caveat_context %s %s: missing", name, p)
+				delete(ctx, name)
+				continue
+			}
+			ctx[name] = v
+		}
+	}
+	if len(ctx) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(ctx)
+	if err != nil {
+		return "", err
+	}
+	tr.step("caveat_context %s", b)
+	return string(b), nil
+}
+
 func applyNormalize(s string, n NormalizeSpec) string {
 	out := s
 	if n.Lowercase {
@@ -391,6 +889,10 @@ func applyNormalize(s string, n NormalizeSpec) string {
 	return out
 }
 
+func ResolvePointer(doc any, ptr string) (any, bool) {
+	return resolveRootPointer(doc, ptr)
+}
+
 func resolveRootPointer(doc any, ptr string) (any, bool) {
 	if !strings.HasPrefix(ptr, "/") {
 		return nil, false
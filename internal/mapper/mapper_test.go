@@ -1,7 +1,21 @@
 package mapper
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+	"github.com/henneberger/metrics-fs/pkg/enums"
+	"gopkg.in/yaml.v3"
 )
 
 func TestResolveRuleForOrders(t *testing.T) {
@@ -73,3 +87,1058 @@ func TestEvaluateOpenLineageFallbackFromFacets(t *testing.T) {
 		t.Fatalf("expected job fallback candidate, got %#v", cands)
 	}
 }
+
+func TestCandidateGuardLimits(t *testing.T) {
+	cands := []Candidate{
+		{ObjectType: "job", ObjectID: "a", Permission: "read"},
+		{ObjectType: "job", ObjectID: "b", Permission: "read"},
+	}
+	deny := &SelectedRule{Rule: MappingRule{Limits: LimitsSpec{MaxCandidatesPerLine: 1, OnExceed: LimitDeny}}}
+	got, err := NewCandidateGuard(deny, "f.jsonl").Check(cands)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("expected oversized line denied, got %v, %v", got, err)
+	}
+
+	warn := &SelectedRule{Rule: MappingRule{Limits: LimitsSpec{MaxCandidatesPerLine: 1, OnExceed: LimitWarn}}}
+	got, err = NewCandidateGuard(warn, "f.jsonl").Check(cands)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected warn to keep candidates, got %v, %v", got, err)
+	}
+
+	perFile := &SelectedRule{Rule: MappingRule{Limits: LimitsSpec{MaxUniqueCandidatesPerFile: 2, OnExceed: LimitDeny}}}
+	g := NewCandidateGuard(perFile, "f.jsonl")
+	if _, err := g.Check(cands); err != nil {
+		t.Fatalf("unexpected error at limit: %v", err)
+	}
+	if _, err := g.Check([]Candidate{{ObjectType: "job", ObjectID: "c", Permission: "read"}}); err == nil {
+		t.Fatalf("expected per-file limit error")
+	}
+}
+
+func TestInvalidObjectIDPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string
+		keep   bool
+	}{
+		{InvalidIDKeep, "acme.checkout", true},
+		{InvalidIDEncode, "acme=2Echeckout", true},
+		{InvalidIDHash, hashObjectID("acme.checkout"), true},
+		{InvalidIDDrop, "", false},
+	}
+	for _, tc := range tests {
+		r := &SelectedRule{Decision: "any", MissingResourceKey: "deny", Rule: MappingRule{
+			ObjectType: "metric_row",
+			Permission: "read",
+			Mapper: MapperSpec{
+				Kind:              "json_pointer",
+				Pointer:           "/id",
+				CanonicalTemplate: "{value}",
+				Normalize:         NormalizeSpec{InvalidObjectID: tc.policy},
+			},
+		}}
+		cands, err := EvaluateLine(r, []byte(`{"id":"acme.checkout"}`))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.policy, err)
+		}
+		if !tc.keep {
+			if len(cands) != 0 {
+				t.Fatalf("%s: expected candidate dropped, got %#v", tc.policy, cands)
+			}
+			continue
+		}
+		if len(cands) != 1 || cands[0].ObjectID != tc.want {
+			t.Fatalf("%s: got %#v, want id %q", tc.policy, cands, tc.want)
+		}
+	}
+	if !ValidObjectID("prod/airflow/daily_etl") || ValidObjectID("a b") || ValidObjectID("*") {
+		t.Fatalf("unexpected ValidObjectID result")
+	}
+
+	// An invalid ID must not alias a valid one that looks encoded or hashed.
+	long := strings.Repeat(" ", MaxObjectIDLength)
+	seen := map[string]string{}
+	for _, id := range []string{"a b", "a=20b", "a=3D20b", "plain", long, hashObjectID(long), "=" + hashObjectID(long)} {
+		enc, ok := applyInvalidIDPolicy(id, InvalidIDEncode)
+		if !ok || !ValidObjectID(enc) {
+			t.Fatalf("encode %q: got %q, %v", id, enc, ok)
+		}
+		if prev, dup := seen[enc]; dup {
+			t.Fatalf("encode: %q and %q both give %q", prev, id, enc)
+		}
+		seen[enc] = id
+	}
+	if enc, _ := applyInvalidIDPolicy("plain", InvalidIDEncode); enc != "plain" {
+		t.Fatalf("encode changed an ID without escapes: %q", enc)
+	}
+}
+
+func TestResolvePermissionsPerOperation(t *testing.T) {
+	r := MappingRule{
+		Permission:           "read",
+		Permissions:          []string{"export", "read"},
+		OperationPermissions: map[string][]string{"open": {"view"}},
+		Mapper:               MapperSpec{Emit: []EmitSpec{{Permission: "read"}}},
+	}
+	open, openHash, err := resolvePermissions(r, "h", "open", auth.DefaultPermission)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if open.Permission != "view" || open.Mapper.Emit[0].Permission != "view" {
+		t.Fatalf("open should use the operation override, got %+v", open)
+	}
+	export, exportHash, err := resolvePermissions(r, "h", "export", auth.DefaultPermission)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if export.Permission != "export+read" || export.Mapper.Emit[0].Permission != "read" {
+		t.Fatalf("export should require read and export, got %+v", export)
+	}
+	if openHash == exportHash {
+		t.Fatalf("operations must not share an index cache key")
+	}
+	if _, _, err := resolvePermissions(MappingRule{Permissions: []string{"a+b"}}, "h", "open", auth.DefaultPermission); err == nil {
+		t.Fatalf("expected invalid permission error")
+	}
+	if _, _, err := resolvePermissions(MappingRule{OperationPermissions: map[string][]string{"copy": {"read"}}}, "h", "open", auth.DefaultPermission); err == nil {
+		t.Fatalf("expected invalid operation error")
+	}
+}
+
+func TestConfiguredDefaultPermission(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: metric_row
+    mapper:
+      kind: json_pointer
+      pointer: /id
+      canonical_template: "metric_row:{value}"
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{SourceDir: dir, MapperFileName: ".metricfs-map.yaml", MissingMapperMode: "deny", DefaultMissingKey: "deny"}
+	path := filepath.Join(dir, "rows.jsonl")
+	before, err := ResolveRuleForFile(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DefaultPermission = "view"
+	r, err := ResolveRuleForFile(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cands, err := EvaluateLine(r, []byte(`{"id":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cands) != 1 || cands[0].Permission != "view" {
+		t.Fatalf("expected a view candidate, got %+v", cands)
+	}
+	if r.RuleHash == before.RuleHash {
+		t.Fatalf("changing the default permission must change the index cache key")
+	}
+}
+
+func TestDebugRuleTracesSampledLines(t *testing.T) {
+	dir := t.TempDir()
+	write := func(debug string) {
+		if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+`+debug+`    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "metric_row:{value}"
+      normalize:
+        lowercase: true
+`), 0o644); err != nil {
+			t.Fatalf("write mapper: %v", err)
+		}
+	}
+	write("")
+	plain, err := ResolveRuleForFile(filepath.Join(dir, "a.jsonl"), Config{SourceDir: dir})
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	write("    debug: true\n    debug_sample_rate: 0.5\n")
+	var b bytes.Buffer
+	rule, err := ResolveRuleForFile(filepath.Join(dir, "a.jsonl"), Config{SourceDir: dir, Trace: &b})
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if rule.RuleHash != plain.RuleHash {
+		t.Fatalf("debug must not change the rule hash")
+	}
+	for _, id := range []string{"A", "B", "C", "D"} {
+		if _, err := EvaluateLine(rule, []byte(`{"id":"`+id+`"}`)); err != nil {
+			t.Fatalf("evaluate: %v", err)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `normalize \"metric_row:A\" -> \"metric_row:a\"`) || !strings.Contains(lines[1], `"metric_row:c#read"`) {
+		t.Fatalf("expected traces for lines 1 and 3, got %q", b.String())
+	}
+	write("    debug: true\n    debug_sample_rate: 2\n")
+	if _, err := ResolveRuleForFile(filepath.Join(dir, "a.jsonl"), Config{SourceDir: dir}); err == nil {
+		t.Fatalf("expected invalid debug_sample_rate rejected")
+	}
+}
+
+func TestGlobMatchingIsSlashSeparatedAndCaseConfigurable(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "Team", "Orders.JSONL")
+	sensitive := newGlobMatcher(enums.GlobCaseSensitive)
+	insensitive := newGlobMatcher(enums.GlobCaseInsensitive)
+	cases := []struct {
+		glob      string
+		sensitive bool
+		folded    bool
+	}{
+		{"Team/*.JSONL", true, true},
+		{"./Team/Orders.JSONL", true, true},
+		{"/Team/**", true, true},
+		{"**/Orders.JSONL", true, true},
+		{"Orders.JSONL", true, true},
+		{"team/*.jsonl", false, true},
+		{"*.jsonl", false, true},
+		{"Other/*.JSONL", false, false},
+	}
+	for _, c := range cases {
+		if got := sensitive.match(c.glob, root, file); got != c.sensitive {
+			t.Errorf("sensitive match(%q) = %v", c.glob, got)
+		}
+		if got := insensitive.match(c.glob, root, file); got != c.folded {
+			t.Errorf("insensitive match(%q) = %v", c.glob, got)
+		}
+	}
+	if got := relToMapper(filepath.Join(root, "Team"), filepath.Join(root, "x.jsonl")); got != "x.jsonl" {
+		t.Fatalf("file outside mapper dir: got %q", got)
+	}
+	if runtime.GOOS == "windows" && !sensitive.match(`Team\*.JSONL`, root, file) {
+		t.Fatalf("backslash glob should match on windows")
+	}
+	if sensitive.hash("h") != "h" || insensitive.hash("h") == "h" {
+		t.Fatalf("case folding must change the rule hash")
+	}
+}
+
+func TestRuleMatchExcludes(t *testing.T) {
+	root := t.TempDir()
+	g := newGlobMatcher(enums.GlobCaseSensitive)
+	m := RuleMatch{Glob: "**/*.jsonl", Exclude: []string{"**/debug/*.jsonl", "!**/debug/keep.jsonl"}}
+	for rel, want := range map[string]bool{
+		"a/orders.jsonl":     true,
+		"a/debug/x.jsonl":    false,
+		"debug/x.jsonl":      false,
+		"a/debug/keep.jsonl": true,
+		"a/orders.csv":       false,
+	} {
+		if _, got := g.matchRule(m, root, root, filepath.Join(root, filepath.FromSlash(rel))); got != want {
+			t.Errorf("matchRule(%s) = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func TestRuleMatchOnSourceRelativePath(t *testing.T) {
+	root := t.TempDir()
+	body := `version: 1
+defaults: {object_type: metric_row, permission: read}
+rules:
+  - match: {path_regex: '^tenants/[^/]+/raw/'}
+    mapper: {kind: json_pointer, pointer: /raw_id, canonical_template: "{value}"}
+  - match: {path_glob: "tenants/*/daily/**/*.jsonl", exclude: ["*.tmp.jsonl"]}
+    mapper: {kind: json_pointer, pointer: /id, canonical_template: "{value}"}
+`
+	if err := os.WriteFile(filepath.Join(root, ".metricfs-map.yaml"), []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{SourceDir: root, MissingMapperMode: "passthrough", GlobCase: enums.GlobCaseSensitive}
+	for rel, want := range map[string]string{
+		"tenants/acme/daily/2026/02/orders.jsonl":     "/id",
+		"tenants/acme/raw/orders.jsonl":               "/raw_id",
+		"tenants/acme/daily/2026/02/orders.tmp.jsonl": "",
+		"orders.jsonl": "",
+	} {
+		r, err := ResolveRuleForFile(filepath.Join(root, filepath.FromSlash(rel)), cfg)
+		if err != nil {
+			t.Fatalf("resolve %s: %v", rel, err)
+		}
+		got := ""
+		if r != nil {
+			got = r.Rule.Mapper.Pointer
+		}
+		if got != want {
+			t.Errorf("resolve %s: pointer %q, want %q", rel, got, want)
+		}
+	}
+
+	bad := strings.Replace(body, "'^tenants/[^/]+/raw/'", "'tenants/('", 1)
+	if err := os.WriteFile(filepath.Join(root, ".metricfs-map.yaml"), []byte(bad), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveRuleForFile(filepath.Join(root, "orders.jsonl"), cfg); err == nil {
+		t.Fatalf("expected an invalid path_regex to be rejected")
+	}
+	// A bad pattern fails the mapper file even when an earlier rule matches.
+	late := body + `  - match: {path_regex: "("}
+    mapper: {kind: json_pointer, pointer: /x, canonical_template: "{value}"}
+`
+	if err := os.WriteFile(filepath.Join(root, ".metricfs-map.yaml"), []byte(late), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveRuleForFile(filepath.Join(root, "tenants", "acme", "raw", "orders.jsonl"), cfg); err == nil {
+		t.Fatalf("expected an invalid path_regex to fail at load")
+	}
+}
+
+func TestMapperDefaultsFillUnsetRuleFields(t *testing.T) {
+	dir := t.TempDir()
+	write := func(sub, body string) string {
+		d := filepath.Join(dir, sub)
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(d, ".metricfs-map.yaml"), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Join(d, "rows.jsonl")
+	}
+	withDefaults := write("defaults", `version: 1
+defaults:
+  object_type: metric_row
+  permission: read
+  normalize:
+    lowercase: true
+  fallback_paths:
+    team: ["/owner"]
+rules:
+  - match:
+      glob: "rows.jsonl"
+    mapper:
+      kind: json_pointer
+      pointer: /id
+  - match:
+      glob: "other.jsonl"
+    object_type: dataset
+    permissions: [export]
+    mapper:
+      kind: json_pointer
+      pointer: /id
+      normalize:
+        trim_slash: true
+`)
+	explicit := write("explicit", `version: 1
+rules:
+  - match:
+      glob: "rows.jsonl"
+    object_type: metric_row
+    permission: read
+    mapper:
+      kind: json_pointer
+      pointer: /id
+      normalize:
+        lowercase: true
+      fallback_paths:
+        team: ["/owner"]
+  - match:
+      glob: "other.jsonl"
+    object_type: dataset
+    permissions: [export]
+    mapper:
+      kind: json_pointer
+      pointer: /id
+      normalize:
+        trim_slash: true
+      fallback_paths:
+        team: ["/owner"]
+`)
+	resolve := func(file string) *SelectedRule {
+		r, err := ResolveRuleForFile(file, Config{SourceDir: dir, MissingMapperMode: "deny", DefaultMissingKey: "deny"})
+		if err != nil {
+			t.Fatalf("resolve %s: %v", file, err)
+		}
+		return r
+	}
+	r := resolve(withDefaults)
+	if r.Rule.ObjectType != "metric_row" || r.Rule.Permission != "read" || !r.Rule.Mapper.Normalize.Lowercase || len(r.Rule.Mapper.FallbackPaths["team"]) != 1 {
+		t.Fatalf("defaults not applied: %+v", r.Rule)
+	}
+	if e := resolve(explicit); e.RuleHash != r.RuleHash {
+		t.Fatalf("defaults must hash like the expanded rule")
+	}
+	o := resolve(filepath.Join(dir, "defaults", "other.jsonl"))
+	if o.Rule.ObjectType != "dataset" || o.Rule.Permission != "export" || o.Rule.Mapper.Normalize.Lowercase || !o.Rule.Mapper.Normalize.TrimSlash {
+		t.Fatalf("rule fields must override defaults: %+v", o.Rule)
+	}
+}
+
+func TestMultiDocumentMapperConcatenatesInOrder(t *testing.T) {
+	dir := t.TempDir()
+	write := func(sub, body string) string {
+		d := filepath.Join(dir, sub)
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(d, ".metricfs-map.yaml"), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	split := write("split", `version: 1
+owner: team-orders
+defaults:
+  object_type: order
+  permission: read
+rules:
+  - match: {glob: "orders.jsonl"}
+    mapper: {kind: json_pointer, pointer: /id}
+---
+version: 1
+owner: team-billing
+defaults:
+  object_type: invoice
+  permission: read
+rules:
+  - match: {glob: "*.jsonl"}
+    mapper: {kind: json_pointer, pointer: /id}
+---
+`)
+	single := write("single", `version: 1
+rules:
+  - match: {glob: "orders.jsonl"}
+    object_type: order
+    permission: read
+    mapper: {kind: json_pointer, pointer: /id}
+  - match: {glob: "*.jsonl"}
+    object_type: invoice
+    permission: read
+    mapper: {kind: json_pointer, pointer: /id}
+`)
+	resolve := func(dir, name string) *SelectedRule {
+		r, err := ResolveRuleForFile(filepath.Join(dir, name), Config{SourceDir: dir, MissingMapperMode: "deny", DefaultMissingKey: "deny"})
+		if err != nil {
+			t.Fatalf("resolve %s: %v", name, err)
+		}
+		return r
+	}
+	if r := resolve(split, "orders.jsonl"); r.Rule.ObjectType != "order" {
+		t.Fatalf("first document should win for orders.jsonl, got %s", r.Rule.ObjectType)
+	}
+	r := resolve(split, "invoices.jsonl")
+	if r.Rule.ObjectType != "invoice" {
+		t.Fatalf("second document defaults not applied: %+v", r.Rule)
+	}
+	if r.RuleHash != resolve(single, "invoices.jsonl").RuleHash {
+		t.Fatalf("splitting into documents must not change the rule hash")
+	}
+
+	bad := write("bad", "version: 1\nextends: ../a.yaml\nrules: []\n---\nversion: 1\nextends: ../b.yaml\nrules: []\n")
+	if _, err := ResolveRuleForFile(filepath.Join(bad, "x.jsonl"), Config{SourceDir: bad}); err == nil || !strings.Contains(err.Error(), "extends") {
+		t.Fatalf("expected a duplicate extends error, got %v", err)
+	}
+	noVersion := write("noversion", "version: 1\nrules: []\n---\nrules: []\n")
+	if _, err := ResolveRuleForFile(filepath.Join(noVersion, "x.jsonl"), Config{SourceDir: noVersion}); err == nil || !strings.Contains(err.Error(), "document 2") {
+		t.Fatalf("expected a document 2 version error, got %v", err)
+	}
+}
+
+func TestLintReportsDeprecatedAndExpiredRules(t *testing.T) {
+	dir := t.TempDir()
+	body := `version: 1
+rules:
+  - match: {glob: "old.jsonl"}
+    object_type: metric_row
+    permission: read
+    deprecated: "use new.jsonl"
+    expires: "2026-03-01"
+    mapper: {kind: json_pointer, pointer: /id}
+  - match: {glob: "*.jsonl"}
+    object_type: metric_row
+    permission: read
+    expires: "2027-01-01"
+    mapper: {kind: json_pointer, pointer: /id}
+`
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	findings, err := Lint(Config{SourceDir: dir}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 || findings[0].Expired || !findings[1].Expired || findings[1].Rule != 0 {
+		t.Fatalf("unexpected findings %+v", findings)
+	}
+	r, err := ResolveRuleForFile(filepath.Join(dir, "x.jsonl"), Config{SourceDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(strings.ReplaceAll(body, "2027-01-01", "2028-01-01")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	again, err := ResolveRuleForFile(filepath.Join(dir, "x.jsonl"), Config{SourceDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.RuleHash != r.RuleHash {
+		t.Fatalf("review metadata must not change the rule hash")
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(strings.ReplaceAll(body, "2027-01-01", "soon")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lint(Config{SourceDir: dir}, now); err == nil {
+		t.Fatalf("expected an invalid expires error")
+	}
+}
+
+func TestObjectPermissionsCoversRulesEmitsAndQuotas(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match: {glob: "orders.jsonl"}
+    object_type: order
+    permissions: [read, audit]
+    operation_permissions: {export: [export]}
+    row_quotas: [{permission: sample, max_rows_per_object: 5}]
+    mapper: {kind: json_pointer, pointer: /id}
+  - match: {glob: "*.jsonl"}
+    object_type: invoice
+    mapper:
+      kind: openlineage
+      emit:
+        - object_type: dataset
+          permission: view
+          fields: {namespace: /ns}
+          canonical_template: "{namespace}"
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ObjectPermissions(Config{SourceDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range got {
+		names = append(names, p.ObjectType+"#"+p.Permission)
+	}
+	want := "dataset#view,invoice#read,order#audit,order#export,order#read,order#sample"
+	if strings.Join(names, ",") != want {
+		t.Fatalf("ObjectPermissions = %v, want %s", names, want)
+	}
+}
+
+func TestCaveatContextFromRowFields(t *testing.T) {
+	r := &SelectedRule{Decision: "any", MissingResourceKey: "deny", Rule: MappingRule{
+		CaveatContext: map[string]string{"ip": "/client/ip", "region": "/region"},
+		Mapper: MapperSpec{
+			Kind: "multi_extract",
+			Emit: []EmitSpec{
+				{ObjectType: "dataset", CanonicalTemplate: "{name}", Fields: map[string]string{"name": "/dataset"}},
+				{
+					ObjectType:    "job",
+					FromArray:     &FromArraySpec{Pointer: "/jobs", Fields: map[string]string{"name": "./name"}, CanonicalTemplate: "{name}"},
+					CaveatContext: map[string]string{"region": "./region", "expires": "./expires"},
+				},
+			},
+		},
+	}}
+	cands, err := EvaluateLine(r, []byte(`{"dataset":"orders","client":{"ip":"10.0.0.1"},"region":"eu","jobs":[{"name":"etl","region":"us","expires":1700000000},{"name":"adhoc"}]}`))
+	if err != nil {
+		t.Fatalf("evaluate line: %v", err)
+	}
+	want := []string{
+		`{"ip":"10.0.0.1","region":"eu"}`,
+		`{"expires":1700000000,"ip":"10.0.0.1","region":"us"}`,
+		`{"ip":"10.0.0.1"}`,
+	}
+	if len(cands) != len(want) {
+		t.Fatalf("expected %d candidates, got %#v", len(want), cands)
+	}
+	for i, c := range cands {
+		if c.Context != want[i] {
+			t.Fatalf("candidate %s:%s: context %s, want %s", c.ObjectType, c.ObjectID, c.Context, want[i])
+		}
+	}
+
+	r.Rule.CaveatContext = map[string]string{"ip": "client/ip"}
+	if _, err := EvaluateLine(r, []byte(`{"dataset":"orders"}`)); err == nil {
+		t.Fatalf("expected a relative caveat_context pointer outside from_array to fail")
+	}
+}
+
+func TestRegexKindMatchesRawLines(t *testing.T) {
+	r := &SelectedRule{Decision: "any", MissingResourceKey: "deny", Rule: MappingRule{
+		ObjectType: "tenant",
+		Permission: "read",
+		Mapper: MapperSpec{
+			Kind:              KindRegex,
+			Pattern:           `tenant=(?P<tenant>[a-z0-9-]+)(?: region=(?P<region>\w+))?`,
+			CanonicalTemplate: "{tenant}",
+		},
+	}}
+	for line, want := range map[string]string{
+		`2026-02-16T10:00:00Z WARN tenant=acme-eu retrying`: "acme-eu",
+		`{"msg":"done","tags":"tenant=globex region=us"}`:   "globex",
+	} {
+		cands, err := EvaluateLine(r, []byte(line))
+		if err != nil {
+			t.Fatalf("evaluate %q: %v", line, err)
+		}
+		if len(cands) != 1 || cands[0].ObjectID != want || cands[0].Permission != "read" {
+			t.Fatalf("evaluate %q: got %#v, want tenant:%s#read", line, cands, want)
+		}
+	}
+	if cands, err := EvaluateLine(r, []byte("no tenant here")); err != nil || len(cands) != 0 {
+		t.Fatalf("unmatched line: got %#v, %v", cands, err)
+	}
+
+	r.Rule.Mapper.CanonicalTemplate = "{region}/{tenant}"
+	if cands, _ := EvaluateLine(r, []byte("tenant=acme")); len(cands) != 0 {
+		t.Fatalf("expected an unmatched optional capture to leave its placeholder unresolved, got %#v", cands)
+	}
+
+	for _, pattern := range []string{"", "tenant=([a-z]+)", "(?P<x>"} {
+		if _, err := compileRegex(MapperSpec{Kind: KindRegex, Pattern: pattern}); err == nil {
+			t.Fatalf("expected pattern %q to be rejected", pattern)
+		}
+	}
+}
+
+func TestWhenClausesRouteLinesToRules(t *testing.T) {
+	dir := t.TempDir()
+	body := `version: 1
+defaults:
+  permission: read
+rules:
+  - match: {glob: "*.jsonl"}
+    when: '/eventType == "COMPLETE"'
+    object_type: job
+    mapper: {kind: json_pointer, pointer: /job/name, canonical_template: "{value}"}
+  - match: {glob: "*.jsonl"}
+    when: {pointer: /eventType, op: in, values: [START, RUNNING]}
+    object_type: run
+    mapper: {kind: json_pointer, pointer: /run/id, canonical_template: "{value}"}
+  - match: {glob: "*.jsonl"}
+    when: /dataset
+    object_type: dataset
+    mapper: {kind: json_pointer, pointer: /dataset, canonical_template: "{value}"}
+`
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ResolveRuleForFile(filepath.Join(dir, "events.jsonl"), Config{SourceDir: dir, MissingMapperMode: "deny", DefaultMissingKey: "deny"})
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	for line, want := range map[string]string{
+		`{"eventType":"COMPLETE","job":{"name":"etl"},"run":{"id":"r1"}}`: "job:etl",
+		`{"eventType":"START","job":{"name":"etl"},"run":{"id":"r1"}}`:    "run:r1",
+		`{"eventType":"OTHER","dataset":"orders"}`:                        "dataset:orders",
+		`{"eventType":"OTHER"}`:                                           "",
+		`not json`:                                                        "",
+	} {
+		cands, err := EvaluateLine(r, []byte(line))
+		if err != nil {
+			t.Fatalf("evaluate %s: %v", line, err)
+		}
+		got := ""
+		for _, c := range cands {
+			got = c.ObjectType + ":" + c.ObjectID
+		}
+		if len(cands) > 1 || got != want {
+			t.Fatalf("evaluate %s: got %#v, want %q", line, cands, want)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(strings.Replace(body, "op: in", "op: like", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveRuleForFile(filepath.Join(dir, "events.jsonl"), Config{SourceDir: dir, MissingMapperMode: "deny"}); err == nil {
+		t.Fatalf("expected an unknown when op to be rejected")
+	}
+}
+
+func TestStaticCandidatesGateEveryLine(t *testing.T) {
+	r := &SelectedRule{Rule: MappingRule{
+		Permission:       "read",
+		StaticCandidates: []string{"dataset:sales_exports", "team:finance#member"},
+	}}
+	cands, err := EvaluateLine(r, []byte("not json"))
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	want := []Candidate{
+		{ObjectType: "dataset", ObjectID: "sales_exports", Permission: "read"},
+		{ObjectType: "team", ObjectID: "finance", Permission: "member"},
+	}
+	if len(cands) != len(want) || cands[0] != want[0] || cands[1] != want[1] {
+		t.Fatalf("got %#v, want %#v", cands, want)
+	}
+
+	r.Rule.ObjectType = "order"
+	r.Rule.Mapper = MapperSpec{Kind: "json_pointer", Pointer: "/id", CanonicalTemplate: "{value}"}
+	if cands, _ := EvaluateLine(r, []byte(`{"id":"o1"}`)); len(cands) != 3 || cands[0].ObjectID != "o1" {
+		t.Fatalf("expected the extracted candidate plus the static ones, got %#v", cands)
+	}
+	if cands, _ := EvaluateLine(r, []byte(`{}`)); len(cands) != 0 {
+		t.Fatalf("a line missing its key should stay without candidates, got %#v", cands)
+	}
+
+	w, _, err := resolvePermissions(MappingRule{StaticCandidates: []string{"team:finance#member"}}, "h", enums.OperationWrite, auth.DefaultPermission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := staticCandidates(w, auth.DefaultPermission); len(got) != 1 || got[0].Permission != "write" {
+		t.Fatalf("write operation should check write on static candidates, got %#v", got)
+	}
+	if _, err := staticCandidates(MappingRule{StaticCandidates: []string{"sales_exports"}}, auth.DefaultPermission); err == nil {
+		t.Fatalf("expected a static candidate without a type to be rejected")
+	}
+}
+
+func TestTemplatesUsePathVariables(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match: {path_regex: '^tenant=(?P<tenant>[^/]+)/date=(?P<date>[^/]+)/'}
+    object_type: partition
+    permission: read
+    mapper: {kind: json_pointer, pointer: /id, canonical_template: "{tenant}/{date}/{value}"}
+  - match: {glob: "*.jsonl"}
+    object_type: file
+    permission: read
+    mapper: {kind: json_pointer, pointer: /id, canonical_template: "{__dir}|{__file}|{__path}"}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{SourceDir: root, MissingMapperMode: "deny", GlobCase: enums.GlobCaseSensitive}
+	for rel, want := range map[string]string{
+		"tenant=acme/date=2026-02-16/orders.jsonl": "acme/2026-02-16/o1",
+		"exports/eu/orders.jsonl":                  "exports/eu|orders.jsonl|exports/eu/orders.jsonl",
+		"orders.jsonl":                             "|orders.jsonl|orders.jsonl",
+	} {
+		r, err := ResolveRuleForFile(filepath.Join(root, filepath.FromSlash(rel)), cfg)
+		if err != nil {
+			t.Fatalf("resolve %s: %v", rel, err)
+		}
+		cands, err := EvaluateLine(r, []byte(`{"id":"o1"}`))
+		if err != nil {
+			t.Fatalf("evaluate %s: %v", rel, err)
+		}
+		if len(cands) != 1 || cands[0].ObjectID != want {
+			t.Fatalf("%s: got %#v, want object id %q", rel, cands, want)
+		}
+	}
+}
+
+func TestNestedFromArrayScopesItemPointers(t *testing.T) {
+	r := &SelectedRule{Rule: MappingRule{Mapper: MapperSpec{
+		Kind: "multi_extract",
+		Emit: []EmitSpec{{
+			ObjectType: "column",
+			FromArray: &FromArraySpec{
+				Pointer: "/inputs",
+				Fields:  map[string]string{"ns": "./namespace"},
+				FromArray: &FromArraySpec{
+					Pointer:           "./facets/columnLineage/fields",
+					Fields:            map[string]string{"table": "../name", "col": "./name"},
+					CanonicalTemplate: "{ns}/{table}/{col}",
+				},
+			},
+		}},
+	}}}
+	line := `{"inputs":[
+		{"namespace":"prod","name":"orders","facets":{"columnLineage":{"fields":[{"name":"id"},{"name":"total"}]}}},
+		{"namespace":"dev","name":"refunds","facets":{}}
+	]}`
+	cands, err := EvaluateLine(r, []byte(strings.Join(strings.Fields(line), "")))
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	var ids []string
+	for _, c := range cands {
+		ids = append(ids, c.ObjectID)
+	}
+	if strings.Join(ids, ",") != "prod/orders/id,prod/orders/total" {
+		t.Fatalf("unexpected candidates: %v", ids)
+	}
+
+	r.Rule.Mapper.Emit[0].FromArray.FromArray.Fields["x"] = "../../name"
+	if _, err := EvaluateLine(r, []byte(`{"inputs":[{"name":"o","facets":{"columnLineage":{"fields":[{"name":"c"}]}}}]}`)); err == nil {
+		t.Fatalf("expected a pointer above the outermost item to fail")
+	}
+}
+
+func TestWhenComparesTypedValues(t *testing.T) {
+	for _, tc := range []struct {
+		when string
+		line string
+		want bool
+	}{
+		{"/n == 1", `{"n":1.0}`, true},
+		{"{pointer: /n, value: 1.0}", `{"n":1}`, true},
+		{"/n == 1", `{"n":"1"}`, false},
+		{`/n == "1"`, `{"n":1}`, false},
+		{"/n == null", `{"n":null}`, true},
+		{"{pointer: /n, value: null}", `{"n":null}`, true},
+		{"{pointer: /n, value: null}", `{"n":"null"}`, false},
+		{"{pointer: /n, value: null}", `{}`, false},
+		{"/n != null", `{"n":0}`, true},
+		{"{pointer: /n, op: in, values: [null, 2]}", `{"n":2.0}`, true},
+		{"/n == true", `{"n":"true"}`, false},
+		{"/n == START", `{"n":"START"}`, true},
+	} {
+		var w WhenSpec
+		if err := yaml.Unmarshal([]byte(tc.when), &w); err != nil {
+			t.Fatalf("parse %s: %v", tc.when, err)
+		}
+		var doc any
+		if err := json.Unmarshal([]byte(tc.line), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.holds(doc); got != tc.want {
+			t.Fatalf("%s on %s: got %v, want %v", tc.when, tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestJSONPointerTriesPointersInOrder(t *testing.T) {
+	warns := warnings.New()
+	r := &SelectedRule{Warnings: warns, Rule: MappingRule{
+		ObjectType: "order",
+		Mapper:     MapperSpec{Kind: "json_pointer", Pointers: []string{"/order_id", "/orderId", "/legacy/id"}, CanonicalTemplate: "{value}"},
+	}}
+	for line, want := range map[string]string{
+		`{"order_id":"o1","orderId":"o2"}`: "o1",
+		`{"order_id":"","orderId":"o2"}`:   "o2",
+		`{"legacy":{"id":"o3"}}`:           "o3",
+		`{"other":"x"}`:                    "",
+	} {
+		cands, err := EvaluateLine(r, []byte(line))
+		if err != nil {
+			t.Fatalf("evaluate %s: %v", line, err)
+		}
+		got := ""
+		if len(cands) == 1 {
+			got = cands[0].ObjectID
+		}
+		if len(cands) > 1 || got != want {
+			t.Fatalf("evaluate %s: got %#v, want %q", line, cands, want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := EvaluateLine(r, []byte(`{"orderId":"o4"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c := warns.Counts()[warnings.KindFallbackUsed]; c != 2 {
+		t.Fatalf("expected one fallback_used warning per fallback pointer, got %d", c)
+	}
+	r.Rule.Mapper.Pointers = append(r.Rule.Mapper.Pointers, "bad")
+	if _, err := EvaluateLine(r, []byte(`{}`)); err == nil {
+		t.Fatalf("expected a relative pointer to be rejected")
+	}
+}
+
+func TestComposeJoinsFieldsWithEmptyPolicy(t *testing.T) {
+	emit := EmitSpec{
+		ObjectType: "dataset",
+		Fields:     map[string]string{"ns": "/ns", "db": "/db", "name": "/name"},
+		Compose: &ComposeSpec{
+			Fields: []ComposeField{{Name: "ns", Lowercase: true, TrimSlash: true}, {Name: "db"}, {Name: "name"}},
+			Sep:    "/",
+		},
+	}
+	r := &SelectedRule{Rule: MappingRule{Mapper: MapperSpec{Kind: "multi_extract", Emit: []EmitSpec{emit}}}}
+	id := func(line string) string {
+		t.Helper()
+		cands, err := EvaluateLine(r, []byte(line))
+		if err != nil {
+			t.Fatalf("evaluate %s: %v", line, err)
+		}
+		if len(cands) != 1 {
+			return ""
+		}
+		return cands[0].ObjectID
+	}
+	for empty, want := range map[string]string{
+		"":               "",
+		ComposeEmptyDeny: "",
+		ComposeEmptySkip: "prod/orders",
+	} {
+		r.Rule.Mapper.Emit[0].Compose.Empty = empty
+		if got := id(`{"ns":"/Prod/","db":"","name":"orders"}`); got != want {
+			t.Fatalf("empty=%q: got %q, want %q", empty, got, want)
+		}
+	}
+
+	// (sales/eu, orders) and (sales, eu/orders) would both join to prod/sales/eu/orders.
+	for _, empty := range []string{ComposeEmptyDeny, ComposeEmptySkip} {
+		r.Rule.Mapper.Emit[0].Compose.Empty = empty
+		if got := id(`{"ns":"prod","db":"sales","name":"eu/orders"}`); got != "" {
+			t.Fatalf("empty=%s: sep inside a value gave %q", empty, got)
+		}
+		if got := id(`{"ns":"prod","db":"sales/eu","name":"orders"}`); got != "" {
+			t.Fatalf("empty=%s: sep inside a value gave %q", empty, got)
+		}
+		if got := id(`{"ns":"prod","db":"sales","name":"orders"}`); got != "prod/sales/orders" {
+			t.Fatalf("empty=%s: got %q", empty, got)
+		}
+	}
+	// collapse aliased (a, "", b) with (a, b, ""); it is no longer accepted.
+	r.Rule.Mapper.Emit[0].Compose.Empty = "collapse"
+	if err := validateCompose(r.Rule); err == nil {
+		t.Fatalf("expected empty=collapse to be rejected")
+	}
+	noSep := MappingRule{Mapper: MapperSpec{Kind: "multi_extract", Emit: []EmitSpec{{Compose: &ComposeSpec{Fields: []ComposeField{{Name: "a"}, {Name: "b"}}}}}}}
+	if err := validateCompose(noSep); err == nil {
+		t.Fatalf("expected compose of two fields without sep to be rejected")
+	}
+
+	var spec MapperSpec
+	if err := yaml.Unmarshal([]byte("compose: {fields: [value, {name: __file, lowercase: true}], sep: \":\"}"), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Compose.Fields) != 2 || spec.Compose.Fields[0].Name != "value" || !spec.Compose.Fields[1].Lowercase {
+		t.Fatalf("unexpected compose spec: %+v", spec.Compose)
+	}
+	bad := MappingRule{Mapper: MapperSpec{Kind: "json_pointer", CanonicalTemplate: "{value}", Compose: spec.Compose}}
+	if err := validateCompose(bad); err == nil {
+		t.Fatalf("expected compose beside canonical_template to be rejected")
+	}
+}
+
+func TestValidateReportsProblemsWithLines(t *testing.T) {
+	dir := t.TempDir()
+	write := func(rel, body string) string {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	good := write("good/.metricfs-map.yaml", `version: 1
+rules:
+  - match: {glob: "*.jsonl", exclude: ["debug/**"]}
+    when: '/eventType == "COMPLETE"'
+    object_type: column
+    permission: read
+    mapper:
+      kind: multi_extract
+      emit:
+        - object_type: column
+          from_array:
+            pointer: /inputs
+            from_array: {pointer: ./fields, fields: {table: ../name, col: ./name}, compose: {fields: [table, col], sep: "."}}
+`)
+	write("bad/.metricfs-map.yaml", `version: 1
+rules:
+  - match: {glob: "[a-"}
+    object_type: order
+    permision: read
+    decision: most
+    mapper:
+      kind: json_pointer
+      pointer: order_id
+  - match: {path_regex: "("}
+    mapper: {kind: multi_extract, emit: [{object_type: x, fields: {id: ./id}}]}
+`)
+	write("cycle/a/.metricfs-map.yaml", "version: 1\nextends: ../b/.metricfs-map.yaml\nrules: []\n")
+	write("cycle/b/.metricfs-map.yaml", "version: 1\nextends: ../a/.metricfs-map.yaml\nrules: []\n")
+
+	problems, err := Validate(Config{SourceDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, p := range problems {
+		if p.Path == good {
+			t.Errorf("valid mapper reported: %s", p)
+		}
+		rel, _ := filepath.Rel(dir, p.Path)
+		got[fmt.Sprintf("%s:%d", filepath.ToSlash(rel), p.Line)] = true
+	}
+	for _, want := range []string{
+		"bad/.metricfs-map.yaml:3",  // unparseable glob
+		"bad/.metricfs-map.yaml:5",  // unknown field permision
+		"bad/.metricfs-map.yaml:6",  // decision enum
+		"bad/.metricfs-map.yaml:9",  // relative root pointer
+		"bad/.metricfs-map.yaml:10", // path_regex
+		"bad/.metricfs-map.yaml:11", // ./ outside from_array
+		"cycle/a/.metricfs-map.yaml:2",
+		"cycle/b/.metricfs-map.yaml:2",
+	} {
+		if !got[want] {
+			t.Errorf("missing problem at %s; got %v", want, problems)
+		}
+	}
+}
+
+func TestSchemaCoversMappingFileFields(t *testing.T) {
+	var schema map[string]any
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatal(err)
+	}
+	defs, _ := schema["$defs"].(map[string]any)
+	var resolve func(n map[string]any) map[string]any
+	resolve = func(n map[string]any) map[string]any {
+		if ref, ok := n["$ref"].(string); ok {
+			d, _ := defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]any)
+			return resolve(d)
+		}
+		if items, ok := n["items"].(map[string]any); ok {
+			return resolve(items)
+		}
+		if _, ok := n["properties"]; !ok {
+			if ap, ok := n["additionalProperties"].(map[string]any); ok {
+				return resolve(ap)
+			}
+		}
+		return n
+	}
+	seen := map[reflect.Type]bool{}
+	var check func(typ reflect.Type, node map[string]any, where string)
+	check = func(typ reflect.Type, node map[string]any, where string) {
+		if seen[typ] {
+			return
+		}
+		seen[typ] = true
+		props, _ := node["properties"].(map[string]any)
+		tags := map[string]bool{}
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			tag, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if !f.IsExported() || tag == "" || tag == "-" {
+				continue
+			}
+			tags[tag] = true
+			prop, ok := props[tag].(map[string]any)
+			if !ok {
+				t.Errorf("%s.%s: yaml key %q is missing from the schema", where, f.Name, tag)
+				continue
+			}
+			elem := f.Type
+			for elem.Kind() == reflect.Pointer || elem.Kind() == reflect.Slice || elem.Kind() == reflect.Map {
+				elem = elem.Elem()
+			}
+			if elem.Kind() == reflect.Struct {
+				check(elem, resolve(prop), where+"."+tag)
+			}
+		}
+		for key := range props {
+			if !tags[key] {
+				t.Errorf("%s: schema property %q has no yaml field", where, key)
+			}
+		}
+	}
+	check(reflect.TypeOf(MappingFile{}), schema, "file")
+}
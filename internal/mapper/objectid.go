@@ -0,0 +1,86 @@
+package mapper
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	InvalidIDKeep   = "keep"
+	InvalidIDEncode = "encode"
+	InvalidIDHash   = "hash"
+	InvalidIDDrop   = "drop"
+)
+
+const MaxObjectIDLength = 1024
+
+func validateInvalidIDPolicy(policy string) error {
+	switch policy {
+	case "", InvalidIDKeep, InvalidIDEncode, InvalidIDHash, InvalidIDDrop:
+		return nil
+	default:
+		return fmt.Errorf("invalid normalize.invalid_object_id: %s", policy)
+	}
+}
+
+func ValidObjectID(id string) bool {
+	if id == "" || len(id) > MaxObjectIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if !validObjectIDByte(id[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func validObjectIDByte(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("/_|-=+", c) >= 0
+}
+
+func applyInvalidIDPolicy(id, policy string) (string, bool) {
+	if policy == "" || policy == InvalidIDKeep {
+		return id, true
+	}
+	if policy == InvalidIDEncode {
+		enc := encodeObjectID(id)
+		if len(enc) > MaxObjectIDLength {
+			return "=" + hashObjectID(id), true
+		}
+		return enc, true
+	}
+	if ValidObjectID(id) {
+		return id, true
+	}
+	switch policy {
+	case InvalidIDHash:
+		return hashObjectID(id), true
+	default:
+		return "", false
+	}
+}
+
+func encodeObjectID(id string) string {
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c != '=' && validObjectIDByte(c) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "=%02X", c)
+	}
+	return b.String()
+}
+
+func hashObjectID(id string) string {
+	h := sha1.Sum([]byte(id))
+	return "sha1-" + hex.EncodeToString(h[:])
+}
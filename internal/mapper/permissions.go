@@ -0,0 +1,85 @@
+package mapper
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/pkg/enums"
+)
+
+func resolvePermissions(r MappingRule, ruleHash string, op enums.Operation, defaultPermission string) (MappingRule, string, error) {
+	for name := range r.OperationPermissions {
+		if _, err := enums.ParseOperation(name); err != nil || name == "" {
+			return r, "", fmt.Errorf("invalid operation_permissions key: %q", name)
+		}
+	}
+	override, hasOverride := r.OperationPermissions[string(op)]
+	if op == enums.OperationWrite && !hasOverride {
+		override, hasOverride = []string{"write"}, true
+	}
+	perm, err := compositePermission(r.Permission, r.Permissions, override, hasOverride)
+	if err != nil {
+		return r, "", err
+	}
+	if perm == "" {
+		perm = defaultPermission
+	}
+	r.Permission = perm
+	emits := make([]EmitSpec, len(r.Mapper.Emit))
+	for i, e := range r.Mapper.Emit {
+		perm, err := compositePermission(e.Permission, e.Permissions, override, hasOverride)
+		if err != nil {
+			return r, "", err
+		}
+		if perm == "" {
+			perm = defaultPermission
+		}
+		e.Permission = perm
+		emits[i] = e
+	}
+	r.Mapper.Emit = emits
+	if hasOverride {
+		// The operation's permissions replace the ones static candidates name.
+		statics := make([]string, len(r.StaticCandidates))
+		for i, c := range r.StaticCandidates {
+			statics[i], _, _ = strings.Cut(c, "#")
+		}
+		r.StaticCandidates = statics
+	}
+	if len(r.OperationPermissions) > 0 {
+		h := sha1.Sum([]byte(ruleHash + "|" + string(op)))
+		ruleHash = hex.EncodeToString(h[:])
+	}
+	return r, ruleHash, nil
+}
+
+func compositePermission(single string, list, override []string, hasOverride bool) (string, error) {
+	perms := append([]string{}, list...)
+	if single != "" {
+		perms = append(perms, single)
+	}
+	if hasOverride {
+		perms = override
+	}
+	set := map[string]struct{}{}
+	for _, p := range perms {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.Contains(p, auth.PermissionSeparator) {
+			return "", fmt.Errorf("invalid permission: %q", p)
+		}
+		set[p] = struct{}{}
+	}
+	if len(set) == 0 {
+		return "", nil
+	}
+	out := make([]string, 0, len(set))
+	for p := range set {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return strings.Join(out, auth.PermissionSeparator), nil
+}
@@ -0,0 +1,23 @@
+package mapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+type RowQuota struct {
+	Permission       string `yaml:"permission" json:"permission"`
+	MaxRowsPerObject int    `yaml:"max_rows_per_object" json:"max_rows_per_object"`
+}
+
+func validateRowQuotas(r MappingRule) error {
+	for i, q := range r.RowQuotas {
+		if strings.TrimSpace(q.Permission) == "" {
+			return fmt.Errorf("row_quotas[%d]: permission is required", i)
+		}
+		if q.MaxRowsPerObject <= 0 {
+			return fmt.Errorf("row_quotas[%d]: max_rows_per_object must be positive, got %d", i, q.MaxRowsPerObject)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package mapper
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const KindRegex = "regex"
+
+func compileRegex(ms MapperSpec) (*regexp.Regexp, error) {
+	if ms.Kind != KindRegex {
+		return nil, nil
+	}
+	if ms.Pattern == "" {
+		return nil, fmt.Errorf("regex mapper needs a pattern")
+	}
+	re, err := regexp.Compile(ms.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("regex mapper pattern: %w", err)
+	}
+	named := false
+	for _, name := range re.SubexpNames() {
+		named = named || name != ""
+	}
+	if !named {
+		return nil, fmt.Errorf("regex mapper pattern %q has no named capture", ms.Pattern)
+	}
+	return re, nil
+}
+
+func regexValues(re *regexp.Regexp, line []byte) (map[string]any, bool) {
+	m := re.FindSubmatchIndex(line)
+	if m == nil {
+		return nil, false
+	}
+	vals := map[string]any{}
+	for i, name := range re.SubexpNames() {
+		if name == "" || m[2*i] < 0 {
+			continue
+		}
+		vals[name] = string(line[m[2*i]:m[2*i+1]])
+	}
+	return vals, true
+}
@@ -0,0 +1,32 @@
+package mapper
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+func staticCandidates(r MappingRule, defaultPermission string) ([]Candidate, error) {
+	out := make([]Candidate, 0, len(r.StaticCandidates))
+	for _, s := range r.StaticCandidates {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "#") {
+			perm := r.Permission
+			if perm == "" {
+				perm = defaultPermission
+			}
+			s += "#" + perm
+		}
+		c, err := auth.ParseCandidateKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("static_candidates: %w", err)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func (r *SelectedRule) staticOnly() bool {
+	return r.Rule.Mapper.Kind == "" && len(r.Rule.StaticCandidates) > 0
+}
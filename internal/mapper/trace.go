@@ -0,0 +1,92 @@
+package mapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultDebugSampleRate = 0.01
+
+func validateDebug(r MappingRule) error {
+	if r.DebugSampleRate < 0 || r.DebugSampleRate > 1 {
+		return fmt.Errorf("debug_sample_rate must be in (0, 1], got %v", r.DebugSampleRate)
+	}
+	return nil
+}
+
+type tracer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	path  string
+	glob  string
+	every uint64
+	n     atomic.Uint64
+}
+
+func newTracer(r MappingRule, w io.Writer, path string) *tracer {
+	if !r.Debug || w == nil {
+		return nil
+	}
+	rate := r.DebugSampleRate
+	if rate == 0 {
+		rate = DefaultDebugSampleRate
+	}
+	return &tracer{w: w, path: path, glob: r.Match.String(), every: uint64(math.Max(1, math.Round(1/rate)))}
+}
+
+func (t *tracer) sample() *lineTrace {
+	if t == nil {
+		return nil
+	}
+	if (t.n.Add(1)-1)%t.every != 0 {
+		return nil
+	}
+	return &lineTrace{t: t}
+}
+
+type lineTrace struct {
+	t     *tracer
+	steps []string
+}
+
+func (lt *lineTrace) step(format string, args ...any) {
+	if lt == nil {
+		return
+	}
+	lt.steps = append(lt.steps, fmt.Sprintf(format, args...))
+}
+
+func (lt *lineTrace) done(cands []Candidate, err error) {
+	if lt == nil {
+		return
+	}
+	rec := struct {
+		Time       time.Time `json:"time"`
+		Path       string    `json:"path"`
+		Rule       string    `json:"rule"`
+		Steps      []string  `json:"steps"`
+		Candidates []string  `json:"candidates"`
+		Error      string    `json:"error,omitempty"`
+	}{Time: time.Now().UTC(), Path: lt.t.path, Rule: lt.t.glob, Steps: lt.steps, Candidates: []string{}}
+	for _, c := range cands {
+		rec.Candidates = append(rec.Candidates, c.ObjectType+":"+c.ObjectID+"#"+c.Permission)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(rec) != nil {
+		return
+	}
+	lt.t.mu.Lock()
+	defer lt.t.mu.Unlock()
+	_, _ = lt.t.w.Write(b.Bytes())
+}
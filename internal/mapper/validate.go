@@ -0,0 +1,415 @@
+package mapper
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is the JSON Schema of a mapper file, for editors and for
+// Validate.
+//
+//go:embed mapper.schema.json
+var Schema []byte
+
+type Problem struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d: %s", p.Path, p.Line, p.Message)
+}
+
+func Validate(cfg Config) ([]Problem, error) {
+	cfg = defaults(cfg)
+	root, err := compileSchema(Schema)
+	if err != nil {
+		return nil, err
+	}
+	var out []Problem
+	err = filepath.WalkDir(cfg.SourceDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != cfg.MapperFileName {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out = append(out, validateFile(path, b, root, cfg)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Path != out[j].Path {
+			return out[i].Path < out[j].Path
+		}
+		return out[i].Line < out[j].Line
+	})
+	return out, nil
+}
+
+var yamlLine = regexp.MustCompile(`line (\d+)`)
+
+func validateFile(path string, b []byte, root *schemaNode, cfg Config) []Problem {
+	var out []Problem
+	add := func(line int, format string, args ...any) {
+		out = append(out, Problem{Path: path, Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	extendsLine := 0
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			line := 1
+			if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+				fmt.Sscan(m[1], &line)
+			}
+			add(line, "%v", err)
+			return out
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+			continue
+		}
+		n := doc.Content[0]
+		schemaErrs := root.check(n, root, "")
+		for _, e := range schemaErrs {
+			add(e.line, "%s", e.msg)
+		}
+		if v := mappingValue(n, "extends"); v != nil && extendsLine == 0 {
+			extendsLine = v.Line
+		}
+		var mf MappingFile
+		if err := n.Decode(&mf); err != nil {
+			// The schema check has already said why.
+			continue
+		}
+		rules := mappingValue(n, "rules")
+		for i, r := range mf.Rules {
+			rn, end := n, math.MaxInt
+			if rules != nil && i < len(rules.Content) {
+				rn = rules.Content[i]
+			}
+			if rules != nil && i+1 < len(rules.Content) {
+				end = rules.Content[i+1].Line
+			}
+			// selectRule can only point at the rule, so it speaks only when nothing else did.
+			errs := append(checkRulePointers(rn), checkRuleMatch(rn)...)
+			for _, e := range errs {
+				add(e.line, "%s", e.msg)
+			}
+			for _, e := range schemaErrs {
+				if e.line >= rn.Line && e.line < end {
+					errs = append(errs, e)
+				}
+			}
+			if _, _, err := selectRule(applyDefaults(r, mf.Defaults), "", cfg); err != nil && len(errs) == 0 {
+				add(rn.Line, "rule %d: %v", i+1, err)
+			}
+		}
+	}
+	// Checked last so the chain's own errors are not reported twice.
+	if extendsLine > 0 && len(out) == 0 {
+		if _, _, err := loadRules(path, true, map[string]bool{}); err != nil {
+			add(extendsLine, "extends: %v", err)
+		}
+	}
+	return out
+}
+
+type nodeError struct {
+	line int
+	msg  string
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func checkRuleMatch(rule *yaml.Node) []nodeError {
+	var out []nodeError
+	m := mappingValue(rule, "match")
+	globs := []*yaml.Node{mappingValue(m, "glob"), mappingValue(m, "path_glob")}
+	if ex := mappingValue(m, "exclude"); ex != nil && ex.Kind == yaml.SequenceNode {
+		globs = append(globs, ex.Content...)
+	}
+	for _, g := range globs {
+		if g == nil || g.Kind != yaml.ScalarNode {
+			continue
+		}
+		if !doublestar.ValidatePattern(normalizeGlob(strings.TrimPrefix(strings.TrimSpace(g.Value), "!"))) {
+			out = append(out, nodeError{g.Line, fmt.Sprintf("invalid glob %q", g.Value)})
+		}
+	}
+	if re := mappingValue(m, "path_regex"); re != nil && re.Kind == yaml.ScalarNode {
+		if _, err := regexp.Compile(re.Value); err != nil {
+			out = append(out, nodeError{re.Line, fmt.Sprintf("match.path_regex: %v", err)})
+		}
+	}
+	return out
+}
+
+func checkRulePointers(rule *yaml.Node) []nodeError {
+	var out []nodeError
+	root := func(n *yaml.Node, what string) {
+		if n != nil && n.Kind == yaml.ScalarNode && !strings.HasPrefix(n.Value, "/") {
+			out = append(out, nodeError{n.Line, fmt.Sprintf("%s %q must be a root pointer starting with /", what, n.Value)})
+		}
+	}
+	each := func(n *yaml.Node, fn func(*yaml.Node)) {
+		if n == nil {
+			return
+		}
+		switch n.Kind {
+		case yaml.SequenceNode:
+			for _, c := range n.Content {
+				fn(c)
+			}
+		case yaml.MappingNode:
+			for i := 1; i < len(n.Content); i += 2 {
+				fn(n.Content[i])
+			}
+		}
+	}
+	var fromArray func(fa *yaml.Node, depth int)
+	fromArray = func(fa *yaml.Node, depth int) {
+		if fa == nil {
+			return
+		}
+		if depth == 0 {
+			root(mappingValue(fa, "pointer"), "from_array pointer")
+		} else if p := mappingValue(fa, "pointer"); p != nil && p.Kind == yaml.ScalarNode {
+			if _, _, err := resolveScopedPointer(make([]any, depth), p.Value); err != nil {
+				out = append(out, nodeError{p.Line, "nested from_array pointer: " + err.Error()})
+			}
+		}
+		each(mappingValue(fa, "fields"), func(p *yaml.Node) {
+			if p.Kind != yaml.ScalarNode {
+				return
+			}
+			if _, _, err := resolveScopedPointer(make([]any, depth+1), p.Value); err != nil {
+				out = append(out, nodeError{p.Line, "from_array field pointer: " + err.Error()})
+			}
+		})
+		fromArray(mappingValue(fa, "from_array"), depth+1)
+	}
+
+	each(mappingValue(rule, "caveat_context"), func(p *yaml.Node) { root(p, "caveat_context pointer") })
+	if w := mappingValue(rule, "when"); w != nil {
+		if w.Kind == yaml.ScalarNode {
+			var ws WhenSpec
+			if ws.parse(w.Value) == nil && !strings.HasPrefix(ws.Pointer, "/") {
+				out = append(out, nodeError{w.Line, fmt.Sprintf("when pointer %q must be a root pointer starting with /", ws.Pointer)})
+			}
+		} else {
+			root(mappingValue(w, "pointer"), "when pointer")
+		}
+	}
+	m := mappingValue(rule, "mapper")
+	root(mappingValue(m, "pointer"), "pointer")
+	each(mappingValue(m, "pointers"), func(p *yaml.Node) { root(p, "pointer") })
+	each(mappingValue(m, "fallback_paths"), func(ps *yaml.Node) {
+		each(ps, func(p *yaml.Node) { root(p, "fallback_paths pointer") })
+	})
+	fromArray(mappingValue(m, "from_array"), 0)
+	each(mappingValue(m, "emit"), func(e *yaml.Node) {
+		each(mappingValue(e, "fields"), func(p *yaml.Node) { root(p, "fields pointer") })
+		fa := mappingValue(e, "from_array")
+		fromArray(fa, 0)
+		each(mappingValue(e, "caveat_context"), func(p *yaml.Node) {
+			if fa != nil && p.Kind == yaml.ScalarNode && strings.HasPrefix(p.Value, "./") {
+				return
+			}
+			root(p, "caveat_context pointer")
+		})
+	})
+	return out
+}
+
+type schemaNode struct {
+	Type                 any                    `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Properties           map[string]*schemaNode `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *schemaNode            `json:"items"`
+	Ref                  string                 `json:"$ref"`
+	Defs                 map[string]*schemaNode `json:"$defs"`
+
+	additional *schemaNode
+	closed     bool
+}
+
+func compileSchema(b []byte) (*schemaNode, error) {
+	var root schemaNode
+	if err := json.Unmarshal(b, &root); err != nil {
+		return nil, fmt.Errorf("mapper schema: %w", err)
+	}
+	var prepare func(*schemaNode) error
+	prepare = func(s *schemaNode) error {
+		if s == nil {
+			return nil
+		}
+		switch raw := strings.TrimSpace(string(s.AdditionalProperties)); {
+		case raw == "false":
+			s.closed = true
+		case strings.HasPrefix(raw, "{"):
+			s.additional = &schemaNode{}
+			if err := json.Unmarshal(s.AdditionalProperties, s.additional); err != nil {
+				return err
+			}
+		}
+		for _, c := range s.Properties {
+			if err := prepare(c); err != nil {
+				return err
+			}
+		}
+		for _, c := range s.Defs {
+			if err := prepare(c); err != nil {
+				return err
+			}
+		}
+		if err := prepare(s.Items); err != nil {
+			return err
+		}
+		return prepare(s.additional)
+	}
+	if err := prepare(&root); err != nil {
+		return nil, fmt.Errorf("mapper schema: %w", err)
+	}
+	return &root, nil
+}
+
+func (s *schemaNode) check(n *yaml.Node, root *schemaNode, at string) []nodeError {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if s.Ref != "" {
+		def, ok := root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+		if !ok {
+			return []nodeError{{n.Line, fmt.Sprintf("%s: schema has no %s", where(at), s.Ref)}}
+		}
+		return def.check(n, root, at)
+	}
+	kind := nodeType(n)
+	if types := s.types(); len(types) > 0 && !slices.Contains(types, kind) && !(kind == "integer" && slices.Contains(types, "number")) {
+		return []nodeError{{n.Line, fmt.Sprintf("%s: expected %s, got %s", where(at), strings.Join(types, " or "), kind)}}
+	}
+	var out []nodeError
+	if len(s.Enum) > 0 && n.Kind == yaml.ScalarNode {
+		ok := false
+		for _, e := range s.Enum {
+			ok = ok || fmt.Sprint(e) == n.Value
+		}
+		if !ok {
+			out = append(out, nodeError{n.Line, fmt.Sprintf("%s: %q is not one of %v", where(at), n.Value, s.Enum)})
+		}
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			seen[k.Value] = true
+			child := s.Properties[k.Value]
+			if child == nil {
+				child = s.additional
+			}
+			if child == nil {
+				if s.closed {
+					out = append(out, nodeError{k.Line, fmt.Sprintf("%s: unknown field %q", where(at), k.Value)})
+				}
+				continue
+			}
+			out = append(out, child.check(v, root, join(at, k.Value))...)
+		}
+		for _, r := range s.Required {
+			if !seen[r] {
+				out = append(out, nodeError{n.Line, fmt.Sprintf("%s: missing required field %q", where(at), r)})
+			}
+		}
+	case yaml.SequenceNode:
+		if s.Items != nil {
+			for i, c := range n.Content {
+				out = append(out, s.Items.check(c, root, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	}
+	return out
+}
+
+func (s *schemaNode) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		out := make([]string, 0, len(t))
+		for _, x := range t {
+			out = append(out, fmt.Sprint(x))
+		}
+		return out
+	}
+	return nil
+}
+
+func nodeType(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "array"
+	}
+	switch n.ShortTag() {
+	case "!!int":
+		return "integer"
+	case "!!float":
+		return "number"
+	case "!!bool":
+		return "boolean"
+	case "!!null":
+		return "null"
+	}
+	return "string"
+}
+
+func join(at, key string) string {
+	if at == "" {
+		return key
+	}
+	return at + "." + key
+}
+
+func where(at string) string {
+	if at == "" {
+		return "document"
+	}
+	return at
+}
@@ -0,0 +1,190 @@
+package mapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	WhenEq      = "eq"
+	WhenNe      = "ne"
+	WhenIn      = "in"
+	WhenExists  = "exists"
+	WhenMissing = "missing"
+)
+
+type WhenSpec struct {
+	Pointer string `yaml:"pointer" json:"pointer"`
+	Op      string `yaml:"op" json:"op,omitempty"`
+	Value   any    `yaml:"value" json:"value,omitempty"`
+	Values  []any  `yaml:"values" json:"values,omitempty"`
+
+	valueSet bool
+}
+
+func (w *WhenSpec) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return w.parse(n.Value)
+	}
+	type plain WhenSpec
+	if err := n.Decode((*plain)(w)); err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == "value" {
+			w.valueSet = true
+		}
+	}
+	return nil
+}
+
+func (w *WhenSpec) parse(expr string) error {
+	expr = strings.TrimSpace(expr)
+	for _, op := range []struct{ tok, op string }{{"==", WhenEq}, {"!=", WhenNe}} {
+		ptr, val, ok := strings.Cut(expr, op.tok)
+		if !ok {
+			continue
+		}
+		w.Pointer, w.Op = strings.TrimSpace(ptr), op.op
+		val = strings.TrimSpace(val)
+		w.valueSet = true
+		if strings.HasPrefix(val, `"`) {
+			var s string
+			if err := json.Unmarshal([]byte(val), &s); err != nil {
+				return fmt.Errorf("when %q: invalid string %s", expr, val)
+			}
+			w.Value = s
+		} else if err := json.Unmarshal([]byte(val), &w.Value); err != nil {
+			w.Value = val
+		}
+		return nil
+	}
+	w.Pointer, w.Op = expr, WhenExists
+	return nil
+}
+
+func validateWhen(r MappingRule) error {
+	w := r.When
+	if w == nil {
+		return nil
+	}
+	if !strings.HasPrefix(w.Pointer, "/") {
+		return fmt.Errorf("when pointer must start with /, got %q", w.Pointer)
+	}
+	switch w.op() {
+	case WhenEq, WhenNe, WhenExists, WhenMissing:
+	case WhenIn:
+		if len(w.Values) == 0 {
+			return fmt.Errorf("when op in needs values")
+		}
+	default:
+		return fmt.Errorf("invalid when op: %s", w.Op)
+	}
+	return nil
+}
+
+func (w *WhenSpec) op() string {
+	switch {
+	case w.Op != "":
+		return w.Op
+	case w.Value != nil || w.valueSet:
+		return WhenEq
+	default:
+		return WhenExists
+	}
+}
+
+func (w *WhenSpec) holds(doc any) bool {
+	v, ok := resolveRootPointer(doc, w.Pointer)
+	switch w.op() {
+	case WhenExists:
+		return ok
+	case WhenMissing:
+		return !ok
+	case WhenNe:
+		return !ok || !whenEqual(v, w.Value)
+	case WhenIn:
+		return ok && slices.ContainsFunc(w.Values, func(x any) bool { return whenEqual(v, x) })
+	default:
+		return ok && whenEqual(v, w.Value)
+	}
+}
+
+func whenEqual(row, want any) bool {
+	if rn, ok := whenNumber(row); ok {
+		wn, ok := whenNumber(want)
+		return ok && rn == wn
+	}
+	switch rv := row.(type) {
+	case nil:
+		return want == nil
+	case string:
+		wv, ok := want.(string)
+		return ok && rv == wv
+	case bool:
+		wv, ok := want.(bool)
+		return ok && rv == wv
+	default:
+		return false
+	}
+}
+
+func whenNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func whenLiteral(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+func (w *WhenSpec) String() string {
+	switch op := w.op(); op {
+	case WhenEq:
+		return fmt.Sprintf("%s == %s", w.Pointer, whenLiteral(w.Value))
+	case WhenNe:
+		return fmt.Sprintf("%s != %s", w.Pointer, whenLiteral(w.Value))
+	case WhenIn:
+		return fmt.Sprintf("%s in %s", w.Pointer, whenLiteral(w.Values))
+	default:
+		return w.Pointer + " " + op
+	}
+}
+
+func (r *SelectedRule) applicable(line []byte) (*SelectedRule, any) {
+	if r.Rule.When == nil {
+		return r, nil
+	}
+	var doc any
+	parsed := json.Unmarshal(line, &doc) == nil
+	for cur := r; cur != nil; cur = cur.next {
+		if cur.Rule.When == nil {
+			return cur, doc
+		}
+		if parsed && cur.Rule.When.holds(doc) {
+			return cur, doc
+		}
+	}
+	return nil, nil
+}
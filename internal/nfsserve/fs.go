@@ -0,0 +1,117 @@
+package nfsserve
+
+import (
+	"bytes"
+	"os"
+	"path"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/vtree"
+	"github.com/willscott/go-nfs/file"
+)
+
+type Options = options.Options
+
+type FS struct {
+	view *vtree.View
+}
+
+func New(cfg Options, az auth.Authorizer) *FS {
+	return &FS{view: vtree.NewView(cfg, az)}
+}
+
+func (f *FS) Close() {
+	f.view.Close()
+}
+
+type fileInfo struct {
+	*vtree.Info
+}
+
+func (fi fileInfo) Sys() any {
+	nlink := uint32(1)
+	if fi.IsDir() {
+		nlink = 2
+	}
+	return &file.FileInfo{Nlink: nlink, UID: fi.UID, GID: fi.GID, Fileid: fi.ID}
+}
+
+func (f *FS) Stat(filename string) (os.FileInfo, error) {
+	fi, err := f.view.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{fi}, nil
+}
+
+func (f *FS) Lstat(filename string) (os.FileInfo, error) {
+	return f.Stat(filename)
+}
+
+func (f *FS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	infos, err := f.view.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]os.FileInfo, len(infos))
+	for i, fi := range infos {
+		out[i] = fileInfo{fi}
+	}
+	return out, nil
+}
+
+func (f *FS) Open(filename string) (billy.File, error) {
+	return f.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (f *FS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, billy.ErrReadOnly
+	}
+	data, err := f.view.Read(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{name: vtree.Clean(filename), Reader: bytes.NewReader(data)}, nil
+}
+
+func (f *FS) Create(filename string) (billy.File, error) { return nil, billy.ErrReadOnly }
+
+func (f *FS) TempFile(dir, prefix string) (billy.File, error) { return nil, billy.ErrReadOnly }
+
+func (f *FS) Rename(oldpath, newpath string) error { return billy.ErrReadOnly }
+
+func (f *FS) Remove(filename string) error { return billy.ErrReadOnly }
+
+func (f *FS) MkdirAll(filename string, perm os.FileMode) error { return billy.ErrReadOnly }
+
+func (f *FS) Symlink(target, link string) error { return billy.ErrReadOnly }
+
+func (f *FS) Readlink(link string) (string, error) { return "", billy.ErrNotSupported }
+
+func (f *FS) Join(elem ...string) string { return path.Join(elem...) }
+
+func (f *FS) Chroot(p string) (billy.Filesystem, error) { return nil, billy.ErrNotSupported }
+
+func (f *FS) Root() string { return "/" }
+
+func (f *FS) Capabilities() billy.Capability {
+	return billy.ReadCapability | billy.SeekCapability
+}
+
+type memFile struct {
+	name string
+	*bytes.Reader
+}
+
+func (m *memFile) Name() string                { return m.name }
+func (m *memFile) Write(p []byte) (int, error) { return 0, billy.ErrReadOnly }
+func (m *memFile) Truncate(size int64) error   { return billy.ErrReadOnly }
+func (m *memFile) Close() error                { return nil }
+func (m *memFile) Lock() error                 { return nil }
+func (m *memFile) Unlock() error               { return nil }
+
+var _ billy.Filesystem = (*FS)(nil)
+var _ billy.Capable = (*FS)(nil)
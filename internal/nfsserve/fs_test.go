@@ -0,0 +1,83 @@
+package nfsserve
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/willscott/go-nfs/file"
+)
+
+func TestFSServesFilteredTreeReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		".metricfs-map.yaml": "version: 1\nrules:\n  - match:\n      glob: \"*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n",
+		"sub/rows.jsonl":     "{\"id\":\"a\"}\n{\"id\":\"b\"}\n",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	perm := filepath.Join(dir, "perm.json")
+	if err := os.WriteFile(perm, []byte(`{"allow":[{"object_type":"metric_row","object_id":"b","permission":"read"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	az, err := auth.NewFromPermissionsFile(perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := options.New(options.WithSourceDir(src), options.WithIndex(filepath.Join(dir, "idx"), 1), options.WithOwner(1234, -1), options.WithModes(0o440, 0))
+	f := New(cfg, az)
+	defer f.Close()
+
+	infos, err := f.ReadDir("/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if len(names) != 3 || names[0] != "rows.jsonl" {
+		t.Fatalf("unexpected listing %v", names)
+	}
+	want := "{\"id\":\"b\"}\n"
+	fi, err := f.Stat("sub/rows.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(want)) || fi.Mode() != 0o440 || file.GetInfo(fi).UID != 1234 {
+		t.Fatalf("unexpected attrs size=%d mode=%v uid=%d", fi.Size(), fi.Mode(), file.GetInfo(fi).UID)
+	}
+	if st, err := f.Stat("/sub"); err != nil || st.Mode() != os.ModeDir|0o555 {
+		t.Fatalf("unexpected dir attrs %v %v", st, err)
+	}
+	fh, err := f.Open("/sub/rows.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(fh); string(got) != want {
+		t.Fatalf("read %q", got)
+	}
+	if _, err := f.Stat("/sub/missing.jsonl"); !os.IsNotExist(err) {
+		t.Fatalf("missing file: %v", err)
+	}
+	if _, err := f.OpenFile("/sub/rows.jsonl", os.O_WRONLY|os.O_APPEND, 0); err != billy.ErrReadOnly {
+		t.Fatalf("write open: %v", err)
+	}
+	if err := f.Remove("/sub/rows.jsonl"); err != billy.ErrReadOnly {
+		t.Fatalf("remove: %v", err)
+	}
+	if billy.CapabilityCheck(f, billy.WriteCapability) {
+		t.Fatalf("fs must not advertise write capability")
+	}
+}
@@ -0,0 +1,25 @@
+package nfsserve
+
+import (
+	"context"
+	"net"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+const handleLimit = 4096
+
+func Serve(ctx context.Context, l net.Listener, f *FS) error {
+	nfs.Log.SetLevel(nfs.ErrorLevel)
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(f), handleLimit)
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	err := nfs.Serve(l, handler)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
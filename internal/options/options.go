@@ -0,0 +1,282 @@
+package options
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/henneberger/metrics-fs/internal/chunkcache"
+	"github.com/henneberger/metrics-fs/internal/indexstore"
+	"github.com/henneberger/metrics-fs/internal/mapper"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+	"github.com/henneberger/metrics-fs/pkg/enums"
+)
+
+type Options struct {
+	SourceDir          string
+	MountDir           string
+	MapperFileName     string
+	MapperInherit      bool
+	MissingMapperMode  enums.MissingMapperMode
+	MissingResource    enums.MissingResourceKey
+	GlobCase           enums.GlobCase
+	IndexDir           string
+	IndexFormatVersion int
+	IndexStore         indexstore.Store
+	IndexBuilder       IndexBuilder
+	AllowOther         bool
+	VolumeName         string
+	ReadOnly           bool
+	StrictReadOnly     bool
+	CollisionPolicy    string
+	OutputFormat       string
+	OutputColumns      []string
+	Warnings           *warnings.Collector
+	Provenance         bool
+	Operation          enums.Operation
+	ChunkCache         *chunkcache.Cache
+	HideEmptyFiles     bool
+	VisibilityTopN     int
+	MountUID           int
+	MountGID           int
+	FileMode           os.FileMode
+	DirMode            os.FileMode
+	AttrTimeout        time.Duration
+	EntryTimeout       time.Duration
+	NoKernelCache      bool
+	OpenFiles          int
+	MaxConcurrentReads int
+	MaxReadahead       int
+	MaxSubjectReads    int
+	PassthroughMin     int64
+	Exclude            []string
+	PreserveGzip       bool
+	Trace              io.Writer
+	DefaultPermission  string
+}
+
+type Option func(*Options)
+
+type IndexBuilder interface {
+	BuildIndex(sourcePath string) ([]byte, error)
+}
+
+func (o Options) MapperConfig() mapper.Config {
+	return mapper.Config{
+		SourceDir:         o.SourceDir,
+		MapperFileName:    o.MapperFileName,
+		InheritParent:     o.MapperInherit,
+		MissingMapperMode: o.MissingMapperMode,
+		DefaultMissingKey: o.MissingResource,
+		Operation:         o.Operation,
+		GlobCase:          o.GlobCase,
+		Warnings:          o.Warnings,
+		Trace:             o.Trace,
+		DefaultPermission: o.DefaultPermission,
+	}
+}
+
+func New(opts ...Option) Options {
+	o := Options{
+		MapperFileName:     ".metricfs-map.yaml",
+		MapperInherit:      true,
+		MissingMapperMode:  enums.MissingMapperDeny,
+		MissingResource:    enums.MissingResourceDeny,
+		IndexFormatVersion: 1,
+		ReadOnly:           true,
+		MountUID:           -1,
+		MountGID:           -1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o Options) With(opts ...Option) Options {
+	o.OutputColumns = append([]string(nil), o.OutputColumns...)
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func WithSourceDir(dir string) Option {
+	return func(o *Options) { o.SourceDir = dir }
+}
+
+func WithMountDir(dir string) Option {
+	return func(o *Options) { o.MountDir = dir }
+}
+
+func WithMapper(fileName string, inherit bool) Option {
+	return func(o *Options) {
+		o.MapperFileName = fileName
+		o.MapperInherit = inherit
+	}
+}
+
+func WithMissingMapperMode(mode enums.MissingMapperMode) Option {
+	return func(o *Options) { o.MissingMapperMode = mode }
+}
+
+func WithMissingResource(mode enums.MissingResourceKey) Option {
+	return func(o *Options) { o.MissingResource = mode }
+}
+
+func WithGlobCase(c enums.GlobCase) Option {
+	return func(o *Options) { o.GlobCase = c }
+}
+
+func WithIndex(dir string, formatVersion int) Option {
+	return func(o *Options) {
+		o.IndexDir = dir
+		o.IndexFormatVersion = formatVersion
+	}
+}
+
+func WithIndexStore(store indexstore.Store) Option {
+	return func(o *Options) { o.IndexStore = store }
+}
+
+func WithIndexBuilder(b IndexBuilder) Option {
+	return func(o *Options) { o.IndexBuilder = b }
+}
+
+func WithAllowOther(allow bool) Option {
+	return func(o *Options) { o.AllowOther = allow }
+}
+
+func WithVolumeName(name string) Option {
+	return func(o *Options) { o.VolumeName = name }
+}
+
+func WithReadOnly(readOnly bool) Option {
+	return func(o *Options) { o.ReadOnly = readOnly }
+}
+
+func WithCollisionPolicy(policy string) Option {
+	return func(o *Options) { o.CollisionPolicy = policy }
+}
+
+func WithOutput(format string, columns []string) Option {
+	return func(o *Options) {
+		o.OutputFormat = format
+		o.OutputColumns = columns
+	}
+}
+
+func WithWarnings(c *warnings.Collector) Option {
+	return func(o *Options) { o.Warnings = c }
+}
+
+func WithProvenance(enabled bool) Option {
+	return func(o *Options) { o.Provenance = enabled }
+}
+
+func WithOperation(op enums.Operation) Option {
+	return func(o *Options) { o.Operation = op }
+}
+
+func WithChunkCache(c *chunkcache.Cache) Option {
+	return func(o *Options) { o.ChunkCache = c }
+}
+
+func WithVisibilityTopN(n int) Option {
+	return func(o *Options) { o.VisibilityTopN = n }
+}
+
+func WithHideEmptyFiles(hide bool) Option {
+	return func(o *Options) { o.HideEmptyFiles = hide }
+}
+
+func WithStrictReadOnly(strict bool) Option {
+	return func(o *Options) { o.StrictReadOnly = strict }
+}
+
+func WithOwner(uid, gid int) Option {
+	return func(o *Options) {
+		o.MountUID = uid
+		o.MountGID = gid
+	}
+}
+
+func WithModes(file, dir os.FileMode) Option {
+	return func(o *Options) {
+		o.FileMode = file
+		o.DirMode = dir
+	}
+}
+
+func WithCacheTimeouts(attr, entry time.Duration) Option {
+	return func(o *Options) {
+		o.AttrTimeout = attr
+		o.EntryTimeout = entry
+	}
+}
+
+func WithNoKernelCache(disable bool) Option {
+	return func(o *Options) { o.NoKernelCache = disable }
+}
+
+func WithOpenFiles(n int) Option {
+	return func(o *Options) { o.OpenFiles = n }
+}
+
+func WithReadLimits(reads, readahead int) Option {
+	return func(o *Options) {
+		o.MaxConcurrentReads = reads
+		o.MaxReadahead = readahead
+	}
+}
+
+func WithPassthroughMin(min int64) Option {
+	return func(o *Options) { o.PassthroughMin = min }
+}
+
+func WithSubjectReadLimit(n int) Option {
+	return func(o *Options) { o.MaxSubjectReads = n }
+}
+
+func WithPreserveCompression(preserve bool) Option {
+	return func(o *Options) { o.PreserveGzip = preserve }
+}
+
+func WithExclude(globs []string) Option {
+	return func(o *Options) { o.Exclude = globs }
+}
+
+func (o Options) Excluded(p string) bool {
+	if len(o.Exclude) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(o.SourceDir, p)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, g := range o.Exclude {
+		if ok, _ := doublestar.Match(g, rel); ok {
+			return true
+		}
+		if strings.Contains(g, "/") {
+			continue
+		}
+		if ok, _ := doublestar.Match(g, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func WithTrace(w io.Writer) Option {
+	return func(o *Options) { o.Trace = w }
+}
+
+func WithDefaultPermission(p string) Option {
+	return func(o *Options) { o.DefaultPermission = p }
+}
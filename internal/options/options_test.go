@@ -0,0 +1,47 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/henneberger/metrics-fs/pkg/enums"
+)
+
+func TestNewAppliesDefaultsThenOptions(t *testing.T) {
+	o := New(
+		WithSourceDir("/data"),
+		WithMissingMapperMode(enums.MissingMapperPassthrough),
+		WithIndex("/cache", 2),
+	)
+	if o.MapperFileName != ".metricfs-map.yaml" || !o.MapperInherit || !o.ReadOnly {
+		t.Fatalf("expected defaults to be kept: %#v", o)
+	}
+	if o.SourceDir != "/data" || o.MissingMapperMode != enums.MissingMapperPassthrough || o.IndexDir != "/cache" || o.IndexFormatVersion != 2 {
+		t.Fatalf("options not applied: %#v", o)
+	}
+	cfg := o.MapperConfig()
+	if cfg.SourceDir != "/data" || cfg.MissingMapperMode != enums.MissingMapperPassthrough || cfg.DefaultMissingKey != enums.MissingResourceDeny {
+		t.Fatalf("mapper config mismatch: %#v", cfg)
+	}
+
+	derived := o.With(WithOutput("csv", []string{"/a"}))
+	if o.OutputFormat != "" || derived.OutputFormat != "csv" || derived.SourceDir != "/data" {
+		t.Fatalf("With must copy, got base %#v derived %#v", o, derived)
+	}
+}
+
+func TestExcludedMatchesRelativePathOrBaseName(t *testing.T) {
+	o := New(WithSourceDir("/data"), WithExclude([]string{"_SUCCESS", "*.tmp", "scratch/**", "tmp"}))
+	for p, want := range map[string]bool{
+		"/data/a/_SUCCESS":           true,
+		"/data/rows.jsonl.tmp":       true,
+		"/data/scratch/x/rows.jsonl": true,
+		"/data/a/tmp":                true,
+		"/data/a/rows.jsonl":         false,
+		"/data/a/scratch":            false,
+		"/data":                      false,
+	} {
+		if got := o.Excluded(p); got != want {
+			t.Errorf("Excluded(%s) = %v, want %v", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package p9serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/vtree"
+	"github.com/hugelgupf/p9/fsimpl/templatefs"
+	"github.com/hugelgupf/p9/linux"
+	"github.com/hugelgupf/p9/p9"
+)
+
+type Options = options.Options
+
+type FS struct {
+	view *vtree.View
+}
+
+func New(cfg Options, az auth.Authorizer) *FS {
+	return &FS{view: vtree.NewView(cfg, az)}
+}
+
+func (f *FS) Close() {
+	f.view.Close()
+}
+
+func (f *FS) Attach() (p9.File, error) {
+	return &node{fs: f, path: "/"}, nil
+}
+
+func Serve(ctx context.Context, l net.Listener, f *FS) error {
+	return p9.NewServer(f).ServeContext(ctx, l)
+}
+
+type node struct {
+	p9.DefaultWalkGetAttr
+	templatefs.ReadOnlyDir
+	templatefs.NilCloser
+
+	fs   *FS
+	path string
+	data *bytes.Reader
+}
+
+func (n *node) Walk(names []string) ([]p9.QID, p9.File, error) {
+	p := n.path
+	qids := make([]p9.QID, 0, len(names))
+	for _, name := range names {
+		p = path.Join(p, name)
+		fi, err := n.fs.view.Stat(p)
+		if err != nil {
+			return nil, nil, errno(err)
+		}
+		qids = append(qids, qid(fi))
+	}
+	return qids, &node{fs: n.fs, path: p}, nil
+}
+
+func (n *node) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	fi, err := n.fs.view.Stat(n.path)
+	if err != nil {
+		return p9.QID{}, p9.AttrMask{}, p9.Attr{}, errno(err)
+	}
+	attr := p9.Attr{
+		Mode:         p9.ModeFromOS(fi.Mode()),
+		UID:          p9.UID(fi.UID),
+		GID:          p9.GID(fi.GID),
+		NLink:        1,
+		Size:         uint64(fi.Size()),
+		BlockSize:    4096,
+		Blocks:       (uint64(fi.Size()) + 511) / 512,
+		MTimeSeconds: uint64(fi.ModTime().Unix()),
+		CTimeSeconds: uint64(fi.ModTime().Unix()),
+		ATimeSeconds: uint64(fi.ModTime().Unix()),
+	}
+	if fi.IsDir() {
+		attr.NLink = 2
+	}
+	return qid(fi), p9.AttrMaskAll, attr, nil
+}
+
+func (n *node) StatFS() (p9.FSStat, error) {
+	return p9.FSStat{Type: 0x01021997, BlockSize: 4096, NameLength: 255}, nil
+}
+
+func (n *node) Open(mode p9.OpenFlags) (p9.QID, uint32, error) {
+	if mode.Mode() != p9.ReadOnly {
+		return p9.QID{}, 0, linux.EROFS
+	}
+	fi, err := n.fs.view.Stat(n.path)
+	if err != nil {
+		return p9.QID{}, 0, errno(err)
+	}
+	if !fi.IsDir() {
+		data, err := n.fs.view.Read(n.path)
+		if err != nil {
+			return p9.QID{}, 0, errno(err)
+		}
+		n.data = bytes.NewReader(data)
+	}
+	return qid(fi), 0, nil
+}
+
+func (n *node) ReadAt(p []byte, off int64) (int, error) {
+	if n.data == nil {
+		return 0, linux.EISDIR
+	}
+	return n.data.ReadAt(p, off)
+}
+
+func (n *node) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
+	infos, err := n.fs.view.ReadDir(n.path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	var out p9.Dirents
+	for i := offset; i < uint64(len(infos)) && i < offset+uint64(count); i++ {
+		q := qid(infos[i])
+		out = append(out, p9.Dirent{QID: q, Type: q.Type, Offset: i + 1, Name: infos[i].Name()})
+	}
+	return out, nil
+}
+
+func qid(fi *vtree.Info) p9.QID {
+	q := p9.QID{Type: p9.TypeRegular, Path: fi.ID}
+	if fi.IsDir() {
+		q.Type = p9.TypeDir
+	}
+	return q
+}
+
+func errno(err error) error {
+	switch {
+	case errors.Is(err, vtree.ErrNotDir):
+		return linux.ENOTDIR
+	case errors.Is(err, vtree.ErrIsDir):
+		return linux.EISDIR
+	}
+	return err
+}
+
+var _ p9.File = (*node)(nil)
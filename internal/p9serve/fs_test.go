@@ -0,0 +1,117 @@
+package p9serve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/hugelgupf/p9/linux"
+	"github.com/hugelgupf/p9/p9"
+)
+
+func TestServeExportsFilteredTreeReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		".metricfs-map.yaml": "version: 1\nrules:\n  - match:\n      glob: \"*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n",
+		"sub/rows.jsonl":     "{\"id\":\"a\"}\n{\"id\":\"b\"}\n",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	perm := filepath.Join(dir, "perm.json")
+	if err := os.WriteFile(perm, []byte(`{"allow":[{"object_type":"metric_row","object_id":"b","permission":"read"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	az, err := auth.NewFromPermissionsFile(perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := options.New(options.WithSourceDir(src), options.WithIndex(filepath.Join(dir, "idx"), 1), options.WithOwner(1234, -1))
+	f := New(cfg, az)
+	defer f.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Serve(ctx, lis, f) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := p9.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	root, err := client.Attach("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sub, err := root.Walk([]string{"sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sub.Open(p9.ReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	ents, err := sub.Readdir(0, 4096)
+	if err != nil || len(ents) != 3 || ents[0].Name != "rows.jsonl" {
+		t.Fatalf("readdir %v %v", ents, err)
+	}
+
+	want := "{\"id\":\"b\"}\n"
+	_, file, err := root.Walk([]string{"sub", "rows.jsonl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, attr, err := file.GetAttr(p9.AttrMaskAll)
+	if err != nil || attr.Size != uint64(len(want)) || attr.UID != 1234 {
+		t.Fatalf("getattr %v %v", attr, err)
+	}
+	if _, _, err := file.Open(p9.ReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, _ := file.ReadAt(buf, 0)
+	if string(buf[:n]) != want {
+		t.Fatalf("read %q", buf[:n])
+	}
+
+	if _, _, err := root.Walk([]string{"sub", "missing.jsonl"}); !errors.Is(err, linux.ENOENT) {
+		t.Fatalf("missing file: %v", err)
+	}
+	_, again, err := root.Walk([]string{"sub", "rows.jsonl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := again.Open(p9.WriteOnly); !errors.Is(err, linux.EROFS) {
+		t.Fatalf("write open: %v", err)
+	}
+	_, parent, err := root.Walk([]string{"sub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.UnlinkAt("rows.jsonl", 0); !errors.Is(err, linux.EROFS) {
+		t.Fatalf("unlink: %v", err)
+	}
+}
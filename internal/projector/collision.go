@@ -0,0 +1,124 @@
+package projector
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	CollisionPreferPlain      = "prefer-plain"
+	CollisionPreferCompressed = "prefer-compressed"
+	CollisionExposeBoth       = "expose-both-with-suffix"
+	CollisionError            = "error"
+)
+
+func ValidateCollisionPolicy(policy string) error {
+	switch policy {
+	case "", CollisionPreferPlain, CollisionPreferCompressed, CollisionExposeBoth, CollisionError:
+		return nil
+	default:
+		return fmt.Errorf("unsupported collision policy %q, expected %s|%s|%s|%s",
+			policy, CollisionPreferPlain, CollisionPreferCompressed, CollisionExposeBoth, CollisionError)
+	}
+}
+
+type ProjectedName struct {
+	Name      string
+	Source    string
+	Projected bool
+}
+
+type Collision struct {
+	Name     string
+	Sources  []string
+	Winner   string
+	Shadowed []string
+}
+
+func ProjectNames(sourceNames []string, policy string) ([]ProjectedName, []Collision, error) {
+	if err := ValidateCollisionPolicy(policy); err != nil {
+		return nil, nil, err
+	}
+	if policy == "" {
+		policy = CollisionPreferPlain
+	}
+	sorted := append([]string{}, sourceNames...)
+	sort.Strings(sorted)
+	groups := map[string][]ProjectedName{}
+	order := []string{}
+	for _, name := range sorted {
+		vname, projected := VirtualJSONLName(name)
+		if _, ok := groups[vname]; !ok {
+			order = append(order, vname)
+		}
+		groups[vname] = append(groups[vname], ProjectedName{Name: vname, Source: name, Projected: projected})
+	}
+
+	out := []ProjectedName{}
+	collisions := []Collision{}
+	type suffixed struct {
+		name      ProjectedName
+		collision int
+	}
+	var deferred []suffixed
+	for _, vname := range order {
+		group := groups[vname]
+		if len(group) == 1 {
+			out = append(out, group[0])
+			continue
+		}
+		c := Collision{Name: vname}
+		for _, g := range group {
+			c.Sources = append(c.Sources, g.Source)
+		}
+		switch policy {
+		case CollisionError:
+			return nil, nil, fmt.Errorf("virtual name %s is produced by multiple sources: %s", vname, strings.Join(c.Sources, ", "))
+		case CollisionExposeBoth:
+			keep := pickWinner(group, false)
+			c.Winner = keep.Source
+			out = append(out, keep)
+			for _, g := range group {
+				if g.Source != keep.Source {
+					g.Name = suffixedName(vname, g.Source)
+					deferred = append(deferred, suffixed{g, len(collisions)})
+				}
+			}
+		default:
+			winner := pickWinner(group, policy == CollisionPreferCompressed)
+			c.Winner = winner.Source
+			out = append(out, winner)
+		}
+		collisions = append(collisions, c)
+	}
+	// Suffixed names go last so they cannot displace a real orders.gz.jsonl.
+	taken := make(map[string]bool, len(out))
+	for _, p := range out {
+		taken[p.Name] = true
+	}
+	for _, d := range deferred {
+		if taken[d.name.Name] {
+			collisions[d.collision].Shadowed = append(collisions[d.collision].Shadowed, d.name.Source)
+			continue
+		}
+		taken[d.name.Name] = true
+		out = append(out, d.name)
+	}
+	return out, collisions, nil
+}
+
+func pickWinner(group []ProjectedName, preferCompressed bool) ProjectedName {
+	for _, g := range group {
+		if g.Projected == preferCompressed {
+			return g
+		}
+	}
+	return group[len(group)-1]
+}
+
+func suffixedName(vname, source string) string {
+	base := strings.TrimSuffix(vname, ".jsonl")
+	ext := source[len(vname):]
+	return base + ext + ".jsonl"
+}
@@ -0,0 +1,289 @@
+package projector
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/henneberger/metrics-fs/internal/mapper"
+	"github.com/henneberger/metrics-fs/internal/schema"
+)
+
+const (
+	OutputJSONL      = "jsonl"
+	OutputJSON       = "json"
+	OutputJSONPretty = "json-pretty"
+	OutputCSV        = "csv"
+)
+
+func ValidateOutputFormat(format string, columns []string) error {
+	switch normalizeOutputFormat(format) {
+	case OutputJSONL, OutputJSON, OutputJSONPretty:
+		if len(columns) > 0 {
+			return fmt.Errorf("columns are only supported with csv output")
+		}
+		return nil
+	case OutputCSV:
+		if len(columns) == 0 {
+			return fmt.Errorf("csv output requires at least one column pointer")
+		}
+		for _, c := range columns {
+			if !strings.HasPrefix(c, "/") {
+				return fmt.Errorf("csv column pointer must start with /: %q", c)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q, expected jsonl|json|json-pretty|csv", format)
+	}
+}
+
+func ParseColumns(raw string) []string {
+	out := []string{}
+	for _, c := range strings.Split(raw, ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func OutputFileName(virtualName, format string) string {
+	ext := ".json"
+	switch normalizeOutputFormat(format) {
+	case OutputJSONL:
+		return virtualName
+	case OutputCSV:
+		ext = ".csv"
+	}
+	lower := strings.ToLower(virtualName)
+	switch {
+	case strings.HasSuffix(lower, ".jsonl"):
+		return virtualName[:len(virtualName)-len(".jsonl")] + ext
+	case strings.HasSuffix(lower, ".jsonl.gz"):
+		return virtualName[:len(virtualName)-len(".jsonl.gz")] + ext + ".gz"
+	}
+	return virtualName
+}
+
+func normalizeOutputFormat(format string) string {
+	f := strings.ToLower(strings.TrimSpace(format))
+	if f == "" {
+		return OutputJSONL
+	}
+	return f
+}
+
+func NewOutputWriter(format string, columns []string, w io.Writer) (io.WriteCloser, error) {
+	if err := ValidateOutputFormat(format, columns); err != nil {
+		return nil, err
+	}
+	switch normalizeOutputFormat(format) {
+	case OutputCSV:
+		return &csvWriter{w: csv.NewWriter(w), columns: columns}, nil
+	case OutputJSON:
+		return &arrayWriter{w: w}, nil
+	case OutputJSONPretty:
+		return &arrayWriter{w: w, indent: "  "}, nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type lineBuffer struct {
+	pending []byte
+}
+
+func (l *lineBuffer) feed(p []byte, fn func([]byte) error) error {
+	l.pending = append(l.pending, p...)
+	for {
+		i := bytes.IndexByte(l.pending, '\n')
+		if i < 0 {
+			return nil
+		}
+		if err := fn(l.pending[:i]); err != nil {
+			return err
+		}
+		l.pending = l.pending[i+1:]
+	}
+}
+
+func (l *lineBuffer) flush(fn func([]byte) error) error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	err := fn(l.pending)
+	l.pending = nil
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type arrayWriter struct {
+	lineBuffer
+	w      io.Writer
+	indent string
+	rows   int
+}
+
+func (a *arrayWriter) Write(p []byte) (int, error) {
+	if err := a.feed(p, a.writeRow); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *arrayWriter) writeRow(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	if !json.Valid(line) {
+		return fmt.Errorf("cannot encode non-JSON row as %s", a.format())
+	}
+	var buf bytes.Buffer
+	if a.rows == 0 {
+		buf.WriteString("[")
+	} else {
+		buf.WriteString(",")
+	}
+	if a.indent != "" {
+		buf.WriteString("\n" + a.indent)
+		if err := json.Indent(&buf, line, a.indent, a.indent); err != nil {
+			return err
+		}
+	} else {
+		buf.Write(line)
+	}
+	a.rows++
+	_, err := a.w.Write(buf.Bytes())
+	return err
+}
+
+func (a *arrayWriter) format() string {
+	if a.indent != "" {
+		return OutputJSONPretty
+	}
+	return OutputJSON
+}
+
+func (a *arrayWriter) Close() error {
+	if err := a.flush(a.writeRow); err != nil {
+		return err
+	}
+	tail := "]\n"
+	switch {
+	case a.rows == 0:
+		tail = "[]\n"
+	case a.indent != "":
+		tail = "\n]\n"
+	}
+	_, err := io.WriteString(a.w, tail)
+	return err
+}
+
+type csvWriter struct {
+	lineBuffer
+	w             *csv.Writer
+	columns       []string
+	headerWritten bool
+}
+
+func (c *csvWriter) Write(p []byte) (int, error) {
+	if err := c.feed(p, c.writeRow); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *csvWriter) writeHeader() error {
+	if c.headerWritten {
+		return nil
+	}
+	c.headerWritten = true
+	return c.w.Write(c.columns)
+}
+
+func (c *csvWriter) writeRow(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("cannot encode non-JSON row as csv: %w", err)
+	}
+	record := make([]string, len(c.columns))
+	for i, ptr := range c.columns {
+		v, ok := mapper.ResolvePointer(doc, ptr)
+		if !ok {
+			continue
+		}
+		record[i] = csvValue(v)
+	}
+	return c.w.Write(record)
+}
+
+func csvValue(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return fmt.Sprintf("%t", t)
+	default:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return fmt.Sprintf("%v", t)
+		}
+		return string(b)
+	}
+}
+
+func (c *csvWriter) Close() error {
+	if err := c.flush(c.writeRow); err != nil {
+		return err
+	}
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type schemaWriter struct {
+	lineBuffer
+	schema *schema.Schema
+}
+
+func (s *schemaWriter) Write(p []byte) (int, error) {
+	if err := s.feed(p, s.addRow); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *schemaWriter) addRow(line []byte) error {
+	var doc any
+	if err := json.Unmarshal(bytes.TrimSpace(line), &doc); err != nil {
+		return nil
+	}
+	s.schema = schema.Merge(s.schema, schema.Infer(doc))
+	return nil
+}
@@ -2,27 +2,35 @@ package projector
 
 import (
 	"archive/tar"
-	"bufio"
-	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 
 	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/codec"
+	"github.com/henneberger/metrics-fs/internal/faults"
 	"github.com/henneberger/metrics-fs/internal/indexer"
 	"github.com/henneberger/metrics-fs/internal/mapper"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/schema"
+	"github.com/henneberger/metrics-fs/internal/warnings"
 )
 
-type Options struct {
-	SourceDir         string
-	MapperFileName    string
-	MapperInherit     bool
-	MissingMapperMode string
-	MissingResource   string
-	IndexDir          string
-	FormatVersion     int
+type Options = options.Options
+
+const SchemaSuffix = "._schema.json"
+
+func SchemaFileName(virtualName string) string {
+	return virtualName + SchemaSuffix
+}
+
+const VisibilitySuffix = "._visibility.json"
+
+func VisibilityFileName(virtualName string) string {
+	return virtualName + VisibilitySuffix
 }
 
 func VirtualJSONLName(name string) (string, bool) {
@@ -40,45 +48,137 @@ func VirtualJSONLName(name string) (string, bool) {
 }
 
 func RenderFiltered(sourcePath string, opts Options, az auth.Authorizer, w io.Writer) error {
+	out, err := NewOutputWriter(opts.OutputFormat, opts.OutputColumns, w)
+	if err != nil {
+		return err
+	}
+	decode := normalizeOutputFormat(opts.OutputFormat) != OutputJSONL
+	if err := renderFiltered(sourcePath, opts, az, decode, out); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func renderFiltered(sourcePath string, opts Options, az auth.Authorizer, decode bool, w io.Writer) error {
 	lower := strings.ToLower(sourcePath)
-	if strings.HasSuffix(lower, ".jsonl") {
-		fi, err := indexer.BuildOrLoad(sourcePath, indexer.Options{
-			SourceDir:         opts.SourceDir,
-			MapperFileName:    opts.MapperFileName,
-			MapperInherit:     opts.MapperInherit,
-			MissingMapperMode: opts.MissingMapperMode,
-			MissingResource:   opts.MissingResource,
-			IndexDir:          opts.IndexDir,
-			FormatVersion:     opts.FormatVersion,
-		})
+	virtualPath := virtualPathForRule(sourcePath)
+	rule, err := mapper.ResolveRuleForFile(virtualPath, opts.MapperConfig())
+	if err != nil {
+		return err
+	}
+	// Files whose rule opts out of indexing are streamed like compressed ones.
+	if strings.HasSuffix(lower, ".jsonl") && (rule == nil || rule.Rule.Index != mapper.IndexNone) {
+		fi, err := indexer.BuildOrLoad(sourcePath, opts)
 		if err != nil {
 			return err
 		}
-		return indexer.FilterToWriter(fi, az, w)
+		jsonl := fi.Codec == "" || fi.Codec == codec.JSONL
+		decode = decode && !jsonl && !fi.Passthrough
+		provenance := opts.Provenance && !fi.Passthrough && (jsonl || decode)
+		if !provenance && !decode {
+			return indexer.CopyVisible(fi, az, opts.ChunkCache, w)
+		}
+		rc, err := codec.Lookup(fi.Codec)
+		if err != nil {
+			return err
+		}
+		return indexer.FilterLines(fi, az, func(ln indexer.LineIndex, line []byte) error {
+			if decode {
+				doc, err := rc.Decode(line)
+				if err != nil {
+					return nil
+				}
+				line = append(append([]byte(nil), doc...), '\n')
+			}
+			if provenance {
+				granted := indexer.GrantingCandidates(ln.Decision, ln.Candidates, az)
+				var clash bool
+				if line, clash = annotateRow(line, fi.RuleHash, granted); clash {
+					warnProvenanceClash(opts.Warnings, sourcePath)
+				}
+			}
+			_, err := w.Write(line)
+			return err
+		})
 	}
 
-	virtualPath := virtualPathForRule(sourcePath)
-	rule, err := mapper.ResolveRuleForFile(virtualPath, mapper.Config{
-		SourceDir:         opts.SourceDir,
-		MapperFileName:    opts.MapperFileName,
-		InheritParent:     opts.MapperInherit,
-		MissingMapperMode: opts.MissingMapperMode,
-		DefaultMissingKey: opts.MissingResource,
-	})
-	if err != nil {
-		return err
+	if rule != nil {
+		rule.SourcePath = sourcePath
 	}
 
+	memo := indexer.NewDecisionMemo(az)
+	if rule != nil {
+		memo.WithRowQuotas(rule.Rule.RowQuotas)
+	}
+	decode = decode && !rule.JSONL()
+	lf := &lineFilter{
+		rule:       rule,
+		guard:      mapper.NewCandidateGuard(rule, sourcePath),
+		memo:       memo,
+		az:         az,
+		provenance: opts.Provenance && rule != nil && (rule.JSONL() || decode),
+		decode:     decode,
+	}
 	switch {
 	case strings.HasSuffix(lower, ".jsonl.gz"):
-		return renderGzipJSONL(sourcePath, rule, az, w)
+		return renderGzipJSONL(sourcePath, lf, w)
 	case strings.HasSuffix(lower, ".jsonl.tar.gz"):
-		return renderTarGzipJSONL(sourcePath, rule, az, w)
+		return renderTarGzipJSONL(sourcePath, lf, w)
+	case strings.HasSuffix(lower, ".jsonl"):
+		f, err := os.Open(sourcePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return streamRecords(f, lf, w)
 	default:
 		return fmt.Errorf("unsupported file type for filtering: %s", sourcePath)
 	}
 }
 
+func RenderSchema(sourcePath string, opts Options, az auth.Authorizer, w io.Writer) error {
+	if strings.HasSuffix(strings.ToLower(sourcePath), ".jsonl") {
+		fi, err := indexer.BuildOrLoad(sourcePath, opts)
+		if err != nil {
+			return err
+		}
+		if !fi.Passthrough {
+			return writeSchema(indexer.VisibleSchema(fi, az), w)
+		}
+	}
+	sw := &schemaWriter{}
+	if err := renderFiltered(sourcePath, opts, az, true, sw); err != nil {
+		return err
+	}
+	if err := sw.flush(sw.addRow); err != nil {
+		return err
+	}
+	return writeSchema(sw.schema, w)
+}
+
+func RenderVisibility(sourcePath string, opts Options, az auth.Authorizer, w io.Writer) error {
+	fi, err := indexer.BuildOrLoad(sourcePath, opts)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(indexer.VisibilityOf(fi, az, opts.VisibilityTopN), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func writeSchema(s *schema.Schema, w io.Writer) error {
+	b, err := schema.Document(s)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
 func virtualPathForRule(sourcePath string) string {
 	lower := strings.ToLower(sourcePath)
 	switch {
@@ -91,7 +191,7 @@ func virtualPathForRule(sourcePath string) string {
 	}
 }
 
-func renderGzipJSONL(path string, rule *mapper.SelectedRule, az auth.Authorizer, w io.Writer) error {
+func renderGzipJSONL(path string, lf *lineFilter, w io.Writer) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -102,10 +202,10 @@ func renderGzipJSONL(path string, rule *mapper.SelectedRule, az auth.Authorizer,
 		return err
 	}
 	defer gz.Close()
-	return streamJSONLLines(gz, rule, az, w)
+	return streamRecords(gz, lf, w)
 }
 
-func renderTarGzipJSONL(path string, rule *mapper.SelectedRule, az auth.Authorizer, w io.Writer) error {
+func renderTarGzipJSONL(path string, lf *lineFilter, w io.Writer) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -131,55 +231,110 @@ func renderTarGzipJSONL(path string, rule *mapper.SelectedRule, az auth.Authoriz
 		if !strings.HasSuffix(strings.ToLower(hdr.Name), ".jsonl") {
 			continue
 		}
-		if err := streamJSONLLines(tr, rule, az, w); err != nil {
+		if err := streamRecords(tr, lf, w); err != nil {
 			return err
 		}
 	}
 }
 
-func streamJSONLLines(r io.Reader, rule *mapper.SelectedRule, az auth.Authorizer, w io.Writer) error {
-	br := bufio.NewReaderSize(r, 1<<20)
+const streamBatch = 1024
+
+type streamedRecord struct {
+	rec, doc []byte
+	cands    []auth.CandidateKey
+	ok       bool
+}
+
+func streamRecords(r io.Reader, lf *lineFilter, w io.Writer) error {
+	rc := lf.rule.Codec()
+	records := rc.Split(r)
+	batch := make([]streamedRecord, 0, streamBatch)
 	for {
-		line, err := br.ReadBytes('\n')
+		rec, err := records.Next()
 		if err != nil && err != io.EOF {
 			return err
 		}
-		if len(line) > 0 {
-			if isVisibleLine(rule, bytes.TrimRight(line, "\r\n"), az) {
-				if _, err := w.Write(line); err != nil {
-					return err
-				}
+		if err == nil {
+			if ferr := faults.Inject(faults.SourceRead); ferr != nil {
+				return ferr
+			}
+			doc, derr := rc.Decode(rec)
+			cands, ok, gerr := lf.candidates(doc, derr)
+			if gerr != nil {
+				return gerr
 			}
+			batch = append(batch, streamedRecord{rec: rec, doc: doc, cands: cands, ok: ok})
+			if len(batch) < streamBatch {
+				continue
+			}
+		}
+		if werr := lf.writeBatch(batch, w); werr != nil {
+			return werr
 		}
 		if err == io.EOF {
 			return nil
 		}
+		batch = batch[:0]
 	}
 }
 
-func isVisibleLine(rule *mapper.SelectedRule, line []byte, az auth.Authorizer) bool {
-	if rule == nil {
-		return true
-	}
-	cands, err := mapper.EvaluateLine(rule, line)
-	if err != nil {
-		return false
-	}
-	if len(cands) == 0 {
-		return false
+func (lf *lineFilter) writeBatch(batch []streamedRecord, w io.Writer) error {
+	if lf.rule != nil {
+		var cands []auth.CandidateKey
+		for _, r := range batch {
+			cands = append(cands, r.cands...)
+		}
+		lf.memo.Prefetch(cands)
 	}
-	if rule.Decision == "all" {
-		for _, c := range cands {
-			if !az.IsAllowed(c) {
-				return false
+	for _, r := range batch {
+		if !r.ok || (lf.rule != nil && !lf.memo.Visible(lf.rule.Decision, r.cands)) {
+			continue
+		}
+		out := r.rec
+		if lf.decode {
+			out = append(append([]byte(nil), r.doc...), '\n')
+		}
+		if lf.provenance {
+			granted := indexer.GrantingCandidates(lf.rule.Decision, r.cands, lf.az)
+			var clash bool
+			if out, clash = annotateRow(out, lf.rule.RuleHash, granted); clash {
+				warnProvenanceClash(lf.rule.Warnings, lf.rule.SourcePath)
 			}
 		}
-		return true
-	}
-	for _, c := range cands {
-		if az.IsAllowed(c) {
-			return true
+		if _, err := w.Write(out); err != nil {
+			return err
 		}
 	}
-	return false
+	return nil
+}
+
+type lineFilter struct {
+	rule       *mapper.SelectedRule
+	guard      *mapper.CandidateGuard
+	memo       *indexer.DecisionMemo
+	az         auth.Authorizer
+	provenance bool
+	decode     bool
+	lineNo     int
+}
+
+func (lf *lineFilter) candidates(doc []byte, decodeErr error) ([]auth.CandidateKey, bool, error) {
+	lf.lineNo++
+	if lf.rule == nil {
+		return nil, true, nil
+	}
+	if decodeErr != nil {
+		lf.rule.Warnings.Add(warnings.KindMalformedLine, lf.rule.SourcePath, lf.lineNo, "%v", decodeErr)
+		return nil, false, nil
+	}
+	cands, err := mapper.EvaluateLine(lf.rule, doc)
+	if err != nil {
+		lf.rule.Warnings.Add(warnings.KindMalformedLine, lf.rule.SourcePath, lf.lineNo, "%v", err)
+		return nil, false, nil
+	}
+	cands, err = lf.guard.Check(cands)
+	if err != nil {
+		return nil, false, err
+	}
+	return cands, true, nil
 }
@@ -4,12 +4,14 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/pkg/authtest"
 )
 
 func TestVirtualJSONLName(t *testing.T) {
@@ -179,3 +181,337 @@ func writeTarGzipJSONL(path, name string, data []byte) error {
 	_, err = tw.Write(data)
 	return err
 }
+
+func TestOutputWriterFormats(t *testing.T) {
+	rows := "{\"a\":1}\n{\"a\":2}\n"
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{OutputJSONL, rows},
+		{OutputJSON, "[{\"a\":1},{\"a\":2}]\n"},
+		{OutputJSONPretty, "[\n  {\n    \"a\": 1\n  },\n  {\n    \"a\": 2\n  }\n]\n"},
+	}
+	for _, tc := range tests {
+		var b bytes.Buffer
+		w, err := NewOutputWriter(tc.format, nil, &b)
+		if err != nil {
+			t.Fatalf("NewOutputWriter(%q): %v", tc.format, err)
+		}
+		if _, err := w.Write([]byte(rows)); err != nil {
+			t.Fatalf("write %s: %v", tc.format, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close %s: %v", tc.format, err)
+		}
+		if b.String() != tc.want {
+			t.Fatalf("format %s: got %q, want %q", tc.format, b.String(), tc.want)
+		}
+	}
+
+	var empty bytes.Buffer
+	w, _ := NewOutputWriter(OutputJSON, nil, &empty)
+	_ = w.Close()
+	if empty.String() != "[]\n" {
+		t.Fatalf("expected empty array, got %q", empty.String())
+	}
+	if _, err := NewOutputWriter("xml", nil, &empty); err == nil {
+		t.Fatalf("expected unsupported format error")
+	}
+}
+
+func TestOutputWriterCSV(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewOutputWriter(OutputCSV, []string{"/id", "/value", "/tags", "/missing"}, &b)
+	if err != nil {
+		t.Fatalf("NewOutputWriter: %v", err)
+	}
+	rows := "{\"id\":\"orders_1\",\"value\":10.5,\"tags\":[\"a\",\"b\"]}\n{\"id\":\"x,y\",\"value\":3}\n"
+	if _, err := w.Write([]byte(rows)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	want := "/id,/value,/tags,/missing\norders_1,10.5,\"[\"\"a\"\",\"\"b\"\"]\",\n\"x,y\",3,,\n"
+	if b.String() != want {
+		t.Fatalf("got %q, want %q", b.String(), want)
+	}
+	if _, err := NewOutputWriter(OutputCSV, nil, &b); err == nil {
+		t.Fatalf("expected csv without columns to fail")
+	}
+}
+
+func TestRenderSchemaVisibleRowsOnly(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	src := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(src, []byte("{\"id\":\"a\",\"value\":1}\n{\"id\":\"b\",\"secret\":true}\n"), 0o644); err != nil {
+		t.Fatalf("write rows: %v", err)
+	}
+	permPath := filepath.Join(dir, "permissions.json")
+	if err := os.WriteFile(permPath, []byte(`{"allow":[{"object_type":"metric_row","object_id":"a"}]}`), 0o644); err != nil {
+		t.Fatalf("write permissions: %v", err)
+	}
+	az, err := auth.NewFromPermissionsFile(permPath)
+	if err != nil {
+		t.Fatalf("new authorizer: %v", err)
+	}
+	var out bytes.Buffer
+	if err := RenderSchema(src, Options{SourceDir: dir, MissingMapperMode: "deny", MissingResource: "deny"}, az, &out); err != nil {
+		t.Fatalf("RenderSchema: %v", err)
+	}
+	got := out.String()
+	if !strings.Contains(got, `"value"`) || strings.Contains(got, `"secret"`) {
+		t.Fatalf("schema should describe visible rows only: %s", got)
+	}
+}
+
+func TestProjectNamesCollisionPolicies(t *testing.T) {
+	names := []string{"orders.jsonl.gz", "orders.jsonl", "notes.txt"}
+	tests := []struct {
+		policy string
+		want   map[string]string
+	}{
+		{CollisionPreferPlain, map[string]string{"orders.jsonl": "orders.jsonl", "notes.txt": "notes.txt"}},
+		{CollisionPreferCompressed, map[string]string{"orders.jsonl": "orders.jsonl.gz", "notes.txt": "notes.txt"}},
+		{CollisionExposeBoth, map[string]string{"orders.jsonl": "orders.jsonl", "orders.gz.jsonl": "orders.jsonl.gz", "notes.txt": "notes.txt"}},
+	}
+	for _, tc := range tests {
+		got, collisions, err := ProjectNames(names, tc.policy)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.policy, err)
+		}
+		if len(collisions) != 1 {
+			t.Fatalf("%s: expected one reported collision, got %#v", tc.policy, collisions)
+		}
+		m := map[string]string{}
+		for _, p := range got {
+			m[p.Name] = p.Source
+		}
+		if len(m) != len(tc.want) {
+			t.Fatalf("%s: got %#v, want %#v", tc.policy, m, tc.want)
+		}
+		for k, v := range tc.want {
+			if m[k] != v {
+				t.Fatalf("%s: got %#v, want %#v", tc.policy, m, tc.want)
+			}
+		}
+	}
+	// A real orders.gz.jsonl keeps its name.
+	got, collisions, err := ProjectNames(append(names, "orders.gz.jsonl"), CollisionExposeBoth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range got {
+		if p.Name == "orders.gz.jsonl" && p.Source != "orders.gz.jsonl" {
+			t.Fatalf("suffixed name shadowed a real file: %#v", got)
+		}
+	}
+	if len(got) != 3 || len(collisions) != 1 || len(collisions[0].Shadowed) != 1 || collisions[0].Shadowed[0] != "orders.jsonl.gz" {
+		t.Fatalf("expected orders.jsonl.gz reported as shadowed, got %#v %#v", got, collisions)
+	}
+	if _, _, err := ProjectNames(names, CollisionError); err == nil {
+		t.Fatalf("expected collision error")
+	}
+	if _, _, err := ProjectNames(names, "random"); err == nil {
+		t.Fatalf("expected invalid policy error")
+	}
+}
+
+func TestRenderFilteredProvenance(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	src := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(src, []byte("{\"id\":\"a\",\"value\":1}\n{\"id\":\"b\"}\n"), 0o644); err != nil {
+		t.Fatalf("write rows: %v", err)
+	}
+	permPath := filepath.Join(dir, "permissions.json")
+	if err := os.WriteFile(permPath, []byte(`{"allow":[{"object_type":"metric_row","object_id":"a"}]}`), 0o644); err != nil {
+		t.Fatalf("write permissions: %v", err)
+	}
+	az, err := auth.NewFromPermissionsFile(permPath)
+	if err != nil {
+		t.Fatalf("new authorizer: %v", err)
+	}
+	opts := Options{SourceDir: dir, MissingMapperMode: "deny", MissingResource: "deny"}
+
+	var plain bytes.Buffer
+	if err := RenderFiltered(src, opts, az, &plain); err != nil {
+		t.Fatalf("RenderFiltered: %v", err)
+	}
+	if got := plain.String(); got != "{\"id\":\"a\",\"value\":1}\n" {
+		t.Fatalf("unexpected default output: %q", got)
+	}
+
+	opts.Provenance = true
+	var annotated bytes.Buffer
+	if err := RenderFiltered(src, opts, az, &annotated); err != nil {
+		t.Fatalf("RenderFiltered: %v", err)
+	}
+	got := annotated.String()
+	if !strings.HasPrefix(got, `{"id":"a","value":1,"_metricfs":{"rule_hash":"`) ||
+		!strings.HasSuffix(got, `","granted_by":["metric_row:a#read"]}}`+"\n") {
+		t.Fatalf("unexpected annotated output: %q", got)
+	}
+}
+
+func TestAnnotateRowEdgeCases(t *testing.T) {
+	if got, clash := annotateRow([]byte("{}\n"), "h", nil); clash || string(got) != `{"_metricfs":{"rule_hash":"h","granted_by":[]}}`+"\n" {
+		t.Fatalf("empty object: %q", got)
+	}
+	if got, clash := annotateRow([]byte("[1]\n"), "h", nil); clash || string(got) != "[1]\n" {
+		t.Fatalf("non-object rows should be unchanged: %q", got)
+	}
+	for _, row := range []string{
+		`{"id":"a","_metricfs":1}` + "\n",
+		`{"id":"a","\u005fmetricfs":{"x":1}}` + "\n",
+	} {
+		if got, clash := annotateRow([]byte(row), "h", nil); !clash || string(got) != row {
+			t.Fatalf("row with a _metricfs member must be left alone: %q -> %q", row, got)
+		}
+	}
+	// The name inside a value or a nested object is not a top-level member.
+	for _, row := range []string{`{"note":"_metricfs"}`, `{"a":{"_metricfs":1}}`} {
+		if got, clash := annotateRow([]byte(row), "h", nil); clash || !strings.Contains(string(got), `,"_metricfs":{`) {
+			t.Fatalf("%s: got %q", row, got)
+		}
+	}
+}
+
+func TestRenderFilteredLengthPrefixedCodec(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    codec: "length_prefixed_json"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "{value}"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	record := func(doc string) []byte {
+		return append([]byte{0, 0, 0, byte(len(doc))}, doc...)
+	}
+	var data []byte
+	data = append(data, record(`{"id":"a"}`)...)
+	data = append(data, record(`{"id":"b"}`)...)
+	data = append(data, 0, 0, 0, 9, '{')
+	src := filepath.Join(dir, "rows.jsonl")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatalf("write rows: %v", err)
+	}
+	permPath := filepath.Join(dir, "permissions.json")
+	if err := os.WriteFile(permPath, []byte(`{"allow":[{"object_type":"metric_row","object_id":"a"}]}`), 0o644); err != nil {
+		t.Fatalf("write permissions: %v", err)
+	}
+	az, err := auth.NewFromPermissionsFile(permPath)
+	if err != nil {
+		t.Fatalf("new authorizer: %v", err)
+	}
+	opts := Options{SourceDir: dir, MissingMapperMode: "deny", MissingResource: "deny"}
+
+	var framed bytes.Buffer
+	if err := RenderFiltered(src, opts, az, &framed); err != nil {
+		t.Fatalf("RenderFiltered: %v", err)
+	}
+	if !bytes.Equal(framed.Bytes(), record(`{"id":"a"}`)) {
+		t.Fatalf("expected the visible record with its framing, got %q", framed.Bytes())
+	}
+
+	opts.OutputFormat = OutputJSON
+	var decoded bytes.Buffer
+	if err := RenderFiltered(src, opts, az, &decoded); err != nil {
+		t.Fatalf("RenderFiltered: %v", err)
+	}
+	if got := decoded.String(); got != "[{\"id\":\"a\"}]\n" {
+		t.Fatalf("unexpected decoded output: %q", got)
+	}
+}
+
+func TestRenderFilteredBatchesSpiceDBChecks(t *testing.T) {
+	sourceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, ".metricfs-map.yaml"), []byte(`version: 1
+rules:
+  - match:
+      glob: "*.jsonl"
+    object_type: "metric_row"
+    permission: "read"
+    mapper:
+      kind: "json_pointer"
+      pointer: "/id"
+      canonical_template: "metric_row:{value}"
+    missing_resource_key: "deny"
+`), 0o644); err != nil {
+		t.Fatalf("write mapper: %v", err)
+	}
+	srv := authtest.NewServer("token")
+	defer srv.Close()
+	var data bytes.Buffer
+	for i := 0; i < 300; i++ {
+		id := fmt.Sprintf("r%d", i%150)
+		fmt.Fprintf(&data, "{\"id\":%q}\n", id)
+		if i%2 == 0 {
+			srv.Grant("metric_row:"+id, "read", "user:alice")
+		}
+	}
+	plain := filepath.Join(sourceDir, "rows.jsonl")
+	if err := os.WriteFile(plain, data.Bytes(), 0o644); err != nil {
+		t.Fatalf("write rows: %v", err)
+	}
+	gz := filepath.Join(sourceDir, "rows.jsonl.gz")
+	if err := writeGzip(gz, data.Bytes()); err != nil {
+		t.Fatalf("write gzip: %v", err)
+	}
+	opts := Options{SourceDir: sourceDir, MapperFileName: ".metricfs-map.yaml", MapperInherit: true, MissingMapperMode: "deny", MissingResource: "deny"}
+
+	// Both files fit 150 distinct candidates in two bulk requests.
+	for i, path := range []string{plain, gz} {
+		az, err := auth.NewSpiceDB(auth.SpiceDBConfig{Endpoint: srv.URL, Token: "token", Subject: "user:alice"})
+		if err != nil {
+			t.Fatalf("new spicedb auth: %v", err)
+		}
+		var out bytes.Buffer
+		if err := RenderFiltered(path, opts, az, &out); err != nil {
+			t.Fatalf("RenderFiltered %s: %v", path, err)
+		}
+		if n := strings.Count(out.String(), "\n"); n != 150 {
+			t.Fatalf("%s: %d visible rows, want 150", path, n)
+		}
+		if got := srv.BulkChecks(); got != 2*(i+1) {
+			t.Fatalf("%s: %d bulk checks total, want %d", path, got, 2*(i+1))
+		}
+		if got := len(srv.Checks()); got != 150*(i+1) {
+			t.Fatalf("%s: %d checks total, want %d", path, got, 150*(i+1))
+		}
+	}
+}
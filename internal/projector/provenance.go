@@ -0,0 +1,76 @@
+package projector
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+const ProvenanceField = "_metricfs"
+
+type provenance struct {
+	RuleHash  string   `json:"rule_hash"`
+	GrantedBy []string `json:"granted_by"`
+}
+
+func annotateRow(line []byte, ruleHash string, granted []auth.CandidateKey) (out []byte, clash bool) {
+	body := bytes.TrimRight(line, "\r\n")
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' {
+		return line, false
+	}
+	if hasMember(trimmed, ProvenanceField) {
+		return line, true
+	}
+	p := provenance{RuleHash: ruleHash, GrantedBy: make([]string, 0, len(granted))}
+	for _, c := range granted {
+		p.GrantedBy = append(p.GrantedBy, c.ObjectType+":"+c.ObjectID+"#"+c.Permission)
+	}
+	meta, err := json.Marshal(p)
+	if err != nil {
+		return line, false
+	}
+	inner := bytes.TrimSpace(trimmed[1 : len(trimmed)-1])
+	var b bytes.Buffer
+	b.Grow(len(line) + len(meta) + 16)
+	b.WriteByte('{')
+	b.Write(inner)
+	if len(inner) > 0 {
+		b.WriteByte(',')
+	}
+	b.WriteString(`"` + ProvenanceField + `":`)
+	b.Write(meta)
+	b.WriteByte('}')
+	b.Write(line[len(body):])
+	return b.Bytes(), false
+}
+
+func hasMember(obj []byte, name string) bool {
+	if !bytes.Contains(obj, []byte(name)) && !bytes.Contains(obj, []byte(`\u`)) {
+		return false
+	}
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	if _, err := dec.Token(); err != nil {
+		return false
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if key == name {
+			return true
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+func warnProvenanceClash(c *warnings.Collector, path string) {
+	c.Add(warnings.KindProvenanceClash, path, 0, "rows that already have a %s member are served without provenance", ProvenanceField)
+}
@@ -0,0 +1,176 @@
+package schema
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+type Schema struct {
+	Types      []string
+	Properties map[string]*Schema
+	Required   []string
+	Items      *Schema
+}
+
+func Infer(doc any) *Schema {
+	switch v := doc.(type) {
+	case nil:
+		return &Schema{Types: []string{"null"}}
+	case bool:
+		return &Schema{Types: []string{"boolean"}}
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return &Schema{Types: []string{"integer"}}
+		}
+		return &Schema{Types: []string{"number"}}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return &Schema{Types: []string{"integer"}}
+		}
+		return &Schema{Types: []string{"number"}}
+	case string:
+		return &Schema{Types: []string{"string"}}
+	case []any:
+		s := &Schema{Types: []string{"array"}}
+		for _, item := range v {
+			s.Items = Merge(s.Items, Infer(item))
+		}
+		return s
+	case map[string]any:
+		s := &Schema{Types: []string{"object"}, Properties: map[string]*Schema{}}
+		for k, child := range v {
+			s.Properties[k] = Infer(child)
+			s.Required = append(s.Required, k)
+		}
+		sort.Strings(s.Required)
+		return s
+	default:
+		return &Schema{}
+	}
+}
+
+func Merge(a, b *Schema) *Schema {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	out := &Schema{Types: unionTypes(a.Types, b.Types)}
+	if a.Properties != nil || b.Properties != nil {
+		out.Properties = map[string]*Schema{}
+		for k, v := range a.Properties {
+			out.Properties[k] = v
+		}
+		for k, v := range b.Properties {
+			out.Properties[k] = Merge(out.Properties[k], v)
+		}
+		out.Required = intersect(a, b)
+	}
+	out.Items = Merge(a.Items, b.Items)
+	return out
+}
+
+func unionTypes(a, b []string) []string {
+	set := map[string]struct{}{}
+	for _, t := range a {
+		set[t] = struct{}{}
+	}
+	for _, t := range b {
+		set[t] = struct{}{}
+	}
+	if _, ok := set["number"]; ok {
+		delete(set, "integer")
+	}
+	out := make([]string, 0, len(set))
+	for t := range set {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func intersect(a, b *Schema) []string {
+	if a.Properties == nil {
+		return b.Required
+	}
+	if b.Properties == nil {
+		return a.Required
+	}
+	inB := map[string]struct{}{}
+	for _, k := range b.Required {
+		inB[k] = struct{}{}
+	}
+	out := []string{}
+	for _, k := range a.Required {
+		if _, ok := inB[k]; ok {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.toMap())
+}
+
+func (s *Schema) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Type       json.RawMessage    `json:"type"`
+		Properties map[string]*Schema `json:"properties"`
+		Required   []string           `json:"required"`
+		Items      *Schema            `json:"items"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	s.Types = nil
+	if len(raw.Type) > 0 {
+		var one string
+		if err := json.Unmarshal(raw.Type, &one); err == nil {
+			s.Types = []string{one}
+		} else if err := json.Unmarshal(raw.Type, &s.Types); err != nil {
+			return err
+		}
+	}
+	s.Properties = raw.Properties
+	s.Required = raw.Required
+	s.Items = raw.Items
+	return nil
+}
+
+func (s *Schema) toMap() map[string]any {
+	out := map[string]any{}
+	switch len(s.Types) {
+	case 0:
+	case 1:
+		out["type"] = s.Types[0]
+	default:
+		out["type"] = s.Types
+	}
+	if s.Properties != nil {
+		out["properties"] = s.Properties
+		if len(s.Required) > 0 {
+			out["required"] = s.Required
+		}
+	}
+	if s.Items != nil {
+		out["items"] = s.Items
+	}
+	return out
+}
+
+func Document(s *Schema) ([]byte, error) {
+	doc := map[string]any{"$schema": "https://json-schema.org/draft/2020-12/schema"}
+	if s != nil {
+		for k, v := range s.toMap() {
+			doc[k] = v
+		}
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
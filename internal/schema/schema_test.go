@@ -0,0 +1,34 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInferAndMerge(t *testing.T) {
+	var a, b any
+	if err := json.Unmarshal([]byte(`{"id":"x","value":1,"tags":["a"]}`), &a); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"id":"y","value":1.5,"extra":null}`), &b); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	merged := Merge(Infer(a), Infer(b))
+	got, err := json.Marshal(merged)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	want := `{"properties":{"extra":{"type":"null"},"id":{"type":"string"},"tags":{"items":{"type":"string"},"type":"array"},"value":{"type":"number"}},"required":["id","value"],"type":"object"}`
+	if string(got) != want {
+		t.Fatalf("merged schema mismatch:\n got %s\nwant %s", got, want)
+	}
+
+	var round Schema
+	if err := json.Unmarshal(got, &round); err != nil {
+		t.Fatalf("unmarshal schema: %v", err)
+	}
+	again, _ := json.Marshal(&round)
+	if string(again) != want {
+		t.Fatalf("round trip mismatch: %s", again)
+	}
+}
@@ -0,0 +1,54 @@
+package sftpserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type Keys struct {
+	subjects map[string]string
+}
+
+type keysDoc struct {
+	Keys []struct {
+		PublicKey string `json:"public_key"`
+		Subject   string `json:"subject"`
+	} `json:"keys"`
+}
+
+func LoadKeys(path string) (*Keys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc keysDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	k := &Keys{subjects: make(map[string]string, len(doc.Keys))}
+	for i, e := range doc.Keys {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(e.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %w", i, err)
+		}
+		typ, id, ok := strings.Cut(e.Subject, ":")
+		if !ok || typ == "" || id == "" {
+			return nil, fmt.Errorf("keys[%d]: invalid subject %q, expected type:id", i, e.Subject)
+		}
+		fp := string(pk.Marshal())
+		if prev, ok := k.subjects[fp]; ok && prev != e.Subject {
+			return nil, fmt.Errorf("keys[%d]: key already maps to %s", i, prev)
+		}
+		k.subjects[fp] = e.Subject
+	}
+	return k, nil
+}
+
+func (k *Keys) Subject(pk ssh.PublicKey) (string, bool) {
+	s, ok := k.subjects[string(pk.Marshal())]
+	return s, ok
+}
@@ -0,0 +1,205 @@
+package sftpserve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/vtree"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type Options = options.Options
+
+type Server struct {
+	cfg           Options
+	ssh           *ssh.ServerConfig
+	newAuthorizer func(subject string) (auth.Authorizer, error)
+
+	mu    sync.Mutex
+	views map[string]*vtree.View
+	azs   []auth.Authorizer
+}
+
+func New(cfg Options, hostKey ssh.Signer, keys *Keys, newAuthorizer func(subject string) (auth.Authorizer, error)) *Server {
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, pk ssh.PublicKey) (*ssh.Permissions, error) {
+			subject, ok := keys.Subject(pk)
+			if !ok {
+				return nil, fmt.Errorf("unknown key for %s", meta.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"subject": subject}}, nil
+		},
+	}
+	conf.AddHostKey(hostKey)
+	return &Server{cfg: cfg, ssh: conf, newAuthorizer: newAuthorizer, views: map[string]*vtree.View{}}
+}
+
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.views {
+		v.Close()
+	}
+	for _, az := range s.azs {
+		if cl, ok := az.(io.Closer); ok {
+			_ = cl.Close()
+		}
+	}
+	s.views, s.azs = map[string]*vtree.View{}, nil
+}
+
+func (s *Server) view(subject string) (*vtree.View, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.views[subject]; ok {
+		return v, nil
+	}
+	az, err := s.newAuthorizer(subject)
+	if err != nil {
+		return nil, err
+	}
+	v := vtree.NewView(s.cfg, az)
+	s.views[subject] = v
+	s.azs = append(s.azs, az)
+	return v, nil
+}
+
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop := context.AfterFunc(ctx, func() { _ = nc.Close() })
+			defer stop()
+			s.serveConn(nc)
+		}()
+	}
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer nc.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.ssh)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	subject := conn.Permissions.Extensions["subject"]
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			_ = nch.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveSession(subject, ch, requests)
+	}
+}
+
+func (s *Server) serveSession(subject string, ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range requests {
+		if req.Type != "subsystem" || !bytes.Equal(req.Payload, []byte("\x00\x00\x00\x04sftp")) {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		v, err := s.view(subject)
+		if err != nil {
+			_ = req.Reply(false, nil)
+			fmt.Fprintf(ch.Stderr(), "metricfs: authorizer for %s: %v\n", subject, err)
+			return
+		}
+		_ = req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+		h := handlers{view: v}
+		rs := sftp.NewRequestServer(ch, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+		_ = rs.Serve()
+		_ = rs.Close()
+		return
+	}
+}
+
+type handlers struct {
+	view *vtree.View
+}
+
+func (h handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	data, err := h.view.Read(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (h handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return nil, sftp.ErrSSHFxPermissionDenied
+}
+
+func (h handlers) Filecmd(r *sftp.Request) error {
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+func (h handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		infos, err := h.view.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		out := make(lister, len(infos))
+		for i, fi := range infos {
+			out[i] = fileInfo{fi}
+		}
+		return out, nil
+	case "Stat", "Lstat":
+		fi, err := h.view.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return lister{fileInfo{fi}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type fileInfo struct {
+	*vtree.Info
+}
+
+func (fi fileInfo) Uid() uint32 { return fi.UID }
+func (fi fileInfo) Gid() uint32 { return fi.GID }
+
+type lister []os.FileInfo
+
+func (l lister) ListAt(out []os.FileInfo, off int64) (int, error) {
+	if off >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(out, l[off:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,127 @@
+package sftpserve
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/pkg/authtest"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestServerGivesEachKeyItsSubjectsRows(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		".metricfs-map.yaml": "version: 1\nrules:\n  - match:\n      glob: \"*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n",
+		"rows.jsonl":         "{\"id\":\"a\"}\n{\"id\":\"b\"}\n",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spice := authtest.NewServer("token")
+	defer spice.Close()
+	spice.Grant("metric_row:a", "read", "user:alice")
+	spice.Grant("metric_row:b", "read", "user:bob")
+
+	alice, bob, stranger := newSigner(t), newSigner(t), newSigner(t)
+	keysFile := filepath.Join(dir, "keys.json")
+	doc := fmt.Sprintf(`{"keys":[{"public_key":%q,"subject":"user:alice"},{"public_key":%q,"subject":"user:bob"}]}`,
+		ssh.MarshalAuthorizedKey(alice.PublicKey()), ssh.MarshalAuthorizedKey(bob.PublicKey()))
+	if err := os.WriteFile(keysFile, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeys(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := options.New(options.WithSourceDir(src), options.WithIndex(filepath.Join(dir, "idx"), 1))
+	srv := New(cfg, newSigner(t), keys, func(subject string) (auth.Authorizer, error) {
+		return auth.NewSpiceDB(auth.SpiceDBConfig{Endpoint: spice.URL, Token: "token", Subject: subject})
+	})
+	defer srv.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ctx, lis) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+
+	dial := func(key ssh.Signer) (*sftp.Client, error) {
+		conn, err := ssh.Dial("tcp", lis.Addr().String(), &ssh.ClientConfig{
+			User:            "partner",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		c, err := sftp.NewClient(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	for key, want := range map[ssh.Signer]string{alice: "{\"id\":\"a\"}\n", bob: "{\"id\":\"b\"}\n"} {
+		c, err := dial(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := c.Open("/rows.jsonl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(f)
+		if err != nil || string(got) != want {
+			t.Fatalf("read %q, %v; want %q", got, err, want)
+		}
+		if fi, err := c.Stat("/rows.jsonl"); err != nil || fi.Size() != int64(len(want)) {
+			t.Fatalf("stat %v %v", fi, err)
+		}
+		if _, err := c.Create("/new.jsonl"); err == nil {
+			t.Fatalf("create must fail on a read-only tree")
+		}
+		if err := c.Remove("/rows.jsonl"); err == nil {
+			t.Fatalf("remove must fail on a read-only tree")
+		}
+		_ = c.Close()
+	}
+	if _, err := dial(stranger); err == nil {
+		t.Fatalf("unmapped key must not log in")
+	}
+}
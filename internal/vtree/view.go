@@ -0,0 +1,234 @@
+package vtree
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+)
+
+const maxViews = 64
+
+var (
+	ErrNotDir = errors.New("not a directory")
+	ErrIsDir  = errors.New("is a directory")
+)
+
+type View struct {
+	cfg      Options
+	az       auth.Authorizer
+	uid, gid uint32
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	unsub    func()
+
+	mu       sync.Mutex
+	gen      uint64
+	rendered map[string]rendered
+}
+
+type rendered struct {
+	data  []byte
+	gen   uint64
+	mtime time.Time
+	size  int64
+}
+
+func NewView(cfg Options, az auth.Authorizer) *View {
+	v := &View{cfg: cfg, az: az, uid: uint32(os.Getuid()), gid: uint32(os.Getgid()), fileMode: 0o444, dirMode: 0o555, rendered: map[string]rendered{}}
+	if cfg.MountUID >= 0 {
+		v.uid = uint32(cfg.MountUID)
+	}
+	if cfg.MountGID >= 0 {
+		v.gid = uint32(cfg.MountGID)
+	}
+	if cfg.FileMode != 0 {
+		v.fileMode = cfg.FileMode
+	}
+	if cfg.DirMode != 0 {
+		v.dirMode = cfg.DirMode
+	}
+	v.unsub = auth.Subscribe(az, v.invalidate)
+	return v
+}
+
+func (v *View) Close() {
+	v.unsub()
+}
+
+func (v *View) invalidate() {
+	v.mu.Lock()
+	v.gen++
+	v.rendered = map[string]rendered{}
+	v.mu.Unlock()
+}
+
+func (v *View) list(dir string) (map[string]Entry, error) {
+	entries, err := List(v.cfg, dir)
+	if err != nil {
+		return nil, err
+	}
+	if v.cfg.HideEmptyFiles {
+		HideEmpty(v.cfg, entries, v.az)
+	}
+	return entries, nil
+}
+
+func (v *View) Resolve(p string) (string, Entry, error) {
+	p = Clean(p)
+	e := Entry{Name: "/", Source: v.cfg.SourceDir, Dir: true}
+	if p == "/" {
+		return p, e, nil
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		if !e.Dir {
+			return p, e, &os.PathError{Op: "lookup", Path: p, Err: os.ErrNotExist}
+		}
+		entries, err := v.list(e.Source)
+		if err != nil {
+			return p, e, err
+		}
+		next, ok := entries[name]
+		if !ok {
+			return p, e, &os.PathError{Op: "lookup", Path: p, Err: os.ErrNotExist}
+		}
+		e = next
+	}
+	return p, e, nil
+}
+
+func Clean(p string) string {
+	return path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+}
+
+func (v *View) Read(p string) ([]byte, error) {
+	p, e, err := v.Resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.Dir {
+		return nil, &os.PathError{Op: "open", Path: p, Err: ErrIsDir}
+	}
+	return v.render(p, e)
+}
+
+func (v *View) render(p string, e Entry) ([]byte, error) {
+	st, err := os.Stat(e.Source)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	r, ok := v.rendered[p]
+	gen := v.gen
+	v.mu.Unlock()
+	if ok && r.gen == gen && r.mtime.Equal(st.ModTime()) && r.size == st.Size() {
+		return r.data, nil
+	}
+	data, err := Render(v.cfg, e, v.az)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	if v.gen == gen {
+		if len(v.rendered) >= maxViews {
+			for k := range v.rendered {
+				delete(v.rendered, k)
+				break
+			}
+		}
+		v.rendered[p] = rendered{data: data, gen: gen, mtime: st.ModTime(), size: st.Size()}
+	}
+	v.mu.Unlock()
+	return data, nil
+}
+
+type Info struct {
+	name     string
+	size     int64
+	mode     os.FileMode
+	mtime    time.Time
+	UID, GID uint32
+	ID       uint64
+}
+
+func (fi *Info) Name() string       { return fi.name }
+func (fi *Info) Size() int64        { return fi.size }
+func (fi *Info) Mode() os.FileMode  { return fi.mode }
+func (fi *Info) ModTime() time.Time { return fi.mtime }
+func (fi *Info) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *Info) Sys() any           { return nil }
+
+func (v *View) info(p string, e Entry) (*Info, error) {
+	st, err := os.Stat(e.Source)
+	if err != nil {
+		return nil, err
+	}
+	fi := &Info{name: path.Base(p), mtime: st.ModTime(), UID: v.uid, GID: v.gid, ID: pathID(p)}
+	switch {
+	case e.Dir:
+		fi.mode = os.ModeDir | v.dirMode
+	case e.Sidecar() || e.Projected:
+		// Sized by rendering, so keep the render for the reads that follow.
+		data, err := v.render(p, e)
+		if err != nil {
+			return nil, err
+		}
+		fi.mode, fi.size = v.fileMode, int64(len(data))
+	default:
+		n, err := Size(v.cfg, e, v.az)
+		if err != nil {
+			return nil, err
+		}
+		fi.mode, fi.size = v.fileMode, n
+	}
+	return fi, nil
+}
+
+func pathID(p string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(p))
+	return h.Sum64()
+}
+
+func (v *View) Stat(p string) (*Info, error) {
+	p, e, err := v.Resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	return v.info(p, e)
+}
+
+func (v *View) ReadDir(p string) ([]*Info, error) {
+	p, e, err := v.Resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if !e.Dir {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: ErrNotDir}
+	}
+	entries, err := v.list(e.Source)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]*Info, 0, len(names))
+	for _, name := range names {
+		fi, err := v.info(path.Join(p, name), entries[name])
+		if err != nil {
+			// The source vanished between listing and stat.
+			continue
+		}
+		out = append(out, fi)
+	}
+	return out, nil
+}
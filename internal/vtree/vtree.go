@@ -0,0 +1,217 @@
+package vtree
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/indexer"
+	"github.com/henneberger/metrics-fs/internal/options"
+	"github.com/henneberger/metrics-fs/internal/projector"
+	"github.com/henneberger/metrics-fs/internal/warnings"
+)
+
+type Options = options.Options
+
+type Entry struct {
+	Name       string
+	Source     string
+	Dir        bool
+	Projected  bool
+	Schema     bool
+	Visibility bool
+	Gzip       bool
+}
+
+func (e Entry) Sidecar() bool {
+	return e.Schema || e.Visibility
+}
+
+func (e Entry) Raw() bool {
+	return !e.Dir && !e.Sidecar() && !e.Projected && !e.Plain()
+}
+
+func (e Entry) Plain() bool {
+	return !e.Dir && !e.Sidecar() && !e.Projected && strings.HasSuffix(strings.ToLower(e.Source), ".jsonl")
+}
+
+func Render(cfg Options, e Entry, az auth.Authorizer) ([]byte, error) {
+	var b bytes.Buffer
+	var err error
+	switch {
+	case e.Schema:
+		err = projector.RenderSchema(e.Source, cfg, az, &b)
+	case e.Visibility:
+		err = projector.RenderVisibility(e.Source, cfg, az, &b)
+	case e.Raw():
+		return os.ReadFile(e.Source)
+	case e.Gzip:
+		zw := gzip.NewWriter(&b)
+		if err = projector.RenderFiltered(e.Source, cfg, az, zw); err == nil {
+			err = zw.Close()
+		}
+	default:
+		err = projector.RenderFiltered(e.Source, cfg, az, &b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func Streamable(cfg Options, e Entry) bool {
+	rawRows := (cfg.OutputFormat == "" || cfg.OutputFormat == projector.OutputJSONL) && !cfg.Provenance
+	return e.Plain() && rawRows
+}
+
+func Size(cfg Options, e Entry, az auth.Authorizer) (int64, error) {
+	if Streamable(cfg, e) {
+		fi, err := indexer.BuildOrLoad(e.Source, cfg)
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		for _, seg := range indexer.VisibleSegments(fi, az) {
+			n += seg[1] - seg[0]
+		}
+		return n, nil
+	}
+	if e.Raw() {
+		st, err := os.Stat(e.Source)
+		if err != nil {
+			return 0, err
+		}
+		return st.Size(), nil
+	}
+	data, err := Render(cfg, e, az)
+	return int64(len(data)), err
+}
+
+func Usage(cfg Options, dir string, az auth.Authorizer) (size, files int64, err error) {
+	entries, err := List(cfg, dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		switch {
+		case e.Dir:
+			b, f, err := Usage(cfg, e.Source, az)
+			if err != nil {
+				return 0, 0, err
+			}
+			size, files = size+b, files+f
+		case !e.Sidecar():
+			n, err := Size(cfg, e, az)
+			if err != nil {
+				return 0, 0, err
+			}
+			size, files = size+n, files+1
+		}
+	}
+	return size, files, nil
+}
+
+func HideEmpty(cfg Options, entries map[string]Entry, az auth.Authorizer) {
+	empty := map[string]bool{}
+	for _, e := range entries {
+		if e.Dir || e.Sidecar() || e.Raw() {
+			continue
+		}
+		// An empty gzip stream still has a header; size the rows instead.
+		e.Gzip = false
+		n, err := Size(cfg, e, az)
+		if err != nil {
+			continue
+		}
+		empty[e.Source] = n == 0
+	}
+	for name, e := range entries {
+		if !e.Dir && empty[e.Source] {
+			delete(entries, name)
+		}
+	}
+}
+
+func List(cfg Options, dir string) (map[string]Entry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]Entry{}
+	fileNames := []string{}
+	for _, e := range dirEntries {
+		if cfg.Excluded(filepath.Join(dir, e.Name())) {
+			continue
+		}
+		if e.IsDir() {
+			out[e.Name()] = Entry{Name: e.Name(), Source: filepath.Join(dir, e.Name()), Dir: true}
+			continue
+		}
+		if cfg.PreserveGzip && strings.HasSuffix(strings.ToLower(e.Name()), ".jsonl.gz") {
+			name := projector.OutputFileName(e.Name(), cfg.OutputFormat)
+			out[name] = Entry{Name: name, Source: filepath.Join(dir, e.Name()), Projected: true, Gzip: true}
+			continue
+		}
+		fileNames = append(fileNames, e.Name())
+	}
+	projected, collisions, err := projector.ProjectNames(fileNames, cfg.CollisionPolicy)
+	if err != nil {
+		cfg.Warnings.Add(warnings.KindCollision, dir, 0, "%v", err)
+		return nil, err
+	}
+	for _, c := range collisions {
+		key := filepath.Join(dir, c.Name)
+		if _, seen := loggedCollisions.LoadOrStore(key, struct{}{}); seen {
+			continue
+		}
+		cfg.Warnings.Add(warnings.KindCollision, dir, 0, "virtual name %s collides (%s), policy %s keeps %s",
+			c.Name, strings.Join(c.Sources, ", "), collisionPolicyName(cfg.CollisionPolicy), c.Winner)
+		if len(c.Shadowed) > 0 {
+			cfg.Warnings.Add(warnings.KindCollision, dir, 0, "not exposing %s: its suffixed name is already taken",
+				strings.Join(c.Shadowed, ", "))
+		}
+	}
+	for _, p := range projected {
+		e := Entry{Name: p.Name, Source: filepath.Join(dir, p.Source), Projected: p.Projected}
+		if !e.Raw() {
+			e.Name = projector.OutputFileName(p.Name, cfg.OutputFormat)
+		}
+		if _, ok := out[e.Name]; ok {
+			if _, seen := loggedCollisions.LoadOrStore(filepath.Join(dir, p.Source), struct{}{}); !seen {
+				cfg.Warnings.Add(warnings.KindCollision, dir, 0, "not exposing %s: its virtual name %s is already taken", p.Source, e.Name)
+			}
+			continue
+		}
+		out[e.Name] = e
+	}
+	sidecars := []Entry{}
+	for vname, e := range out {
+		if e.Dir || e.Raw() {
+			continue
+		}
+		sidecars = append(sidecars, Entry{Name: projector.SchemaFileName(vname), Source: e.Source, Schema: true})
+		// Visibility is computed from the index, which only plain JSONL has.
+		if !e.Projected {
+			sidecars = append(sidecars, Entry{Name: projector.VisibilityFileName(vname), Source: e.Source, Visibility: true})
+		}
+	}
+	for _, e := range sidecars {
+		if _, ok := out[e.Name]; !ok {
+			out[e.Name] = e
+		}
+	}
+	return out, nil
+}
+
+var loggedCollisions sync.Map
+
+func collisionPolicyName(policy string) string {
+	if policy == "" {
+		return projector.CollisionPreferPlain
+	}
+	return policy
+}
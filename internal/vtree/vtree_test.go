@@ -0,0 +1,125 @@
+package vtree
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henneberger/metrics-fs/internal/auth"
+	"github.com/henneberger/metrics-fs/internal/options"
+)
+
+func TestPreserveCompressionServesGzippedView(t *testing.T) {
+	dir := t.TempDir()
+	mapper := "version: 1\nrules:\n  - match:\n      glob: \"*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n"
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(mapper), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("{\"id\":\"a\"}\n{\"id\":\"b\"}\n"))
+	_ = zw.Close()
+	if err := os.WriteFile(filepath.Join(dir, "rows.jsonl.gz"), gz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	perm := filepath.Join(t.TempDir(), "perm.json")
+	if err := os.WriteFile(perm, []byte(`{"allow":[{"object_type":"metric_row","object_id":"b","permission":"read"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	az, err := auth.NewFromPermissionsFile(perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := options.New(options.WithSourceDir(dir), options.WithPreserveCompression(true))
+	entries, err := List(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := entries["rows.jsonl.gz"]
+	if _, plain := entries["rows.jsonl"]; !ok || plain || !e.Gzip {
+		t.Fatalf("entries %v", entries)
+	}
+	if _, ok := entries["rows.jsonl.gz._schema.json"]; !ok {
+		t.Fatalf("missing schema sidecar: %v", entries)
+	}
+	data, err := Render(cfg, e, az)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := io.ReadAll(zr)
+	if err != nil || string(rows) != "{\"id\":\"b\"}\n" {
+		t.Fatalf("rows %q %v", rows, err)
+	}
+
+	HideEmpty(cfg, entries, auth.NewDenyAll())
+	if _, ok := entries["rows.jsonl.gz"]; ok {
+		t.Fatalf("empty gzip view not hidden: %v", entries)
+	}
+}
+
+func TestRawEntriesServeTheSourceUnmodified(t *testing.T) {
+	for _, tc := range []struct {
+		e   Entry
+		raw bool
+	}{
+		{Entry{Name: "blob.bin", Source: "/s/blob.bin"}, true},
+		{Entry{Name: "rows.jsonl", Source: "/s/rows.jsonl"}, false},
+		{Entry{Name: "rows.jsonl", Source: "/s/rows.jsonl.gz", Projected: true}, false},
+		{Entry{Name: "rows.jsonl._schema.json", Source: "/s/rows.jsonl", Schema: true}, false},
+		{Entry{Name: "sub", Source: "/s/sub", Dir: true}, false},
+	} {
+		if got := tc.e.Raw(); got != tc.raw {
+			t.Errorf("%s: Raw() = %v, want %v", tc.e.Name, got, tc.raw)
+		}
+	}
+}
+
+func TestOutputFormatReachesServedViews(t *testing.T) {
+	dir := t.TempDir()
+	mapper := "version: 1\nrules:\n  - match:\n      glob: \"*.jsonl\"\n    object_type: metric_row\n    permission: read\n    mapper:\n      kind: json_pointer\n      pointer: /id\n      canonical_template: \"{value}\"\n"
+	if err := os.WriteFile(filepath.Join(dir, ".metricfs-map.yaml"), []byte(mapper), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "rows.jsonl"), []byte("{\"id\":\"a\"}\n{\"id\":\"b\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	perm := filepath.Join(t.TempDir(), "perm.json")
+	if err := os.WriteFile(perm, []byte(`{"allow":[{"object_type":"metric_row","object_id":"b","permission":"read"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	az, err := auth.NewFromPermissionsFile(perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := options.New(options.WithSourceDir(dir), options.WithIndex(t.TempDir(), 1), options.WithOutput("json", nil))
+	entries, err := List(cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := entries["rows.json"]
+	if _, stale := entries["rows.jsonl"]; !ok || stale {
+		t.Fatalf("json output must be served as rows.json, got %v", entries)
+	}
+	if Streamable(cfg, e) {
+		t.Fatalf("json output must not stream source segments")
+	}
+	data, err := Render(cfg, e, az)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[{"id":"b"}]`+"\n" {
+		t.Fatalf("rows %q", data)
+	}
+	if n, err := Size(cfg, e, az); err != nil || n != int64(len(data)) {
+		t.Fatalf("size %d %v, want %d", n, err, len(data))
+	}
+}
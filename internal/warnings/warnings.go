@@ -0,0 +1,176 @@
+package warnings
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	KindFileSkipped     = "file_skipped"
+	KindRuleUnmatched   = "rule_unmatched"
+	KindMalformedLine   = "malformed_line"
+	KindFallbackUsed    = "fallback_used"
+	KindCollision       = "collision"
+	KindLimitExceeded   = "limit_exceeded"
+	KindCanaryDrift     = "canary_drift"
+	KindIndexFallback   = "index_fallback"
+	KindWriteRejected   = "write_rejected"
+	KindRuleExpired     = "rule_expired"
+	KindRuleDeprecated  = "rule_deprecated"
+	KindSourceWatch     = "source_watch"
+	KindVisibilityShift = "visibility_shift"
+	KindAuthzFailed     = "authz_failed"
+	KindProvenanceClash = "provenance_clash"
+)
+
+const DefaultMaxEntries = 1000
+
+type Warning struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Path    string    `json:"path,omitempty"`
+	Line    int       `json:"line,omitempty"`
+	Message string    `json:"message"`
+}
+
+func (w Warning) String() string {
+	loc := w.Path
+	if w.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", w.Path, w.Line)
+	}
+	if loc == "" {
+		return fmt.Sprintf("warning[%s]: %s", w.Kind, w.Message)
+	}
+	return fmt.Sprintf("warning[%s] %s: %s", w.Kind, loc, w.Message)
+}
+
+// A nil *Collector is valid and discards.
+type Collector struct {
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries []Warning
+	next    int
+	counts  map[string]int
+	seen    map[string]struct{}
+	dropped int
+}
+
+func New() *Collector {
+	return &Collector{MaxEntries: DefaultMaxEntries}
+}
+
+func (c *Collector) Add(kind, path string, line int, format string, args ...any) {
+	if c == nil {
+		return
+	}
+	w := Warning{Time: time.Now().UTC(), Kind: kind, Path: path, Line: line, Message: fmt.Sprintf(format, args...)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = map[string]int{}
+		c.seen = map[string]struct{}{}
+	}
+	c.counts[kind]++
+	// Keep one file-level occurrence so repeats do not crowd out the rest.
+	if line == 0 {
+		key := seenKey(w)
+		if _, ok := c.seen[key]; ok {
+			return
+		}
+		c.seen[key] = struct{}{}
+	}
+	max := c.MaxEntries
+	if max <= 0 {
+		max = DefaultMaxEntries
+	}
+	if len(c.entries) < max {
+		c.entries = append(c.entries, w)
+		return
+	}
+	if old := c.entries[c.next]; old.Line == 0 {
+		delete(c.seen, seenKey(old))
+	}
+	c.entries[c.next] = w
+	c.next = (c.next + 1) % len(c.entries)
+	c.dropped++
+}
+
+func seenKey(w Warning) string {
+	return w.Kind + "\x00" + w.Path + "\x00" + w.Message
+}
+
+func (c *Collector) Snapshot() []Warning {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]Warning, 0, len(c.entries))
+	out = append(out, c.entries[c.next:]...)
+	return append(out, c.entries[:c.next]...)
+}
+
+func (c *Collector) Dropped() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+func (c *Collector) Counts() map[string]int {
+	out := map[string]int{}
+	if c == nil {
+		return out
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.counts {
+		out[k] = v
+	}
+	return out
+}
+
+func (c *Collector) WriteJSONL(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, e := range c.Snapshot() {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Collector) WriteSummary(w io.Writer) error {
+	for _, e := range c.Snapshot() {
+		if _, err := fmt.Fprintln(w, e.String()); err != nil {
+			return err
+		}
+	}
+	if d := c.Dropped(); d > 0 {
+		counts := c.Counts()
+		kinds := make([]string, 0, len(counts))
+		for k := range counts {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		if _, err := fmt.Fprintf(w, "%d earlier warnings not shown;", d); err != nil {
+			return err
+		}
+		for _, k := range kinds {
+			if _, err := fmt.Fprintf(w, " %s=%d", k, counts[k]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package warnings
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCollectorDedupesAndKeepsRecent(t *testing.T) {
+	c := New()
+	c.MaxEntries = 2
+	c.Add(KindFallbackUsed, "a.jsonl", 0, "placeholder {x}")
+	c.Add(KindFallbackUsed, "a.jsonl", 0, "placeholder {x}")
+	c.Add(KindMalformedLine, "a.jsonl", 3, "bad json")
+	c.Add(KindMalformedLine, "a.jsonl", 4, "bad json")
+
+	if got := len(c.Snapshot()); got != 2 {
+		t.Fatalf("expected 2 retained warnings, got %d", got)
+	}
+	if c.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped warning, got %d", c.Dropped())
+	}
+	if counts := c.Counts(); counts[KindFallbackUsed] != 2 || counts[KindMalformedLine] != 2 {
+		t.Fatalf("unexpected counts: %#v", counts)
+	}
+
+	var b bytes.Buffer
+	if err := c.WriteJSONL(&b); err != nil {
+		t.Fatalf("write jsonl: %v", err)
+	}
+	var w Warning
+	if err := json.Unmarshal([]byte(strings.SplitN(b.String(), "\n", 2)[0]), &w); err != nil || w.Kind != KindMalformedLine || w.Line != 3 {
+		t.Fatalf("unexpected first warning %#v, %v", w, err)
+	}
+	b.Reset()
+	_ = c.WriteSummary(&b)
+	if !strings.Contains(b.String(), "a.jsonl:3") || !strings.Contains(b.String(), "1 earlier warnings not shown") {
+		t.Fatalf("unexpected summary: %s", b.String())
+	}
+
+	// Evicting the file-level warning lets it be recorded again.
+	c.Add(KindFallbackUsed, "a.jsonl", 0, "placeholder {x}")
+	if got := c.Snapshot(); len(got) != 2 || got[1].Kind != KindFallbackUsed || got[0].Line != 4 {
+		t.Fatalf("expected the newest two warnings, got %#v", got)
+	}
+	if len(c.seen) != 1 {
+		t.Fatalf("seen should only hold retained warnings, got %d", len(c.seen))
+	}
+
+	var nilCollector *Collector
+	nilCollector.Add(KindFileSkipped, "x", 0, "ignored")
+	if len(nilCollector.Snapshot()) != 0 {
+		t.Fatalf("nil collector should discard")
+	}
+}
@@ -0,0 +1,161 @@
+package authtest
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) ServeGRPC() string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s.grpc = grpc.NewServer(grpc.UnaryInterceptor(s.authUnary), grpc.StreamInterceptor(s.authStream))
+	g := &grpcServer{s: s}
+	v1.RegisterPermissionsServiceServer(s.grpc, g)
+	v1.RegisterSchemaServiceServer(s.grpc, g)
+	go func() { _ = s.grpc.Serve(lis) }()
+	return lis.Addr().String()
+}
+
+func (s *Server) authorized(ctx context.Context) error {
+	tok := s.token()
+	if tok == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if v == "Bearer "+tok {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthenticated")
+}
+
+func (s *Server) authUnary(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.authorized(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) authStream(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorized(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+type grpcServer struct {
+	v1.UnimplementedPermissionsServiceServer
+	v1.UnimplementedSchemaServiceServer
+	s *Server
+}
+
+func grpcCheck(resource *v1.ObjectReference, permission string, sub *v1.SubjectReference) Check {
+	return Check{
+		ResourceType: resource.GetObjectType(),
+		ResourceID:   resource.GetObjectId(),
+		Permission:   permission,
+		Subject:      grpcSubject(sub),
+	}
+}
+
+func grpcSubject(sub *v1.SubjectReference) string {
+	subject := sub.GetObject().GetObjectType() + ":" + sub.GetObject().GetObjectId()
+	if rel := sub.GetOptionalRelation(); rel != "" {
+		subject += "#" + rel
+	}
+	return subject
+}
+
+func (g *grpcServer) CheckPermission(ctx context.Context, req *v1.CheckPermissionRequest) (*v1.CheckPermissionResponse, error) {
+	checkedAt := g.s.consistency(req.Consistency.GetAtLeastAsFresh().GetToken())
+	allowed, code := g.s.check(grpcCheck(req.Resource, req.Permission, req.Subject), req.Context.AsMap())
+	if code != 0 {
+		return nil, status.Error(codes.Unavailable, "injected failure")
+	}
+	resp := &v1.CheckPermissionResponse{CheckedAt: &v1.ZedToken{Token: checkedAt}, Permissionship: v1.CheckPermissionResponse_PERMISSIONSHIP_NO_PERMISSION}
+	if allowed {
+		resp.Permissionship = v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) CheckBulkPermissions(ctx context.Context, req *v1.CheckBulkPermissionsRequest) (*v1.CheckBulkPermissionsResponse, error) {
+	if !g.s.bulk() {
+		return nil, status.Error(codes.Unavailable, "injected failure")
+	}
+	resp := &v1.CheckBulkPermissionsResponse{CheckedAt: &v1.ZedToken{Token: g.s.consistency(req.Consistency.GetAtLeastAsFresh().GetToken())}}
+	for _, item := range req.Items {
+		pair := &v1.CheckBulkPermissionsPair{Request: item}
+		allowed, code := g.s.check(grpcCheck(item.Resource, item.Permission, item.Subject), item.Context.AsMap())
+		switch {
+		case code != 0:
+			pair.Response = &v1.CheckBulkPermissionsPair_Error{Error: &rpcstatus.Status{Code: int32(codes.Unavailable), Message: "injected failure"}}
+		case allowed:
+			pair.Response = &v1.CheckBulkPermissionsPair_Item{Item: &v1.CheckBulkPermissionsResponseItem{Permissionship: v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION}}
+		default:
+			pair.Response = &v1.CheckBulkPermissionsPair_Item{Item: &v1.CheckBulkPermissionsResponseItem{Permissionship: v1.CheckPermissionResponse_PERMISSIONSHIP_NO_PERMISSION}}
+		}
+		resp.Pairs = append(resp.Pairs, pair)
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) LookupResources(req *v1.LookupResourcesRequest, stream grpc.ServerStreamingServer[v1.LookupResourcesResponse]) error {
+	ids, down := g.s.lookup(req.ResourceObjectType, req.Permission, grpcSubject(req.Subject))
+	if down {
+		return status.Error(codes.Unavailable, "injected failure")
+	}
+	for _, id := range ids {
+		if err := stream.Send(&v1.LookupResourcesResponse{ResourceObjectId: id, Permissionship: v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *grpcServer) ReadSchema(ctx context.Context, req *v1.ReadSchemaRequest) (*v1.ReadSchemaResponse, error) {
+	g.s.mu.Lock()
+	down, schema := g.s.down, g.s.schema
+	g.s.mu.Unlock()
+	if down {
+		return nil, status.Error(codes.Unavailable, "injected failure")
+	}
+	return &v1.ReadSchemaResponse{SchemaText: schema}, nil
+}
+
+func (g *grpcServer) ExportBulkRelationships(req *v1.ExportBulkRelationshipsRequest, stream grpc.ServerStreamingServer[v1.ExportBulkRelationshipsResponse]) error {
+	rels, down := g.s.export(req.OptionalRelationshipFilter.GetResourceType())
+	if down {
+		return status.Error(codes.Unavailable, "injected failure")
+	}
+	for len(rels) > 0 {
+		n := min(len(rels), 100)
+		msg := &v1.ExportBulkRelationshipsResponse{}
+		for _, rel := range rels[:n] {
+			typ, id, _ := strings.Cut(rel.Resource, ":")
+			subject, subRel, _ := strings.Cut(rel.Subject, "#")
+			styp, sid, _ := strings.Cut(subject, ":")
+			msg.Relationships = append(msg.Relationships, &v1.Relationship{
+				Resource: &v1.ObjectReference{ObjectType: typ, ObjectId: id},
+				Relation: rel.Relation,
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: styp, ObjectId: sid}, OptionalRelation: subRel},
+			})
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+		rels = rels[n:]
+	}
+	return nil
+}
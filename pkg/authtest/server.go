@@ -0,0 +1,448 @@
+package authtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+type Check struct {
+	ResourceType string
+	ResourceID   string
+	Permission   string
+	Subject      string
+}
+
+type Server struct {
+	URL   string
+	Token string
+
+	srv  *httptest.Server
+	grpc *grpc.Server
+
+	mu       sync.Mutex
+	grants   map[Check]struct{}
+	caveats  map[Check]func(context map[string]any) bool
+	latency  time.Duration
+	down     bool
+	failNext int
+	failCode int
+	checks   []Check
+	decider  func(Check) bool
+	schema   string
+	rels     map[Relationship]struct{}
+	exports  int
+	bulks    int
+	lookups  int
+	revision int
+	fresh    []string
+}
+
+type Relationship struct {
+	Resource string
+	Relation string
+	Subject  string
+}
+
+func NewServer(token string) *Server {
+	s := &Server{Token: token, grants: map[Check]struct{}{}, rels: map[Relationship]struct{}{}, failCode: http.StatusServiceUnavailable}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.srv.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+	if s.grpc != nil {
+		s.grpc.Stop()
+	}
+}
+
+func (s *Server) Grant(resource, permission, subject string) {
+	typ, id, _ := strings.Cut(resource, ":")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grants[Check{ResourceType: typ, ResourceID: id, Permission: permission, Subject: subject}] = struct{}{}
+	s.revision++
+}
+
+func (s *Server) GrantWithCaveat(resource, permission, subject string, cond func(context map[string]any) bool) {
+	typ, id, _ := strings.Cut(resource, ":")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.caveats == nil {
+		s.caveats = map[Check]func(map[string]any) bool{}
+	}
+	s.caveats[Check{ResourceType: typ, ResourceID: id, Permission: permission, Subject: subject}] = cond
+	s.revision++
+}
+
+func (s *Server) Revoke(resource, permission, subject string) {
+	typ, id, _ := strings.Cut(resource, ":")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.grants, Check{ResourceType: typ, ResourceID: id, Permission: permission, Subject: subject})
+	s.revision++
+}
+
+func (s *Server) SetDecider(fn func(Check) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decider = fn
+}
+
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+func (s *Server) SetToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Token = token
+}
+
+func (s *Server) token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Token
+}
+
+func (s *Server) FailNext(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failNext = n
+	s.failCode = status
+}
+
+func (s *Server) SetUnavailable(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *Server) SetSchema(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schema = text
+}
+
+func (s *Server) Relate(resource, relation, subject string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rels[Relationship{Resource: resource, Relation: relation, Subject: subject}] = struct{}{}
+	s.revision++
+}
+
+func (s *Server) Unrelate(resource, relation, subject string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rels, Relationship{Resource: resource, Relation: relation, Subject: subject})
+	s.revision++
+}
+
+func (s *Server) Exports() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exports
+}
+
+func (s *Server) BulkChecks() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bulks
+}
+
+func (s *Server) ZedToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.zedToken()
+}
+
+func (s *Server) zedToken() string { return fmt.Sprintf("rev-%d", s.revision) }
+
+func (s *Server) FreshTokens() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.fresh...)
+}
+
+func (s *Server) consistency(fresh string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fresh != "" {
+		s.fresh = append(s.fresh, fresh)
+	}
+	return s.zedToken()
+}
+
+func (s *Server) Lookups() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookups
+}
+
+func (s *Server) Checks() []Check {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Check(nil), s.checks...)
+}
+
+type objectRef struct {
+	ObjectType string `json:"objectType"`
+	ObjectID   string `json:"objectId"`
+}
+
+type consistency struct {
+	AtLeastAsFresh struct {
+		Token string `json:"token"`
+	} `json:"atLeastAsFresh"`
+}
+
+type checkRequest struct {
+	Consistency consistency `json:"consistency"`
+	Resource    objectRef   `json:"resource"`
+	Permission  string      `json:"permission"`
+	Subject     struct {
+		Object           objectRef `json:"object"`
+		OptionalRelation string    `json:"optionalRelation"`
+	} `json:"subject"`
+	Context map[string]any `json:"context"`
+}
+
+func (r checkRequest) check() Check {
+	subject := r.Subject.Object.ObjectType + ":" + r.Subject.Object.ObjectID
+	if r.Subject.OptionalRelation != "" {
+		subject += "#" + r.Subject.OptionalRelation
+	}
+	return Check{
+		ResourceType: r.Resource.ObjectType,
+		ResourceID:   r.Resource.ObjectID,
+		Permission:   r.Permission,
+		Subject:      subject,
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if tok := s.token(); tok != "" && r.Header.Get("Authorization") != "Bearer "+tok {
+		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/permissions/check":
+		s.handleCheck(w, r)
+	case "/v1/permissions/checkbulk":
+		s.handleCheckBulk(w, r)
+	case "/v1/permissions/resources":
+		s.handleLookup(w, r)
+	case "/v1/schema/read":
+		s.mu.Lock()
+		down, schema := s.down, s.schema
+		s.mu.Unlock()
+		if down {
+			http.Error(w, "injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"schemaText": schema})
+	case "/v1/relationships/exportbulk":
+		s.handleExport(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type exportedRelationship struct {
+	Resource objectRef `json:"resource"`
+	Relation string    `json:"relation"`
+	Subject  struct {
+		Object           objectRef `json:"object"`
+		OptionalRelation string    `json:"optionalRelation,omitempty"`
+	} `json:"subject"`
+}
+
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Filter struct {
+			ResourceType string `json:"resourceType"`
+		} `json:"optionalRelationshipFilter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rels, down := s.export(req.Filter.ResourceType)
+	if down {
+		http.Error(w, "injected failure", http.StatusServiceUnavailable)
+		return
+	}
+	var out []exportedRelationship
+	for _, rel := range rels {
+		typ, id, _ := strings.Cut(rel.Resource, ":")
+		var e exportedRelationship
+		e.Resource = objectRef{ObjectType: typ, ObjectID: id}
+		e.Relation = rel.Relation
+		subject, subRel, _ := strings.Cut(rel.Subject, "#")
+		styp, sid, _ := strings.Cut(subject, ":")
+		e.Subject.Object = objectRef{ObjectType: styp, ObjectID: sid}
+		e.Subject.OptionalRelation = subRel
+		out = append(out, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for len(out) > 0 {
+		n := min(len(out), 100)
+		_ = enc.Encode(map[string]any{"result": map[string]any{"relationships": out[:n]}})
+		out = out[n:]
+	}
+}
+
+func (s *Server) export(resourceType string) ([]Relationship, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exports++
+	var out []Relationship
+	for rel := range s.rels {
+		if typ, _, _ := strings.Cut(rel.Resource, ":"); resourceType != "" && typ != resourceType {
+			continue
+		}
+		out = append(out, rel)
+	}
+	return out, s.down
+}
+
+func (s *Server) handleCheck(w http.ResponseWriter, r *http.Request) {
+	var req checkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	checkedAt := s.consistency(req.Consistency.AtLeastAsFresh.Token)
+	allowed, code := s.check(req.check(), req.Context)
+	if code != 0 {
+		http.Error(w, "injected failure", code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"checkedAt": map[string]string{"token": checkedAt}, "permissionship": permissionship(allowed)})
+}
+
+func (s *Server) handleCheckBulk(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Consistency consistency    `json:"consistency"`
+		Items       []checkRequest `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.bulk() {
+		http.Error(w, "injected failure", http.StatusServiceUnavailable)
+		return
+	}
+	checkedAt := s.consistency(req.Consistency.AtLeastAsFresh.Token)
+	pairs := []map[string]any{}
+	for _, item := range req.Items {
+		allowed, code := s.check(item.check(), item.Context)
+		if code != 0 {
+			pairs = append(pairs, map[string]any{"request": item, "error": map[string]any{"code": 14, "message": "injected failure"}})
+			continue
+		}
+		pairs = append(pairs, map[string]any{"request": item, "item": map[string]string{"permissionship": permissionship(allowed)}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"checkedAt": map[string]string{"token": checkedAt}, "pairs": pairs})
+}
+
+func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceObjectType string `json:"resourceObjectType"`
+		Permission         string `json:"permission"`
+		checkRequest
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids, down := s.lookup(req.ResourceObjectType, req.Permission, req.check().Subject)
+	if down {
+		http.Error(w, "injected failure", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for _, id := range ids {
+		_ = enc.Encode(map[string]any{"result": map[string]string{"resourceObjectId": id, "permissionship": "LOOKUP_PERMISSIONSHIP_HAS_PERMISSION"}})
+	}
+}
+
+func (s *Server) lookup(resourceType, permission, subject string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lookups++
+	var ids []string
+	for g := range s.grants {
+		if g.ResourceType == resourceType && g.Permission == permission && g.Subject == subject {
+			ids = append(ids, g.ResourceID)
+		}
+	}
+	sort.Strings(ids)
+	return ids, s.down
+}
+
+func (s *Server) bulk() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bulks++
+	return !s.down
+}
+
+func permissionship(allowed bool) string {
+	if allowed {
+		return "PERMISSIONSHIP_HAS_PERMISSION"
+	}
+	return "PERMISSIONSHIP_NO_PERMISSION"
+}
+
+func (s *Server) check(c Check, context map[string]any) (bool, int) {
+	s.mu.Lock()
+	s.checks = append(s.checks, c)
+	latency := s.latency
+	code := s.failCode
+	if s.down {
+		code = http.StatusServiceUnavailable
+	}
+	fail := s.down || s.failNext > 0
+	if s.failNext > 0 {
+		s.failNext--
+	}
+	allowed := false
+	if s.decider != nil {
+		allowed = s.decider(c)
+	} else if cond, ok := s.caveats[c]; ok {
+		allowed = cond(context)
+	} else {
+		_, allowed = s.grants[c]
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fail {
+		return false, code
+	}
+	return allowed, 0
+}
@@ -0,0 +1,210 @@
+package enums
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Decision string
+
+const (
+	DecisionAny Decision = "any"
+	DecisionAll Decision = "all"
+)
+
+func ParseDecision(s string) (Decision, error) {
+	switch d := Decision(strings.TrimSpace(s)); d {
+	case "":
+		return DecisionAny, nil
+	case DecisionAny, DecisionAll:
+		return d, nil
+	default:
+		return "", fmt.Errorf("invalid decision: %s", s)
+	}
+}
+
+type MissingMapperMode string
+
+const (
+	MissingMapperDeny        MissingMapperMode = "deny"
+	MissingMapperPassthrough MissingMapperMode = "passthrough"
+)
+
+func ParseMissingMapperMode(s string) (MissingMapperMode, error) {
+	switch m := MissingMapperMode(strings.TrimSpace(s)); m {
+	case "":
+		return MissingMapperDeny, nil
+	case MissingMapperDeny, MissingMapperPassthrough:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid missing mapper mode: %s", s)
+	}
+}
+
+type MissingResourceKey string
+
+const (
+	MissingResourceDeny   MissingResourceKey = "deny"
+	MissingResourceIgnore MissingResourceKey = "ignore"
+)
+
+func ParseMissingResourceKey(s string) (MissingResourceKey, error) {
+	switch m := MissingResourceKey(strings.TrimSpace(s)); m {
+	case "":
+		return MissingResourceDeny, nil
+	case MissingResourceDeny, MissingResourceIgnore:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid missing_resource_key: %s", s)
+	}
+}
+
+type Consistency string
+
+const (
+	ConsistencyMinimizeLatency Consistency = "minimize_latency"
+	ConsistencyFullyConsistent Consistency = "fully_consistent"
+	ConsistencyAtLeastAsFresh  Consistency = "at_least_as_fresh"
+)
+
+func ParseConsistency(s string) (Consistency, error) {
+	switch c := Consistency(strings.ToLower(strings.TrimSpace(s))); c {
+	case "":
+		return ConsistencyMinimizeLatency, nil
+	case ConsistencyMinimizeLatency, ConsistencyFullyConsistent, ConsistencyAtLeastAsFresh:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unsupported spicedb consistency mode %q", s)
+	}
+}
+
+type UnavailableMode string
+
+const (
+	UnavailableFailClosed UnavailableMode = "fail_closed"
+	UnavailableServeStale UnavailableMode = "serve_stale"
+)
+
+func ParseUnavailableMode(s string) (UnavailableMode, error) {
+	switch m := UnavailableMode(strings.TrimSpace(s)); m {
+	case "":
+		return UnavailableFailClosed, nil
+	case UnavailableFailClosed, UnavailableServeStale:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid spicedb unavailable mode: %s", s)
+	}
+}
+
+type SpiceDBTransport string
+
+const (
+	SpiceDBTransportHTTP SpiceDBTransport = "http"
+	SpiceDBTransportGRPC SpiceDBTransport = "grpc"
+)
+
+func ParseSpiceDBTransport(s string) (SpiceDBTransport, error) {
+	switch t := SpiceDBTransport(strings.ToLower(strings.TrimSpace(s))); t {
+	case "":
+		return SpiceDBTransportHTTP, nil
+	case SpiceDBTransportHTTP, SpiceDBTransportGRPC:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported spicedb transport %q", s)
+	}
+}
+
+type AuthzMode string
+
+const (
+	AuthzModeCheck  AuthzMode = "check"
+	AuthzModeLookup AuthzMode = "lookup"
+)
+
+func ParseAuthzMode(s string) (AuthzMode, error) {
+	switch m := AuthzMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return AuthzModeCheck, nil
+	case AuthzModeCheck, AuthzModeLookup:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported authz mode %q", s)
+	}
+}
+
+type AuthBackend string
+
+const (
+	AuthBackendFile     AuthBackend = "file"
+	AuthBackendSpiceDB  AuthBackend = "spicedb"
+	AuthBackendSQLite   AuthBackend = "sqlite"
+	AuthBackendHTTP     AuthBackend = "http"
+	AuthBackendOPA      AuthBackend = "opa"
+	AuthBackendCedar    AuthBackend = "cedar"
+	AuthBackendCasbin   AuthBackend = "casbin"
+	AuthBackendSnapshot AuthBackend = "snapshot"
+)
+
+func ParseAuthBackend(s string) (AuthBackend, error) {
+	switch b := AuthBackend(strings.TrimSpace(s)); b {
+	case AuthBackendFile, AuthBackendSpiceDB, AuthBackendSQLite, AuthBackendHTTP, AuthBackendOPA, AuthBackendCedar, AuthBackendCasbin, AuthBackendSnapshot:
+		return b, nil
+	default:
+		return "", fmt.Errorf("unsupported auth backend: %s", s)
+	}
+}
+
+type MapperResolution string
+
+const (
+	MapperResolutionNearestAncestor MapperResolution = "nearest_ancestor"
+)
+
+func ParseMapperResolution(s string) (MapperResolution, error) {
+	switch r := MapperResolution(strings.TrimSpace(s)); r {
+	case "":
+		return MapperResolutionNearestAncestor, nil
+	case MapperResolutionNearestAncestor:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unsupported mapper resolution: %s", s)
+	}
+}
+
+type Operation string
+
+const (
+	OperationOpen   Operation = "open"
+	OperationExport Operation = "export"
+	OperationWrite  Operation = "write"
+)
+
+func ParseOperation(s string) (Operation, error) {
+	switch o := Operation(strings.TrimSpace(s)); o {
+	case "":
+		return OperationOpen, nil
+	case OperationOpen, OperationExport, OperationWrite:
+		return o, nil
+	default:
+		return "", fmt.Errorf("invalid operation: %s", s)
+	}
+}
+
+type GlobCase string
+
+const (
+	GlobCaseAuto        GlobCase = "auto"
+	GlobCaseSensitive   GlobCase = "sensitive"
+	GlobCaseInsensitive GlobCase = "insensitive"
+)
+
+func ParseGlobCase(s string) (GlobCase, error) {
+	switch c := GlobCase(strings.ToLower(strings.TrimSpace(s))); c {
+	case "":
+		return GlobCaseAuto, nil
+	case GlobCaseAuto, GlobCaseSensitive, GlobCaseInsensitive:
+		return c, nil
+	default:
+		return "", fmt.Errorf("invalid glob case: %s", s)
+	}
+}
@@ -0,0 +1,39 @@
+package enums
+
+import "testing"
+
+func TestParseDefaultsAndErrors(t *testing.T) {
+	if d, err := ParseDecision(""); err != nil || d != DecisionAny {
+		t.Fatalf("empty decision should default to any, got %q, %v", d, err)
+	}
+	if _, err := ParseDecision("most"); err == nil {
+		t.Fatalf("expected invalid decision error")
+	}
+	if m, err := ParseMissingMapperMode("passthrough"); err != nil || m != MissingMapperPassthrough {
+		t.Fatalf("unexpected missing mapper parse: %q, %v", m, err)
+	}
+	if _, err := ParseMissingResourceKey("skip"); err == nil {
+		t.Fatalf("expected invalid missing_resource_key error")
+	}
+	if c, err := ParseConsistency("FULLY_CONSISTENT"); err != nil || c != ConsistencyFullyConsistent {
+		t.Fatalf("consistency should parse case-insensitively, got %q, %v", c, err)
+	}
+	if _, err := ParseAuthBackend(""); err == nil {
+		t.Fatalf("auth backend has no default")
+	}
+	if tr, err := ParseSpiceDBTransport(""); err != nil || tr != SpiceDBTransportHTTP {
+		t.Fatalf("empty spicedb transport should default to http, got %q, %v", tr, err)
+	}
+	if m, err := ParseAuthzMode("LOOKUP"); err != nil || m != AuthzModeLookup {
+		t.Fatalf("authz mode should parse case-insensitively, got %q, %v", m, err)
+	}
+	if _, err := ParseUnavailableMode("serve_stale"); err != nil {
+		t.Fatalf("serve_stale should be valid: %v", err)
+	}
+	if _, err := ParseMapperResolution("closest"); err == nil {
+		t.Fatalf("expected unsupported mapper resolution")
+	}
+	if o, err := ParseOperation(""); err != nil || o != OperationOpen {
+		t.Fatalf("empty operation should default to open, got %q, %v", o, err)
+	}
+}